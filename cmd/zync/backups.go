@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	backupsCmd = &cobra.Command{
+		Use:   "backups",
+		Short: "Inspect and prune backups kept in the state directory",
+	}
+
+	backupsListCmd = &cobra.Command{
+		Use:   "list [path]",
+		Short: "List backups, optionally for a single path",
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stateDir, err := requireStateDir()
+			if err != nil {
+				return err
+			}
+			relativePath := ""
+			if len(args) == 1 {
+				relativePath = args[0]
+			}
+			records, err := syncpkg.ListBackups(stateDir, relativePath)
+			if err != nil {
+				logger.Error("list backups", zap.Error(err))
+				return err
+			}
+			out := cmd.OutOrStdout()
+			for _, record := range records {
+				fmt.Fprintf(out, "%s\t%s\t%s\t%d\n", record.ID, record.Time.Local().Format(time.RFC3339), record.Side, record.Size)
+			}
+			return nil
+		},
+	}
+
+	backupsShowCmd = &cobra.Command{
+		Use:   "show <id>",
+		Short: "Print the content of a backup",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stateDir, err := requireStateDir()
+			if err != nil {
+				return err
+			}
+			content, err := syncpkg.ReadBackup(stateDir, args[0])
+			if err != nil {
+				logger.Error("read backup", zap.String("id", args[0]), zap.Error(err))
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(content)
+			return err
+		},
+	}
+
+	backupsPruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove backups outside the retention policy",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stateDir, err := requireStateDir()
+			if err != nil {
+				return err
+			}
+			policy := backupRetention()
+			flags := cmd.Flags()
+			if flags.Changed("keep") {
+				policy.MaxCountPerPath, _ = flags.GetInt("keep")
+			}
+			if flags.Changed("max-age") {
+				policy.MaxAge, _ = flags.GetDuration("max-age")
+			}
+			if flags.Changed("max-size") {
+				policy.MaxTotalBytes, _ = flags.GetInt64("max-size")
+			}
+			removed, err := syncpkg.PruneBackups(stateDir, policy, time.Now())
+			if err != nil {
+				logger.Error("prune backups", zap.Error(err))
+				return err
+			}
+			out := cmd.OutOrStdout()
+			for _, record := range removed {
+				fmt.Fprintln(out, record.ID)
+			}
+			logger.Info("pruned backups", zap.Int("removed", len(removed)))
+			return nil
+		},
+	}
+)
+
+func init() {
+	pruneFlags := backupsPruneCmd.Flags()
+	pruneFlags.Int("keep", 0, "backups to keep per path (defaults to --backup-keep)")
+	pruneFlags.Duration("max-age", 0, "remove backups older than this (defaults to --backup-max-age)")
+	pruneFlags.Int64("max-size", 0, "total backup bytes to keep (defaults to --backup-max-size)")
+
+	backupsCmd.AddCommand(backupsListCmd, backupsShowCmd, backupsPruneCmd)
+	rootCmd.AddCommand(backupsCmd)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var (
+	bundleCmd = &cobra.Command{
+		Use:   "bundle",
+		Short: "Carry changes in a file to a tree that cannot be reached directly",
+	}
+
+	bundleCreateCmd = &cobra.Command{
+		Use:   "create <root> <bundle_file>",
+		Short: "Write the changes of a root since the last exchange to a bundle",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stateDir, err := requireStateDir()
+			if err != nil {
+				return err
+			}
+			options, err := syncOptions(stateDir)
+			if err != nil {
+				return err
+			}
+			options.RootAPath = args[0]
+			summary, err := syncpkg.CreateBundle(options, args[1], logger)
+			if err != nil {
+				logger.Error("create bundle", zap.String("bundle", args[1]), zap.Error(err))
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "%d changed paths, %d blobs\n", summary.EntryCount, summary.BlobCount)
+			logger.Info("bundle created", zap.String("bundle", args[1]), zap.Int("paths", summary.EntryCount))
+			return nil
+		},
+	}
+
+	bundleApplyCmd = &cobra.Command{
+		Use:   "apply <bundle_file> <root>",
+		Short: "Merge a bundle into a root",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stateDir, err := requireStateDir()
+			if err != nil {
+				return err
+			}
+			options, err := syncOptions(stateDir)
+			if err != nil {
+				return err
+			}
+			options.RootBPath = args[1]
+			result, err := syncpkg.ApplyBundle(args[0], options, logger)
+			if err != nil {
+				logger.Error("apply bundle", zap.String("bundle", args[0]), zap.Error(err))
+				return err
+			}
+			logger.Info("bundle applied",
+				zap.Int("changed", result.ChangedFileCount),
+				zap.Any("actions", result.ActionCounters),
+				zap.String("run", result.RunID),
+			)
+			return nil
+		},
+	}
+)
+
+func init() {
+	bundleCmd.AddCommand(bundleCreateCmd, bundleApplyCmd)
+	rootCmd.AddCommand(bundleCmd)
+}
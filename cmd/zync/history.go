@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	"2006-01-02",
+}
+
+var (
+	historyCmd = &cobra.Command{
+		Use:   "history <path>",
+		Short: "List the recorded versions of a file",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stateDir, err := requireStateDir()
+			if err != nil {
+				return err
+			}
+			versions, err := syncpkg.ListVersions(stateDir, args[0])
+			if err != nil {
+				logger.Error("list versions", zap.String("path", args[0]), zap.Error(err))
+				return err
+			}
+			out := cmd.OutOrStdout()
+			for _, version := range versions {
+				fmt.Fprintf(out, "%d\t%s\t%s\t%s\n", version.Number, version.Time.Local().Format(time.RFC3339), version.Side, version.Digest[:12])
+			}
+			return nil
+		},
+	}
+
+	restoreCmd = &cobra.Command{
+		Use:   "restore <path>",
+		Short: "Write a past version of a file back into both local roots",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stateDir, err := requireStateDir()
+			if err != nil {
+				return err
+			}
+			flags := cmd.Flags()
+			number, _ := flags.GetInt("version")
+			at, _ := flags.GetString("at")
+			if (number == 0) == (at == "") {
+				err := errors.New("exactly one of --version or --at is required")
+				logger.Error("invalid restore selector", zap.Error(err))
+				return err
+			}
+
+			versions, err := syncpkg.ListVersions(stateDir, args[0])
+			if err != nil {
+				logger.Error("list versions", zap.String("path", args[0]), zap.Error(err))
+				return err
+			}
+			var version syncpkg.Version
+			if number != 0 {
+				version, err = syncpkg.VersionByNumber(versions, number)
+			} else {
+				var when time.Time
+				when, err = parseTime(at)
+				if err == nil {
+					version, err = syncpkg.VersionAt(versions, when)
+				}
+			}
+			if err != nil {
+				logger.Error("select version", zap.Error(err))
+				return err
+			}
+
+			options, err := syncOptions(stateDir)
+			if err != nil {
+				return err
+			}
+			if err := syncpkg.RestoreVersion(options, args[0], version, logger); err != nil {
+				logger.Error("restore failed", zap.String("path", args[0]), zap.Error(err))
+				return err
+			}
+			logger.Info("restored version", zap.String("path", args[0]), zap.Int("version", version.Number))
+			return nil
+		},
+	}
+)
+
+func parseTime(value string) (time.Time, error) {
+	for _, layout := range timeLayouts {
+		if parsed, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cannot parse time %q", value)
+}
+
+func init() {
+	restoreFlags := restoreCmd.Flags()
+	restoreFlags.Int("version", 0, "version number as listed by history")
+	restoreFlags.String("at", "", "restore the version current at this time")
+
+	rootCmd.AddCommand(historyCmd, restoreCmd)
+}
@@ -2,8 +2,10 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"os"
 	"strings"
+	"time"
 
         "github.com/MarkoPoloResearchLab/zync/internal/logging"
         syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
@@ -19,38 +21,43 @@ var (
 		Short: "Synchronize files between two directories",
 		Args:  cobra.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			stateDir := viper.GetString("state-dir")
-			includePattern := viper.GetString("include")
-			disableBackups := viper.GetBool("no-backups")
-
-			if stateDir == "" {
-				err := errors.New("--state-dir is required")
-				logger.Error("missing state-dir", zap.Error(err))
+			stateDir, err := requireStateDir()
+			if err != nil {
+				return err
+			}
+			options, err := syncOptions(stateDir)
+			if err != nil {
 				return err
 			}
 
-			options := syncpkg.Options{
-				RootAPath:            args[0],
-				RootBPath:            args[1],
-				StateDirectory:       stateDir,
-				IncludeGlob:          includePattern,
-				CreateBackupsOnWrite: !disableBackups,
-				IgnorePathPrefixes: []string{
-					".obsidian",
-					".git",
-					"node_modules",
-					"@eaDir",
-					"#recycle",
-				},
-				IgnoreFileNames: []string{
-					".Trash*",
-					".DS_Store",
-					"._*",
-					"Thumbs.db",
-					"desktop.ini",
-				},
-				ConflictMtimeEpsilonSeconds: 1.0,
+			rootConfig := syncpkg.RootConfig{
+				SSHCommand:      viper.GetString("ssh-command"),
+				RemoteCommand:   viper.GetString("remote-command"),
+				IdentityFiles:   viper.GetStringSlice("identity"),
+				KnownHostsFile:  viper.GetString("known-hosts"),
+				SFTPMaxRequests: viper.GetInt("sftp-max-requests"),
+				S3Endpoint:      viper.GetString("s3-endpoint"),
+				S3Region:        viper.GetString("s3-region"),
+				WebDAVPassword:  viper.GetString("webdav-password"),
+				WriteArchives:   viper.GetBool("write-archives"),
+				StateDirectory:  stateDir,
+			}
+			replicaA, err := syncpkg.OpenRoot(args[0], rootConfig)
+			if err != nil {
+				logger.Error("open root A", zap.String("root", args[0]), zap.Error(err))
+				return err
+			}
+			defer closeRoot(replicaA, args[0])
+			replicaB, err := syncpkg.OpenRoot(args[1], rootConfig)
+			if err != nil {
+				logger.Error("open root B", zap.String("root", args[1]), zap.Error(err))
+				return err
 			}
+			defer closeRoot(replicaB, args[1])
+
+			options.RootAPath, options.RootBPath = args[0], args[1]
+			options.ReplicaA, options.ReplicaB = replicaA, replicaB
+			options.ForceDirDeletions = viper.GetBool("force-dir-deletions")
 
 			result, err := syncpkg.RunSync(options, logger)
 			if err != nil {
@@ -62,6 +69,9 @@ var (
 				zap.Int("changed", result.ChangedFileCount),
 				zap.Any("actions", result.ActionCounters),
 				zap.Bool("diff3", result.Diff3Available),
+				zap.String("run", result.RunID),
+				zap.Int("auto_resolved", len(result.AutoResolutions)),
+				zap.Strings("commits", result.GitCommits),
 			)
 
 			return nil
@@ -70,20 +80,109 @@ var (
 )
 
 func init() {
+	persistentFlags := rootCmd.PersistentFlags()
+	persistentFlags.String("state-dir", "", "directory for persistent state")
+	persistentFlags.String("log-level", "info", "log level")
+
+	// Sync flags are inherited by the subcommands, so that bundle apply
+	// merges the way a run does.
+	persistentFlags.String("include", "*", "glob to restrict synced files (default '*')")
+	persistentFlags.Bool("no-backups", false, "disable backups of conflicting files when overwriting")
+	persistentFlags.Int("backup-keep", 0, "backups to keep per path (0 keeps all)")
+	persistentFlags.Duration("backup-max-age", 0, "remove backups older than this (0 keeps all)")
+	persistentFlags.Int64("backup-max-size", 0, "total backup bytes to keep (0 is unlimited)")
+	persistentFlags.Int("history-keep", syncpkg.DefaultHistoryLimit, "versions to keep in each file's history")
+	persistentFlags.String("symlinks", "preserve", "symlink handling: preserve or follow")
+	persistentFlags.Bool("xattrs", false, "synchronize extended attributes")
+	persistentFlags.Bool("acls", false, "synchronize POSIX ACLs")
+	persistentFlags.StringSlice("xattr-include", nil, "attribute name globs to synchronize (default 'user.*')")
+	persistentFlags.StringSlice("xattr-exclude", nil, "attribute name globs to skip")
+	persistentFlags.Bool("preserve-owner", false, "preserve file owners when running as root")
+	persistentFlags.StringSlice("uid-map", nil, "uid mapping between roots as a:b")
+	persistentFlags.StringSlice("gid-map", nil, "gid mapping between roots as a:b")
+	persistentFlags.String("default-owner", "", "uid:gid for files whose source has no owner, such as archive or remote roots")
+	persistentFlags.Bool("structured-merge", false, "merge JSON, YAML, TOML and INI files key by key")
+	persistentFlags.Bool("markdown-merge", false, "merge Markdown front matter as data and resolve checkbox and rewrap conflicts")
+	persistentFlags.Bool("word-merge", false, "retry conflicting lines word by word before writing conflict markers")
+	persistentFlags.Bool("normalize-eol", false, "compare and merge text with normalized line endings and final newlines")
+	persistentFlags.Bool("ignore-trailing-space", false, "ignore trailing white space when comparing text lines")
+	persistentFlags.String("line-ending", "", "line ending for merged text: lf or crlf (default each side's own)")
+	persistentFlags.Bool("detect-encoding", false, "merge UTF-16 and BOM-marked text as UTF-8 and write it back in its encoding")
+	persistentFlags.String("legacy-charset", "", "charset of text files that are not valid UTF-8, e.g. windows-1252")
+	persistentFlags.StringArray("filter", nil, "content filter for matching paths as glob=filter")
+	persistentFlags.StringArray("filter-clean", nil, "clean command of an external filter as name=command")
+	persistentFlags.StringArray("filter-smudge", nil, "smudge command of an external filter as name=command")
+	persistentFlags.Duration("filter-timeout", 30*time.Second, "time limit for filter commands")
+	persistentFlags.StringArray("merge-driver", nil, "merge driver for matching paths as glob=driver")
+	persistentFlags.StringArray("merge-command", nil, "external merge driver as name=command with %O %A %B %P placeholders")
+	persistentFlags.Duration("merge-timeout", 30*time.Second, "time limit for external merge commands")
+	persistentFlags.Bool("auto-resolve", false, "resolve conflicts that differ only in white space or where one side extends the other")
+	persistentFlags.String("git-commit", "", "commit the changes written to a git work tree root: a, b or both")
+	persistentFlags.Bool("git-require-clean", false, "refuse to run while a git-commit root has uncommitted changes")
+	persistentFlags.StringArray("resolve-rule", nil, "resolve conflicts whose lines all match a regular expression, as [glob=]ours|theirs|union:regex")
+
 	flags := rootCmd.Flags()
-	flags.String("state-dir", "", "directory for persistent state")
-	flags.String("include", "*", "glob to restrict synced files (default '*')")
-	flags.Bool("no-backups", false, "disable .bak files when overwriting")
-	flags.String("log-level", "info", "log level")
+	flags.Bool("force-dir-deletions", false, "propagate directory deletions even when a root is empty")
+	flags.String("ssh-command", "ssh", "command used to reach ssh:// roots")
+	flags.String("remote-command", "zync", "zync executable on the hosts of ssh:// roots")
+	flags.StringArray("identity", nil, "private key offered to sftp:// servers (default the keys in ~/.ssh)")
+	flags.String("known-hosts", "", "known hosts file for sftp:// servers (default ~/.ssh/known_hosts)")
+	flags.Int("sftp-max-requests", 8, "requests in flight on one sftp:// connection")
+	flags.String("s3-endpoint", "", "base URL of the S3-compatible service for s3:// roots (default AWS)")
+	flags.String("s3-region", "", "region of s3:// roots (default $AWS_REGION or us-east-1)")
+	flags.Bool("write-archives", false, "rewrite .tar, .tar.gz and .zip roots with the merged tree instead of only reading them")
+	flags.String("webdav-password", "", "password for webdav:// and davs:// roots whose URL has none (or $ZYNC_WEBDAV_PASSWORD)")
 
         viper.SetEnvPrefix("ZYNC")
 	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
 	viper.AutomaticEnv()
 
-	viper.BindPFlag("state-dir", flags.Lookup("state-dir"))
-	viper.BindPFlag("include", flags.Lookup("include"))
-	viper.BindPFlag("no-backups", flags.Lookup("no-backups"))
-	viper.BindPFlag("log-level", flags.Lookup("log-level"))
+	viper.BindPFlag("state-dir", persistentFlags.Lookup("state-dir"))
+	viper.BindPFlag("log-level", persistentFlags.Lookup("log-level"))
+	viper.BindPFlag("include", persistentFlags.Lookup("include"))
+	viper.BindPFlag("no-backups", persistentFlags.Lookup("no-backups"))
+	viper.BindPFlag("backup-keep", persistentFlags.Lookup("backup-keep"))
+	viper.BindPFlag("backup-max-age", persistentFlags.Lookup("backup-max-age"))
+	viper.BindPFlag("backup-max-size", persistentFlags.Lookup("backup-max-size"))
+	viper.BindPFlag("history-keep", persistentFlags.Lookup("history-keep"))
+	viper.BindPFlag("symlinks", persistentFlags.Lookup("symlinks"))
+	viper.BindPFlag("xattrs", persistentFlags.Lookup("xattrs"))
+	viper.BindPFlag("acls", persistentFlags.Lookup("acls"))
+	viper.BindPFlag("xattr-include", persistentFlags.Lookup("xattr-include"))
+	viper.BindPFlag("xattr-exclude", persistentFlags.Lookup("xattr-exclude"))
+	viper.BindPFlag("preserve-owner", persistentFlags.Lookup("preserve-owner"))
+	viper.BindPFlag("uid-map", persistentFlags.Lookup("uid-map"))
+	viper.BindPFlag("gid-map", persistentFlags.Lookup("gid-map"))
+	viper.BindPFlag("default-owner", persistentFlags.Lookup("default-owner"))
+	viper.BindPFlag("structured-merge", persistentFlags.Lookup("structured-merge"))
+	viper.BindPFlag("markdown-merge", persistentFlags.Lookup("markdown-merge"))
+	viper.BindPFlag("word-merge", persistentFlags.Lookup("word-merge"))
+	viper.BindPFlag("normalize-eol", persistentFlags.Lookup("normalize-eol"))
+	viper.BindPFlag("ignore-trailing-space", persistentFlags.Lookup("ignore-trailing-space"))
+	viper.BindPFlag("line-ending", persistentFlags.Lookup("line-ending"))
+	viper.BindPFlag("detect-encoding", persistentFlags.Lookup("detect-encoding"))
+	viper.BindPFlag("legacy-charset", persistentFlags.Lookup("legacy-charset"))
+	viper.BindPFlag("filter", persistentFlags.Lookup("filter"))
+	viper.BindPFlag("filter-clean", persistentFlags.Lookup("filter-clean"))
+	viper.BindPFlag("filter-smudge", persistentFlags.Lookup("filter-smudge"))
+	viper.BindPFlag("filter-timeout", persistentFlags.Lookup("filter-timeout"))
+	viper.BindPFlag("merge-driver", persistentFlags.Lookup("merge-driver"))
+	viper.BindPFlag("merge-command", persistentFlags.Lookup("merge-command"))
+	viper.BindPFlag("merge-timeout", persistentFlags.Lookup("merge-timeout"))
+	viper.BindPFlag("auto-resolve", persistentFlags.Lookup("auto-resolve"))
+	viper.BindPFlag("resolve-rule", persistentFlags.Lookup("resolve-rule"))
+	viper.BindPFlag("force-dir-deletions", flags.Lookup("force-dir-deletions"))
+	viper.BindPFlag("git-commit", persistentFlags.Lookup("git-commit"))
+	viper.BindPFlag("git-require-clean", persistentFlags.Lookup("git-require-clean"))
+	viper.BindPFlag("ssh-command", flags.Lookup("ssh-command"))
+	viper.BindPFlag("remote-command", flags.Lookup("remote-command"))
+	viper.BindPFlag("identity", flags.Lookup("identity"))
+	viper.BindPFlag("known-hosts", flags.Lookup("known-hosts"))
+	viper.BindPFlag("sftp-max-requests", flags.Lookup("sftp-max-requests"))
+	viper.BindPFlag("s3-endpoint", flags.Lookup("s3-endpoint"))
+	viper.BindPFlag("s3-region", flags.Lookup("s3-region"))
+	viper.BindPFlag("webdav-password", flags.Lookup("webdav-password"))
+	viper.BindPFlag("write-archives", flags.Lookup("write-archives"))
 
 	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
 		viper.SetConfigFile("config.yaml")
@@ -104,6 +203,209 @@ func init() {
 	}
 }
 
+func requireStateDir() (string, error) {
+	stateDir := viper.GetString("state-dir")
+	if stateDir == "" {
+		err := errors.New("--state-dir is required")
+		logger.Error("missing state-dir", zap.Error(err))
+		return "", err
+	}
+	return stateDir, nil
+}
+
+// syncOptions builds the options shared by a run and bundle apply from the
+// sync flags. The caller sets the roots.
+func syncOptions(stateDir string) (syncpkg.Options, error) {
+	uidMap, err := parseIDMappings(viper.GetStringSlice("uid-map"))
+	if err != nil {
+		logger.Error("invalid uid-map", zap.Error(err))
+		return syncpkg.Options{}, err
+	}
+	gidMap, err := parseIDMappings(viper.GetStringSlice("gid-map"))
+	if err != nil {
+		logger.Error("invalid gid-map", zap.Error(err))
+		return syncpkg.Options{}, err
+	}
+
+	mergeRules, err := parseMergeDrivers(viper.GetStringSlice("merge-command"), viper.GetStringSlice("merge-driver"), viper.GetDuration("merge-timeout"))
+	if err != nil {
+		logger.Error("invalid merge driver", zap.Error(err))
+		return syncpkg.Options{}, err
+	}
+
+	conflictRules, err := parseConflictRules(viper.GetStringSlice("resolve-rule"))
+	if err != nil {
+		logger.Error("invalid resolve rule", zap.Error(err))
+		return syncpkg.Options{}, err
+	}
+
+	filterRules, err := parseFilters(viper.GetStringSlice("filter-clean"), viper.GetStringSlice("filter-smudge"), viper.GetStringSlice("filter"), viper.GetDuration("filter-timeout"))
+	if err != nil {
+		logger.Error("invalid filter", zap.Error(err))
+		return syncpkg.Options{}, err
+	}
+
+	options := syncpkg.Options{
+		StateDirectory:              stateDir,
+		IncludeGlob:                 viper.GetString("include"),
+		CreateBackupsOnWrite:        !viper.GetBool("no-backups"),
+		BackupRetention:             backupRetention(),
+		HistoryLimit:                viper.GetInt("history-keep"),
+		IgnorePathPrefixes:          defaultIgnorePathPrefixes,
+		IgnoreFileNames:             defaultIgnoreFileNames,
+		ConflictMtimeEpsilonSeconds: 1.0,
+		SymlinkMode:                 syncpkg.SymlinkMode(viper.GetString("symlinks")),
+		SyncXattrs:                  viper.GetBool("xattrs"),
+		SyncACLs:                    viper.GetBool("acls"),
+		XattrInclude:                viper.GetStringSlice("xattr-include"),
+		XattrExclude:                viper.GetStringSlice("xattr-exclude"),
+		PreserveOwnership:           viper.GetBool("preserve-owner"),
+		UIDMap:                      uidMap,
+		GIDMap:                      gidMap,
+		StructuredMerge:             viper.GetBool("structured-merge"),
+		MarkdownMerge:               viper.GetBool("markdown-merge"),
+		MergeRules:                  mergeRules,
+		WordMerge:                   viper.GetBool("word-merge"),
+		NormalizeLineEndings:        viper.GetBool("normalize-eol"),
+		IgnoreTrailingWhitespace:    viper.GetBool("ignore-trailing-space"),
+		LineEnding:                  viper.GetString("line-ending"),
+		DetectEncoding:              viper.GetBool("detect-encoding"),
+		LegacyCharset:               viper.GetString("legacy-charset"),
+		FilterRules:                 filterRules,
+		AutoResolve:                 viper.GetBool("auto-resolve"),
+		ConflictRules:               conflictRules,
+		GitCommit:                   viper.GetString("git-commit"),
+		GitRequireClean:             viper.GetBool("git-require-clean"),
+	}
+
+	if defaultOwner := viper.GetString("default-owner"); defaultOwner != "" {
+		uid, gid, ownerErr := syncpkg.ParseOwner(defaultOwner)
+		if ownerErr != nil {
+			logger.Error("invalid default-owner", zap.Error(ownerErr))
+			return syncpkg.Options{}, ownerErr
+		}
+		options.DefaultUID = &uid
+		options.DefaultGID = &gid
+	}
+	return options, nil
+}
+
+// Paths and file names never synchronized: tool settings, version control,
+// dependencies and the litter of NAS and desktop file managers.
+var (
+	defaultIgnorePathPrefixes = []string{".obsidian", ".git", "node_modules", "@eaDir", "#recycle"}
+	defaultIgnoreFileNames    = []string{".Trash*", ".DS_Store", "._*", "Thumbs.db", "desktop.ini"}
+)
+
+// closeRoot ends the connection of a replica opened by OpenRoot.
+func closeRoot(replica syncpkg.ReplicaFS, root string) {
+	if err := syncpkg.CloseReplica(replica); err != nil {
+		logger.Warn("close root", zap.String("root", root), zap.Error(err))
+	}
+}
+
+func backupRetention() syncpkg.RetentionPolicy {
+	return syncpkg.RetentionPolicy{
+		MaxCountPerPath: viper.GetInt("backup-keep"),
+		MaxAge:          viper.GetDuration("backup-max-age"),
+		MaxTotalBytes:   viper.GetInt64("backup-max-size"),
+	}
+}
+
+func parseIDMappings(specs []string) ([]syncpkg.IDMapping, error) {
+	mappings := make([]syncpkg.IDMapping, 0, len(specs))
+	for _, spec := range specs {
+		mapping, err := syncpkg.ParseIDMapping(spec)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings, nil
+}
+
+// parseMergeDrivers registers the external merge commands and returns the
+// merge rules, both given as name=value pairs.
+func parseMergeDrivers(commands []string, rules []string, timeout time.Duration) ([]syncpkg.MergeRule, error) {
+	for _, spec := range commands {
+		name, command, ok := strings.Cut(spec, "=")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("merge command %q is not name=command", spec)
+		}
+		driver, err := syncpkg.NewExternalMergeDriver(command, timeout)
+		if err != nil {
+			return nil, err
+		}
+		syncpkg.RegisterMergeDriver(strings.TrimSpace(name), driver)
+	}
+	mergeRules := make([]syncpkg.MergeRule, 0, len(rules))
+	for _, spec := range rules {
+		pattern, driver, ok := strings.Cut(spec, "=")
+		if !ok || strings.TrimSpace(pattern) == "" || strings.TrimSpace(driver) == "" {
+			return nil, fmt.Errorf("merge driver %q is not glob=driver", spec)
+		}
+		mergeRules = append(mergeRules, syncpkg.MergeRule{Pattern: strings.TrimSpace(pattern), Driver: strings.TrimSpace(driver)})
+	}
+	return mergeRules, nil
+}
+
+// parseConflictRules reads rules given as resolution:regex, optionally
+// preceded by glob= to limit them to matching paths.
+func parseConflictRules(specs []string) ([]syncpkg.ConflictRule, error) {
+	rules := make([]syncpkg.ConflictRule, 0, len(specs))
+	for _, spec := range specs {
+		head, match, ok := strings.Cut(spec, ":")
+		if !ok {
+			return nil, fmt.Errorf("resolve rule %q is not [glob=]resolution:regex", spec)
+		}
+		rule := syncpkg.ConflictRule{Match: match, Resolution: strings.TrimSpace(head)}
+		if separator := strings.LastIndex(head, "="); separator >= 0 {
+			rule.Pattern = strings.TrimSpace(head[:separator])
+			rule.Resolution = strings.TrimSpace(head[separator+1:])
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// parseFilters registers the external filters, whose clean and smudge
+// commands are given as name=command pairs, and returns the filter rules.
+func parseFilters(cleans []string, smudges []string, rules []string, timeout time.Duration) ([]syncpkg.FilterRule, error) {
+	commands := map[string][2]string{}
+	var names []string
+	for index, specs := range [][]string{cleans, smudges} {
+		for _, spec := range specs {
+			name, command, ok := strings.Cut(spec, "=")
+			name = strings.TrimSpace(name)
+			if !ok || name == "" {
+				return nil, fmt.Errorf("filter command %q is not name=command", spec)
+			}
+			pair, seen := commands[name]
+			if !seen {
+				names = append(names, name)
+			}
+			pair[index] = command
+			commands[name] = pair
+		}
+	}
+	for _, name := range names {
+		filter, err := syncpkg.NewExternalContentFilter(commands[name][0], commands[name][1], timeout)
+		if err != nil {
+			return nil, fmt.Errorf("filter %q: %w", name, err)
+		}
+		syncpkg.RegisterContentFilter(name, filter)
+	}
+	filterRules := make([]syncpkg.FilterRule, 0, len(rules))
+	for _, spec := range rules {
+		pattern, filter, ok := strings.Cut(spec, "=")
+		if !ok || strings.TrimSpace(pattern) == "" || strings.TrimSpace(filter) == "" {
+			return nil, fmt.Errorf("filter %q is not glob=filter", spec)
+		}
+		filterRules = append(filterRules, syncpkg.FilterRule{Pattern: strings.TrimSpace(pattern), Filter: strings.TrimSpace(filter)})
+	}
+	return filterRules, nil
+}
+
 func main() {
 	if err := rootCmd.Execute(); err != nil {
 		if logger != nil {
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var serverCmd = &cobra.Command{
+	Use:    "server <root>",
+	Short:  "Serve a root over stdin and stdout for a zync on another host",
+	Args:   cobra.ExactArgs(1),
+	Hidden: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		info, err := os.Stat(args[0])
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s is not a directory", args[0])
+		}
+		if err != nil {
+			logger.Error("open root", zap.String("root", args[0]), zap.Error(err))
+			return err
+		}
+		if err := syncpkg.ServeReplica(syncpkg.NewLocalFS(args[0]), cmd.InOrStdin(), cmd.OutOrStdout()); err != nil {
+			logger.Error("serve root", zap.String("root", args[0]), zap.Error(err))
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(serverCmd)
+}
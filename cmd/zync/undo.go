@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+var undoCmd = &cobra.Command{
+	Use:   "undo [run_id]",
+	Short: "Revert the most recent sync run, or the named one",
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		stateDir, err := requireStateDir()
+		if err != nil {
+			return err
+		}
+
+		if list, _ := cmd.Flags().GetBool("list"); list {
+			runs, err := syncpkg.ListRuns(stateDir)
+			if err != nil {
+				logger.Error("list runs", zap.Error(err))
+				return err
+			}
+			out := cmd.OutOrStdout()
+			for _, run := range runs {
+				status := ""
+				if run.Undone {
+					status = "undone"
+				}
+				fmt.Fprintf(out, "%s\t%s\t%d\t%s\n", run.ID, run.StartedAt.Local().Format(time.RFC3339), run.ChangeCount, status)
+			}
+			return nil
+		}
+
+		runID := ""
+		if len(args) == 1 {
+			runID = args[0]
+		}
+		undone, err := syncpkg.UndoRun(stateDir, runID, logger)
+		if err != nil {
+			logger.Error("undo failed", zap.String("run", undone), zap.Error(err))
+			return err
+		}
+		logger.Info("run undone", zap.String("run", undone))
+		return nil
+	},
+}
+
+func init() {
+	undoCmd.Flags().Bool("list", false, "list recorded runs instead of undoing")
+	rootCmd.AddCommand(undoCmd)
+}
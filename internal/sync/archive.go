@@ -0,0 +1,377 @@
+package sync
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// Archive formats recognized by the extension of a root.
+const (
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+	archiveZip   = "zip"
+)
+
+// archiveFormat returns the format of an archive named name, or "" when the
+// name has no archive extension.
+func archiveFormat(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".tar"):
+		return archiveTar
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return archiveTarGz
+	case strings.HasSuffix(lower, ".zip"):
+		return archiveZip
+	}
+	return ""
+}
+
+// ArchiveFS is a ReplicaFS read from a .tar, .tar.gz or .zip archive and held
+// in memory. A writable archive is rewritten in one piece when it is flushed:
+// the new archive is written next to the old one and then takes its place.
+// A read-only archive keeps the run's writes in memory and discards them, so
+// it acts as a one-way source.
+type ArchiveFS struct {
+	*MemoryFS
+	path     string
+	format   string
+	writable bool
+	dirty    atomic.Bool
+}
+
+// OpenArchive reads the archive at archivePath. A writable archive that does
+// not exist yet starts out empty and is created when flushed.
+func OpenArchive(archivePath string, writable bool) (*ArchiveFS, error) {
+	format := archiveFormat(archivePath)
+	if format == "" {
+		return nil, fmt.Errorf("%s is not a .tar, .tar.gz or .zip archive", archivePath)
+	}
+	archive := &ArchiveFS{MemoryFS: NewMemoryFS(), path: archivePath, format: format, writable: writable}
+	content, err := os.ReadFile(archivePath)
+	if errors.Is(err, fs.ErrNotExist) && writable {
+		archive.dirty.Store(true)
+		return archive, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case archiveTarGz:
+		var reader *gzip.Reader
+		if reader, err = gzip.NewReader(bytes.NewReader(content)); err == nil {
+			err = archive.loadTar(reader)
+		}
+	case archiveTar:
+		err = archive.loadTar(bytes.NewReader(content))
+	case archiveZip:
+		err = archive.loadZip(content)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", archivePath, err)
+	}
+	return archive, nil
+}
+
+// archiveEntryName returns the replica name of an archive member, with
+// leading slashes and "./" removed, and false for the archive's root.
+func archiveEntryName(member string) (string, bool, error) {
+	name := path.Clean(strings.TrimLeft(member, "/"))
+	if name == "." {
+		return "", false, nil
+	}
+	if !fs.ValidPath(name) {
+		return "", false, fmt.Errorf("invalid member name %q", member)
+	}
+	return name, true, nil
+}
+
+// add stores one member read from the archive, replacing an earlier member
+// of the same name.
+func (a *ArchiveFS) add(member string, mode fs.FileMode, data []byte, target string) error {
+	name, ok, err := archiveEntryName(member)
+	if err != nil || !ok {
+		return err
+	}
+	if mode.IsDir() {
+		return a.MemoryFS.MkdirAll(name, mode.Perm())
+	}
+	if err := a.MemoryFS.MkdirAll(path.Dir(name), 0o755); err != nil {
+		return err
+	}
+	if err := a.MemoryFS.RemoveAll(name); err != nil {
+		return err
+	}
+	if mode&fs.ModeSymlink != 0 {
+		return a.MemoryFS.Symlink(target, name)
+	}
+	return a.MemoryFS.WriteFile(name, data, mode.Perm())
+}
+
+func (a *ArchiveFS) loadTar(r io.Reader) error {
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mode := fs.FileMode(header.Mode).Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = a.add(header.Name, fs.ModeDir|mode, nil, "")
+		case tar.TypeSymlink:
+			err = a.add(header.Name, fs.ModeSymlink|0o777, nil, header.Linkname)
+		case tar.TypeReg:
+			var data []byte
+			if data, err = io.ReadAll(reader); err == nil {
+				err = a.add(header.Name, mode, data, "")
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (a *ArchiveFS) loadZip(content []byte) error {
+	reader, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		return err
+	}
+	for _, file := range reader.File {
+		mode := file.Mode()
+		if strings.HasSuffix(file.Name, "/") {
+			mode |= fs.ModeDir
+		}
+		if mode.IsDir() {
+			if err := a.add(file.Name, mode, nil, ""); err != nil {
+				return err
+			}
+			continue
+		}
+		if !mode.IsRegular() && mode&fs.ModeSymlink == 0 {
+			continue
+		}
+		member, err := file.Open()
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(member)
+		member.Close()
+		if err != nil {
+			return err
+		}
+		if mode&fs.ModeSymlink != 0 {
+			err = a.add(file.Name, mode, nil, string(data))
+		} else {
+			err = a.add(file.Name, mode, data, "")
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readOnly reports whether writes are discarded.
+func (a *ArchiveFS) readOnly() bool {
+	return !a.writable
+}
+
+// flush rewrites a writable archive that changed since it was read or last
+// flushed.
+func (a *ArchiveFS) flush() error {
+	if !a.writable || !a.dirty.Load() {
+		return nil
+	}
+	if err := a.save(); err != nil {
+		return fmt.Errorf("write %s: %w", a.path, err)
+	}
+	a.dirty.Store(false)
+	return nil
+}
+
+// Close writes a writable archive that still has changes.
+func (a *ArchiveFS) Close() error {
+	return a.flush()
+}
+
+// save writes the tree to a temporary file next to the archive, which then
+// replaces it, keeping its permissions.
+func (a *ArchiveFS) save() error {
+	temp, err := os.CreateTemp(filepath.Dir(a.path), "."+filepath.Base(a.path)+".*.zync-tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if a.format == archiveZip {
+		err = a.writeZip(temp)
+	} else {
+		err = a.writeTar(temp)
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	perm := fs.FileMode(0o644)
+	if info, statErr := os.Stat(a.path); statErr == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := os.Chmod(temp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), a.path)
+}
+
+// members calls fn for every entry of the tree in lexical order, with the
+// content of files and the target of links.
+func (a *ArchiveFS) members(fn func(name string, info fs.FileInfo, data []byte) error) error {
+	return a.MemoryFS.WalkDir(".", func(name string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil || name == "." {
+			return walkErr
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		var data []byte
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			target, linkErr := a.MemoryFS.Readlink(name)
+			if linkErr != nil {
+				return linkErr
+			}
+			data = []byte(target)
+		case info.Mode().IsRegular():
+			if data, err = a.MemoryFS.ReadFile(name); err != nil {
+				return err
+			}
+		}
+		return fn(name, info, data)
+	})
+}
+
+func (a *ArchiveFS) writeTar(w io.Writer) error {
+	var compressed *gzip.Writer
+	if a.format == archiveTarGz {
+		compressed = gzip.NewWriter(w)
+		w = compressed
+	}
+	writer := tar.NewWriter(w)
+	err := a.members(func(name string, info fs.FileInfo, data []byte) error {
+		header := &tar.Header{Name: name, Mode: int64(info.Mode().Perm()), ModTime: info.ModTime(), Typeflag: tar.TypeReg, Size: int64(len(data))}
+		switch {
+		case info.IsDir():
+			header.Name, header.Typeflag, header.Size = name+"/", tar.TypeDir, 0
+		case info.Mode()&fs.ModeSymlink != 0:
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, string(data), 0
+			data = nil
+		}
+		if err := writer.WriteHeader(header); err != nil {
+			return err
+		}
+		_, err := writer.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if compressed != nil {
+		return compressed.Close()
+	}
+	return nil
+}
+
+func (a *ArchiveFS) writeZip(w io.Writer) error {
+	writer := zip.NewWriter(w)
+	err := a.members(func(name string, info fs.FileInfo, data []byte) error {
+		header := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: info.ModTime()}
+		if info.IsDir() {
+			header.Name, header.Method = name+"/", zip.Store
+		}
+		header.SetMode(info.Mode())
+		member, err := writer.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		_, err = member.Write(data)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// changed marks the archive for rewriting when err is nil.
+func (a *ArchiveFS) changed(err error) error {
+	if err == nil {
+		a.dirty.Store(true)
+	}
+	return err
+}
+
+// WriteFile replaces the content of the file at name in memory.
+func (a *ArchiveFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return a.changed(a.MemoryFS.WriteFile(name, data, perm))
+}
+
+// Mkdir creates the directory name in memory.
+func (a *ArchiveFS) Mkdir(name string, perm fs.FileMode) error {
+	return a.changed(a.MemoryFS.Mkdir(name, perm))
+}
+
+// MkdirAll creates the directory name and its parents in memory.
+func (a *ArchiveFS) MkdirAll(name string, perm fs.FileMode) error {
+	if info, err := a.MemoryFS.Stat(name); err == nil && info.IsDir() {
+		return nil
+	}
+	return a.changed(a.MemoryFS.MkdirAll(name, perm))
+}
+
+// Rename moves oldName to newName in memory.
+func (a *ArchiveFS) Rename(oldName string, newName string) error {
+	return a.changed(a.MemoryFS.Rename(oldName, newName))
+}
+
+// Remove removes name in memory.
+func (a *ArchiveFS) Remove(name string) error {
+	return a.changed(a.MemoryFS.Remove(name))
+}
+
+// RemoveAll removes name and everything below it in memory.
+func (a *ArchiveFS) RemoveAll(name string) error {
+	return a.changed(a.MemoryFS.RemoveAll(name))
+}
+
+// Chmod changes the permissions of name in memory.
+func (a *ArchiveFS) Chmod(name string, mode fs.FileMode) error {
+	return a.changed(a.MemoryFS.Chmod(name, mode))
+}
+
+// Symlink creates the link name in memory.
+func (a *ArchiveFS) Symlink(target string, name string) error {
+	return a.changed(a.MemoryFS.Symlink(target, name))
+}
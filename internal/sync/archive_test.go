@@ -0,0 +1,179 @@
+package sync_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+// writeArchive creates an archive at archivePath holding files, plus a link
+// named link.md to notes/a.md.
+func writeArchive(t *testing.T, archivePath string, files map[string]string) {
+	t.Helper()
+	archive, err := syncpkg.OpenArchive(archivePath, true)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for name, content := range files {
+		writeReplicaFile(t, archive, name, content)
+	}
+	if err := archive.Symlink("notes/a.md", "link.md"); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+}
+
+func syncArchive(t *testing.T, opts syncpkg.Options, archivePath string, writable bool) syncpkg.SyncResult {
+	t.Helper()
+	replica, err := syncpkg.OpenRoot(archivePath, syncpkg.RootConfig{WriteArchives: writable})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	opts.ReplicaB = replica
+	res, err := syncpkg.RunSync(opts, zap.NewNop())
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if err := syncpkg.CloseReplica(replica); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	return res
+}
+
+func TestArchiveReadOnlySource(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "backup.tar.gz")
+	writeArchive(t, archivePath, map[string]string{"notes/a.md": "one\ntwo\nthree\n", "notes/b.md": "from the backup"})
+	before, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	rootA, state := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(rootA, "notes", "a.md"), "one\ntwo\nthree\nfour\n")
+	writeFile(t, filepath.Join(rootA, "live.md"), "only in the directory")
+	opts := defaultOptions(rootA, archivePath, state)
+	for run := 0; run < 2; run++ {
+		res := syncArchive(t, opts, archivePath, false)
+		if res.RunID != "" {
+			t.Fatalf("run against a read-only archive was journaled as %s", res.RunID)
+		}
+		if got := readFile(t, filepath.Join(rootA, "notes", "b.md")); got != "from the backup" {
+			t.Fatalf("run %d: A has %q", run, got)
+		}
+		if got := readFile(t, filepath.Join(rootA, "notes", "a.md")); !strings.Contains(got, "four") {
+			t.Fatalf("run %d: A lost its own edit: %q", run, got)
+		}
+		if target, err := os.Readlink(filepath.Join(rootA, "link.md")); err != nil || target != "notes/a.md" {
+			t.Fatalf("run %d: link = %q, %v", run, target, err)
+		}
+	}
+	after, err := os.ReadFile(archivePath)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if !bytes.Equal(before, after) {
+		t.Fatal("read-only archive was rewritten")
+	}
+}
+
+func TestArchiveReadOnlyKeepsNewerDirectories(t *testing.T) {
+	rootA, rootB, state := t.TempDir(), t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(rootA, "notes", "a.md"), "one\ntwo\nthree\n")
+	opts := defaultOptions(rootA, rootB, state)
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "old.tar")
+	writeArchive(t, archivePath, map[string]string{"notes/a.md": "one\ntwo\nthree\n"})
+	writeFile(t, filepath.Join(rootA, "projects", "p.md"), "P")
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+
+	res := syncArchive(t, opts, archivePath, false)
+	if res.ActionCounters["A<-B (rmdir)"] != 0 {
+		t.Fatalf("read-only archive deleted directories: %v", res.ActionCounters)
+	}
+	if got := readFile(t, filepath.Join(rootA, "projects", "p.md")); got != "P" {
+		t.Fatalf("A has %q", got)
+	}
+}
+
+func TestArchiveReadWrite(t *testing.T) {
+	for _, name := range []string{"vault.zip", "vault.tar", "vault.tgz"} {
+		t.Run(name, func(t *testing.T) {
+			dir := t.TempDir()
+			archivePath := filepath.Join(dir, name)
+			writeArchive(t, archivePath, map[string]string{"notes/a.md": "one\ntwo\nthree\n"})
+			if err := os.Chmod(archivePath, 0o600); err != nil {
+				t.Fatalf("chmod: %v", err)
+			}
+
+			rootA, state := t.TempDir(), t.TempDir()
+			opts := defaultOptions(rootA, archivePath, state)
+			syncArchive(t, opts, archivePath, true)
+
+			writeFile(t, filepath.Join(rootA, "notes", "a.md"), "ONE\ntwo\nthree\n")
+			writeFile(t, filepath.Join(rootA, "new", "c.md"), "new on A")
+			archive, err := syncpkg.OpenArchive(archivePath, true)
+			if err != nil {
+				t.Fatalf("open: %v", err)
+			}
+			writeReplicaFile(t, archive, "notes/a.md", "one\ntwo\nTHREE\n")
+			if err := archive.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+
+			res := syncArchive(t, opts, archivePath, true)
+			if res.ActionCounters["merge(3way)"] != 1 {
+				t.Fatalf("counters %v", res.ActionCounters)
+			}
+			reopened, err := syncpkg.OpenArchive(archivePath, false)
+			if err != nil {
+				t.Fatalf("reopen: %v", err)
+			}
+			if got := readReplicaFile(t, reopened, "notes/a.md"); got != "ONE\ntwo\nTHREE\n" {
+				t.Fatalf("archive has %q", got)
+			}
+			if got := readReplicaFile(t, reopened, "new/c.md"); got != "new on A" {
+				t.Fatalf("archive has %q", got)
+			}
+			if target, err := reopened.Readlink("link.md"); err != nil || target != "notes/a.md" {
+				t.Fatalf("link = %q, %v", target, err)
+			}
+			if info, err := os.Stat(archivePath); err != nil || info.Mode().Perm() != 0o600 {
+				t.Fatalf("archive permissions changed: %v %v", info.Mode(), err)
+			}
+			entries, err := os.ReadDir(dir)
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("expected only the archive, found %v: %v", entries, err)
+			}
+		})
+	}
+}
+
+func TestArchiveRejectsEscapingMembers(t *testing.T) {
+	var buffer bytes.Buffer
+	writer := tar.NewWriter(&buffer)
+	if err := writer.WriteHeader(&tar.Header{Name: "../evil.md", Mode: 0o644, Size: 4, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatalf("header: %v", err)
+	}
+	writer.Write([]byte("evil"))
+	writer.Close()
+	archivePath := filepath.Join(t.TempDir(), "evil.tar")
+	if err := os.WriteFile(archivePath, buffer.Bytes(), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if _, err := syncpkg.OpenArchive(archivePath, false); err == nil || !strings.Contains(err.Error(), "evil.md") {
+		t.Fatalf("expected the escaping member to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const backupTimeLayout = "20060102T150405.000000000Z"
+
+// BackupRecord describes one backup kept in the state directory.
+type BackupRecord struct {
+	ID   string
+	Path string
+	Side string
+	Time time.Time
+	Size int64
+}
+
+// RetentionPolicy bounds the backups kept in the state directory. Zero
+// values disable the corresponding limit.
+type RetentionPolicy struct {
+	MaxCountPerPath int
+	MaxAge          time.Duration
+	MaxTotalBytes   int64
+}
+
+func (p RetentionPolicy) isZero() bool {
+	return p.MaxCountPerPath <= 0 && p.MaxAge <= 0 && p.MaxTotalBytes <= 0
+}
+
+func backupDirectory(stateDir string) string {
+	return filepath.Join(stateDir, "backups")
+}
+
+// storeBackup saves content as the version of relativePath on the given side
+// ("a" or "b") at the given time.
+func (s *stateStore) storeBackup(relativePath string, side string, content []byte, at time.Time) error {
+	name := at.UTC().Format(backupTimeLayout) + "." + side
+	target := filepath.Join(s.BackupDir, filepath.FromSlash(relativePath), name)
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(target, content, 0o644)
+}
+
+func parseBackupID(id string) (BackupRecord, error) {
+	id = strings.TrimPrefix(path.Clean(filepath.ToSlash(id)), "/")
+	dir, name := path.Split(id)
+	dot := strings.LastIndex(name, ".")
+	if dir == "" || dot < 0 || id == ".." || strings.HasPrefix(id, "../") {
+		return BackupRecord{}, fmt.Errorf("invalid backup id %q", id)
+	}
+	stamp, side := name[:dot], name[dot+1:]
+	at, err := time.Parse(backupTimeLayout, stamp)
+	if err != nil || (side != "a" && side != "b") {
+		return BackupRecord{}, fmt.Errorf("invalid backup id %q", id)
+	}
+	return BackupRecord{ID: id, Path: strings.TrimSuffix(dir, "/"), Side: side, Time: at}, nil
+}
+
+// ListBackups returns the backups of relativePath, or of every path when
+// relativePath is empty, ordered by path and then oldest first.
+func ListBackups(stateDir string, relativePath string) ([]BackupRecord, error) {
+	root := backupDirectory(stateDir)
+	start := root
+	if relativePath != "" {
+		start = filepath.Join(root, filepath.FromSlash(path.Clean(filepath.ToSlash(relativePath))))
+	}
+	var records []BackupRecord
+	err := filepath.WalkDir(start, func(currentPath string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			if errors.Is(walkErr, fs.ErrNotExist) {
+				return filepath.SkipAll
+			}
+			return walkErr
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, currentPath)
+		record, parseErr := parseBackupID(rel)
+		if parseErr != nil {
+			return nil
+		}
+		if relativePath != "" && record.Path != path.Clean(filepath.ToSlash(relativePath)) {
+			return nil
+		}
+		info, infoErr := d.Info()
+		if infoErr != nil {
+			return infoErr
+		}
+		record.Size = info.Size()
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		if records[i].Path != records[j].Path {
+			return records[i].Path < records[j].Path
+		}
+		if !records[i].Time.Equal(records[j].Time) {
+			return records[i].Time.Before(records[j].Time)
+		}
+		return records[i].Side < records[j].Side
+	})
+	return records, nil
+}
+
+// ReadBackup returns the content of the backup with the given id.
+func ReadBackup(stateDir string, id string) ([]byte, error) {
+	record, err := parseBackupID(id)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(filepath.Join(backupDirectory(stateDir), filepath.FromSlash(record.ID)))
+}
+
+// PruneBackups removes backups that fall outside policy as of now and returns
+// the removed records. The count limit applies per path, the size limit to
+// the whole store, removing the oldest backups first.
+func PruneBackups(stateDir string, policy RetentionPolicy, now time.Time) ([]BackupRecord, error) {
+	if policy.isZero() {
+		return nil, nil
+	}
+	records, err := ListBackups(stateDir, "")
+	if err != nil {
+		return nil, err
+	}
+
+	doomed := map[string]bool{}
+	if policy.MaxAge > 0 {
+		cutoff := now.Add(-policy.MaxAge)
+		for _, record := range records {
+			if record.Time.Before(cutoff) {
+				doomed[record.ID] = true
+			}
+		}
+	}
+	if policy.MaxCountPerPath > 0 {
+		byPath := map[string][]BackupRecord{}
+		for _, record := range records {
+			byPath[record.Path] = append(byPath[record.Path], record)
+		}
+		for _, versions := range byPath {
+			for index := 0; index < len(versions)-policy.MaxCountPerPath; index++ {
+				doomed[versions[index].ID] = true
+			}
+		}
+	}
+	if policy.MaxTotalBytes > 0 {
+		oldestFirst := append([]BackupRecord(nil), records...)
+		sort.SliceStable(oldestFirst, func(i, j int) bool {
+			return oldestFirst[i].Time.Before(oldestFirst[j].Time)
+		})
+		var total int64
+		for _, record := range oldestFirst {
+			if !doomed[record.ID] {
+				total += record.Size
+			}
+		}
+		for _, record := range oldestFirst {
+			if total <= policy.MaxTotalBytes {
+				break
+			}
+			if !doomed[record.ID] {
+				doomed[record.ID] = true
+				total -= record.Size
+			}
+		}
+	}
+
+	root := backupDirectory(stateDir)
+	var removed []BackupRecord
+	for _, record := range records {
+		if !doomed[record.ID] {
+			continue
+		}
+		target := filepath.Join(root, filepath.FromSlash(record.ID))
+		if err := os.Remove(target); err != nil {
+			return removed, err
+		}
+		removeEmptyParents(filepath.Dir(target), root)
+		removed = append(removed, record)
+	}
+	return removed, nil
+}
+
+func removeEmptyParents(dir string, stop string) {
+	for dir != stop && strings.HasPrefix(dir, stop) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
@@ -0,0 +1,90 @@
+package sync_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+func TestBackupsStoredInStateDirectory(t *testing.T) {
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	state := t.TempDir()
+	writeFile(t, filepath.Join(rootA, "n.md"), "A1")
+	writeFile(t, filepath.Join(rootB, "n.md"), "B1")
+	os.Chtimes(filepath.Join(rootA, "n.md"), testTime(2000), testTime(2000))
+	os.Chtimes(filepath.Join(rootB, "n.md"), testTime(3000), testTime(3000))
+
+	opts := defaultOptions(rootA, rootB, state)
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	for _, stray := range []string{filepath.Join(rootA, "n.md.bak.a"), filepath.Join(rootB, "n.md.bak.b")} {
+		if _, err := os.Stat(stray); !os.IsNotExist(err) {
+			t.Fatalf("backup written next to user file: %s", stray)
+		}
+	}
+
+	records, err := syncpkg.ListBackups(state, "n.md")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(records) != 2 || records[0].Side != "a" || records[1].Side != "b" {
+		t.Fatalf("unexpected backups: %+v", records)
+	}
+	content, err := syncpkg.ReadBackup(state, records[0].ID)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if string(content) != "A1" {
+		t.Fatalf("unexpected backup content: %q", content)
+	}
+	if _, err := syncpkg.ReadBackup(state, "../state.json"); err == nil {
+		t.Fatalf("expected invalid id error")
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name   string
+		policy syncpkg.RetentionPolicy
+		kept   int
+	}{
+		{name: "NoPolicyKeepsAll", policy: syncpkg.RetentionPolicy{}, kept: 6},
+		{name: "CountPerPath", policy: syncpkg.RetentionPolicy{MaxCountPerPath: 1}, kept: 2},
+		{name: "Age", policy: syncpkg.RetentionPolicy{MaxAge: 36 * time.Hour}, kept: 4},
+		{name: "TotalSize", policy: syncpkg.RetentionPolicy{MaxTotalBytes: 6}, kept: 2},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := t.TempDir()
+			for _, rel := range []string{"a.md", "dir/b.md"} {
+				for day := 0; day < 3; day++ {
+					stamp := now.Add(-time.Duration(day) * 24 * time.Hour).Format("20060102T150405.000000000Z")
+					writeFile(t, filepath.Join(state, "backups", filepath.FromSlash(rel), stamp+".a"), "xyz")
+				}
+			}
+			if _, err := syncpkg.PruneBackups(state, tc.policy, now); err != nil {
+				t.Fatalf("prune: %v", err)
+			}
+			records, err := syncpkg.ListBackups(state, "")
+			if err != nil {
+				t.Fatalf("list: %v", err)
+			}
+			if len(records) != tc.kept {
+				t.Fatalf("kept %d backups, want %d", len(records), tc.kept)
+			}
+			for _, record := range records {
+				if record.Time.Before(now.Add(-24*time.Hour)) && tc.policy.MaxCountPerPath == 1 {
+					t.Fatalf("older backup kept: %+v", record)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,433 @@
+package sync
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	bundleFormatVersion = 1
+	bundleManifestName  = "manifest.json"
+	bundleBlobDirectory = "blobs/"
+)
+
+// bundleManifest lists the entries of a bundle. Contents and ancestors are
+// stored next to it as blobs named by their digest. Tree lists the sender's
+// other files and links without content, so that the receiver learns which
+// of its paths the sender already has.
+type bundleManifest struct {
+	Version   int           `json:"version"`
+	CreatedAt time.Time     `json:"created_at"`
+	Root      string        `json:"root,omitempty"`
+	Entries   []bundleEntry `json:"entries"`
+	Tree      []bundleEntry `json:"tree,omitempty"`
+}
+
+// bundleEntry is a file or link that changed on the sending side, with the
+// ancestor it changed from. An entry without ancestor is new to the
+// receiving side as far as the sender knows. SentHex is the content an
+// earlier bundle carried for the path; a receiver that applied that bundle
+// merges against it instead of the ancestor.
+type bundleEntry struct {
+	Path           string `json:"path"`
+	Kind           string `json:"kind"`
+	Digest         string `json:"digest,omitempty"`
+	Target         string `json:"target,omitempty"`
+	AncestorHex    string `json:"ancestor_hex,omitempty"`
+	AncestorTarget string `json:"ancestor_target,omitempty"`
+	SentHex        string `json:"sent_hex,omitempty"`
+}
+
+// BundleSummary describes a bundle written by CreateBundle.
+type BundleSummary struct {
+	EntryCount int
+	BlobCount  int
+}
+
+// CreateBundle writes to bundlePath every file and link of root A that
+// differs from the ancestor recorded in the state directory, along with the
+// ancestors, so that ApplyBundle can merge them into a tree that cannot be
+// reached from here. Files deleted on A are not carried, as zync does not
+// propagate file deletions. The state remembers what each file was sent as,
+// so that the next bundle merges cleanly on a receiver that applied this one.
+func CreateBundle(options Options, bundlePath string, logger *zap.Logger) (BundleSummary, error) {
+	var summary BundleSummary
+	options = withReplicas(options)
+	store, state, err := createOrOpenStateStore(options.StateDirectory)
+	if err != nil {
+		return summary, err
+	}
+	relativeSet, dirSet := map[string]struct{}{}, map[string]struct{}{}
+	if err := collectRelativePaths(options.ReplicaA, options, relativeSet, dirSet, logger); err != nil {
+		return summary, err
+	}
+	relativeList := make([]string, 0, len(relativeSet))
+	for rel := range relativeSet {
+		relativeList = append(relativeList, rel)
+	}
+	sort.Strings(relativeList)
+
+	manifest := bundleManifest{Version: bundleFormatVersion, CreatedAt: time.Now().UTC(), Root: localRoot(options.ReplicaA)}
+	blobs := map[string][]byte{}
+	for _, rel := range relativeList {
+		snapshot, err := captureEntry(options.ReplicaA, rel, options.SymlinkMode == SymlinkModeFollow)
+		if err != nil {
+			return summary, err
+		}
+		previous, known := state.FileEntry[rel]
+		entry := bundleEntry{Path: rel, Kind: snapshot.Kind, Digest: snapshot.Digest, Target: snapshot.Target}
+		switch snapshot.Kind {
+		case snapshotFile:
+			if known && previous.LinkTarget == "" && previous.AncestorHex == snapshot.Digest {
+				manifest.Tree = append(manifest.Tree, entry)
+				continue
+			}
+			if snapshot.content == nil {
+				if snapshot.content, err = options.ReplicaA.ReadFile(rel); err != nil {
+					return summary, err
+				}
+				entry.Digest = digestBytes(snapshot.content)
+			}
+			blobs[entry.Digest] = snapshot.content
+			if known {
+				entry.SentHex = previous.SentHex
+			}
+		case snapshotLink:
+			if known && previous.LinkTarget == snapshot.Target {
+				manifest.Tree = append(manifest.Tree, entry)
+				continue
+			}
+		default:
+			continue
+		}
+		if known && previous.LinkTarget != "" {
+			entry.AncestorTarget = previous.LinkTarget
+		} else if known && previous.AncestorHex != "" {
+			ancestor, ancErr := store.ancestorBytes(previous.AncestorHex)
+			if ancErr != nil && !errors.Is(ancErr, fs.ErrNotExist) {
+				return summary, ancErr
+			}
+			if ancErr == nil {
+				entry.AncestorHex = previous.AncestorHex
+				blobs[entry.AncestorHex] = ancestor
+			} else if logger != nil {
+				logger.Warn("ancestor missing from the state directory, bundling without it", zap.String("path", rel))
+			}
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	if err := writeBundle(bundlePath, manifest, blobs); err != nil {
+		return summary, fmt.Errorf("write %s: %w", bundlePath, err)
+	}
+	for _, entry := range manifest.Entries {
+		if entry.Kind == snapshotFile {
+			sent := state.FileEntry[entry.Path]
+			sent.SentHex = entry.Digest
+			state.FileEntry[entry.Path] = sent
+		}
+	}
+	if err := store.save(state); err != nil {
+		return summary, err
+	}
+	summary.EntryCount, summary.BlobCount = len(manifest.Entries), len(blobs)
+	return summary, nil
+}
+
+// writeBundle writes the manifest and the blobs as a gzip-compressed tar
+// file next to bundlePath, which then replaces it.
+func writeBundle(bundlePath string, manifest bundleManifest, blobs map[string][]byte) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(bundlePath), "."+filepath.Base(bundlePath)+".*.zync-tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	compressed := gzip.NewWriter(temp)
+	writer := tar.NewWriter(compressed)
+	now := time.Now()
+	add := func(name string, content []byte) error {
+		if err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), ModTime: now, Typeflag: tar.TypeReg}); err != nil {
+			return err
+		}
+		_, err := writer.Write(content)
+		return err
+	}
+	err = add(bundleManifestName, data)
+	digests := make([]string, 0, len(blobs))
+	for digest := range blobs {
+		digests = append(digests, digest)
+	}
+	sort.Strings(digests)
+	for _, digest := range digests {
+		if err == nil {
+			err = add(bundleBlobDirectory+digest, blobs[digest])
+		}
+	}
+	if err == nil {
+		err = writer.Close()
+	}
+	if err == nil {
+		err = compressed.Close()
+	}
+	if err == nil {
+		err = temp.Sync()
+	}
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(temp.Name(), 0o644); err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), bundlePath)
+}
+
+// readBundle reads and checks the bundle at bundlePath.
+func readBundle(bundlePath string) (*bundleManifest, map[string][]byte, error) {
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	compressed, err := gzip.NewReader(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read %s: %w", bundlePath, err)
+	}
+	reader := tar.NewReader(compressed)
+	var manifest *bundleManifest
+	blobs := map[string][]byte{}
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s: %w", bundlePath, err)
+		}
+		content, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("read %s: %w", bundlePath, err)
+		}
+		if header.Name == bundleManifestName {
+			manifest = &bundleManifest{}
+			if err := json.Unmarshal(content, manifest); err != nil {
+				return nil, nil, fmt.Errorf("read %s: %w", bundlePath, err)
+			}
+		} else if digest, ok := strings.CutPrefix(header.Name, bundleBlobDirectory); ok {
+			if digestBytes(content) != digest {
+				return nil, nil, fmt.Errorf("%s is damaged: blob %s does not match its digest", bundlePath, digest)
+			}
+			blobs[digest] = content
+		}
+	}
+	if manifest == nil {
+		return nil, nil, fmt.Errorf("%s is not a zync bundle", bundlePath)
+	}
+	if manifest.Version != bundleFormatVersion {
+		return nil, nil, fmt.Errorf("%s has unsupported bundle version %d", bundlePath, manifest.Version)
+	}
+	for _, entry := range manifest.Tree {
+		if !validBundleEntry(entry) {
+			return nil, nil, fmt.Errorf("%s has an invalid entry %q", bundlePath, entry.Path)
+		}
+	}
+	for _, entry := range manifest.Entries {
+		if !validBundleEntry(entry) {
+			return nil, nil, fmt.Errorf("%s has an invalid entry %q", bundlePath, entry.Path)
+		}
+		for _, digest := range []string{entry.Digest, entry.AncestorHex} {
+			if _, ok := blobs[digest]; digest != "" && !ok {
+				return nil, nil, fmt.Errorf("%s is damaged: blob %s of %s is missing", bundlePath, digest, entry.Path)
+			}
+		}
+	}
+	return manifest, blobs, nil
+}
+
+// validBundleEntry reports whether entry names a file or link inside the root.
+func validBundleEntry(entry bundleEntry) bool {
+	return fs.ValidPath(entry.Path) && entry.Path != "." && (entry.Kind == snapshotFile || entry.Kind == snapshotLink)
+}
+
+// ApplyBundle merges the bundle at bundlePath into root B, taking the place
+// of root A. The merge is a regular run limited to the paths of the bundle,
+// using the ancestors it carries. Afterwards the state records the sender's
+// content as the ancestor of those paths, so that a bundle created here
+// carries what the sender does not have yet.
+func ApplyBundle(bundlePath string, options Options, logger *zap.Logger) (SyncResult, error) {
+	manifest, blobs, err := readBundle(bundlePath)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	incoming := NewMemoryFS()
+	options.RootAPath, options.ReplicaA = bundlePath, incoming
+	options = withReplicas(options)
+	store, original, err := createOrOpenStateStore(options.StateDirectory)
+	if err != nil {
+		return SyncResult{}, err
+	}
+
+	view := bundleView{ReplicaFS: options.ReplicaB, paths: map[string]struct{}{}, dirs: map[string]struct{}{}}
+	for _, entry := range manifest.Entries {
+		view.add(entry.Path)
+		if err := incoming.MkdirAll(path.Dir(entry.Path), 0o755); err != nil {
+			return SyncResult{}, err
+		}
+		if entry.Kind == snapshotLink {
+			err = incoming.Symlink(entry.Target, entry.Path)
+		} else {
+			err = incoming.WriteFile(entry.Path, blobs[entry.Digest], 0o644)
+		}
+		if err != nil {
+			return SyncResult{}, err
+		}
+	}
+	// The run merges against the sender's ancestors, which only live in
+	// memory, so a failed run leaves the state as it was.
+	options.seedState = func(store *stateStore, state *syncState) error {
+		for _, entry := range manifest.Entries {
+			// The sender's ancestor is current only if it is what was last
+			// sent from here; otherwise content received in an earlier
+			// bundle and not answered yet is the better base.
+			own := state.FileEntry[entry.Path]
+			if entry.SentHex != "" && own.LinkTarget == "" && own.AncestorHex == entry.SentHex && (entry.AncestorHex == "" || entry.AncestorHex != own.SentHex) {
+				continue
+			}
+			if entry.AncestorHex == "" && entry.AncestorTarget == "" {
+				delete(state.FileEntry, entry.Path)
+				continue
+			}
+			if entry.AncestorHex != "" {
+				if _, err := store.ensureAncestorStored(blobs[entry.AncestorHex]); err != nil {
+					return err
+				}
+			}
+			seeded := state.FileEntry[entry.Path]
+			seeded.AncestorHex, seeded.LinkTarget = entry.AncestorHex, entry.AncestorTarget
+			state.FileEntry[entry.Path] = seeded
+		}
+		// Directories the bundle does not mention are not gone on the other
+		// side, so none may be taken for deleted.
+		state.DirEntry = map[string]struct{}{}
+		return nil
+	}
+
+	options.ReplicaB = view
+	result, err := RunSync(options, logger)
+	if err != nil {
+		return result, restoreState(store, original, err)
+	}
+
+	_, merged, err := createOrOpenStateStore(options.StateDirectory)
+	if err != nil {
+		return result, restoreState(store, original, err)
+	}
+	for _, entry := range manifest.Entries {
+		recorded := merged.FileEntry[entry.Path]
+		recorded.AncestorHex, recorded.LinkTarget = entry.Digest, entry.Target
+		if entry.Kind == snapshotFile {
+			if _, err := store.ensureAncestorStored(blobs[entry.Digest]); err != nil {
+				return result, restoreState(store, original, err)
+			}
+		}
+		original.FileEntry[entry.Path] = recorded
+	}
+	for _, entry := range manifest.Tree {
+		if err := recordSenderEntry(store, original, options.ReplicaB, entry); err != nil {
+			return result, restoreState(store, original, err)
+		}
+	}
+	if err := store.save(original); err != nil {
+		return result, err
+	}
+	if logger != nil {
+		logger.Debug("applied bundle", zap.String("bundle", bundlePath), zap.Time("created", manifest.CreatedAt), zap.Int("entries", len(manifest.Entries)))
+	}
+	return result, nil
+}
+
+// restoreState saves state back over what a failed apply may have recorded
+// and returns cause.
+func restoreState(store *stateStore, state *syncState, cause error) error {
+	if err := store.save(state); err != nil {
+		return errors.Join(cause, err)
+	}
+	return cause
+}
+
+// recordSenderEntry records what the sender has at an unchanged path as its
+// ancestor when the tree here holds the same, which the sender then need not
+// carry back.
+func recordSenderEntry(store *stateStore, state *syncState, fsys ReplicaFS, entry bundleEntry) error {
+	if previous, known := state.FileEntry[entry.Path]; known && previous.AncestorHex == entry.Digest && previous.LinkTarget == entry.Target {
+		return nil
+	}
+	current, err := captureEntry(fsys, entry.Path, false)
+	if err != nil {
+		return err
+	}
+	if !current.sameAs(entrySnapshot{Kind: entry.Kind, Digest: entry.Digest, Target: entry.Target}) {
+		return nil
+	}
+	if current.Kind == snapshotFile && !current.hashed {
+		if _, err := store.ensureAncestorStored(current.content); err != nil {
+			return err
+		}
+	}
+	recorded := state.FileEntry[entry.Path]
+	recorded.AncestorHex, recorded.LinkTarget = entry.Digest, entry.Target
+	state.FileEntry[entry.Path] = recorded
+	return nil
+}
+
+// bundleView shows only the paths of a bundle, and the directories leading
+// to them, when the tree is walked, so that applying a bundle leaves every
+// other path alone.
+type bundleView struct {
+	ReplicaFS
+	paths map[string]struct{}
+	dirs  map[string]struct{}
+}
+
+func (v bundleView) add(rel string) {
+	v.paths[rel] = struct{}{}
+	for dir := path.Dir(rel); dir != "."; dir = path.Dir(dir) {
+		v.dirs[dir] = struct{}{}
+	}
+}
+
+// WalkDir walks the bundle's paths in the tree at name.
+func (v bundleView) WalkDir(name string, fn fs.WalkDirFunc) error {
+	return v.ReplicaFS.WalkDir(name, func(rel string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil || rel == "." {
+			return fn(rel, d, walkErr)
+		}
+		_, listed := v.paths[rel]
+		if _, leading := v.dirs[rel]; d.IsDir() && !leading && !listed {
+			return fs.SkipDir
+		}
+		if !d.IsDir() && !listed {
+			return nil
+		}
+		return fn(rel, d, nil)
+	})
+}
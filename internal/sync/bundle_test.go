@@ -0,0 +1,161 @@
+package sync_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+func TestBundleRoundTrip(t *testing.T) {
+	rootX, stateX := t.TempDir(), t.TempDir()
+	rootY, stateY := t.TempDir(), t.TempDir()
+	carried := filepath.Join(t.TempDir(), "carried.zync")
+	create := func(root string, state string) syncpkg.BundleSummary {
+		t.Helper()
+		summary, err := syncpkg.CreateBundle(defaultOptions(root, "", state), carried, zap.NewNop())
+		if err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		return summary
+	}
+	apply := func(root string, state string) syncpkg.SyncResult {
+		t.Helper()
+		res, err := syncpkg.ApplyBundle(carried, defaultOptions("", root, state), zap.NewNop())
+		if err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+		return res
+	}
+
+	writeFile(t, filepath.Join(rootX, "notes", "a.md"), "one\ntwo\nthree\n")
+	if err := os.Symlink("notes/a.md", filepath.Join(rootX, "link.md")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	writeFile(t, filepath.Join(rootY, "keep", "y.md"), "only on Y")
+	if summary := create(rootX, stateX); summary.EntryCount != 2 {
+		t.Fatalf("first bundle has %d entries", summary.EntryCount)
+	}
+	apply(rootY, stateY)
+	if got := readFile(t, filepath.Join(rootY, "notes", "a.md")); got != "one\ntwo\nthree\n" {
+		t.Fatalf("Y has %q", got)
+	}
+	if target, err := os.Readlink(filepath.Join(rootY, "link.md")); err != nil || target != "notes/a.md" {
+		t.Fatalf("link = %q, %v", target, err)
+	}
+	if got := readFile(t, filepath.Join(rootY, "keep", "y.md")); got != "only on Y" {
+		t.Fatalf("apply touched a path outside the bundle: %q", got)
+	}
+
+	writeFile(t, filepath.Join(rootY, "notes", "a.md"), "one\ntwo\nTHREE\n")
+	writeFile(t, filepath.Join(rootX, "notes", "a.md"), "ONE\ntwo\nthree\n")
+	if summary := create(rootY, stateY); summary.EntryCount != 2 {
+		t.Fatalf("bundle from Y has %d entries, want a.md and y.md", summary.EntryCount)
+	}
+	if res := apply(rootX, stateX); res.ActionCounters["merge(3way)"] != 1 {
+		t.Fatalf("expected a three-way merge on X, counters %v", res.ActionCounters)
+	}
+	if got := readFile(t, filepath.Join(rootX, "notes", "a.md")); got != "ONE\ntwo\nTHREE\n" {
+		t.Fatalf("X has %q", got)
+	}
+	if got := readFile(t, filepath.Join(rootX, "keep", "y.md")); got != "only on Y" {
+		t.Fatalf("X has %q", got)
+	}
+
+	create(rootX, stateX)
+	apply(rootY, stateY)
+	if got := readFile(t, filepath.Join(rootY, "notes", "a.md")); got != "ONE\ntwo\nTHREE\n" {
+		t.Fatalf("Y did not take the merge: %q", got)
+	}
+	if summary := create(rootY, stateY); summary.EntryCount != 0 {
+		t.Fatalf("Y still has %d changes for X after the exchange", summary.EntryCount)
+	}
+	apply(rootX, stateX)
+	if summary := create(rootX, stateX); summary.EntryCount != 0 {
+		t.Fatalf("X still has %d changes for Y after the exchange", summary.EntryCount)
+	}
+}
+
+func TestBundleFailedApplyKeepsState(t *testing.T) {
+	rootX, stateX := t.TempDir(), t.TempDir()
+	rootY, stateY := t.TempDir(), t.TempDir()
+	carried := filepath.Join(t.TempDir(), "carried.zync")
+	writeFile(t, filepath.Join(rootX, "notes", "a.md"), "one")
+	writeFile(t, filepath.Join(rootY, "keep", "y.md"), "only on Y")
+	if _, err := syncpkg.CreateBundle(defaultOptions(rootX, "", stateX), carried, zap.NewNop()); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	if _, err := syncpkg.ApplyBundle(carried, defaultOptions("", rootY, stateY), zap.NewNop()); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	before := readFile(t, filepath.Join(stateY, "state.json"))
+
+	writeFile(t, filepath.Join(rootX, "notes", "a.md"), "two")
+	if _, err := syncpkg.CreateBundle(defaultOptions(rootX, "", stateX), carried, zap.NewNop()); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	opts := defaultOptions("", rootY, stateY)
+	opts.GitCommit = syncpkg.GitCommitB
+	if _, err := syncpkg.ApplyBundle(carried, opts, zap.NewNop()); err == nil {
+		t.Fatal("expected the apply to fail outside a git work tree")
+	}
+	if after := readFile(t, filepath.Join(stateY, "state.json")); after != before {
+		t.Fatalf("failed apply changed the state:\n%s\nwant\n%s", after, before)
+	}
+}
+
+func TestBundleSentTwiceMergesAgainstFirst(t *testing.T) {
+	rootX, stateX := t.TempDir(), t.TempDir()
+	rootY, stateY := t.TempDir(), t.TempDir()
+	carried := filepath.Join(t.TempDir(), "carried.zync")
+	exchange := func() {
+		t.Helper()
+		if _, err := syncpkg.CreateBundle(defaultOptions(rootX, "", stateX), carried, zap.NewNop()); err != nil {
+			t.Fatalf("create: %v", err)
+		}
+		if _, err := syncpkg.ApplyBundle(carried, defaultOptions("", rootY, stateY), zap.NewNop()); err != nil {
+			t.Fatalf("apply: %v", err)
+		}
+	}
+
+	writeFile(t, filepath.Join(rootX, "a.md"), "one\ntwo\nthree\n")
+	writeFile(t, filepath.Join(rootX, "b.md"), "bee\n")
+	exchange()
+
+	writeFile(t, filepath.Join(rootY, "a.md"), "one\ntwo\nTHREE\n")
+	writeFile(t, filepath.Join(rootY, "b.md"), "BEE\n")
+	writeFile(t, filepath.Join(rootX, "a.md"), "ONE\ntwo\nthree\n")
+	exchange()
+	if got := readFile(t, filepath.Join(rootY, "a.md")); got != "ONE\ntwo\nTHREE\n" {
+		t.Fatalf("Y has %q", got)
+	}
+	if got := readFile(t, filepath.Join(rootY, "b.md")); got != "BEE\n" {
+		t.Fatalf("Y lost its edit of b.md: %q", got)
+	}
+}
+
+func TestBundleRejectsDamage(t *testing.T) {
+	root, state := t.TempDir(), t.TempDir()
+	writeFile(t, filepath.Join(root, "a.md"), "content")
+	carried := filepath.Join(t.TempDir(), "carried.zync")
+	if _, err := syncpkg.CreateBundle(defaultOptions(root, "", state), carried, zap.NewNop()); err != nil {
+		t.Fatalf("create: %v", err)
+	}
+	data, err := os.ReadFile(carried)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	if err := os.WriteFile(carried, data[:len(data)/2], 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	target := t.TempDir()
+	if _, err := syncpkg.ApplyBundle(carried, defaultOptions("", target, t.TempDir()), zap.NewNop()); err == nil || !strings.Contains(err.Error(), carried) {
+		t.Fatalf("expected the truncated bundle to be refused, got %v", err)
+	}
+	if entries, _ := os.ReadDir(target); len(entries) != 0 {
+		t.Fatalf("refused bundle changed the tree: %v", entries)
+	}
+}
@@ -0,0 +1,144 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// mergeCSV merges CSV or TSV rows. With keyColumn set, rows are matched by
+// the value in that column of the header row; otherwise they are matched by
+// position with a diff3 over whole rows. Inserted and deleted rows follow the
+// side that made them and cells changed on one side take that side's value.
+// Cells changed differently on both sides are returned as conflicts.
+func mergeCSV(relativePath string, base []byte, a []byte, b []byte, keyColumn string) ([]byte, []string, error) {
+	delimiter := ','
+	if strings.EqualFold(path.Ext(relativePath), ".tsv") {
+		delimiter = '\t'
+	}
+	var tables [3][][]string
+	for index, content := range [][]byte{base, a, b} {
+		reader := csv.NewReader(bytes.NewReader(content))
+		reader.Comma = delimiter
+		reader.FieldsPerRecord = -1
+		rows, err := reader.ReadAll()
+		if err != nil {
+			return nil, nil, err
+		}
+		tables[index] = rows
+	}
+
+	var conflicts []string
+	var merged [][]string
+	if keyColumn == "" {
+		merged = mergeSequence("row", tables[0], tables[1], tables[2], rowsEqual, mergeRowCells(&conflicts, nil), &conflicts)
+	} else {
+		var err error
+		merged, err = mergeKeyedRows(tables, keyColumn, &conflicts)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if len(conflicts) > 0 {
+		return nil, conflicts, nil
+	}
+
+	var out bytes.Buffer
+	writer := csv.NewWriter(&out)
+	writer.Comma = delimiter
+	writer.UseCRLF = bytes.Contains(a, []byte("\r\n"))
+	if err := writer.WriteAll(merged); err != nil {
+		return nil, nil, err
+	}
+	return out.Bytes(), nil, nil
+}
+
+// mergeKeyedRows merges rows identified by keyColumn. All three tables must
+// share the same header row.
+func mergeKeyedRows(tables [3][][]string, keyColumn string, conflicts *[]string) ([][]string, error) {
+	for _, rows := range tables {
+		if len(rows) == 0 {
+			return nil, fmt.Errorf("header row missing")
+		}
+	}
+	for _, rows := range tables {
+		if !rowsEqual(rows[0], tables[1][0]) {
+			return nil, fmt.Errorf("header rows differ")
+		}
+	}
+	header := tables[1][0]
+	keyIndex := -1
+	for index, name := range header {
+		if name == keyColumn {
+			keyIndex = index
+		}
+	}
+	if keyIndex < 0 {
+		return nil, fmt.Errorf("key column %q not found", keyColumn)
+	}
+
+	var keyed [3]keyedEntries[[]string]
+	for tableIndex, rows := range tables {
+		entries := keyedEntries[[]string]{values: map[string][]string{}}
+		for _, row := range rows[1:] {
+			if keyIndex >= len(row) {
+				return nil, fmt.Errorf("row without key column %q", keyColumn)
+			}
+			key := row[keyIndex]
+			if _, duplicate := entries.values[key]; duplicate {
+				return nil, fmt.Errorf("duplicate key %q", key)
+			}
+			entries.keys = append(entries.keys, key)
+			entries.values[key] = row
+		}
+		keyed[tableIndex] = entries
+	}
+
+	rows := mergeKeyed("", keyed[0], keyed[1], keyed[2], rowsEqual, mergeRowCells(conflicts, header), conflicts)
+	merged := [][]string{header}
+	for _, key := range rows.keys {
+		merged = append(merged, rows.values[key])
+	}
+	return merged, nil
+}
+
+// mergeRowCells returns a row merge that merges cell by cell, naming
+// conflicting cells by header name when one is given. Rows added on both
+// sides have no base, so their cells must agree.
+func mergeRowCells(conflicts *[]string, header []string) func(string, []string, bool, []string, []string) []string {
+	return func(rowPath string, base []string, hasBase bool, a []string, b []string) []string {
+		width := max(len(a), len(b))
+		merged := make([]string, 0, width)
+		for column := 0; column < width; column++ {
+			baseCell := "\x00"
+			if hasBase {
+				baseCell = cellAt(base, column)
+			}
+			cell, ok := mergeValue(baseCell, cellAt(a, column), cellAt(b, column))
+			if !ok {
+				name := fmt.Sprint(column)
+				if column < len(header) {
+					name = header[column]
+				}
+				*conflicts = append(*conflicts, rowPath+"."+name)
+			}
+			merged = append(merged, cell)
+		}
+		return merged
+	}
+}
+
+func cellAt(row []string, column int) string {
+	if column < len(row) {
+		return row[column]
+	}
+	return ""
+}
+
+func rowsEqual(x []string, y []string) bool {
+	return sequencesEqual(x, y, func(left string, right string) bool {
+		return left == right
+	})
+}
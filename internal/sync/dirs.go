@@ -0,0 +1,245 @@
+package sync
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var errSubtreeChanged = errors.New("subtree has unsynchronized content")
+
+// propagateDirectoryDeletions removes directories from one side when they were
+// deleted on the other since the last run and everything left below them is
+// already known to the state. It returns the relative directories removed.
+func propagateDirectoryDeletions(options Options, state *syncState, result *SyncResult, recorder *runRecorder, logger *zap.Logger) ([]string, error) {
+	known := make([]string, 0, len(state.DirEntry))
+	for rel := range state.DirEntry {
+		known = append(known, rel)
+	}
+	sort.Strings(known)
+
+	var removed []string
+	for _, rel := range known {
+		if _, stillKnown := state.DirEntry[rel]; !stillKnown {
+			continue
+		}
+		pathA := filepath.Join(options.RootAPath, filepath.FromSlash(rel))
+		pathB := filepath.Join(options.RootBPath, filepath.FromSlash(rel))
+		kindA, _, errA := lstatKind(options.ReplicaA, rel)
+		if errA != nil {
+			return removed, errA
+		}
+		kindB, _, errB := lstatKind(options.ReplicaB, rel)
+		if errB != nil {
+			return removed, errB
+		}
+
+		var survivor ReplicaFS
+		var survivorRoot, survivorPath, survivorSide, tag string
+		switch {
+		case kindA == entryMissing && kindB == entryDir:
+			survivor, survivorRoot, survivorPath, survivorSide, tag = options.ReplicaB, options.RootBPath, pathB, VersionSideB, "B<-A (rmdir)"
+		case kindB == entryMissing && kindA == entryDir:
+			survivor, survivorRoot, survivorPath, survivorSide, tag = options.ReplicaA, options.RootAPath, pathA, VersionSideA, "A<-B (rmdir)"
+		default:
+			continue
+		}
+
+		inside, guardErr := withinReplica(survivor, path.Dir(rel))
+		if guardErr != nil {
+			return removed, guardErr
+		}
+		if !inside {
+			if logger != nil {
+				logger.Warn("refusing path that resolves outside root", zap.String("path", survivorPath), zap.String("root", survivorRoot))
+			}
+			continue
+		}
+
+		unchanged, checkErr := subtreeUnchanged(survivor, rel, options, state)
+		if checkErr != nil {
+			if logger != nil {
+				logger.Error("inspect directory", zap.String("path", survivorPath), zap.Error(checkErr))
+			}
+			return removed, checkErr
+		}
+		if !unchanged {
+			if logger != nil {
+				logger.Info("keeping deleted directory with new content", zap.String("path", rel))
+			}
+			continue
+		}
+
+		if err := recorder.watchTree(survivorSide, rel); err != nil {
+			return removed, err
+		}
+		if err := survivor.RemoveAll(rel); err != nil {
+			if logger != nil {
+				logger.Error("remove directory", zap.String("path", survivorPath), zap.Error(err))
+			}
+			return removed, err
+		}
+		if err := recorder.settle(tag, true); err != nil {
+			return removed, err
+		}
+		forgetSubtree(state, rel)
+		removed = append(removed, rel)
+		result.ChangedFileCount++
+		result.ActionCounters[tag]++
+	}
+	return removed, nil
+}
+
+// subtreeUnchanged reports whether every entry below relativeDir in fsys
+// matches what the state recorded at the end of the previous run.
+func subtreeUnchanged(fsys ReplicaFS, relativeDir string, options Options, state *syncState) (bool, error) {
+	err := fsys.WalkDir(relativeDir, func(rel string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if d.IsDir() {
+			if shouldIgnorePath(rel, options.IgnorePathPrefixes) {
+				return errSubtreeChanged
+			}
+			if _, ok := state.DirEntry[rel]; !ok {
+				return errSubtreeChanged
+			}
+			return nil
+		}
+		if shouldIgnoreName(d.Name(), options.IgnoreFileNames) {
+			return nil
+		}
+		if !shouldInclude(rel, d.Name(), options.IncludeGlob) {
+			return errSubtreeChanged
+		}
+		entry, ok := state.FileEntry[rel]
+		if !ok {
+			return errSubtreeChanged
+		}
+		if d.Type()&fs.ModeSymlink != 0 {
+			target, readErr := fsys.Readlink(rel)
+			if readErr != nil {
+				return readErr
+			}
+			if entry.LinkTarget == "" || entry.LinkTarget != target {
+				return errSubtreeChanged
+			}
+			return nil
+		}
+		digest, hashErr := hashReplicaFile(fsys, rel)
+		if hashErr != nil {
+			return hashErr
+		}
+		if entry.AncestorHex == "" || entry.AncestorHex != digest {
+			return errSubtreeChanged
+		}
+		return nil
+	})
+	if errors.Is(err, errSubtreeChanged) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// forgetSubtree drops the state below relativeDir, keeping only the version
+// history of its files so that they can still be restored.
+func forgetSubtree(state *syncState, relativeDir string) {
+	prefix := relativeDir + "/"
+	delete(state.DirEntry, relativeDir)
+	for rel := range state.DirEntry {
+		if strings.HasPrefix(rel, prefix) {
+			delete(state.DirEntry, rel)
+		}
+	}
+	for rel, entry := range state.FileEntry {
+		if !strings.HasPrefix(rel, prefix) {
+			continue
+		}
+		if len(entry.History) == 0 {
+			delete(state.FileEntry, rel)
+			continue
+		}
+		state.FileEntry[rel] = stateEntry{History: entry.History}
+	}
+}
+
+func underAnyDirectory(relativePath string, directories []string) bool {
+	for _, dir := range directories {
+		if strings.HasPrefix(relativePath, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// reconcileDirectories creates directories missing on one side and records
+// every directory present on both sides in the state.
+func reconcileDirectories(relativeDirs []string, options Options, state *syncState, result *SyncResult, recorder *runRecorder, logger *zap.Logger) error {
+	for _, rel := range relativeDirs {
+		pathA := filepath.Join(options.RootAPath, filepath.FromSlash(rel))
+		pathB := filepath.Join(options.RootBPath, filepath.FromSlash(rel))
+		kindA, _, errA := lstatKind(options.ReplicaA, rel)
+		if errA != nil {
+			return errA
+		}
+		kindB, _, errB := lstatKind(options.ReplicaB, rel)
+		if errB != nil {
+			return errB
+		}
+
+		if (kindA != entryDir && kindA != entryMissing) || (kindB != entryDir && kindB != entryMissing) {
+			continue
+		}
+
+		var missingRoot, missingPath, tag string
+		towardB := false
+		switch {
+		case kindA == entryMissing && kindB == entryMissing:
+			delete(state.DirEntry, rel)
+			continue
+		case kindA == entryMissing:
+			missingRoot, missingPath, tag = options.RootAPath, pathA, "A<-B (mkdir)"
+		case kindB == entryMissing:
+			missingRoot, missingPath, tag = options.RootBPath, pathB, "B<-A (mkdir)"
+			towardB = true
+		}
+
+		if missingPath != "" {
+			inside, guardErr := withinReplica(replicaFor(options, towardB), rel)
+			if guardErr != nil {
+				return guardErr
+			}
+			if !inside {
+				if logger != nil {
+					logger.Warn("refusing path that resolves outside root", zap.String("path", missingPath), zap.String("root", missingRoot))
+				}
+				result.ActionCounters["skip(escape)"]++
+				continue
+			}
+			if err := recorder.watch(rel); err != nil {
+				return err
+			}
+			if err := ensureDirsLike(options, rel, towardB); err != nil {
+				if logger != nil {
+					logger.Error("create directory", zap.String("path", missingPath), zap.Error(err))
+				}
+				return err
+			}
+			if err := recorder.settle(tag, true); err != nil {
+				return err
+			}
+			result.ChangedFileCount++
+			result.ActionCounters[tag]++
+		}
+		state.DirEntry[rel] = struct{}{}
+	}
+	return nil
+}
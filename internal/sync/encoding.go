@@ -0,0 +1,240 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// Encodings recognized without configuration.
+const (
+	encodingUTF8    = "utf-8"
+	encodingUTF16LE = "utf-16le"
+	encodingUTF16BE = "utf-16be"
+)
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// textEncoding is the encoding of one file. An empty name means the content
+// is not text in any encoding zync knows and is handled as bytes.
+type textEncoding struct {
+	name  string
+	bom   bool
+	ascii bool
+}
+
+func resolveLegacyCharset(name string) (encoding.Encoding, error) {
+	if name == "" {
+		return nil, nil
+	}
+	charset, err := ianaindex.IANA.Encoding(name)
+	if err != nil || charset == nil {
+		return nil, fmt.Errorf("unknown legacy charset %q", name)
+	}
+	return charset, nil
+}
+
+// detectEncoding recognizes byte order marks, UTF-16 without a mark by the
+// position of its NUL bytes, and UTF-8. Content that is none of these is
+// taken to be in the legacy charset when one is configured.
+func detectEncoding(content []byte, legacyName string) textEncoding {
+	switch {
+	case bytes.HasPrefix(content, bomUTF8):
+		return textEncoding{name: encodingUTF8, bom: true}
+	case bytes.HasPrefix(content, bomUTF16LE):
+		return textEncoding{name: encodingUTF16LE, bom: true}
+	case bytes.HasPrefix(content, bomUTF16BE):
+		return textEncoding{name: encodingUTF16BE, bom: true}
+	}
+	if name := sniffUTF16(content); name != "" {
+		return textEncoding{name: name}
+	}
+	if utf8.Valid(content) {
+		ascii := true
+		for _, char := range content {
+			if char >= utf8.RuneSelf {
+				ascii = false
+				break
+			}
+		}
+		return textEncoding{name: encodingUTF8, ascii: ascii}
+	}
+	if legacyName != "" && looksLikeText(content) {
+		return textEncoding{name: legacyName}
+	}
+	return textEncoding{}
+}
+
+// sniffUTF16 detects UTF-16 text without a byte order mark, which for mostly
+// Latin text has a NUL in every other byte.
+func sniffUTF16(content []byte) string {
+	sample := content[:min(len(content), binarySniffLength)]
+	if len(sample) < 4 || len(sample)%2 != 0 {
+		return ""
+	}
+	evenZeros, oddZeros := 0, 0
+	for index, char := range sample {
+		if char != 0 {
+			continue
+		}
+		if index%2 == 0 {
+			evenZeros++
+		} else {
+			oddZeros++
+		}
+	}
+	pairs := len(sample) / 2
+	switch {
+	case oddZeros*10 >= pairs*4 && evenZeros*20 < pairs:
+		return encodingUTF16LE
+	case evenZeros*10 >= pairs*4 && oddZeros*20 < pairs:
+		return encodingUTF16BE
+	}
+	return ""
+}
+
+// textCodec decodes both sides of a file to UTF-8 for comparing and merging
+// and encodes merged results back to each side's encoding.
+type textCodec struct {
+	enabled    bool
+	legacyName string
+	legacy     encoding.Encoding
+	encodingA  textEncoding
+	encodingB  textEncoding
+}
+
+// newTextCodec detects the encoding of both sides. It reports false when the
+// sides are text in different encodings. ASCII content fits any encoding
+// other than UTF-16.
+func newTextCodec(options Options, contentA []byte, contentB []byte) (textCodec, bool) {
+	if !options.DetectEncoding {
+		return textCodec{}, true
+	}
+	legacy, err := resolveLegacyCharset(options.LegacyCharset)
+	if err != nil {
+		return textCodec{}, true
+	}
+	encodingA := detectEncoding(contentA, options.LegacyCharset)
+	encodingB := detectEncoding(contentB, options.LegacyCharset)
+	if encodingA.name == "" || encodingB.name == "" {
+		return textCodec{}, true
+	}
+	if encodingA.ascii && !encodingB.ascii && !isUTF16(encodingB) {
+		encodingA.name = encodingB.name
+	}
+	if encodingB.ascii && !encodingA.ascii && !isUTF16(encodingA) {
+		encodingB.name = encodingA.name
+	}
+	if encodingA.name != encodingB.name {
+		return textCodec{}, false
+	}
+	return textCodec{
+		enabled:    true,
+		legacyName: options.LegacyCharset,
+		legacy:     legacy,
+		encodingA:  encodingA,
+		encodingB:  encodingB,
+	}, true
+}
+
+func isUTF16(enc textEncoding) bool {
+	return enc.name == encodingUTF16LE || enc.name == encodingUTF16BE
+}
+
+func (c textCodec) charset(enc textEncoding) encoding.Encoding {
+	switch enc.name {
+	case encodingUTF8:
+		return nil
+	case encodingUTF16LE:
+		return unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM)
+	case encodingUTF16BE:
+		return unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	}
+	return c.legacy
+}
+
+func (c textCodec) decodeAs(content []byte, enc textEncoding) []byte {
+	if enc.bom {
+		content = content[bomLength(enc):]
+	}
+	charset := c.charset(enc)
+	if charset == nil {
+		return content
+	}
+	decoded, err := charset.NewDecoder().Bytes(content)
+	if err != nil {
+		return content
+	}
+	return decoded
+}
+
+func bomLength(enc textEncoding) int {
+	if enc.name == encodingUTF8 {
+		return len(bomUTF8)
+	}
+	return len(bomUTF16LE)
+}
+
+// decode returns side A's or side B's content as UTF-8.
+func (c textCodec) decode(content []byte, sideA bool) []byte {
+	if !c.enabled {
+		return content
+	}
+	if sideA {
+		return c.decodeAs(content, c.encodingA)
+	}
+	return c.decodeAs(content, c.encodingB)
+}
+
+// decodeBase returns the ancestor as UTF-8, detecting its encoding anew since
+// it was stored as written by an earlier run.
+func (c textCodec) decodeBase(content []byte) []byte {
+	if !c.enabled || content == nil {
+		return content
+	}
+	enc := detectEncoding(content, c.legacyName)
+	if enc.name == "" {
+		return content
+	}
+	return c.decodeAs(content, enc)
+}
+
+// encode converts merged UTF-8 content to side A's or side B's encoding.
+func (c textCodec) encode(content []byte, sideA bool) ([]byte, error) {
+	if !c.enabled {
+		return content, nil
+	}
+	enc := c.encodingB
+	if sideA {
+		enc = c.encodingA
+	}
+	out := content
+	if charset := c.charset(enc); charset != nil {
+		encoded, err := encoding.ReplaceUnsupported(charset.NewEncoder()).Bytes(content)
+		if err != nil {
+			return nil, err
+		}
+		out = encoded
+	}
+	if enc.bom {
+		var bom []byte
+		switch enc.name {
+		case encodingUTF8:
+			bom = bomUTF8
+		case encodingUTF16LE:
+			bom = bomUTF16LE
+		case encodingUTF16BE:
+			bom = bomUTF16BE
+		}
+		out = append(append([]byte{}, bom...), out...)
+	}
+	return out, nil
+}
@@ -0,0 +1,113 @@
+package sync_test
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func encodeText(t *testing.T, charset encoding.Encoding, text string) string {
+	t.Helper()
+	encoded, err := charset.NewEncoder().String(text)
+	if err != nil {
+		t.Fatalf("encode: %v", err)
+	}
+	return encoded
+}
+
+func TestEncodingAwareMerge(t *testing.T) {
+	if _, err := exec.LookPath("diff3"); err != nil {
+		t.Skip("diff3 not available")
+	}
+	utf16BOM := unicode.UTF16(unicode.LittleEndian, unicode.UseBOM)
+	utf16BE := unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM)
+	latin := charmap.Windows1252
+
+	cases := []struct {
+		name    string
+		legacy  string
+		base    string
+		sideA   string
+		sideB   string
+		wantA   string
+		wantB   string
+		wantTag string
+	}{
+		{
+			name:    "UTF16WithBOM",
+			base:    encodeText(t, utf16BOM, "one\ntwo\nthree\nfour\n"),
+			sideA:   encodeText(t, utf16BOM, "uno\ntwo\nthree\nfour\n"),
+			sideB:   encodeText(t, utf16BOM, "one\ntwo\nthree\nvier\n"),
+			wantA:   encodeText(t, utf16BOM, "uno\ntwo\nthree\nvier\n"),
+			wantB:   encodeText(t, utf16BOM, "uno\ntwo\nthree\nvier\n"),
+			wantTag: "merge(3way)",
+		},
+		{
+			name:    "UTF16WithoutBOM",
+			base:    encodeText(t, utf16BE, "one\ntwo\nthree\nfour\n"),
+			sideA:   encodeText(t, utf16BE, "uno\ntwo\nthree\nfour\n"),
+			sideB:   encodeText(t, utf16BE, "one\ntwo\nthree\nvier\n"),
+			wantA:   encodeText(t, utf16BE, "uno\ntwo\nthree\nvier\n"),
+			wantB:   encodeText(t, utf16BE, "uno\ntwo\nthree\nvier\n"),
+			wantTag: "merge(3way)",
+		},
+		{
+			name:    "UTF8BOMOnOneSideIsEqual",
+			base:    "same\n",
+			sideA:   "\xEF\xBB\xBFsame\n",
+			sideB:   "same\n",
+			wantA:   "\xEF\xBB\xBFsame\n",
+			wantB:   "same\n",
+			wantTag: "equal",
+		},
+		{
+			name:    "LegacyCharset",
+			legacy:  "windows-1252",
+			base:    encodeText(t, latin, "café\ntwo\nthree\nfour\n"),
+			sideA:   encodeText(t, latin, "café crème\ntwo\nthree\nfour\n"),
+			sideB:   encodeText(t, latin, "café\ntwo\nthree\nfoür\n"),
+			wantA:   encodeText(t, latin, "café crème\ntwo\nthree\nfoür\n"),
+			wantB:   encodeText(t, latin, "café crème\ntwo\nthree\nfoür\n"),
+			wantTag: "merge(3way)",
+		},
+		{
+			name:    "DifferentEncodingsConflict",
+			base:    "one\n",
+			sideA:   encodeText(t, utf16BOM, "one\nzwei\n"),
+			sideB:   "one\ntwo\n",
+			wantA:   encodeText(t, utf16BOM, "one\nzwei\n"),
+			wantB:   "one\ntwo\n",
+			wantTag: "conflict(encoding)",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+			opts.DetectEncoding = true
+			opts.LegacyCharset = tc.legacy
+
+			res := mergeBothChanged(t, opts, "n.txt", tc.base, tc.sideA, tc.sideB)
+			if res.ActionCounters[tc.wantTag] != 1 {
+				t.Fatalf("expected %s, got %v", tc.wantTag, res.ActionCounters)
+			}
+			if got := readFile(t, filepath.Join(opts.RootAPath, "n.txt")); got != tc.wantA {
+				t.Fatalf("side A = %q, want %q", got, tc.wantA)
+			}
+			if got := readFile(t, filepath.Join(opts.RootBPath, "n.txt")); got != tc.wantB {
+				t.Fatalf("side B = %q, want %q", got, tc.wantB)
+			}
+		})
+	}
+
+	opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+	opts.LegacyCharset = "no-such-charset"
+	if _, err := syncpkg.RunSync(opts, nil); err == nil {
+		t.Fatalf("expected an error for an unknown charset")
+	}
+}
@@ -0,0 +1,95 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// digestCache remembers the digests of remote files by ETag in a JSON file of
+// the state directory, so that files whose ETag did not change are compared
+// without being downloaded. Several roots share a file, each under its own
+// scope.
+type digestCache struct {
+	path  string
+	scope string
+}
+
+type cachedDigest struct {
+	ETag   string `json:"etag"`
+	Digest string `json:"digest"`
+}
+
+// newDigestCache returns the cache for scope in fileName below stateDir, or a
+// cache that remembers nothing when stateDir is empty.
+func newDigestCache(stateDir string, fileName string, scope string) digestCache {
+	if stateDir == "" {
+		return digestCache{}
+	}
+	return digestCache{path: filepath.Join(stateDir, fileName), scope: scope}
+}
+
+func (c digestCache) readAll() (map[string]cachedDigest, error) {
+	cached := map[string]cachedDigest{}
+	if c.path == "" {
+		return cached, nil
+	}
+	data, err := os.ReadFile(c.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return cached, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &cached); err != nil {
+		return nil, fmt.Errorf("read %s: %w", c.path, err)
+	}
+	return cached, nil
+}
+
+// read returns the digests of the scope by name.
+func (c digestCache) read() (map[string]cachedDigest, error) {
+	cached, err := c.readAll()
+	if err != nil {
+		return nil, err
+	}
+	digests := map[string]cachedDigest{}
+	for key, digest := range cached {
+		if name, ok := strings.CutPrefix(key, c.scope); ok {
+			digests[name] = digest
+		}
+	}
+	return digests, nil
+}
+
+// write replaces the digests of the scope, keeping those of other scopes.
+func (c digestCache) write(digests map[string]cachedDigest) error {
+	if c.path == "" {
+		return nil
+	}
+	cached, err := c.readAll()
+	if err != nil {
+		return err
+	}
+	for key := range cached {
+		if strings.HasPrefix(key, c.scope) {
+			delete(cached, key)
+		}
+	}
+	for name, digest := range digests {
+		cached[c.scope+name] = digest
+	}
+	data, err := json.MarshalIndent(cached, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.path)
+}
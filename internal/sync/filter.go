@@ -0,0 +1,202 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// FilterJSON is the built-in filter that canonicalizes JSON: keys sorted,
+// two-space indentation and a final newline.
+const FilterJSON = "json"
+
+// ContentFilter converts file content into the form that is compared and
+// merged, and merged content back into the form written to the roots, like
+// git's clean and smudge filters.
+type ContentFilter interface {
+	Clean(relativePath string, content []byte) ([]byte, error)
+	Smudge(relativePath string, content []byte) ([]byte, error)
+}
+
+// FilterRule applies the named filter to paths matching Pattern, which
+// matches like MergeRule.Pattern.
+type FilterRule struct {
+	Pattern string
+	Filter  string
+}
+
+var registeredContentFilters = map[string]ContentFilter{}
+
+// RegisterContentFilter makes filter available to filter rules under name.
+func RegisterContentFilter(name string, filter ContentFilter) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registeredContentFilters[name] = filter
+}
+
+func lookupContentFilter(name string) (ContentFilter, bool) {
+	registryMutex.RLock()
+	filter, ok := registeredContentFilters[name]
+	registryMutex.RUnlock()
+	if ok {
+		return filter, true
+	}
+	if name == FilterJSON {
+		return jsonCanonicalFilter{}, true
+	}
+	return nil, false
+}
+
+func validateFilterRules(rules []FilterRule) error {
+	for _, rule := range rules {
+		if err := validatePathPattern(rule.Pattern); err != nil {
+			return err
+		}
+		if _, ok := lookupContentFilter(rule.Filter); !ok {
+			return fmt.Errorf("unknown filter %q for %q", rule.Filter, rule.Pattern)
+		}
+	}
+	return nil
+}
+
+type jsonCanonicalFilter struct{}
+
+func (jsonCanonicalFilter) Clean(_ string, content []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func (jsonCanonicalFilter) Smudge(_ string, content []byte) ([]byte, error) {
+	return content, nil
+}
+
+// fileFilter applies the filter selected for one path. Filter failures are
+// logged and leave the content as it is.
+type fileFilter struct {
+	name         string
+	filter       ContentFilter
+	relativePath string
+	logger       *zap.Logger
+}
+
+func newFileFilter(rules []FilterRule, relativePath string, logger *zap.Logger) fileFilter {
+	name := ""
+	for _, rule := range rules {
+		if matchPathPattern(rule.Pattern, relativePath) {
+			name = rule.Filter
+		}
+	}
+	if name == "" {
+		return fileFilter{}
+	}
+	filter, _ := lookupContentFilter(name)
+	return fileFilter{name: name, filter: filter, relativePath: relativePath, logger: logger}
+}
+
+func (f fileFilter) clean(content []byte) []byte {
+	if f.filter == nil || content == nil {
+		return content
+	}
+	cleaned, err := f.filter.Clean(f.relativePath, content)
+	if err != nil {
+		if f.logger != nil {
+			f.logger.Warn("clean filter failed, using content as is", zap.String("path", f.relativePath), zap.String("filter", f.name), zap.Error(err))
+		}
+		return content
+	}
+	return cleaned
+}
+
+func (f fileFilter) smudge(content []byte) []byte {
+	if f.filter == nil {
+		return content
+	}
+	smudged, err := f.filter.Smudge(f.relativePath, content)
+	if err != nil {
+		if f.logger != nil {
+			f.logger.Warn("smudge filter failed, writing cleaned content", zap.String("path", f.relativePath), zap.String("filter", f.name), zap.Error(err))
+		}
+		return content
+	}
+	return smudged
+}
+
+// ExternalContentFilter runs commands that read content on standard input
+// and write the filtered content to standard output. %P in the arguments is
+// replaced with the relative path and %% with a percent sign. Without a
+// smudge command, cleaned content is written back as it is.
+type ExternalContentFilter struct {
+	CleanArgs  []string
+	SmudgeArgs []string
+	Timeout    time.Duration
+}
+
+// NewExternalContentFilter splits both commands into arguments on white
+// space. The commands are not run through a shell.
+func NewExternalContentFilter(clean string, smudge string, timeout time.Duration) (*ExternalContentFilter, error) {
+	filter := &ExternalContentFilter{CleanArgs: strings.Fields(clean), SmudgeArgs: strings.Fields(smudge), Timeout: timeout}
+	if len(filter.CleanArgs) == 0 && len(filter.SmudgeArgs) == 0 {
+		return nil, errors.New("filter needs a clean or smudge command")
+	}
+	return filter, nil
+}
+
+// Clean runs the clean command.
+func (f *ExternalContentFilter) Clean(relativePath string, content []byte) ([]byte, error) {
+	return runFilterCommand(f.CleanArgs, f.Timeout, relativePath, content)
+}
+
+// Smudge runs the smudge command.
+func (f *ExternalContentFilter) Smudge(relativePath string, content []byte) ([]byte, error) {
+	return runFilterCommand(f.SmudgeArgs, f.Timeout, relativePath, content)
+}
+
+func runFilterCommand(command []string, timeout time.Duration, relativePath string, content []byte) ([]byte, error) {
+	if len(command) == 0 {
+		return content, nil
+	}
+	replacer := strings.NewReplacer("%%", "%", "%P", relativePath)
+	args := make([]string, len(command))
+	for index, arg := range command {
+		args[index] = replacer.Replace(arg)
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.WaitDelay = time.Second
+	cmd.Stdin = bytes.NewReader(content)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("filter command %q timed out after %s", command[0], timeout)
+		}
+		return nil, fmt.Errorf("filter command %q: %w: %s", command[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,90 @@
+package sync_test
+
+import (
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+)
+
+func TestContentFilters(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("filter commands use grep")
+	}
+	grepPath, err := exec.LookPath("grep")
+	if err != nil {
+		t.Skip("grep not available")
+	}
+	dropTimestamps, err := syncpkg.NewExternalContentFilter(grepPath+" -v ^updated:", "", 0)
+	if err != nil {
+		t.Fatalf("filter: %v", err)
+	}
+	syncpkg.RegisterContentFilter("drop-timestamps", dropTimestamps)
+
+	cases := []struct {
+		name    string
+		file    string
+		rules   []syncpkg.FilterRule
+		base    string
+		sideA   string
+		sideB   string
+		wantA   string
+		wantB   string
+		wantTag string
+	}{
+		{
+			name:    "JSONKeyOrderIsEqual",
+			file:    "settings.json",
+			rules:   []syncpkg.FilterRule{{Pattern: "*.json", Filter: syncpkg.FilterJSON}},
+			base:    `{"a":1,"b":2}`,
+			sideA:   `{"b":2,"a":1}`,
+			sideB:   "{\n  \"a\": 1,\n  \"b\": 2\n}\n",
+			wantA:   `{"b":2,"a":1}`,
+			wantB:   "{\n  \"a\": 1,\n  \"b\": 2\n}\n",
+			wantTag: "equal",
+		},
+		{
+			name:    "JSONMergesCanonicalForm",
+			file:    "settings.json",
+			rules:   []syncpkg.FilterRule{{Pattern: "*.json", Filter: syncpkg.FilterJSON}},
+			base:    `{"a":1,"b":2,"c":3,"d":4}`,
+			sideA:   `{"d":4,"c":3,"b":2,"a":10}`,
+			sideB:   `{"a":1,"b":2,"c":3,"d":40}`,
+			wantA:   "{\n  \"a\": 10,\n  \"b\": 2,\n  \"c\": 3,\n  \"d\": 40\n}\n",
+			wantB:   "{\n  \"a\": 10,\n  \"b\": 2,\n  \"c\": 3,\n  \"d\": 40\n}\n",
+			wantTag: "merge(struct)",
+		},
+		{
+			name:    "ExternalCleanDropsVolatileLines",
+			file:    "doc.meta",
+			rules:   []syncpkg.FilterRule{{Pattern: "*.meta", Filter: "drop-timestamps"}},
+			base:    "title: x\nupdated: 1\n",
+			sideA:   "title: x\nupdated: 2\n",
+			sideB:   "title: x\nupdated: 3\n",
+			wantA:   "title: x\nupdated: 2\n",
+			wantB:   "title: x\nupdated: 3\n",
+			wantTag: "equal",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+			opts.StructuredMerge = true
+			opts.FilterRules = tc.rules
+
+			res := mergeBothChanged(t, opts, tc.file, tc.base, tc.sideA, tc.sideB)
+			if res.ActionCounters[tc.wantTag] != 1 {
+				t.Fatalf("expected %s, got %v", tc.wantTag, res.ActionCounters)
+			}
+			if got := readFile(t, filepath.Join(opts.RootAPath, tc.file)); got != tc.wantA {
+				t.Fatalf("side A = %q, want %q", got, tc.wantA)
+			}
+			if got := readFile(t, filepath.Join(opts.RootBPath, tc.file)); got != tc.wantB {
+				t.Fatalf("side B = %q, want %q", got, tc.wantB)
+			}
+		})
+	}
+}
@@ -0,0 +1,204 @@
+package sync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Values of Options.GitCommit, naming the roots whose git work tree receives
+// a commit for the changes zync writes to them.
+const (
+	GitCommitA    = "a"
+	GitCommitB    = "b"
+	GitCommitBoth = "both"
+)
+
+func validateGitCommit(sides string) error {
+	switch sides {
+	case "", GitCommitA, GitCommitB, GitCommitBoth:
+		return nil
+	}
+	return fmt.Errorf("unknown git commit side %q, expected a, b or both", sides)
+}
+
+func gitCommitSides(sides string) []string {
+	switch sides {
+	case GitCommitA:
+		return []string{VersionSideA}
+	case GitCommitB:
+		return []string{VersionSideB}
+	case GitCommitBoth:
+		return []string{VersionSideA, VersionSideB}
+	}
+	return nil
+}
+
+// runGit runs git in dir and returns its standard output. Failures include
+// what git printed on standard error.
+func runGit(dir string, stdin []byte, args ...string) (string, error) {
+	command := exec.Command("git", args...)
+	command.Dir = dir
+	command.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	command.Stdout = &stdout
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return stdout.String(), fmt.Errorf("git %s: %w: %s", args[0], err, message)
+		}
+		return stdout.String(), fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return stdout.String(), nil
+}
+
+// checkGitRoot verifies that root lies in a git work tree and, with
+// requireClean, that nothing below it differs from the last commit. Files in
+// stateDir are zync's own and do not count.
+func checkGitRoot(root string, stateDir string, requireClean bool) error {
+	top, err := runGit(root, nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return fmt.Errorf("%s is not in a git work tree: %w", root, err)
+	}
+	if !requireClean {
+		return nil
+	}
+	status, err := runGit(root, nil, "status", "--porcelain=v1", "-z", "--untracked-files=all", "--", ".")
+	if err != nil {
+		return err
+	}
+	stateDir, _ = filepath.Abs(stateDir)
+	if resolved, resolveErr := filepath.EvalSymlinks(stateDir); resolveErr == nil {
+		stateDir = resolved
+	}
+	top = strings.TrimSpace(top)
+	var dirty []string
+	fields := strings.Split(status, "\x00")
+	for index := 0; index < len(fields); index++ {
+		field := fields[index]
+		if len(field) < 4 {
+			continue
+		}
+		if field[0] == 'R' || field[0] == 'C' {
+			index++
+		}
+		name := field[3:]
+		if inside, _ := pathWithin(filepath.Join(top, filepath.FromSlash(name)), stateDir); inside {
+			continue
+		}
+		dirty = append(dirty, name)
+	}
+	if len(dirty) == 0 {
+		return nil
+	}
+	if len(dirty) > 5 {
+		dirty = append(dirty[:5], "...")
+	}
+	return fmt.Errorf("%s has uncommitted changes outside zync's control: %s", root, strings.Join(dirty, ", "))
+}
+
+// pathWithin reports whether name is dir or lies below it.
+func pathWithin(name string, dir string) (bool, error) {
+	relative, err := filepath.Rel(dir, name)
+	if err != nil {
+		return false, err
+	}
+	return relative != ".." && !strings.HasPrefix(relative, ".."+string(filepath.Separator)), nil
+}
+
+// commitGitChanges commits the files and links that the run runID changed on
+// side in the work tree at root, leaving anything else staged or modified
+// alone. The message lists every path with the action that changed it. It
+// returns the new commit, or "" when there was nothing to commit.
+func commitGitChanges(root string, runID string, side string, changes []runChange) (string, error) {
+	actions := map[string]string{}
+	for _, change := range changes {
+		if change.Side != side || !gitTracked(change.Before.Kind) && !gitTracked(change.After.Kind) {
+			continue
+		}
+		actions[change.Path] = change.Action
+	}
+	ignored, err := gitIgnored(root, actions)
+	if err != nil {
+		return "", err
+	}
+	var paths, pathspecs []string
+	for rel := range actions {
+		if !ignored[rel] {
+			paths = append(paths, rel)
+		}
+	}
+	if len(paths) == 0 {
+		return "", nil
+	}
+	sort.Strings(paths)
+	for _, rel := range paths {
+		pathspecs = append(pathspecs, ":(literal)"+rel)
+	}
+
+	if _, err := runGit(root, nil, append([]string{"add", "--all", "--"}, pathspecs...)...); err != nil {
+		return "", err
+	}
+	if _, err := runGit(root, nil, append([]string{"diff", "--cached", "--quiet", "--"}, pathspecs...)...); err == nil {
+		return "", nil
+	}
+
+	var message strings.Builder
+	if len(paths) == 1 {
+		fmt.Fprintf(&message, "zync: update %s\n\n", paths[0])
+	} else {
+		fmt.Fprintf(&message, "zync: update %d files\n\n", len(paths))
+	}
+	width := 0
+	for _, rel := range paths {
+		width = max(width, len(actions[rel]))
+	}
+	for _, rel := range paths {
+		fmt.Fprintf(&message, "%-*s  %s\n", width, actions[rel], rel)
+	}
+	fmt.Fprintf(&message, "\nzync run %s\n", runID)
+
+	args := []string{"commit", "--quiet", "--file=-"}
+	if _, err := runGit(root, nil, "var", "GIT_COMMITTER_IDENT"); err != nil {
+		args = append([]string{"-c", "user.name=zync", "-c", "user.email=zync@localhost"}, args...)
+	}
+	if _, err := runGit(root, []byte(message.String()), append(append(args, "--"), pathspecs...)...); err != nil {
+		return "", err
+	}
+	commit, err := runGit(root, nil, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(commit), nil
+}
+
+func gitTracked(kind string) bool {
+	return kind == snapshotFile || kind == snapshotLink
+}
+
+// gitIgnored returns the paths among actions that git ignores.
+func gitIgnored(root string, actions map[string]string) (map[string]bool, error) {
+	var input bytes.Buffer
+	for rel := range actions {
+		input.WriteString(rel + "\x00")
+	}
+	ignored := map[string]bool{}
+	output, err := runGit(root, input.Bytes(), "check-ignore", "-z", "--stdin")
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == 1 {
+		return ignored, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, rel := range strings.Split(output, "\x00") {
+		if rel != "" {
+			ignored[rel] = true
+		}
+	}
+	return ignored, nil
+}
@@ -0,0 +1,111 @@
+package sync_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	output, err := exec.Command("git", append([]string{"-C", dir}, args...)...).CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, output)
+	}
+	return string(output)
+}
+
+func newGitRoot(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	root := t.TempDir()
+	git(t, root, "init", "--quiet")
+	git(t, root, "config", "user.name", "Tester")
+	git(t, root, "config", "user.email", "tester@example.com")
+	writeFile(t, filepath.Join(root, "notes", "shared.md"), "one\ntwo\nthree\n")
+	writeFile(t, filepath.Join(root, "old", "gone.md"), "delete me")
+	writeFile(t, filepath.Join(root, ".gitignore"), "*.tmp\n")
+	git(t, root, "add", "--all")
+	git(t, root, "commit", "--quiet", "-m", "initial")
+	return root
+}
+
+func TestGitCommitRoot(t *testing.T) {
+	rootA, rootB, state := t.TempDir(), newGitRoot(t), t.TempDir()
+	opts := defaultOptions(rootA, rootB, state)
+	opts.GitCommit = syncpkg.GitCommitB
+	writeFile(t, filepath.Join(rootA, "notes", "shared.md"), "one\ntwo\nthree\n")
+	writeFile(t, filepath.Join(rootA, "old", "gone.md"), "delete me")
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("seed: %v", err)
+	}
+
+	writeFile(t, filepath.Join(rootA, "notes", "shared.md"), "ONE\ntwo\nthree\n")
+	writeFile(t, filepath.Join(rootB, "notes", "shared.md"), "one\ntwo\nTHREE\n")
+	git(t, rootB, "commit", "--quiet", "-am", "edit on B")
+	writeFile(t, filepath.Join(rootA, "new.md"), "new on A")
+	writeFile(t, filepath.Join(rootA, "scratch.tmp"), "ignored by git")
+	if err := os.RemoveAll(filepath.Join(rootA, "old")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	writeFile(t, filepath.Join(rootB, "staged.md"), "staged by the user")
+	git(t, rootB, "add", "staged.md")
+
+	res, err := syncpkg.RunSync(opts, zap.NewNop())
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if len(res.GitCommits) != 1 {
+		t.Fatalf("commits = %v", res.GitCommits)
+	}
+	message := git(t, rootB, "log", "-1", "--format=%B")
+	for _, want := range []string{"zync: update 3 files", "merge(3way)", "notes/shared.md", "B<-A (create)  new.md", "B<-A (rmdir)   old/gone.md", "zync run " + res.RunID} {
+		if !strings.Contains(message, want) {
+			t.Fatalf("commit message lacks %q:\n%s", want, message)
+		}
+	}
+	if strings.Contains(message, "scratch.tmp") {
+		t.Fatalf("ignored file was committed:\n%s", message)
+	}
+	if got := git(t, rootB, "show", "HEAD:notes/shared.md"); got != "ONE\ntwo\nTHREE\n" {
+		t.Fatalf("committed %q", got)
+	}
+	if status := git(t, rootB, "status", "--porcelain"); status != "A  staged.md\n" {
+		t.Fatalf("status after commit:\n%s", status)
+	}
+
+	if res, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil || len(res.GitCommits) != 0 {
+		t.Fatalf("unchanged run committed %v: %v", res.GitCommits, err)
+	}
+}
+
+func TestGitRequireClean(t *testing.T) {
+	rootA, rootB := t.TempDir(), newGitRoot(t)
+	state := filepath.Join(rootB, ".zync")
+	opts := defaultOptions(rootA, rootB, state)
+	opts.GitCommit = syncpkg.GitCommitB
+	opts.GitRequireClean = true
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("sync with the state directory in the work tree: %v", err)
+	}
+
+	writeFile(t, filepath.Join(rootB, "notes", "shared.md"), "edited outside zync")
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err == nil || !strings.Contains(err.Error(), "notes/shared.md") {
+		t.Fatalf("expected the dirty work tree to be refused, got %v", err)
+	}
+	if got := readFile(t, filepath.Join(rootA, "notes", "shared.md")); got != "one\ntwo\nthree\n" {
+		t.Fatalf("refused run changed A: %q", got)
+	}
+
+	opts.GitCommit = syncpkg.GitCommitA
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err == nil {
+		t.Fatal("expected a root outside any git work tree to be refused")
+	}
+}
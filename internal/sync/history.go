@@ -0,0 +1,280 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Sides recorded in a file's version history.
+const (
+	VersionSideA       = "a"
+	VersionSideB       = "b"
+	VersionSideBoth    = "both"
+	VersionSideMerge   = "merge"
+	VersionSideRestore = "restore"
+)
+
+// DefaultHistoryLimit is the number of versions kept per path when
+// Options.HistoryLimit is not set.
+const DefaultHistoryLimit = 100
+
+type historyEntry struct {
+	Digest string    `json:"digest"`
+	Time   time.Time `json:"time"`
+	Side   string    `json:"side"`
+}
+
+// Version is one recorded version of a file. Numbers start at 1 for the
+// oldest version.
+type Version struct {
+	Number int
+	Digest string
+	Time   time.Time
+	Side   string
+}
+
+// recordVersion makes digest the ancestor of relativePath and appends it to
+// the path's history unless it is already the latest version.
+func recordVersion(state *syncState, relativePath string, digest string, side string, at time.Time) {
+	entry := state.FileEntry[relativePath]
+	entry.AncestorHex = digest
+	entry.LinkTarget = ""
+	if len(entry.History) == 0 || entry.History[len(entry.History)-1].Digest != digest {
+		entry.History = append(entry.History, historyEntry{Digest: digest, Time: at.UTC(), Side: side})
+	}
+	state.FileEntry[relativePath] = entry
+}
+
+// pruneHistory keeps the newest limit versions of every path and returns the
+// digests of the versions it dropped.
+func pruneHistory(state *syncState, limit int) []string {
+	if limit <= 0 {
+		limit = DefaultHistoryLimit
+	}
+	var dropped []string
+	for rel, entry := range state.FileEntry {
+		excess := len(entry.History) - limit
+		if excess <= 0 {
+			continue
+		}
+		for _, item := range entry.History[:excess] {
+			dropped = append(dropped, item.Digest)
+		}
+		entry.History = append([]historyEntry(nil), entry.History[excess:]...)
+		state.FileEntry[rel] = entry
+	}
+	return dropped
+}
+
+// pruneAncestors removes the stored blobs among candidates that neither the
+// state nor a run that can still be undone refers to any more. A run can be
+// undone only while the paths it changed are as it left them, so only its
+// changes to such paths keep their content.
+func pruneAncestors(store *stateStore, stateDir string, state *syncState, candidates []string) error {
+	if len(candidates) == 0 {
+		return nil
+	}
+	referenced := map[string]bool{}
+	for _, entry := range state.FileEntry {
+		referenced[entry.AncestorHex] = true
+		for _, item := range entry.History {
+			referenced[item.Digest] = true
+		}
+	}
+	runs, err := ListRuns(stateDir)
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		if run.Undone {
+			continue
+		}
+		journal, loadErr := loadJournal(stateDir, run.ID)
+		if loadErr != nil {
+			return loadErr
+		}
+		for _, change := range journal.Changes {
+			if change.After.Kind == snapshotFile && state.FileEntry[change.Path].AncestorHex != change.After.Digest {
+				continue
+			}
+			referenced[change.Before.Digest] = true
+			if previous := journal.FileEntries[change.Path]; previous != nil {
+				referenced[previous.AncestorHex] = true
+			}
+		}
+	}
+	for _, digest := range candidates {
+		if referenced[digest] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(store.AncDir, digest)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		referenced[digest] = true
+	}
+	return nil
+}
+
+func mergedSide(merged []byte, contentA []byte, contentB []byte) string {
+	equalA := bytesEqual(merged, contentA)
+	equalB := bytesEqual(merged, contentB)
+	switch {
+	case equalA && !equalB:
+		return VersionSideA
+	case equalB && !equalA:
+		return VersionSideB
+	}
+	return VersionSideMerge
+}
+
+func normalizeRelativePath(relativePath string) string {
+	return path.Clean(filepath.ToSlash(relativePath))
+}
+
+// ListVersions returns the recorded versions of relativePath, oldest first.
+func ListVersions(stateDir string, relativePath string) ([]Version, error) {
+	_, state, err := createOrOpenStateStore(stateDir)
+	if err != nil {
+		return nil, err
+	}
+	entry, ok := state.FileEntry[normalizeRelativePath(relativePath)]
+	if !ok {
+		return nil, fmt.Errorf("no history for %q", relativePath)
+	}
+	versions := make([]Version, 0, len(entry.History))
+	for index, item := range entry.History {
+		versions = append(versions, Version{Number: index + 1, Digest: item.Digest, Time: item.Time, Side: item.Side})
+	}
+	return versions, nil
+}
+
+// VersionByNumber selects the version with the given number.
+func VersionByNumber(versions []Version, number int) (Version, error) {
+	if number < 1 || number > len(versions) {
+		return Version{}, fmt.Errorf("version %d does not exist, have %d", number, len(versions))
+	}
+	return versions[number-1], nil
+}
+
+// VersionAt selects the latest version recorded at or before at.
+func VersionAt(versions []Version, at time.Time) (Version, error) {
+	for index := len(versions) - 1; index >= 0; index-- {
+		if !versions[index].Time.After(at) {
+			return versions[index], nil
+		}
+	}
+	return Version{}, fmt.Errorf("no version recorded at or before %s", at.Format(time.RFC3339))
+}
+
+// RestoreVersion writes version back into both local roots recorded in the
+// state and makes it the new ancestor. Each side gets the version in its own
+// encoding, line endings and filtered form, as a merge would write it. The
+// current contents of both sides are kept as backups first.
+func RestoreVersion(options Options, relativePath string, version Version, logger *zap.Logger) error {
+	store, state, err := createOrOpenStateStore(options.StateDirectory)
+	if err != nil {
+		return err
+	}
+	if state.RootA == "" || state.RootB == "" {
+		return errors.New("restore is only supported for local roots")
+	}
+	relativePath = normalizeRelativePath(relativePath)
+	content, err := store.ancestorBytes(version.Digest)
+	if err != nil {
+		if logger != nil {
+			logger.Error("read version", zap.String("digest", version.Digest), zap.Error(err))
+		}
+		return err
+	}
+
+	sides := []struct {
+		name    string
+		replica *LocalFS
+		current []byte
+	}{
+		{name: VersionSideA, replica: NewLocalFS(state.RootA)},
+		{name: VersionSideB, replica: NewLocalFS(state.RootB)},
+	}
+	for index := range sides {
+		side := &sides[index]
+		inside, guardErr := withinReplica(side.replica, relativePath)
+		if guardErr != nil {
+			return guardErr
+		}
+		if !inside {
+			return fmt.Errorf("refusing to restore %q outside root %q", relativePath, side.replica.Root())
+		}
+		kind, _, kindErr := lstatKind(side.replica, relativePath)
+		if kindErr != nil {
+			return kindErr
+		}
+		switch kind {
+		case entryFile:
+			current, readErr := side.replica.ReadFile(relativePath)
+			if readErr != nil {
+				return readErr
+			}
+			side.current = current
+		case entryMissing:
+		default:
+			return fmt.Errorf("refusing to restore %q over a non-regular file", side.replica.path(relativePath))
+		}
+	}
+
+	restoredA, restoredB, err := restoredForSides(options, relativePath, content, sides[0].current, sides[1].current, logger)
+	if err != nil {
+		if logger != nil {
+			logger.Error("encode file", zap.String("path", relativePath), zap.Error(err))
+		}
+		return err
+	}
+
+	now := time.Now()
+	for index, side := range sides {
+		if side.current != nil {
+			if backupErr := store.storeBackup(relativePath, side.name, side.current, now); backupErr != nil {
+				return backupErr
+			}
+		}
+		restored := restoredA
+		if index == 1 {
+			restored = restoredB
+		}
+		if writeErr := writeAllEnsure(side.replica, relativePath, restored); writeErr != nil {
+			if logger != nil {
+				logger.Error("write file", zap.String("path", side.replica.path(relativePath)), zap.Error(writeErr))
+			}
+			return writeErr
+		}
+	}
+
+	recordVersion(state, relativePath, version.Digest, VersionSideRestore, now)
+	return store.save(state)
+}
+
+// restoredForSides converts a stored version, which is kept in side A's form,
+// to the form each side currently uses. A side without the file takes the
+// form of the stored version.
+func restoredForSides(options Options, relativePath string, stored []byte, currentA []byte, currentB []byte, logger *zap.Logger) ([]byte, []byte, error) {
+	if currentA == nil {
+		currentA = stored
+	}
+	if currentB == nil {
+		currentB = stored
+	}
+	codec, compatible := newTextCodec(options, currentA, currentB)
+	if !compatible {
+		return stored, stored, nil
+	}
+	filter := newFileFilter(options.FilterRules, relativePath, logger)
+	text := newTextNormalizer(options, filter.clean(codec.decode(currentA, true)), filter.clean(codec.decode(currentB, false)))
+	normal := text.normalize(filter.clean(codec.decodeBase(stored)))
+	return encodeForSides(codec, text, filter, normal)
+}
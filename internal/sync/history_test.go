@@ -0,0 +1,197 @@
+package sync_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+func TestHistoryAndRestore(t *testing.T) {
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	state := t.TempDir()
+	opts := defaultOptions(rootA, rootB, state)
+
+	writeFile(t, filepath.Join(rootA, "n.md"), "v1\n")
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("sync 1: %v", err)
+	}
+	writeFile(t, filepath.Join(rootB, "n.md"), "v2\n")
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("sync 2: %v", err)
+	}
+
+	versions, err := syncpkg.ListVersions(state, "n.md")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("expected two versions, got %+v", versions)
+	}
+	if versions[0].Side != syncpkg.VersionSideA || versions[1].Side != syncpkg.VersionSideB {
+		t.Fatalf("unexpected sides: %+v", versions)
+	}
+
+	first, err := syncpkg.VersionByNumber(versions, 1)
+	if err != nil {
+		t.Fatalf("select: %v", err)
+	}
+	if at, err := syncpkg.VersionAt(versions, versions[0].Time); err != nil || at.Number != 1 {
+		t.Fatalf("VersionAt = %+v, %v", at, err)
+	}
+	if _, err := syncpkg.VersionAt(versions, versions[0].Time.Add(-time.Hour)); err == nil {
+		t.Fatalf("expected no version before the first")
+	}
+
+	if err := syncpkg.RestoreVersion(opts, "n.md", first, zap.NewNop()); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	for _, root := range []string{rootA, rootB} {
+		if got := readFile(t, filepath.Join(root, "n.md")); got != "v1\n" {
+			t.Fatalf("restored content = %q", got)
+		}
+	}
+	backups, err := syncpkg.ListBackups(state, "n.md")
+	if err != nil || len(backups) != 4 {
+		t.Fatalf("expected backups of replaced content, got %+v, %v", backups, err)
+	}
+
+	res, err := syncpkg.RunSync(opts, zap.NewNop())
+	if err != nil {
+		t.Fatalf("sync 3: %v", err)
+	}
+	if res.ChangedFileCount != 0 {
+		t.Fatalf("restore left sides out of sync: %v", res.ActionCounters)
+	}
+	versions, _ = syncpkg.ListVersions(state, "n.md")
+	if len(versions) != 3 || versions[2].Side != syncpkg.VersionSideRestore {
+		t.Fatalf("restore not recorded: %+v", versions)
+	}
+}
+
+func TestHistoryOfDeletedDirectory(t *testing.T) {
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	state := t.TempDir()
+	opts := defaultOptions(rootA, rootB, state)
+
+	writeFile(t, filepath.Join(rootA, "old", "n.md"), "v1\n")
+	writeFile(t, filepath.Join(rootA, "keep.md"), "k\n")
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("sync 1: %v", err)
+	}
+	if err := os.RemoveAll(filepath.Join(rootA, "old")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	res, err := syncpkg.RunSync(opts, zap.NewNop())
+	if err != nil || res.ActionCounters["B<-A (rmdir)"] != 1 {
+		t.Fatalf("sync 2: %v, %v", res.ActionCounters, err)
+	}
+
+	versions, err := syncpkg.ListVersions(state, "old/n.md")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("expected the deleted file's version, got %+v, %v", versions, err)
+	}
+	if err := syncpkg.RestoreVersion(opts, "old/n.md", versions[0], zap.NewNop()); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	for _, root := range []string{rootA, rootB} {
+		if got := readFile(t, filepath.Join(root, "old", "n.md")); got != "v1\n" {
+			t.Fatalf("restored content = %q", got)
+		}
+	}
+}
+
+func TestRestoreKeepsEachSidesForm(t *testing.T) {
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	state := t.TempDir()
+	opts := defaultOptions(rootA, rootB, state)
+	opts.NormalizeLineEndings = true
+
+	writeFile(t, filepath.Join(rootA, "n.md"), "v1\n")
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("sync 1: %v", err)
+	}
+	writeFile(t, filepath.Join(rootB, "n.md"), "v2\r\n")
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("sync 2: %v", err)
+	}
+
+	versions, err := syncpkg.ListVersions(state, "n.md")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("expected two versions, got %+v, %v", versions, err)
+	}
+	if err := syncpkg.RestoreVersion(opts, "n.md", versions[0], zap.NewNop()); err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got := readFile(t, filepath.Join(rootA, "n.md")); got != "v1\n" {
+		t.Fatalf("side A = %q", got)
+	}
+	if got := readFile(t, filepath.Join(rootB, "n.md")); got != "v1\r\n" {
+		t.Fatalf("side B = %q", got)
+	}
+}
+
+func TestRestoreRequiresLocalRoots(t *testing.T) {
+	archivePath := filepath.Join(t.TempDir(), "backup.tar.gz")
+	writeArchive(t, archivePath, map[string]string{"notes/a.md": "from the backup"})
+	rootA, state := t.TempDir(), t.TempDir()
+	opts := defaultOptions(rootA, archivePath, state)
+	syncArchive(t, opts, archivePath, true)
+
+	versions, err := syncpkg.ListVersions(state, "notes/a.md")
+	if err != nil || len(versions) == 0 {
+		t.Fatalf("expected a version, got %+v, %v", versions, err)
+	}
+	err = syncpkg.RestoreVersion(opts, "notes/a.md", versions[0], zap.NewNop())
+	if err == nil || !strings.Contains(err.Error(), "local roots") {
+		t.Fatalf("expected a local roots error, got %v", err)
+	}
+}
+
+func TestHistoryIsCapped(t *testing.T) {
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	state := t.TempDir()
+	opts := defaultOptions(rootA, rootB, state)
+	opts.HistoryLimit = 2
+
+	var digests []string
+	for _, content := range []string{"v1\n", "v2\n", "v3\n", "v4\n"} {
+		writeFile(t, filepath.Join(rootA, "n.md"), content)
+		if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+			t.Fatalf("sync %q: %v", content, err)
+		}
+		versions, err := syncpkg.ListVersions(state, "n.md")
+		if err != nil {
+			t.Fatalf("list: %v", err)
+		}
+		digests = append(digests, versions[len(versions)-1].Digest)
+	}
+
+	versions, err := syncpkg.ListVersions(state, "n.md")
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(versions) != 2 || versions[0].Digest != digests[2] || versions[1].Digest != digests[3] {
+		t.Fatalf("expected the two newest versions, got %+v", versions)
+	}
+	for index, digest := range digests {
+		_, statErr := os.Stat(filepath.Join(state, "ancestors", digest))
+		if kept := statErr == nil; kept != (index >= 2) {
+			t.Fatalf("version %d blob kept = %v", index+1, kept)
+		}
+	}
+	if _, err := syncpkg.UndoRun(state, "", zap.NewNop()); err != nil {
+		t.Fatalf("undo of the latest run: %v", err)
+	}
+	if got := readFile(t, filepath.Join(rootB, "n.md")); got != "v3\n" {
+		t.Fatalf("undo restored %q", got)
+	}
+}
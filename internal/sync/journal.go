@@ -0,0 +1,543 @@
+package sync
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	snapshotMissing = "missing"
+	snapshotFile    = "file"
+	snapshotLink    = "link"
+	snapshotDir     = "dir"
+)
+
+// entrySnapshot captures what a path held at one moment.
+type entrySnapshot struct {
+	Kind    string `json:"kind"`
+	Digest  string `json:"digest,omitempty"`
+	Target  string `json:"target,omitempty"`
+	content []byte
+	// hashed is set when only the digest was fetched from the replica.
+	hashed bool
+}
+
+func (s entrySnapshot) sameAs(other entrySnapshot) bool {
+	return s.Kind == other.Kind && s.Digest == other.Digest && s.Target == other.Target
+}
+
+type runChange struct {
+	Path   string        `json:"path"`
+	Side   string        `json:"side"`
+	Action string        `json:"action,omitempty"`
+	Before entrySnapshot `json:"before"`
+	After  entrySnapshot `json:"after"`
+}
+
+// runJournal records every change a run made so that it can be undone.
+// FileEntries and DirEntries hold the state entries the run modified as they
+// were before the run; nil and false mean the entry did not exist.
+type runJournal struct {
+	ID          string                 `json:"id"`
+	StartedAt   time.Time              `json:"started_at"`
+	RootA       string                 `json:"root_a"`
+	RootB       string                 `json:"root_b"`
+	FollowLinks bool                   `json:"follow_links,omitempty"`
+	Changes     []runChange            `json:"changes"`
+	FileEntries map[string]*stateEntry `json:"file_entries"`
+	DirEntries  map[string]bool        `json:"dir_entries"`
+	Resolutions []AutoResolution       `json:"resolutions,omitempty"`
+	Undone      bool                   `json:"undone,omitempty"`
+}
+
+// RunSummary describes a recorded run.
+type RunSummary struct {
+	ID          string
+	StartedAt   time.Time
+	ChangeCount int
+	Undone      bool
+}
+
+func runsDirectory(stateDir string) string {
+	return filepath.Join(stateDir, "runs")
+}
+
+func captureEntry(fsys ReplicaFS, name string, follow bool) (entrySnapshot, error) {
+	snapshot, err := statEntry(fsys, name, follow)
+	if err != nil || snapshot.Kind != snapshotFile {
+		return snapshot, err
+	}
+	if hasher, ok := fsys.(ReplicaHasher); ok {
+		digest, hashErr := hasher.Hash(name)
+		if hashErr != nil {
+			return entrySnapshot{}, hashErr
+		}
+		return entrySnapshot{Kind: snapshotFile, Digest: digest, hashed: true}, nil
+	}
+	content, readErr := fsys.ReadFile(name)
+	if readErr != nil {
+		return entrySnapshot{}, readErr
+	}
+	return entrySnapshot{Kind: snapshotFile, Digest: digestBytes(content), content: content}, nil
+}
+
+// statEntry captures name without reading files, which are left without a
+// digest.
+func statEntry(fsys ReplicaFS, name string, follow bool) (entrySnapshot, error) {
+	var info fs.FileInfo
+	var err error
+	if follow {
+		info, err = fsys.Stat(name)
+	} else {
+		info, err = fsys.Lstat(name)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return entrySnapshot{Kind: snapshotMissing}, nil
+	}
+	if err != nil {
+		return entrySnapshot{}, err
+	}
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		target, readErr := fsys.Readlink(name)
+		if readErr != nil {
+			return entrySnapshot{}, readErr
+		}
+		return entrySnapshot{Kind: snapshotLink, Target: target}, nil
+	case info.IsDir():
+		return entrySnapshot{Kind: snapshotDir}, nil
+	}
+	return entrySnapshot{Kind: snapshotFile}, nil
+}
+
+type pendingSnapshot struct {
+	side   string
+	rel    string
+	before entrySnapshot
+}
+
+// runRecorder snapshots paths before the run touches them and turns every
+// difference found afterwards into a journal change. Files are not read for
+// the snapshot: the content of a file the run replaces is the content it read
+// to merge it, handed over with observe, and a file removed with its
+// directory matches its ancestor. A file the run did not read is one it did
+// not replace.
+//
+// Runs that undo cannot revert, because a root is not a local directory or is
+// read-only, record nothing unless their changes are committed to git.
+type runRecorder struct {
+	store   *stateStore
+	state   *syncState
+	options Options
+	enabled bool
+	journal *runJournal
+	pending []pendingSnapshot
+	watched map[string]struct{}
+}
+
+func newRunRecorder(store *stateStore, state *syncState, options Options, startedAt time.Time) *runRecorder {
+	undoable := state.RootA != "" && state.RootB != "" && !isReadOnly(options.ReplicaA) && !isReadOnly(options.ReplicaB)
+	return &runRecorder{
+		store:   store,
+		state:   state,
+		options: options,
+		enabled: undoable || options.GitCommit != "",
+		journal: &runJournal{
+			ID:          startedAt.UTC().Format(backupTimeLayout),
+			StartedAt:   startedAt.UTC(),
+			RootA:       state.RootA,
+			RootB:       state.RootB,
+			FollowLinks: options.SymlinkMode == SymlinkModeFollow,
+		},
+		watched: map[string]struct{}{},
+	}
+}
+
+func (r *runRecorder) replicaFor(side string) ReplicaFS {
+	return replicaFor(r.options, side == VersionSideB)
+}
+
+func (r *runRecorder) watchSide(side string, rel string) error {
+	key := side + "\x00" + rel
+	if _, seen := r.watched[key]; seen {
+		return nil
+	}
+	before, err := statEntry(r.replicaFor(side), rel, r.options.SymlinkMode == SymlinkModeFollow)
+	if err != nil {
+		return err
+	}
+	r.watched[key] = struct{}{}
+	r.pending = append(r.pending, pendingSnapshot{side: side, rel: rel, before: before})
+	return nil
+}
+
+// watch snapshots rel on both sides, along with every parent directory that
+// does not exist yet and may be created on the way.
+func (r *runRecorder) watch(rel string) error {
+	if !r.enabled {
+		return nil
+	}
+	for _, side := range []string{VersionSideA, VersionSideB} {
+		parts := strings.Split(rel, "/")
+		for index := 1; index < len(parts); index++ {
+			parent := strings.Join(parts[:index], "/")
+			kind, _, err := lstatKind(r.replicaFor(side), parent)
+			if err != nil {
+				return err
+			}
+			if kind == entryMissing {
+				if err := r.watchSide(side, parent); err != nil {
+					return err
+				}
+			}
+		}
+		if err := r.watchSide(side, rel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// watchTree snapshots rel and everything below it on one side. Files known
+// to the state match their ancestor, which already holds their content; only
+// files the state does not know, such as ignored ones, are read.
+func (r *runRecorder) watchTree(side string, rel string) error {
+	if !r.enabled {
+		return nil
+	}
+	fsys := r.replicaFor(side)
+	return fsys.WalkDir(rel, func(currentRel string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if err := r.watchSide(side, currentRel); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if entry := r.state.FileEntry[currentRel]; entry.AncestorHex != "" {
+			r.setBefore(side, currentRel, entrySnapshot{Kind: snapshotFile, Digest: entry.AncestorHex, hashed: true})
+			return nil
+		}
+		content, err := fsys.ReadFile(currentRel)
+		if err != nil {
+			return err
+		}
+		r.setBefore(side, currentRel, entrySnapshot{Kind: snapshotFile, Digest: digestBytes(content), content: content})
+		return nil
+	})
+}
+
+// observe hands over the content of rel on both sides as read before the run
+// writes to it.
+func (r *runRecorder) observe(rel string, contentA []byte, contentB []byte) {
+	r.setBefore(VersionSideA, rel, entrySnapshot{Kind: snapshotFile, Digest: digestBytes(contentA), content: contentA})
+	r.setBefore(VersionSideB, rel, entrySnapshot{Kind: snapshotFile, Digest: digestBytes(contentB), content: contentB})
+}
+
+// setBefore completes the pending snapshot of a file on side.
+func (r *runRecorder) setBefore(side string, rel string, before entrySnapshot) {
+	for index := range r.pending {
+		item := &r.pending[index]
+		if item.side == side && item.rel == rel && item.before.Kind == snapshotFile {
+			item.before = before
+		}
+	}
+}
+
+// settle compares the pending snapshots with the current content and records
+// the differences as made by action. When written is false the run left the
+// paths alone and nothing is read.
+func (r *runRecorder) settle(action string, written bool) error {
+	if !r.enabled {
+		return nil
+	}
+	for _, item := range r.pending {
+		delete(r.watched, item.side+"\x00"+item.rel)
+		if !written {
+			continue
+		}
+		after, err := captureEntry(r.replicaFor(item.side), item.rel, r.options.SymlinkMode == SymlinkModeFollow)
+		if err != nil {
+			return err
+		}
+		if item.before.Kind == snapshotFile && item.before.Digest == "" && after.Kind == snapshotFile {
+			continue
+		}
+		if after.sameAs(item.before) {
+			continue
+		}
+		if item.before.Kind == snapshotFile && !item.before.hashed {
+			if _, storeErr := r.store.ensureAncestorStored(item.before.content); storeErr != nil {
+				return storeErr
+			}
+		}
+		if after.Kind == snapshotFile && !after.hashed {
+			if _, storeErr := r.store.ensureAncestorStored(after.content); storeErr != nil {
+				return storeErr
+			}
+		}
+		r.journal.Changes = append(r.journal.Changes, runChange{Path: item.rel, Side: item.side, Action: action, Before: item.before, After: after})
+	}
+	r.pending = r.pending[:0]
+	return nil
+}
+
+func cloneState(state *syncState) (*syncState, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, err
+	}
+	clone := &syncState{}
+	if err := json.Unmarshal(data, clone); err != nil {
+		return nil, err
+	}
+	return clone, nil
+}
+
+// finish records the state entries that changed since before and writes the
+// journal. Runs that changed nothing leave no journal and report false.
+func (r *runRecorder) finish(before *syncState, after *syncState) (bool, error) {
+	if !r.enabled {
+		return false, nil
+	}
+	fileEntries := map[string]*stateEntry{}
+	for rel, previous := range before.FileEntry {
+		current, ok := after.FileEntry[rel]
+		if !ok || !entriesEqual(previous, current) {
+			copied := previous
+			fileEntries[rel] = &copied
+		}
+	}
+	for rel := range after.FileEntry {
+		if _, ok := before.FileEntry[rel]; !ok {
+			fileEntries[rel] = nil
+		}
+	}
+	dirEntries := map[string]bool{}
+	for rel := range before.DirEntry {
+		if _, ok := after.DirEntry[rel]; !ok {
+			dirEntries[rel] = true
+		}
+	}
+	for rel := range after.DirEntry {
+		if _, ok := before.DirEntry[rel]; !ok {
+			dirEntries[rel] = false
+		}
+	}
+	if len(r.journal.Changes) == 0 && len(fileEntries) == 0 && len(dirEntries) == 0 {
+		return false, nil
+	}
+	r.journal.FileEntries = fileEntries
+	r.journal.DirEntries = dirEntries
+	if err := saveJournal(r.store, r.journal); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func entriesEqual(a stateEntry, b stateEntry) bool {
+	left, _ := json.Marshal(a)
+	right, _ := json.Marshal(b)
+	return string(left) == string(right)
+}
+
+func saveJournal(store *stateStore, journal *runJournal) error {
+	dir := runsDirectory(filepath.Dir(store.StatePath))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(journal, "", "  ")
+	if err != nil {
+		return err
+	}
+	target := filepath.Join(dir, journal.ID+".json")
+	tmpPath := target + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, target)
+}
+
+func loadJournal(stateDir string, id string) (*runJournal, error) {
+	if id != path.Base(id) || strings.HasPrefix(id, ".") {
+		return nil, fmt.Errorf("invalid run id %q", id)
+	}
+	data, err := os.ReadFile(filepath.Join(runsDirectory(stateDir), id+".json"))
+	if err != nil {
+		return nil, err
+	}
+	journal := &runJournal{}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+// ListRuns returns the recorded runs, oldest first.
+func ListRuns(stateDir string) ([]RunSummary, error) {
+	entries, err := os.ReadDir(runsDirectory(stateDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var runs []RunSummary
+	for _, entry := range entries {
+		id, isJournal := strings.CutSuffix(entry.Name(), ".json")
+		if !isJournal || entry.IsDir() {
+			continue
+		}
+		journal, loadErr := loadJournal(stateDir, id)
+		if loadErr != nil {
+			return nil, loadErr
+		}
+		runs = append(runs, RunSummary{ID: journal.ID, StartedAt: journal.StartedAt, ChangeCount: len(journal.Changes), Undone: journal.Undone})
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID < runs[j].ID })
+	return runs, nil
+}
+
+// UndoRun reverts the run with the given id, or the most recent run that has
+// not been undone when id is empty, restoring both roots and the state
+// entries it modified. It refuses to touch anything if a path the run changed
+// has been modified since. The id of the undone run is returned.
+func UndoRun(stateDir string, id string, logger *zap.Logger) (string, error) {
+	if id == "" {
+		runs, err := ListRuns(stateDir)
+		if err != nil {
+			return "", err
+		}
+		for index := len(runs) - 1; index >= 0; index-- {
+			if !runs[index].Undone {
+				id = runs[index].ID
+				break
+			}
+		}
+		if id == "" {
+			return "", errors.New("no run to undo")
+		}
+	}
+	journal, err := loadJournal(stateDir, id)
+	if err != nil {
+		return id, err
+	}
+	if journal.Undone {
+		return id, fmt.Errorf("run %s was already undone", id)
+	}
+	if journal.RootA == "" || journal.RootB == "" {
+		return id, fmt.Errorf("run %s did not synchronize local directories and cannot be undone", id)
+	}
+	store, state, err := createOrOpenStateStore(stateDir)
+	if err != nil {
+		return id, err
+	}
+
+	replicaA, replicaB := NewLocalFS(journal.RootA), NewLocalFS(journal.RootB)
+	replicaFor := func(side string) *LocalFS {
+		if side == VersionSideA {
+			return replicaA
+		}
+		return replicaB
+	}
+
+	var modified []string
+	for _, change := range journal.Changes {
+		current, captureErr := captureEntry(replicaFor(change.Side), change.Path, journal.FollowLinks)
+		if captureErr != nil {
+			return id, captureErr
+		}
+		if !current.sameAs(change.After) {
+			modified = append(modified, change.Side+":"+change.Path)
+		}
+	}
+	if len(modified) > 0 {
+		if logger != nil {
+			logger.Error("paths modified after run", zap.String("run", id), zap.Strings("paths", modified))
+		}
+		return id, fmt.Errorf("refusing to undo run %s: %d paths were modified after it, first %s", id, len(modified), modified[0])
+	}
+
+	for _, change := range journal.Changes {
+		if change.Before.Kind != snapshotFile {
+			continue
+		}
+		if _, statErr := os.Stat(filepath.Join(store.AncDir, change.Before.Digest)); statErr != nil {
+			return id, fmt.Errorf("refusing to undo run %s: the earlier content of %s is no longer stored", id, change.Path)
+		}
+	}
+
+	for index := len(journal.Changes) - 1; index >= 0; index-- {
+		change := journal.Changes[index]
+		replica := replicaFor(change.Side)
+		inside, guardErr := withinReplica(replica, path.Dir(change.Path))
+		if guardErr != nil {
+			return id, guardErr
+		}
+		if !inside {
+			return id, fmt.Errorf("refusing to undo %q outside root %q", change.Path, replica.Root())
+		}
+		if err := revertEntry(store, replica, change); err != nil {
+			if logger != nil {
+				logger.Error("revert path", zap.String("path", replica.path(change.Path)), zap.Error(err))
+			}
+			return id, err
+		}
+	}
+
+	for rel, previous := range journal.FileEntries {
+		if previous == nil {
+			delete(state.FileEntry, rel)
+		} else {
+			state.FileEntry[rel] = *previous
+		}
+	}
+	for rel, existed := range journal.DirEntries {
+		if existed {
+			state.DirEntry[rel] = struct{}{}
+		} else {
+			delete(state.DirEntry, rel)
+		}
+	}
+	if err := store.save(state); err != nil {
+		return id, err
+	}
+	journal.Undone = true
+	return id, saveJournal(store, journal)
+}
+
+func revertEntry(store *stateStore, fsys ReplicaFS, change runChange) error {
+	if change.After.Kind != snapshotDir && change.After.Kind != snapshotMissing && change.Before.Kind != change.After.Kind {
+		if err := fsys.Remove(change.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	switch change.Before.Kind {
+	case snapshotMissing:
+		if err := fsys.Remove(change.Path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	case snapshotDir:
+		return fsys.MkdirAll(change.Path, 0o755)
+	case snapshotLink:
+		return writeSymlinkEnsure(fsys, change.Path, change.Before.Target)
+	}
+	content, err := store.ancestorBytes(change.Before.Digest)
+	if err != nil {
+		return err
+	}
+	return writeAllEnsure(fsys, change.Path, content)
+}
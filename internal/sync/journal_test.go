@@ -0,0 +1,144 @@
+package sync_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+func TestUndoRun(t *testing.T) {
+	cases := []struct {
+		name string
+		run  func(t *testing.T, rootA, rootB, state string)
+	}{
+		{
+			name: "RevertsMergeAndCreation",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				writeFile(t, filepath.Join(rootA, "t.md"), "line1\n")
+				writeFile(t, filepath.Join(rootB, "t.md"), "line1\n")
+				opts := defaultOptions(rootA, rootB, state)
+				first, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("initial sync: %v", err)
+				}
+
+				writeFile(t, filepath.Join(rootA, "t.md"), "line1\nA\n")
+				writeFile(t, filepath.Join(rootB, "t.md"), "line1\nB\n")
+				writeFile(t, filepath.Join(rootA, "new", "n.md"), "N")
+				second, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("merge sync: %v", err)
+				}
+				if second.RunID == "" || second.RunID == first.RunID {
+					t.Fatalf("expected a new run id, got %q", second.RunID)
+				}
+
+				undone, err := syncpkg.UndoRun(state, "", zap.NewNop())
+				if err != nil {
+					t.Fatalf("undo: %v", err)
+				}
+				if undone != second.RunID {
+					t.Fatalf("undid %q, want %q", undone, second.RunID)
+				}
+				if got := readFile(t, filepath.Join(rootA, "t.md")); got != "line1\nA\n" {
+					t.Fatalf("side A not reverted: %q", got)
+				}
+				if got := readFile(t, filepath.Join(rootB, "t.md")); got != "line1\nB\n" {
+					t.Fatalf("side B not reverted: %q", got)
+				}
+				if _, err := os.Stat(filepath.Join(rootB, "new")); !os.IsNotExist(err) {
+					t.Fatalf("created directory not removed")
+				}
+
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("resync: %v", err)
+				}
+				if res.ActionCounters["merge(3way)"] != 1 {
+					t.Fatalf("state not reverted, got %v", res.ActionCounters)
+				}
+			},
+		},
+		{
+			name: "RefusesAfterModification",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				writeFile(t, filepath.Join(rootA, "n.md"), "N")
+				opts := defaultOptions(rootA, rootB, state)
+				if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+					t.Fatalf("sync: %v", err)
+				}
+				writeFile(t, filepath.Join(rootB, "n.md"), "edited")
+				_, err := syncpkg.UndoRun(state, "", zap.NewNop())
+				if err == nil || !strings.Contains(err.Error(), "modified") {
+					t.Fatalf("expected refusal, got %v", err)
+				}
+				if got := readFile(t, filepath.Join(rootB, "n.md")); got != "edited" {
+					t.Fatalf("refused undo touched files: %q", got)
+				}
+			},
+		},
+		{
+			name: "RestoresDeletedDirectory",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				writeFile(t, filepath.Join(rootA, "old", "n.md"), "N")
+				writeFile(t, filepath.Join(rootA, "keep.md"), "K")
+				opts := defaultOptions(rootA, rootB, state)
+				if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+					t.Fatalf("sync: %v", err)
+				}
+				writeFile(t, filepath.Join(rootB, "old", ".DS_Store"), "finder")
+				if err := os.RemoveAll(filepath.Join(rootA, "old")); err != nil {
+					t.Fatalf("remove: %v", err)
+				}
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil || res.ActionCounters["B<-A (rmdir)"] != 1 {
+					t.Fatalf("sync: %v, %v", res.ActionCounters, err)
+				}
+				if _, err := syncpkg.UndoRun(state, "", zap.NewNop()); err != nil {
+					t.Fatalf("undo: %v", err)
+				}
+				if got := readFile(t, filepath.Join(rootB, "old", "n.md")); got != "N" {
+					t.Fatalf("deleted file not restored: %q", got)
+				}
+				if got := readFile(t, filepath.Join(rootB, "old", ".DS_Store")); got != "finder" {
+					t.Fatalf("ignored file not restored: %q", got)
+				}
+				runs, err := syncpkg.ListRuns(state)
+				if err != nil || len(runs) != 2 || !runs[1].Undone || runs[0].Undone {
+					t.Fatalf("unexpected runs: %+v, %v", runs, err)
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rootA := t.TempDir()
+			rootB := t.TempDir()
+			state := t.TempDir()
+			tc.run(t, rootA, rootB, state)
+		})
+	}
+}
+
+func TestRunsOutsideLocalRootsAreNotJournaled(t *testing.T) {
+	state := t.TempDir()
+	opts := defaultOptions("", "", state)
+	replicaA, replicaB := syncpkg.NewMemoryFS(), syncpkg.NewMemoryFS()
+	opts.ReplicaA, opts.ReplicaB = replicaA, replicaB
+	writeReplicaFile(t, replicaA, "n.md", "N")
+	res, err := syncpkg.RunSync(opts, zap.NewNop())
+	if err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if res.ChangedFileCount != 1 || res.RunID != "" {
+		t.Fatalf("expected an unjournaled change, got %d changes in run %q", res.ChangedFileCount, res.RunID)
+	}
+	if runs, err := syncpkg.ListRuns(state); err != nil || len(runs) != 0 {
+		t.Fatalf("unexpected runs: %+v, %v", runs, err)
+	}
+}
@@ -0,0 +1,161 @@
+package sync
+
+import (
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var markdownExtensions = map[string]bool{
+	".md":       true,
+	".markdown": true,
+}
+
+// taskLinePattern splits a task list item into its prefix, checkbox state and
+// the rest of the line.
+var taskLinePattern = regexp.MustCompile(`(?s)^([ \t]*(?:[-*+]|\d+[.)])[ \t]+\[)([ xX])(\].*)$`)
+
+func isMarkdownPath(relativePath string) bool {
+	return markdownExtensions[strings.ToLower(filepath.Ext(relativePath))]
+}
+
+// frontMatter is the YAML block at the top of a Markdown file, kept with its
+// delimiter lines.
+type frontMatter struct {
+	present bool
+	open    string
+	yaml    string
+	close   string
+}
+
+func (f frontMatter) equal(other frontMatter) bool {
+	return f.present == other.present && f.yaml == other.yaml
+}
+
+func (f frontMatter) render() string {
+	if !f.present {
+		return ""
+	}
+	return f.open + f.yaml + f.close
+}
+
+// splitFrontMatter separates a leading "---" delimited YAML block from the
+// Markdown body.
+func splitFrontMatter(content string) (frontMatter, string) {
+	lines := strings.SplitAfter(content, "\n")
+	if len(lines) < 2 || strings.TrimRight(lines[0], "\r\n") != "---" {
+		return frontMatter{}, content
+	}
+	for index := 1; index < len(lines); index++ {
+		delimiter := strings.TrimRight(lines[index], "\r\n")
+		if delimiter == "---" || delimiter == "..." {
+			return frontMatter{
+				present: true,
+				open:    lines[0],
+				yaml:    strings.Join(lines[1:index], ""),
+				close:   lines[index],
+			}, strings.Join(lines[index+1:], "")
+		}
+	}
+	return frontMatter{}, content
+}
+
+// mergeMarkdown merges Markdown files: front matter as YAML data and the body
+// line by line, resolving checkbox toggles and rewrapped paragraphs, and with
+// wordLevel set retrying other conflicts word by word. It reports whether
+// conflict markers were left in the result.
+func mergeMarkdown(base []byte, a []byte, b []byte, wordLevel bool) ([]byte, bool) {
+	baseFront, baseBody := splitFrontMatter(string(base))
+	aFront, aBody := splitFrontMatter(string(a))
+	bFront, bBody := splitFrontMatter(string(b))
+
+	resolve := resolveMarkdownHunk
+	if wordLevel {
+		resolve = chainResolvers(resolveMarkdownHunk, resolveWordHunk)
+	}
+	front, frontConflict := mergeFrontMatter(baseFront, aFront, bFront)
+	body, bodyConflict := mergeLinesWithMarkers(baseBody, aBody, bBody, resolve)
+	return []byte(front + body), frontConflict || bodyConflict
+}
+
+func mergeFrontMatter(base frontMatter, a frontMatter, b frontMatter) (string, bool) {
+	switch {
+	case a.equal(b), base.equal(b):
+		return a.render(), false
+	case base.equal(a):
+		return b.render(), false
+	}
+	shell := a
+	if !shell.present {
+		shell = b
+	}
+	if merged, conflicts, applicable := mergeYAMLDocuments([]byte(base.yaml), []byte(a.yaml), []byte(b.yaml)); applicable && len(conflicts) == 0 {
+		shell.yaml = string(merged)
+		return shell.render(), false
+	}
+	shell.yaml, _ = mergeLinesWithMarkers(base.yaml, a.yaml, b.yaml, nil)
+	return shell.render(), true
+}
+
+// resolveMarkdownHunk resolves a region changed on both sides line by line
+// when only checkbox state and text were changed separately, or in favour of
+// the other side when one side only rewrapped the text.
+func resolveMarkdownHunk(hunk mergeHunk[string]) ([]string, bool) {
+	if len(hunk.A) == len(hunk.Base) && len(hunk.B) == len(hunk.Base) {
+		merged := make([]string, 0, len(hunk.A))
+		for index := range hunk.A {
+			line, ok := mergeTaskLine(hunk.Base[index], hunk.A[index], hunk.B[index])
+			if !ok {
+				merged = nil
+				break
+			}
+			merged = append(merged, line)
+		}
+		if merged != nil {
+			return merged, true
+		}
+	}
+	baseWords := joinedWords(hunk.Base)
+	switch {
+	case joinedWords(hunk.A) == baseWords:
+		return hunk.B, true
+	case joinedWords(hunk.B) == baseWords:
+		return hunk.A, true
+	}
+	return nil, false
+}
+
+// mergeTaskLine merges a single line changed on both sides. Task items merge
+// their checkbox and their text independently.
+func mergeTaskLine(base string, a string, b string) (string, bool) {
+	if merged, ok := mergeValue(base, a, b); ok {
+		return merged, true
+	}
+	baseParts := taskLinePattern.FindStringSubmatch(base)
+	aParts := taskLinePattern.FindStringSubmatch(a)
+	bParts := taskLinePattern.FindStringSubmatch(b)
+	if baseParts == nil || aParts == nil || bParts == nil {
+		return "", false
+	}
+	prefix, prefixOK := mergeValue(baseParts[1], aParts[1], bParts[1])
+	state, stateOK := mergeValue(baseParts[2], aParts[2], bParts[2])
+	text, textOK := mergeValue(baseParts[3], aParts[3], bParts[3])
+	if !prefixOK || !stateOK || !textOK {
+		return "", false
+	}
+	return prefix + state + text, true
+}
+
+func mergeValue(base string, a string, b string) (string, bool) {
+	switch {
+	case a == b, base == b:
+		return a, true
+	case base == a:
+		return b, true
+	}
+	return "", false
+}
+
+func joinedWords(lines []string) string {
+	return strings.Join(strings.Fields(strings.Join(lines, " ")), " ")
+}
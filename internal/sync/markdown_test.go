@@ -0,0 +1,77 @@
+package sync_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+func TestMarkdownMerge(t *testing.T) {
+	cases := []struct {
+		name  string
+		base  string
+		sideA string
+		sideB string
+		want  string
+	}{
+		{
+			name:  "FrontMatterKeys",
+			base:  "---\ntags: [a]\ndate: 2024-01-01\n---\n# Title\n\nbody\n",
+			sideA: "---\ntags: [a, b]\ndate: 2024-01-01\n---\n# Title\n\nbody\n",
+			sideB: "---\ntags: [a]\ndate: 2024-01-01\naliases: [t]\n---\n# Title\n\nbody\n",
+			want:  "---\ntags: [a, b]\ndate: 2024-01-01\naliases: [t]\n---\n# Title\n\nbody\n",
+		},
+		{
+			name:  "CheckboxAndTextOnSameLine",
+			base:  "- [ ] buy milk\n- [ ] call bob\n",
+			sideA: "- [x] buy milk\n- [ ] call bob\n",
+			sideB: "- [ ] buy oat milk\n- [x] call bob\n",
+			want:  "- [x] buy oat milk\n- [x] call bob\n",
+		},
+		{
+			name:  "RewrapOnOneSide",
+			base:  "one two three four\nfive six\n\nend\n",
+			sideA: "one two\nthree four five six\n\nend\n",
+			sideB: "one two three four\nfive seven\n\nend\n",
+			want:  "one two three four\nfive seven\n\nend\n",
+		},
+		{
+			name:  "ConflictingEditsKeepMarkers",
+			base:  "intro\nline\noutro\n",
+			sideA: "intro\nline A\noutro\n",
+			sideB: "intro\nline B\noutro\n",
+			want:  "intro\n<<<<<<< SIDE_A\nline A\n=======\nline B\n>>>>>>> SIDE_B\noutro\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rootA := t.TempDir()
+			rootB := t.TempDir()
+			state := t.TempDir()
+			opts := defaultOptions(rootA, rootB, state)
+			opts.MarkdownMerge = true
+
+			writeFile(t, filepath.Join(rootA, "note.md"), tc.base)
+			if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+				t.Fatalf("initial sync: %v", err)
+			}
+			writeFile(t, filepath.Join(rootA, "note.md"), tc.sideA)
+			writeFile(t, filepath.Join(rootB, "note.md"), tc.sideB)
+			res, err := syncpkg.RunSync(opts, zap.NewNop())
+			if err != nil {
+				t.Fatalf("merge sync: %v", err)
+			}
+			if res.ActionCounters["merge(markdown)"] != 1 {
+				t.Fatalf("expected a markdown merge, got %v", res.ActionCounters)
+			}
+			for _, root := range []string{rootA, rootB} {
+				if got := readFile(t, filepath.Join(root, "note.md")); got != tc.want {
+					t.Fatalf("merged content = %q, want %q", got, tc.want)
+				}
+			}
+		})
+	}
+}
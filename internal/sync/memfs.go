@@ -0,0 +1,403 @@
+package sync
+
+import (
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	stdsync "sync"
+	"time"
+)
+
+var (
+	errIsDirectory    = errors.New("is a directory")
+	errNotDirectory   = errors.New("not a directory")
+	errNotLink        = errors.New("not a symbolic link")
+	errDirectoryInUse = errors.New("directory not empty")
+)
+
+// memoryNode is a file, directory or symbolic link of a MemoryFS.
+type memoryNode struct {
+	mode    fs.FileMode
+	data    []byte
+	target  string
+	modTime time.Time
+}
+
+type memoryFileInfo struct {
+	name string
+	node memoryNode
+}
+
+func (i memoryFileInfo) Name() string       { return i.name }
+func (i memoryFileInfo) Size() int64        { return int64(len(i.data())) }
+func (i memoryFileInfo) Mode() fs.FileMode  { return i.node.mode }
+func (i memoryFileInfo) ModTime() time.Time { return i.node.modTime }
+func (i memoryFileInfo) IsDir() bool        { return i.node.mode.IsDir() }
+func (i memoryFileInfo) Sys() any           { return nil }
+
+func (i memoryFileInfo) data() []byte {
+	if i.node.mode&fs.ModeSymlink != 0 {
+		return []byte(i.node.target)
+	}
+	return i.node.data
+}
+
+// MemoryFS is a ReplicaFS held in memory, for tests and for trees that are
+// assembled before being written elsewhere. It is safe for concurrent use.
+type MemoryFS struct {
+	mutex stdsync.RWMutex
+	nodes map[string]*memoryNode
+}
+
+// NewMemoryFS returns an empty replica.
+func NewMemoryFS() *MemoryFS {
+	return &MemoryFS{nodes: map[string]*memoryNode{
+		".": {mode: fs.ModeDir | 0o755, modTime: time.Now()},
+	}}
+}
+
+// locate returns the key of name with the links in its parent directories
+// resolved, and with follow set also a link at name itself.
+func (m *MemoryFS) locate(op string, name string, follow bool) (string, error) {
+	clean := path.Clean(name)
+	if !fs.ValidPath(clean) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if clean == "." {
+		return clean, nil
+	}
+	parent, inside, err := resolveLinks(m, path.Dir(clean))
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if !inside {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	key := path.Join(parent, path.Base(clean))
+	if !follow {
+		return key, nil
+	}
+	resolved, inside, err := resolveLinks(m, key)
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if !inside {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return resolved, nil
+}
+
+func (m *MemoryFS) info(op string, name string, follow bool) (fs.FileInfo, error) {
+	key, err := m.locate(op, name, follow)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	node, ok := m.nodes[key]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return memoryFileInfo{name: path.Base(key), node: *node}, nil
+}
+
+// checkParent requires the parent of key to be an existing directory. The
+// caller holds the lock.
+func (m *MemoryFS) checkParent(op string, name string, key string) error {
+	parent, ok := m.nodes[path.Dir(key)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	if !parent.mode.IsDir() {
+		return &fs.PathError{Op: op, Path: name, Err: errNotDirectory}
+	}
+	return nil
+}
+
+// hasChildren reports whether any entry lies below key. The caller holds the
+// lock.
+func (m *MemoryFS) hasChildren(key string) bool {
+	for other := range m.nodes {
+		if isBelow(other, key) {
+			return true
+		}
+	}
+	return false
+}
+
+func isBelow(name string, dir string) bool {
+	if dir == "." {
+		return name != "."
+	}
+	return strings.HasPrefix(name, dir+"/")
+}
+
+// Stat returns information about the entry at name, following links.
+func (m *MemoryFS) Stat(name string) (fs.FileInfo, error) {
+	return m.info("stat", name, true)
+}
+
+// Lstat returns information about the entry at name.
+func (m *MemoryFS) Lstat(name string) (fs.FileInfo, error) {
+	return m.info("lstat", name, false)
+}
+
+// ReadDir lists the directory at name sorted by file name.
+func (m *MemoryFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	key, err := m.locate("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	node, ok := m.nodes[key]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDirectory}
+	}
+	var entries []fs.DirEntry
+	for other, child := range m.nodes {
+		if other != "." && path.Dir(other) == key {
+			entries = append(entries, fs.FileInfoToDirEntry(memoryFileInfo{name: path.Base(other), node: *child}))
+		}
+	}
+	sortDirEntries(entries)
+	return entries, nil
+}
+
+// WalkDir walks the tree at name.
+func (m *MemoryFS) WalkDir(name string, fn fs.WalkDirFunc) error {
+	return WalkReplica(m, name, fn)
+}
+
+// ReadFile returns the content of the file at name.
+func (m *MemoryFS) ReadFile(name string) ([]byte, error) {
+	key, err := m.locate("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	node, ok := m.nodes[key]
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if node.mode.IsDir() {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errIsDirectory}
+	}
+	return append([]byte(nil), node.data...), nil
+}
+
+// WriteFile replaces the content of the file at name, creating it with perm.
+func (m *MemoryFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	key, err := m.locate("open", name, true)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if err := m.checkParent("open", name, key); err != nil {
+		return err
+	}
+	node, ok := m.nodes[key]
+	switch {
+	case !ok:
+		node = &memoryNode{mode: perm.Perm()}
+		m.nodes[key] = node
+	case node.mode.IsDir():
+		return &fs.PathError{Op: "open", Path: name, Err: errIsDirectory}
+	}
+	node.data = append([]byte(nil), data...)
+	node.modTime = time.Now()
+	return nil
+}
+
+// Mkdir creates the directory name.
+func (m *MemoryFS) Mkdir(name string, perm fs.FileMode) error {
+	key, err := m.locate("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.nodes[key]; exists {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := m.checkParent("mkdir", name, key); err != nil {
+		return err
+	}
+	m.nodes[key] = &memoryNode{mode: fs.ModeDir | perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+// MkdirAll creates the directory name along with any missing parents.
+func (m *MemoryFS) MkdirAll(name string, perm fs.FileMode) error {
+	clean := path.Clean(name)
+	if clean == "." {
+		return nil
+	}
+	parts := strings.Split(clean, "/")
+	for index := range parts {
+		dir := strings.Join(parts[:index+1], "/")
+		err := m.Mkdir(dir, perm)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		info, statErr := m.Stat(dir)
+		if statErr != nil {
+			return statErr
+		}
+		if !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: dir, Err: errNotDirectory}
+		}
+	}
+	return nil
+}
+
+// Rename moves oldName, and everything below it, to newName.
+func (m *MemoryFS) Rename(oldName string, newName string) error {
+	oldKey, err := m.locate("rename", oldName, false)
+	if err != nil {
+		return err
+	}
+	newKey, err := m.locate("rename", newName, false)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, ok := m.nodes[oldKey]
+	if !ok || oldKey == "." {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	if oldKey == newKey {
+		return nil
+	}
+	if node.mode.IsDir() && isBelow(newKey, oldKey) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrInvalid}
+	}
+	if err := m.checkParent("rename", newName, newKey); err != nil {
+		return err
+	}
+	if existing, exists := m.nodes[newKey]; exists {
+		switch {
+		case existing.mode.IsDir() && !node.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: newName, Err: errIsDirectory}
+		case existing.mode.IsDir() && m.hasChildren(newKey):
+			return &fs.PathError{Op: "rename", Path: newName, Err: errDirectoryInUse}
+		case !existing.mode.IsDir() && node.mode.IsDir():
+			return &fs.PathError{Op: "rename", Path: newName, Err: errNotDirectory}
+		}
+	}
+	moved := map[string]*memoryNode{newKey: node}
+	delete(m.nodes, oldKey)
+	for other, child := range m.nodes {
+		if isBelow(other, oldKey) {
+			moved[newKey+strings.TrimPrefix(other, oldKey)] = child
+			delete(m.nodes, other)
+		}
+	}
+	for key, child := range moved {
+		m.nodes[key] = child
+	}
+	return nil
+}
+
+// Remove removes the file, link or empty directory at name.
+func (m *MemoryFS) Remove(name string) error {
+	key, err := m.locate("remove", name, false)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.nodes[key]; !ok || key == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if m.hasChildren(key) {
+		return &fs.PathError{Op: "remove", Path: name, Err: errDirectoryInUse}
+	}
+	delete(m.nodes, key)
+	return nil
+}
+
+// RemoveAll removes name and everything below it. A missing name is not an
+// error.
+func (m *MemoryFS) RemoveAll(name string) error {
+	key, err := m.locate("removeall", name, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for other := range m.nodes {
+		if isBelow(other, key) {
+			delete(m.nodes, other)
+		}
+	}
+	if key != "." {
+		delete(m.nodes, key)
+	}
+	return nil
+}
+
+// Chmod changes the permission bits of name.
+func (m *MemoryFS) Chmod(name string, mode fs.FileMode) error {
+	key, err := m.locate("chmod", name, true)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	node, ok := m.nodes[key]
+	if !ok {
+		return &fs.PathError{Op: "chmod", Path: name, Err: fs.ErrNotExist}
+	}
+	node.mode = node.mode.Type() | mode.Perm()
+	return nil
+}
+
+// Symlink creates name as a symbolic link to target.
+func (m *MemoryFS) Symlink(target string, name string) error {
+	key, err := m.locate("symlink", name, false)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, exists := m.nodes[key]; exists {
+		return &fs.PathError{Op: "symlink", Path: name, Err: fs.ErrExist}
+	}
+	if err := m.checkParent("symlink", name, key); err != nil {
+		return err
+	}
+	m.nodes[key] = &memoryNode{mode: fs.ModeSymlink | 0o777, target: target, modTime: time.Now()}
+	return nil
+}
+
+// Readlink returns the target of the symbolic link name.
+func (m *MemoryFS) Readlink(name string) (string, error) {
+	key, err := m.locate("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	node, ok := m.nodes[key]
+	if !ok {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: fs.ErrNotExist}
+	}
+	if node.mode&fs.ModeSymlink == 0 {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errNotLink}
+	}
+	return node.target, nil
+}
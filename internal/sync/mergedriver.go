@@ -0,0 +1,346 @@
+package sync
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	stdsync "sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Names of the built-in merge drivers.
+const (
+	MergeDriverText       = "text"
+	MergeDriverOurs       = "ours"
+	MergeDriverTheirs     = "theirs"
+	MergeDriverStructured = "structured"
+	MergeDriverMarkdown   = "markdown"
+	MergeDriverUnion      = "union"
+	MergeDriverUnionDedup = "union-dedup"
+	MergeDriverCSV        = "csv"
+	MergeDriverWords      = "words"
+)
+
+// MergeInput holds the versions of a file changed on both sides since the
+// last run. Path is relative to the roots and slash separated.
+type MergeInput struct {
+	Path string
+	Base []byte
+	A    []byte
+	B    []byte
+}
+
+// MergeResult is the content a merge driver produced. Conflict reports that
+// the driver could not merge cleanly. Content holding conflict markers is
+// written like the text merge's; otherwise both sides are left as they are.
+type MergeResult struct {
+	Content  []byte
+	Conflict bool
+}
+
+// MergeDriver merges both sides of a file against their common ancestor.
+type MergeDriver interface {
+	Merge(input MergeInput) (MergeResult, error)
+}
+
+// MergeDriverFunc adapts a function to the MergeDriver interface.
+type MergeDriverFunc func(input MergeInput) (MergeResult, error)
+
+// Merge calls f.
+func (f MergeDriverFunc) Merge(input MergeInput) (MergeResult, error) {
+	return f(input)
+}
+
+// MergeRule selects the named driver for paths matching Pattern. Patterns
+// without a slash match the file name, others the whole relative path.
+type MergeRule struct {
+	Pattern string
+	Driver  string
+}
+
+var (
+	registryMutex          stdsync.RWMutex
+	registeredMergeDrivers = map[string]MergeDriver{}
+)
+
+// RegisterMergeDriver makes driver available to merge rules under name,
+// replacing any driver registered or built in under the same name.
+func RegisterMergeDriver(name string, driver MergeDriver) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	registeredMergeDrivers[name] = driver
+}
+
+func registeredMergeDriver(name string) (MergeDriver, bool) {
+	registryMutex.RLock()
+	defer registryMutex.RUnlock()
+	driver, ok := registeredMergeDrivers[name]
+	return driver, ok
+}
+
+func builtinMergeDriver(name string, options Options, diff3Path string) (MergeDriver, bool) {
+	if keyColumn, ok := strings.CutPrefix(name, MergeDriverCSV+":"); ok && keyColumn != "" {
+		return csvMergeDriver(keyColumn, diff3Path), true
+	}
+	switch name {
+	case MergeDriverCSV:
+		return csvMergeDriver("", diff3Path), true
+	case MergeDriverText:
+		return MergeDriverFunc(func(input MergeInput) (MergeResult, error) {
+			return mergeText(input, diff3Path), nil
+		}), true
+	case MergeDriverOurs:
+		return MergeDriverFunc(func(input MergeInput) (MergeResult, error) {
+			return MergeResult{Content: input.A}, nil
+		}), true
+	case MergeDriverTheirs:
+		return MergeDriverFunc(func(input MergeInput) (MergeResult, error) {
+			return MergeResult{Content: input.B}, nil
+		}), true
+	case MergeDriverStructured:
+		return MergeDriverFunc(func(input MergeInput) (MergeResult, error) {
+			merged, conflicts, applicable := mergeStructured(input.Path, input.Base, input.A, input.B)
+			if applicable && len(conflicts) == 0 {
+				return MergeResult{Content: merged}, nil
+			}
+			return mergeText(input, diff3Path), nil
+		}), true
+	case MergeDriverUnion, MergeDriverUnionDedup:
+		dedup := name == MergeDriverUnionDedup
+		return MergeDriverFunc(func(input MergeInput) (MergeResult, error) {
+			return MergeResult{Content: mergeUnion(input.Base, input.A, input.B, dedup)}, nil
+		}), true
+	case MergeDriverMarkdown:
+		return MergeDriverFunc(func(input MergeInput) (MergeResult, error) {
+			merged, conflicted := mergeMarkdown(input.Base, input.A, input.B, options.WordMerge)
+			return MergeResult{Content: merged, Conflict: conflicted}, nil
+		}), true
+	case MergeDriverWords:
+		return MergeDriverFunc(func(input MergeInput) (MergeResult, error) {
+			merged, conflicted := mergeWords(input.Base, input.A, input.B)
+			return MergeResult{Content: merged, Conflict: conflicted}, nil
+		}), true
+	}
+	return nil, false
+}
+
+// csvMergeDriver merges rows by keyColumn, or by position when it is empty,
+// and falls back to the text merge when cells conflict or a side does not
+// parse.
+func csvMergeDriver(keyColumn string, diff3Path string) MergeDriver {
+	return MergeDriverFunc(func(input MergeInput) (MergeResult, error) {
+		merged, conflicts, err := mergeCSV(input.Path, input.Base, input.A, input.B, keyColumn)
+		if err != nil || len(conflicts) > 0 {
+			return mergeText(input, diff3Path), nil
+		}
+		return MergeResult{Content: merged}, nil
+	})
+}
+
+func mergeText(input MergeInput, diff3Path string) MergeResult {
+	merged, diffUsed := mergeThreeWay(mergeInputs{
+		BaseBytes:  input.Base,
+		SideABytes: input.A,
+		SideBBytes: input.B,
+		Diff3Path:  diff3Path,
+	})
+	return MergeResult{Content: merged, Conflict: !diffUsed || bytes.Contains(merged, []byte("<<<<<<< "))}
+}
+
+func lookupMergeDriver(name string, options Options, diff3Path string) (MergeDriver, bool) {
+	if driver, ok := registeredMergeDriver(name); ok {
+		return driver, true
+	}
+	return builtinMergeDriver(name, options, diff3Path)
+}
+
+func validatePathPattern(pattern string) error {
+	if _, err := path.Match(strings.TrimPrefix(pattern, "/"), ""); err != nil {
+		return fmt.Errorf("invalid path pattern %q: %w", pattern, err)
+	}
+	return nil
+}
+
+func validateMergeRules(rules []MergeRule) error {
+	for _, rule := range rules {
+		if err := validatePathPattern(rule.Pattern); err != nil {
+			return err
+		}
+		if _, ok := lookupMergeDriver(rule.Driver, Options{}, ""); !ok {
+			return fmt.Errorf("unknown merge driver %q for %q", rule.Driver, rule.Pattern)
+		}
+	}
+	return nil
+}
+
+// matchPathPattern matches patterns without a slash against the file name
+// and others against the whole relative path.
+func matchPathPattern(pattern string, relativePath string) bool {
+	target := filepath.ToSlash(relativePath)
+	if !strings.Contains(pattern, "/") {
+		target = path.Base(target)
+	}
+	matched, _ := path.Match(strings.TrimPrefix(pattern, "/"), target)
+	return matched
+}
+
+// mergeRuleFor returns the driver of the last rule matching relativePath.
+func mergeRuleFor(rules []MergeRule, relativePath string) string {
+	driver := ""
+	for _, rule := range rules {
+		if matchPathPattern(rule.Pattern, relativePath) {
+			driver = rule.Driver
+		}
+	}
+	return driver
+}
+
+// mergeFile merges a file changed on both sides. A matching merge rule picks
+// the driver; otherwise the structured, Markdown, word and text merges are
+// tried in turn as enabled by options. It returns the merged content and the action
+// tag to count, or no content and "conflict(driver)" when a driver reports a
+// conflict without conflict markers.
+func mergeFile(options Options, relativePath string, base []byte, a []byte, b []byte, diff3Path string, logger *zap.Logger) ([]byte, string) {
+	input := MergeInput{Path: filepath.ToSlash(relativePath), Base: base, A: a, B: b}
+	if name := mergeRuleFor(options.MergeRules, relativePath); name != "" {
+		driver, _ := lookupMergeDriver(name, options, diff3Path)
+		result, err := driver.Merge(input)
+		if err == nil {
+			if !result.Conflict {
+				return result.Content, "merge(driver)"
+			}
+			if bytes.Contains(result.Content, []byte("<<<<<<< ")) {
+				if logger != nil {
+					logger.Warn("merge driver left conflict markers", zap.String("path", relativePath), zap.String("driver", name))
+				}
+				return result.Content, "merge(driver)"
+			}
+			// Writing the driver's output would drop the other side's edits
+			// and make it the new ancestor.
+			if logger != nil {
+				logger.Warn("merge driver reported a conflict, keeping both sides", zap.String("path", relativePath), zap.String("driver", name))
+			}
+			return nil, "conflict(driver)"
+		}
+		if logger != nil {
+			logger.Error("merge driver failed, falling back to default merge", zap.String("path", relativePath), zap.String("driver", name), zap.Error(err))
+		}
+	}
+
+	if options.StructuredMerge {
+		merged, conflicts, applicable := mergeStructured(relativePath, base, a, b)
+		switch {
+		case applicable && len(conflicts) == 0:
+			return merged, "merge(struct)"
+		case applicable && logger != nil:
+			logger.Warn("structured merge conflicts, falling back to text merge", zap.String("path", relativePath), zap.Strings("keys", conflicts))
+		}
+	}
+	if options.MarkdownMerge && isMarkdownPath(relativePath) {
+		merged, conflicted := mergeMarkdown(base, a, b, options.WordMerge)
+		if conflicted && logger != nil {
+			logger.Warn("markdown merge left conflict markers", zap.String("path", relativePath))
+		}
+		return merged, "merge(markdown)"
+	}
+	if options.WordMerge {
+		merged, conflicted := mergeWords(base, a, b)
+		if conflicted && logger != nil {
+			logger.Warn("word merge left conflict markers", zap.String("path", relativePath))
+		}
+		return merged, "merge(words)"
+	}
+	merged, diffUsed := mergeThreeWay(mergeInputs{
+		BaseBytes:  base,
+		SideABytes: a,
+		SideBBytes: b,
+		Diff3Path:  diff3Path,
+	})
+	if diffUsed {
+		return merged, "merge(3way)"
+	}
+	return merged, "merge(2way)"
+}
+
+// ExternalMergeDriver runs a command to merge a file, in the manner of git
+// merge drivers. The placeholders %O, %A and %B in the arguments are replaced
+// with temporary files holding the ancestor and both sides, %P with the
+// relative path and %% with a percent sign. The command writes its result to
+// the %A file and exits non-zero when it leaves a conflict.
+type ExternalMergeDriver struct {
+	Args    []string
+	Timeout time.Duration
+}
+
+// NewExternalMergeDriver splits command into arguments on white space. The
+// command is not run through a shell.
+func NewExternalMergeDriver(command string, timeout time.Duration) (*ExternalMergeDriver, error) {
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return nil, errors.New("empty merge command")
+	}
+	return &ExternalMergeDriver{Args: args, Timeout: timeout}, nil
+}
+
+// Merge runs the command on temporary copies of the three versions.
+func (d *ExternalMergeDriver) Merge(input MergeInput) (MergeResult, error) {
+	tempDir, err := os.MkdirTemp("", "zync-driver-*")
+	if err != nil {
+		return MergeResult{}, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	extension := path.Ext(input.Path)
+	files := map[string]string{
+		"%O": filepath.Join(tempDir, "base"+extension),
+		"%A": filepath.Join(tempDir, "a"+extension),
+		"%B": filepath.Join(tempDir, "b"+extension),
+	}
+	for placeholder, content := range map[string][]byte{"%O": input.Base, "%A": input.A, "%B": input.B} {
+		if err := os.WriteFile(files[placeholder], content, 0o600); err != nil {
+			return MergeResult{}, err
+		}
+	}
+
+	replacer := strings.NewReplacer("%%", "%", "%O", files["%O"], "%A", files["%A"], "%B", files["%B"], "%P", input.Path)
+	args := make([]string, len(d.Args))
+	for index, arg := range d.Args {
+		args[index] = replacer.Replace(arg)
+	}
+
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// Children that inherited the output pipe must not outlive the timeout.
+	cmd.WaitDelay = time.Second
+	output, runErr := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		return MergeResult{}, fmt.Errorf("merge command %q timed out after %s", d.Args[0], d.Timeout)
+	}
+	conflict := false
+	if runErr != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(runErr, &exitErr) || exitErr.ExitCode() < 0 {
+			return MergeResult{}, fmt.Errorf("merge command %q: %w: %s", d.Args[0], runErr, bytes.TrimSpace(output))
+		}
+		conflict = true
+	}
+
+	merged, err := os.ReadFile(files["%A"])
+	if err != nil {
+		return MergeResult{}, err
+	}
+	return MergeResult{Content: merged, Conflict: conflict}, nil
+}
@@ -0,0 +1,237 @@
+package sync_test
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+// mergeBothChanged seeds file with base, changes it on both sides and runs a
+// second sync with opts.
+func mergeBothChanged(t *testing.T, opts syncpkg.Options, file, base, sideA, sideB string) syncpkg.SyncResult {
+	t.Helper()
+	writeFile(t, filepath.Join(opts.RootAPath, file), base)
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("initial sync: %v", err)
+	}
+	writeFile(t, filepath.Join(opts.RootAPath, file), sideA)
+	writeFile(t, filepath.Join(opts.RootBPath, file), sideB)
+	res, err := syncpkg.RunSync(opts, zap.NewNop())
+	if err != nil {
+		t.Fatalf("merge sync: %v", err)
+	}
+	return res
+}
+
+func TestMergeDrivers(t *testing.T) {
+	syncpkg.RegisterMergeDriver("upper", syncpkg.MergeDriverFunc(func(input syncpkg.MergeInput) (syncpkg.MergeResult, error) {
+		return syncpkg.MergeResult{Content: bytes.ToUpper(append(append([]byte{}, input.A...), input.B...))}, nil
+	}))
+
+	// Scripts run with an empty PATH so that diff3 is not found.
+	catPath, catErr := exec.LookPath("cat")
+	sleepPath, sleepErr := exec.LookPath("sleep")
+	if catErr != nil || sleepErr != nil {
+		t.Skip("cat and sleep are required")
+	}
+	scriptDir := t.TempDir()
+	script := func(name, body string) string {
+		path := filepath.Join(scriptDir, name)
+		if err := os.WriteFile(path, []byte("#!/bin/sh\n"+body), 0o755); err != nil {
+			t.Fatalf("write script: %v", err)
+		}
+		return path
+	}
+
+	cases := []struct {
+		name     string
+		file     string
+		rules    []syncpkg.MergeRule
+		commands map[string]string
+		timeout  time.Duration
+		contents []string
+		want     string
+		tag      string
+	}{
+		{
+			name:  "OursByFileName",
+			file:  "deps/yarn.lock",
+			rules: []syncpkg.MergeRule{{Pattern: "*.lock", Driver: syncpkg.MergeDriverOurs}},
+			want:  "a\n",
+			tag:   "merge(driver)",
+		},
+		{
+			name: "LastRuleWins",
+			file: "deps/yarn.lock",
+			rules: []syncpkg.MergeRule{
+				{Pattern: "*.lock", Driver: syncpkg.MergeDriverOurs},
+				{Pattern: "deps/*", Driver: syncpkg.MergeDriverTheirs},
+			},
+			want: "b\n",
+			tag:  "merge(driver)",
+		},
+		{
+			name:  "RegisteredDriver",
+			file:  "x.txt",
+			rules: []syncpkg.MergeRule{{Pattern: "*.txt", Driver: "upper"}},
+			want:  "A\nB\n",
+			tag:   "merge(driver)",
+		},
+		{
+			name:     "UnionKeepsBothAppends",
+			file:     "journal/2024.md",
+			rules:    []syncpkg.MergeRule{{Pattern: "journal/*", Driver: syncpkg.MergeDriverUnion}},
+			contents: []string{"# log\nday 1\n", "# log\nday 1\nday 2 on a\n", "# log\nday 1\nday 2 on b\n"},
+			want:     "# log\nday 1\nday 2 on a\nday 2 on b\n",
+			tag:      "merge(driver)",
+		},
+		{
+			name:     "UnionDedupDropsRepeatedLines",
+			file:     ".gitignore",
+			rules:    []syncpkg.MergeRule{{Pattern: ".gitignore", Driver: syncpkg.MergeDriverUnionDedup}},
+			contents: []string{"*.o\n", "*.o\nbin/\n", "*.o\nbin/\ntmp/\n"},
+			want:     "*.o\nbin/\ntmp/\n",
+			tag:      "merge(driver)",
+		},
+		{
+			name:     "UnionDedupKeepsRepeatedBaseLines",
+			file:     "list.txt",
+			rules:    []syncpkg.MergeRule{{Pattern: "list.txt", Driver: syncpkg.MergeDriverUnionDedup}},
+			contents: []string{"- item\n- item\n}\n}\nend\n", "- item\n- item\n}\n}\nend\n}\nnew a\n", "- item\n- item\n}\n}\nend\nnew b\n}\n"},
+			want:     "- item\n- item\n}\n}\nend\nnew a\nnew b\n",
+			tag:      "merge(driver)",
+		},
+		{
+			name:     "CSVByKeyColumn",
+			file:     "stock.csv",
+			rules:    []syncpkg.MergeRule{{Pattern: "*.csv", Driver: "csv:id"}},
+			contents: []string{"id,name,qty\n1,apple,3\n2,pear,5\n", "id,name,qty\n1,apple,4\n", "id,name,qty\n1,green apple,3\n3,plum,1\n2,pear,5\n"},
+			want:     "id,name,qty\n1,green apple,4\n3,plum,1\n",
+			tag:      "merge(driver)",
+		},
+		{
+			name:     "CSVAdjacentRowsByPosition",
+			file:     "grid.tsv",
+			rules:    []syncpkg.MergeRule{{Pattern: "*.tsv", Driver: syncpkg.MergeDriverCSV}},
+			contents: []string{"a\t1\nb\t2\n", "a\t10\nb\t2\n", "a\t1\nb\t20\n"},
+			want:     "a\t10\nb\t20\n",
+			tag:      "merge(driver)",
+		},
+		{
+			name:     "CSVSameCellFallsBackToText",
+			file:     "stock.csv",
+			rules:    []syncpkg.MergeRule{{Pattern: "*.csv", Driver: "csv:id"}},
+			contents: []string{"id,qty\n1,3\n", "id,qty\n1,4\n", "id,qty\n1,5\n"},
+			want:     "<<<<<<< SIDE_A\nid,qty\n1,4\n=======\nid,qty\n1,5\n>>>>>>> SIDE_B\n",
+			tag:      "merge(driver)",
+		},
+		{
+			name:     "CSVEmptySideFallsBackToText",
+			file:     "stock.csv",
+			rules:    []syncpkg.MergeRule{{Pattern: "*.csv", Driver: "csv:id"}},
+			contents: []string{"id,name\n1,a\n", "", "id,name\n1,b\n"},
+			want:     "<<<<<<< SIDE_A\n=======\nid,name\n1,b\n>>>>>>> SIDE_B\n",
+			tag:      "merge(driver)",
+		},
+		{
+			name:     "ExternalCommand",
+			file:     "doc.bin",
+			rules:    []syncpkg.MergeRule{{Pattern: "*.bin", Driver: "concat"}},
+			commands: map[string]string{"concat": script("concat", catPath+" \"$3\" >> \"$2\"\necho \"$4\" >> \"$2\"\n") + " %O %A %B %P"},
+			want:     "a\nb\ndoc.bin\n",
+			tag:      "merge(driver)",
+		},
+		{
+			name:     "ExternalCommandConflictKeepsMarkers",
+			file:     "doc.bin",
+			rules:    []syncpkg.MergeRule{{Pattern: "*.bin", Driver: "fail"}},
+			commands: map[string]string{"fail": script("fail", "echo '<<<<<<< mine' > \"$1\"\nexit 1\n") + " %A"},
+			want:     "<<<<<<< mine\n",
+			tag:      "merge(driver)",
+		},
+		{
+			name:     "ExternalCommandTimeoutFallsBack",
+			file:     "doc.bin",
+			rules:    []syncpkg.MergeRule{{Pattern: "*.bin", Driver: "slow"}},
+			commands: map[string]string{"slow": script("slow", "exec "+sleepPath+" 5\n")},
+			timeout:  100 * time.Millisecond,
+			want:     "<<<<<<< SIDE_A\na\n=======\nb\n>>>>>>> SIDE_B\n",
+			tag:      "merge(2way)",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if len(tc.commands) > 0 && runtime.GOOS == "windows" {
+				t.Skip("external merge commands use sh")
+			}
+			for name, command := range tc.commands {
+				driver, err := syncpkg.NewExternalMergeDriver(command, tc.timeout)
+				if err != nil {
+					t.Fatalf("driver: %v", err)
+				}
+				syncpkg.RegisterMergeDriver(name, driver)
+			}
+			t.Setenv("PATH", t.TempDir())
+			opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+			opts.MergeRules = tc.rules
+
+			contents := tc.contents
+			if contents == nil {
+				contents = []string{"base\n", "a\n", "b\n"}
+			}
+			res := mergeBothChanged(t, opts, tc.file, contents[0], contents[1], contents[2])
+			if res.ActionCounters[tc.tag] != 1 {
+				t.Fatalf("expected %s, got %v", tc.tag, res.ActionCounters)
+			}
+			for _, root := range []string{opts.RootAPath, opts.RootBPath} {
+				if got := readFile(t, filepath.Join(root, tc.file)); got != tc.want {
+					t.Fatalf("merged content = %q, want %q", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMergeDriverConflictKeepsBothSides(t *testing.T) {
+	syncpkg.RegisterMergeDriver("give-up", syncpkg.MergeDriverFunc(func(input syncpkg.MergeInput) (syncpkg.MergeResult, error) {
+		return syncpkg.MergeResult{Content: input.A, Conflict: true}, nil
+	}))
+	opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+	opts.MergeRules = []syncpkg.MergeRule{{Pattern: "*.bin", Driver: "give-up"}}
+	for run := 0; run < 2; run++ {
+		var res syncpkg.SyncResult
+		if run == 0 {
+			res = mergeBothChanged(t, opts, "doc.bin", "base\n", "a\n", "b\n")
+		} else {
+			var err error
+			if res, err = syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+				t.Fatalf("sync: %v", err)
+			}
+		}
+		if res.ActionCounters["conflict(driver)"] != 1 || res.ActionCounters["merge(driver)"] != 0 {
+			t.Fatalf("run %d: counters %v", run, res.ActionCounters)
+		}
+		if got := readFile(t, filepath.Join(opts.RootAPath, "doc.bin")); got != "a\n" {
+			t.Fatalf("run %d: A has %q", run, got)
+		}
+		if got := readFile(t, filepath.Join(opts.RootBPath, "doc.bin")); got != "b\n" {
+			t.Fatalf("run %d: B has %q", run, got)
+		}
+	}
+}
+
+func TestMergeRulesRejectUnknownDriver(t *testing.T) {
+	opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+	opts.MergeRules = []syncpkg.MergeRule{{Pattern: "*.x", Driver: "missing"}}
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err == nil {
+		t.Fatalf("expected an error for an unknown merge driver")
+	}
+}
@@ -1,13 +1,47 @@
 package sync
 
-// Options configures a synchronization run.
+// Options configures a synchronization run. ReplicaA and ReplicaB hold the
+// roots; when nil, RootAPath and RootBPath are opened as local directories.
 type Options struct {
 	RootAPath                   string
 	RootBPath                   string
+	ReplicaA                    ReplicaFS
+	ReplicaB                    ReplicaFS
 	StateDirectory              string
 	IncludeGlob                 string
 	IgnorePathPrefixes          []string
 	IgnoreFileNames             []string
 	CreateBackupsOnWrite        bool
+	BackupRetention             RetentionPolicy
+	HistoryLimit                int
 	ConflictMtimeEpsilonSeconds float64
+	SymlinkMode                 SymlinkMode
+	SyncXattrs                  bool
+	SyncACLs                    bool
+	XattrInclude                []string
+	XattrExclude                []string
+	PreserveOwnership           bool
+	UIDMap                      []IDMapping
+	GIDMap                      []IDMapping
+	DefaultUID                  *int
+	DefaultGID                  *int
+	StructuredMerge             bool
+	MarkdownMerge               bool
+	MergeRules                  []MergeRule
+	WordMerge                   bool
+	NormalizeLineEndings        bool
+	IgnoreTrailingWhitespace    bool
+	LineEnding                  string
+	DetectEncoding              bool
+	LegacyCharset               string
+	FilterRules                 []FilterRule
+	AutoResolve                 bool
+	ConflictRules               []ConflictRule
+	GitCommit                   string
+	GitRequireClean             bool
+	ForceDirDeletions           bool
+
+	// seedState adjusts the loaded state for this run only, after the state
+	// the run journal starts from has been taken.
+	seedState func(store *stateStore, state *syncState) error
 }
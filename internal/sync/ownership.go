@@ -0,0 +1,123 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// IDMapping pairs a numeric user or group id on root A with the id that
+// represents the same principal on root B.
+type IDMapping struct {
+	A int
+	B int
+}
+
+// ParseIDMapping parses an "a:b" mapping such as "1000:1026".
+func ParseIDMapping(spec string) (IDMapping, error) {
+	left, right, found := strings.Cut(spec, ":")
+	if !found {
+		return IDMapping{}, fmt.Errorf("invalid id mapping %q, expected a:b", spec)
+	}
+	idA, errA := strconv.Atoi(strings.TrimSpace(left))
+	idB, errB := strconv.Atoi(strings.TrimSpace(right))
+	if errA != nil || errB != nil || idA < 0 || idB < 0 {
+		return IDMapping{}, fmt.Errorf("invalid id mapping %q, expected a:b", spec)
+	}
+	return IDMapping{A: idA, B: idB}, nil
+}
+
+// ParseOwner parses a "uid:gid" owner specification.
+func ParseOwner(spec string) (int, int, error) {
+	mapping, err := ParseIDMapping(spec)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid owner %q, expected uid:gid", spec)
+	}
+	return mapping.A, mapping.B, nil
+}
+
+func mapID(id int, mappings []IDMapping, towardB bool) int {
+	for _, mapping := range mappings {
+		if towardB && mapping.A == id {
+			return mapping.B
+		}
+		if !towardB && mapping.B == id {
+			return mapping.A
+		}
+	}
+	return id
+}
+
+// defaultID returns the configured default id, or -1 to leave it unchanged.
+func defaultID(fallback *int) int {
+	if fallback == nil {
+		return -1
+	}
+	return *fallback
+}
+
+func ownershipEnabled(options Options) bool {
+	return options.PreserveOwnership && os.Geteuid() == 0
+}
+
+// adoptOwnership gives the entry at relativePath on the target side the owner
+// of the same entry on the source side, translated through the id mappings.
+// When the source has no owner to preserve, such as an archive or remote
+// root, the default owner is applied instead.
+func adoptOwnership(options Options, relativePath string, towardB bool) error {
+	if !ownershipEnabled(options) {
+		return nil
+	}
+	source, target := replicaFor(options, !towardB), replicaFor(options, towardB)
+	setter, ok := target.(ownerSetter)
+	if !ok {
+		return nil
+	}
+	info, err := source.Lstat(relativePath)
+	if err != nil {
+		return err
+	}
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		if options.DefaultUID == nil && options.DefaultGID == nil {
+			return nil
+		}
+		return setter.Lchown(relativePath, defaultID(options.DefaultUID), defaultID(options.DefaultGID))
+	}
+	targetUID := mapID(uid, options.UIDMap, towardB)
+	targetGID := mapID(gid, options.GIDMap, towardB)
+	return setter.Lchown(relativePath, targetUID, targetGID)
+}
+
+// ensureDirsLike creates every missing directory of relativeDir on the target
+// side, giving each new directory the owner of its source counterpart.
+func ensureDirsLike(options Options, relativeDir string, towardB bool) error {
+	target := replicaFor(options, towardB)
+	relativeDir = filepath.ToSlash(relativeDir)
+	if relativeDir == "." || relativeDir == "" {
+		return nil
+	}
+	if !ownershipEnabled(options) {
+		return target.MkdirAll(relativeDir, 0o755)
+	}
+	parts := strings.Split(relativeDir, "/")
+	for index := range parts {
+		rel := strings.Join(parts[:index+1], "/")
+		if _, err := target.Lstat(rel); err == nil {
+			continue
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := target.Mkdir(rel, 0o755); err != nil {
+			return err
+		}
+		if err := adoptOwnership(options, rel, towardB); err != nil {
+			return err
+		}
+	}
+	return nil
+}
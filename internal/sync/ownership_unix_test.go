@@ -0,0 +1,118 @@
+//go:build unix
+
+package sync_test
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+func TestParseIDMapping(t *testing.T) {
+	cases := []struct {
+		spec    string
+		want    syncpkg.IDMapping
+		wantErr bool
+	}{
+		{spec: "1000:1026", want: syncpkg.IDMapping{A: 1000, B: 1026}},
+		{spec: " 0 : 0 ", want: syncpkg.IDMapping{A: 0, B: 0}},
+		{spec: "1000", wantErr: true},
+		{spec: "-1:5", wantErr: true},
+		{spec: "a:b", wantErr: true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.spec, func(t *testing.T) {
+			got, err := syncpkg.ParseIDMapping(tc.spec)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error")
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Fatalf("got %+v, %v; want %+v", got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestOwnershipMapping(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("ownership tests require root")
+	}
+
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	state := t.TempDir()
+	writeFile(t, filepath.Join(rootA, "dir", "mapped.md"), "M")
+	writeFile(t, filepath.Join(rootA, "other.md"), "O")
+	chown(t, filepath.Join(rootA, "dir"), 1000, 100)
+	chown(t, filepath.Join(rootA, "dir", "mapped.md"), 1000, 100)
+	chown(t, filepath.Join(rootA, "other.md"), 2000, 2000)
+
+	defaultUID, defaultGID := 3000, 3000
+	opts := defaultOptions(rootA, rootB, state)
+	opts.PreserveOwnership = true
+	opts.UIDMap = []syncpkg.IDMapping{{A: 1000, B: 1026}}
+	opts.GIDMap = []syncpkg.IDMapping{{A: 100, B: 101}}
+	opts.DefaultUID = &defaultUID
+	opts.DefaultGID = &defaultGID
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+
+	cases := []struct {
+		rel      string
+		uid, gid uint32
+	}{
+		{rel: "dir", uid: 1026, gid: 101},
+		{rel: "dir/mapped.md", uid: 1026, gid: 101},
+		{rel: "other.md", uid: 2000, gid: 2000},
+	}
+	for _, tc := range cases {
+		assertOwner(t, filepath.Join(rootB, tc.rel), tc.uid, tc.gid)
+	}
+}
+
+func TestDefaultOwnerForSourcesWithoutOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("ownership tests require root")
+	}
+
+	archivePath := filepath.Join(t.TempDir(), "backup.tar.gz")
+	writeArchive(t, archivePath, map[string]string{"notes/a.md": "from the backup"})
+	rootA, state := t.TempDir(), t.TempDir()
+
+	defaultUID, defaultGID := 3000, 3000
+	opts := defaultOptions(rootA, archivePath, state)
+	opts.PreserveOwnership = true
+	opts.DefaultUID = &defaultUID
+	opts.DefaultGID = &defaultGID
+	syncArchive(t, opts, archivePath, false)
+
+	assertOwner(t, filepath.Join(rootA, "notes"), 3000, 3000)
+	assertOwner(t, filepath.Join(rootA, "notes", "a.md"), 3000, 3000)
+}
+
+func chown(t *testing.T, path string, uid, gid int) {
+	t.Helper()
+	if err := os.Chown(path, uid, gid); err != nil {
+		t.Fatalf("chown %s: %v", path, err)
+	}
+}
+
+func assertOwner(t *testing.T, path string, uid, gid uint32) {
+	t.Helper()
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("stat %s: %v", path, err)
+	}
+	stat := info.Sys().(*syscall.Stat_t)
+	if stat.Uid != uid || stat.Gid != gid {
+		t.Fatalf("%s owned by %d:%d, want %d:%d", path, stat.Uid, stat.Gid, uid, gid)
+	}
+}
@@ -0,0 +1,103 @@
+package sync
+
+import (
+	"regexp"
+	"strings"
+)
+
+// wordTokenPattern splits text into alternating runs of white space and
+// words, so that joining the tokens gives back the text.
+var wordTokenPattern = regexp.MustCompile(`\s+|\S+`)
+
+// hunkResolver tries to resolve a region changed differently on both sides.
+type hunkResolver func(hunk mergeHunk[string]) ([]string, bool)
+
+func chainResolvers(resolvers ...hunkResolver) hunkResolver {
+	return func(hunk mergeHunk[string]) ([]string, bool) {
+		for _, resolve := range resolvers {
+			if lines, ok := resolve(hunk); ok {
+				return lines, true
+			}
+		}
+		return nil, false
+	}
+}
+
+// mergeLinesWithMarkers runs a line-level three-way merge. Regions changed on
+// both sides are passed to resolve, if set, and wrapped in conflict markers
+// when it cannot resolve them. It reports whether markers were written.
+func mergeLinesWithMarkers(base string, a string, b string, resolve hunkResolver) (string, bool) {
+	equal := func(x string, y string) bool {
+		return x == y
+	}
+	var out strings.Builder
+	conflicted := false
+	for _, hunk := range diff3Hunks(splitLines(base), splitLines(a), splitLines(b), equal) {
+		lines, resolved := hunk.Resolved, !hunk.Conflict
+		if !resolved && resolve != nil {
+			lines, resolved = resolve(hunk)
+		}
+		if resolved {
+			for _, line := range lines {
+				out.WriteString(line)
+			}
+			continue
+		}
+		conflicted = true
+		out.WriteString("<<<<<<< SIDE_A\n")
+		writeTerminatedLines(&out, hunk.A)
+		out.WriteString("=======\n")
+		writeTerminatedLines(&out, hunk.B)
+		out.WriteString(">>>>>>> SIDE_B\n")
+	}
+	return out.String(), conflicted
+}
+
+// resolveWordHunk merges a conflicting region again word by word, so that
+// edits to different sentences of one long line both survive.
+func resolveWordHunk(hunk mergeHunk[string]) ([]string, bool) {
+	equal := func(x string, y string) bool {
+		return x == y
+	}
+	base := wordTokenPattern.FindAllString(strings.Join(hunk.Base, ""), -1)
+	a := wordTokenPattern.FindAllString(strings.Join(hunk.A, ""), -1)
+	b := wordTokenPattern.FindAllString(strings.Join(hunk.B, ""), -1)
+	var out strings.Builder
+	for _, wordHunk := range diff3Hunks(base, a, b, equal) {
+		if wordHunk.Conflict {
+			return nil, false
+		}
+		for _, token := range wordHunk.Resolved {
+			out.WriteString(token)
+		}
+	}
+	return splitLines(out.String()), true
+}
+
+// mergeWords merges text line by line and retries conflicting lines word by
+// word before writing conflict markers.
+func mergeWords(base []byte, a []byte, b []byte) ([]byte, bool) {
+	merged, conflicted := mergeLinesWithMarkers(string(base), string(a), string(b), resolveWordHunk)
+	return []byte(merged), conflicted
+}
+
+// splitLines splits text into lines that keep their terminators.
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func writeTerminatedLines(out *strings.Builder, lines []string) {
+	for _, line := range lines {
+		out.WriteString(line)
+		if !strings.HasSuffix(line, "\n") {
+			out.WriteByte('\n')
+		}
+	}
+}
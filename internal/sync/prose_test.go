@@ -0,0 +1,75 @@
+package sync_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+)
+
+func TestWordMerge(t *testing.T) {
+	cases := []struct {
+		name     string
+		file     string
+		markdown bool
+		base     string
+		sideA    string
+		sideB    string
+		want     string
+		tag      string
+	}{
+		{
+			name:  "DifferentSentencesOfOneLine",
+			file:  "essay.txt",
+			base:  "Title\nThe cat sat. The dog ran. The bird flew.\n",
+			sideA: "Title\nThe black cat sat. The dog ran. The bird flew.\n",
+			sideB: "Title\nThe cat sat. The dog ran. The bird flew away.\n",
+			want:  "Title\nThe black cat sat. The dog ran. The bird flew away.\n",
+			tag:   "merge(words)",
+		},
+		{
+			name:     "MarkdownParagraph",
+			file:     "note.md",
+			markdown: true,
+			base:     "# Note\n\nFirst idea here. Second idea there.\n",
+			sideA:    "# Note\n\nFirst good idea here. Second idea there.\n",
+			sideB:    "# Note\n\nFirst idea here. Second idea over there.\n",
+			want:     "# Note\n\nFirst good idea here. Second idea over there.\n",
+			tag:      "merge(markdown)",
+		},
+		{
+			name:  "SameWordKeepsMarkers",
+			file:  "essay.txt",
+			base:  "one two three\n",
+			sideA: "one 2 three\n",
+			sideB: "one deux three\n",
+			want:  "<<<<<<< SIDE_A\none 2 three\n=======\none deux three\n>>>>>>> SIDE_B\n",
+			tag:   "merge(words)",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+			opts.WordMerge = true
+			opts.MarkdownMerge = tc.markdown
+
+			res := mergeBothChanged(t, opts, tc.file, tc.base, tc.sideA, tc.sideB)
+			if res.ActionCounters[tc.tag] != 1 {
+				t.Fatalf("expected %s, got %v", tc.tag, res.ActionCounters)
+			}
+			for _, root := range []string{opts.RootAPath, opts.RootBPath} {
+				if got := readFile(t, filepath.Join(root, tc.file)); got != tc.want {
+					t.Fatalf("merged content = %q, want %q", got, tc.want)
+				}
+			}
+		})
+	}
+
+	opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+	opts.MergeRules = []syncpkg.MergeRule{{Pattern: "*.txt", Driver: syncpkg.MergeDriverWords}}
+	res := mergeBothChanged(t, opts, "p.txt", "a b c\n", "A b c\n", "a b C\n")
+	if got := readFile(t, filepath.Join(opts.RootBPath, "p.txt")); got != "A b C\n" || res.ActionCounters["merge(driver)"] != 1 {
+		t.Fatalf("words driver merged %q, counters %v", got, res.ActionCounters)
+	}
+}
@@ -0,0 +1,598 @@
+package sync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	stdsync "sync"
+	"time"
+)
+
+// remoteProtocolVersion is exchanged when a connection starts; both ends must
+// speak the same version.
+const remoteProtocolVersion = 1
+
+// maxRemoteFrame bounds the size of a single message.
+const maxRemoteFrame = 1 << 30
+
+// Error codes carried in responses so that the client can rebuild errors that
+// match fs.ErrNotExist and its siblings.
+const (
+	remoteCodeNotExist   = "not-exist"
+	remoteCodeExist      = "exist"
+	remoteCodePermission = "permission"
+	remoteCodeInvalid    = "invalid"
+)
+
+// ReplicaHasher is implemented by replicas that compute digests where the
+// content lives, so that files matching the ancestor need not be transferred.
+// Hash returns the hex SHA-256 of the file at name, following links.
+type ReplicaHasher interface {
+	Hash(name string) (string, error)
+}
+
+type remoteRequest struct {
+	Op      string `json:"op"`
+	Name    string `json:"name,omitempty"`
+	NewName string `json:"new_name,omitempty"`
+	Target  string `json:"target,omitempty"`
+	Data    []byte `json:"data,omitempty"`
+	Mode    uint32 `json:"mode,omitempty"`
+	Version int    `json:"version,omitempty"`
+}
+
+type remoteInfo struct {
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	Mode    uint32 `json:"mode"`
+	ModTime int64  `json:"mod_time"`
+}
+
+type remoteResponse struct {
+	Error   string       `json:"error,omitempty"`
+	Code    string       `json:"code,omitempty"`
+	Info    *remoteInfo  `json:"info,omitempty"`
+	Entries []remoteInfo `json:"entries,omitempty"`
+	Data    []byte       `json:"data,omitempty"`
+	Target  string       `json:"target,omitempty"`
+	Hash    string       `json:"hash,omitempty"`
+	Inside  bool         `json:"inside,omitempty"`
+	Version int          `json:"version,omitempty"`
+}
+
+// errFrameTooLarge is returned for a message over maxRemoteFrame. Nothing is
+// written, so the connection can still be used.
+var errFrameTooLarge = errors.New("message exceeds the remote frame limit")
+
+// writeFrame sends message as a big-endian length followed by its JSON.
+func writeFrame(w io.Writer, message any) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	if len(payload) > maxRemoteFrame {
+		return fmt.Errorf("%w: %d bytes", errFrameTooLarge, len(payload))
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(payload)))
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+// readFrame reads one message written by writeFrame. A clean end of stream
+// before the header is reported as io.EOF. An oversized message is skipped,
+// which keeps the stream in step for the next one.
+func readFrame(r io.Reader, message any) error {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxRemoteFrame {
+		if _, err := io.CopyN(io.Discard, r, int64(size)); err != nil {
+			return unexpectedEOF(err)
+		}
+		return fmt.Errorf("%w: %d bytes", errFrameTooLarge, size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return unexpectedEOF(err)
+	}
+	return json.Unmarshal(payload, message)
+}
+
+// unexpectedEOF reports a stream that ended inside a frame as
+// io.ErrUnexpectedEOF and passes other errors through.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func infoToRemote(name string, info fs.FileInfo) remoteInfo {
+	return remoteInfo{Name: name, Size: info.Size(), Mode: uint32(info.Mode()), ModTime: info.ModTime().UnixNano()}
+}
+
+type remoteFileInfo struct {
+	info remoteInfo
+}
+
+func (i remoteFileInfo) Name() string       { return path.Base(i.info.Name) }
+func (i remoteFileInfo) Size() int64        { return i.info.Size }
+func (i remoteFileInfo) Mode() fs.FileMode  { return fs.FileMode(i.info.Mode) }
+func (i remoteFileInfo) ModTime() time.Time { return time.Unix(0, i.info.ModTime) }
+func (i remoteFileInfo) IsDir() bool        { return i.Mode().IsDir() }
+func (i remoteFileInfo) Sys() any           { return nil }
+
+// remoteError is an error reported by the server. It unwraps to the matching
+// fs sentinel error, if any.
+type remoteError struct {
+	message string
+	kind    error
+}
+
+func (e *remoteError) Error() string { return e.message }
+func (e *remoteError) Unwrap() error { return e.kind }
+
+func remoteErrorCode(err error) string {
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return remoteCodeNotExist
+	case errors.Is(err, fs.ErrExist):
+		return remoteCodeExist
+	case errors.Is(err, fs.ErrPermission):
+		return remoteCodePermission
+	case errors.Is(err, fs.ErrInvalid):
+		return remoteCodeInvalid
+	}
+	return ""
+}
+
+func remoteErrorKind(code string) error {
+	switch code {
+	case remoteCodeNotExist:
+		return fs.ErrNotExist
+	case remoteCodeExist:
+		return fs.ErrExist
+	case remoteCodePermission:
+		return fs.ErrPermission
+	case remoteCodeInvalid:
+		return fs.ErrInvalid
+	}
+	return nil
+}
+
+// ServeReplica answers the requests of a RemoteFS for fsys, reading them from
+// r and writing the responses to w, until r ends.
+func ServeReplica(fsys ReplicaFS, r io.Reader, w io.Writer) error {
+	reader := bufio.NewReader(r)
+	writer := bufio.NewWriter(w)
+	for {
+		var request remoteRequest
+		var response remoteResponse
+		err := readFrame(reader, &request)
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case errors.Is(err, errFrameTooLarge):
+			response = remoteResponse{Error: err.Error()}
+		case err != nil:
+			return err
+		default:
+			response = serveRemoteRequest(fsys, request)
+		}
+		err = writeFrame(writer, response)
+		if errors.Is(err, errFrameTooLarge) {
+			err = writeFrame(writer, remoteResponse{Error: fmt.Sprintf("%s %s: %v", request.Op, request.Name, err)})
+		}
+		if err != nil {
+			return err
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+// validRemoteName reports whether a name sent by the peer is a path inside
+// the served root. The peer is not trusted to stay within it.
+func validRemoteName(name string) bool {
+	if name == "" {
+		name = "."
+	}
+	return fs.ValidPath(name)
+}
+
+func serveRemoteRequest(fsys ReplicaFS, request remoteRequest) remoteResponse {
+	if request.Op != "hello" {
+		for _, name := range []string{request.Name, request.NewName} {
+			if !validRemoteName(name) {
+				err := &fs.PathError{Op: request.Op, Path: name, Err: fs.ErrInvalid}
+				return remoteResponse{Error: err.Error(), Code: remoteErrorCode(err)}
+			}
+		}
+	}
+
+	var response remoteResponse
+	var err error
+	switch request.Op {
+	case "hello":
+		response.Version = remoteProtocolVersion
+		if request.Version != remoteProtocolVersion {
+			err = fmt.Errorf("unsupported protocol version %d, server speaks %d", request.Version, remoteProtocolVersion)
+		}
+	case "stat", "lstat":
+		var info fs.FileInfo
+		if request.Op == "stat" {
+			info, err = fsys.Stat(request.Name)
+		} else {
+			info, err = fsys.Lstat(request.Name)
+		}
+		if err == nil {
+			remote := infoToRemote(request.Name, info)
+			response.Info = &remote
+		}
+	case "readdir":
+		var entries []fs.DirEntry
+		entries, err = fsys.ReadDir(request.Name)
+		for _, entry := range entries {
+			info, infoErr := entry.Info()
+			if infoErr != nil {
+				err = infoErr
+				break
+			}
+			response.Entries = append(response.Entries, infoToRemote(entry.Name(), info))
+		}
+	case "walk":
+		err = fsys.WalkDir(request.Name, func(name string, d fs.DirEntry, walkErr error) error {
+			if walkErr != nil {
+				return walkErr
+			}
+			info, infoErr := d.Info()
+			if infoErr != nil {
+				return infoErr
+			}
+			response.Entries = append(response.Entries, infoToRemote(name, info))
+			return nil
+		})
+	case "read":
+		response.Data, err = fsys.ReadFile(request.Name)
+	case "hash":
+		response.Hash, err = hashReplicaFile(fsys, request.Name)
+	case "write":
+		err = fsys.WriteFile(request.Name, request.Data, fs.FileMode(request.Mode))
+	case "mkdir":
+		err = fsys.Mkdir(request.Name, fs.FileMode(request.Mode))
+	case "mkdirall":
+		err = fsys.MkdirAll(request.Name, fs.FileMode(request.Mode))
+	case "rename":
+		err = fsys.Rename(request.Name, request.NewName)
+	case "remove":
+		err = fsys.Remove(request.Name)
+	case "removeall":
+		err = fsys.RemoveAll(request.Name)
+	case "chmod":
+		err = fsys.Chmod(request.Name, fs.FileMode(request.Mode))
+	case "symlink":
+		err = fsys.Symlink(request.Target, request.Name)
+	case "readlink":
+		response.Target, err = fsys.Readlink(request.Name)
+	case "resolve":
+		response.Target, response.Inside, err = resolveReplicaPath(fsys, request.Name)
+	default:
+		err = fmt.Errorf("unknown request %q", request.Op)
+	}
+	if err != nil {
+		response = remoteResponse{Error: err.Error(), Code: remoteErrorCode(err)}
+	}
+	return response
+}
+
+// hashReplicaFile digests the file at name, streaming local files.
+func hashReplicaFile(fsys ReplicaFS, name string) (string, error) {
+	if hasher, ok := fsys.(ReplicaHasher); ok {
+		return hasher.Hash(name)
+	}
+	if filePath, ok := localPath(fsys, name); ok {
+		file, err := os.Open(filePath)
+		if err != nil {
+			return "", err
+		}
+		defer file.Close()
+		digest := sha256.New()
+		if _, err := io.Copy(digest, file); err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(digest.Sum(nil)), nil
+	}
+	content, err := fsys.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	return digestBytes(content), nil
+}
+
+// RemoteFS is a ReplicaFS served by ServeReplica on the other end of a pair
+// of streams, usually a zync server started over SSH. Requests are answered
+// one at a time.
+type RemoteFS struct {
+	mutex  stdsync.Mutex
+	reader *bufio.Reader
+	writer io.Writer
+	close  func() error
+}
+
+// NewRemoteFS starts a session with the server reading from w and writing to
+// r.
+func NewRemoteFS(r io.Reader, w io.Writer) (*RemoteFS, error) {
+	remote := &RemoteFS{reader: bufio.NewReader(r), writer: w}
+	response, err := remote.call(remoteRequest{Op: "hello", Version: remoteProtocolVersion})
+	if err != nil {
+		return nil, err
+	}
+	if response.Version != remoteProtocolVersion {
+		return nil, fmt.Errorf("remote speaks protocol version %d, want %d", response.Version, remoteProtocolVersion)
+	}
+	return remote, nil
+}
+
+// DialSSH starts "serverCommand server <path>" on the host of rootURL, an
+// ssh://[user@]host[:port]/path URL, with sshCommand and returns a replica
+// for the remote directory. As with unison, the path is relative to the
+// remote home directory unless it starts with a second slash.
+func DialSSH(rootURL string, sshCommand string, serverCommand string) (*RemoteFS, error) {
+	parsed, err := url.Parse(rootURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "ssh" || parsed.Hostname() == "" {
+		return nil, fmt.Errorf("invalid ssh root %q, expected ssh://[user@]host[:port]/path", rootURL)
+	}
+	remotePath := strings.TrimPrefix(parsed.Path, "/")
+	if remotePath == "" {
+		remotePath = "."
+	}
+
+	args := strings.Fields(sshCommand)
+	if len(args) == 0 {
+		args = []string{"ssh"}
+	}
+	if port := parsed.Port(); port != "" {
+		args = append(args, "-p", port)
+	}
+	destination := parsed.Hostname()
+	if parsed.User != nil {
+		destination = parsed.User.Username() + "@" + destination
+	}
+	if strings.TrimSpace(serverCommand) == "" {
+		serverCommand = "zync"
+	}
+	args = append(args, destination, serverCommand+" server "+shellQuote(remotePath))
+
+	cmd := exec.Command(args[0], args[1:]...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start %s: %w", args[0], err)
+	}
+	remote, err := NewRemoteFS(stdout, stdin)
+	if err != nil {
+		stdin.Close()
+		_ = cmd.Wait()
+		return nil, fmt.Errorf("connect to %s: %w: %s", parsed.Host, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	remote.close = func() error {
+		stdin.Close()
+		if err := cmd.Wait(); err != nil {
+			return fmt.Errorf("remote server: %w: %s", err, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return nil
+	}
+	return remote, nil
+}
+
+// shellQuote quotes value for the POSIX shell that runs the remote command.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// Close ends the session and waits for the server to exit.
+func (r *RemoteFS) Close() error {
+	if r.close == nil {
+		return nil
+	}
+	return r.close()
+}
+
+func (r *RemoteFS) call(request remoteRequest) (remoteResponse, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if err := writeFrame(r.writer, request); err != nil {
+		return remoteResponse{}, fmt.Errorf("remote %s: %w", request.Op, err)
+	}
+	var response remoteResponse
+	if err := readFrame(r.reader, &response); err != nil {
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return remoteResponse{}, fmt.Errorf("remote %s: %w", request.Op, err)
+	}
+	if response.Error != "" {
+		return response, &remoteError{message: response.Error, kind: remoteErrorKind(response.Code)}
+	}
+	return response, nil
+}
+
+// Stat returns information about the entry at name, following links.
+func (r *RemoteFS) Stat(name string) (fs.FileInfo, error) {
+	response, err := r.call(remoteRequest{Op: "stat", Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{info: *response.Info}, nil
+}
+
+// Lstat returns information about the entry at name.
+func (r *RemoteFS) Lstat(name string) (fs.FileInfo, error) {
+	response, err := r.call(remoteRequest{Op: "lstat", Name: name})
+	if err != nil {
+		return nil, err
+	}
+	return remoteFileInfo{info: *response.Info}, nil
+}
+
+// ReadDir lists the directory at name sorted by file name.
+func (r *RemoteFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	response, err := r.call(remoteRequest{Op: "readdir", Name: name})
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, 0, len(response.Entries))
+	for _, entry := range response.Entries {
+		entries = append(entries, fs.FileInfoToDirEntry(remoteFileInfo{info: entry}))
+	}
+	return entries, nil
+}
+
+// WalkDir lists the whole tree at name in one request and walks the listing.
+func (r *RemoteFS) WalkDir(name string, fn fs.WalkDirFunc) error {
+	response, err := r.call(remoteRequest{Op: "walk", Name: name})
+	if err != nil {
+		err = fn(name, nil, err)
+		if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+			return nil
+		}
+		return err
+	}
+	skipped := ""
+	for _, entry := range response.Entries {
+		if skipped != "" && isBelow(entry.Name, skipped) {
+			continue
+		}
+		skipped = ""
+		d := fs.FileInfoToDirEntry(remoteFileInfo{info: entry})
+		if err := fn(entry.Name, d, nil); err != nil {
+			switch {
+			case errors.Is(err, fs.SkipAll):
+				return nil
+			case errors.Is(err, fs.SkipDir) && d.IsDir():
+				skipped = entry.Name
+			case errors.Is(err, fs.SkipDir):
+				skipped = path.Dir(entry.Name)
+			default:
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ReadFile transfers the content of the file at name.
+func (r *RemoteFS) ReadFile(name string) ([]byte, error) {
+	response, err := r.call(remoteRequest{Op: "read", Name: name})
+	if err != nil {
+		return nil, err
+	}
+	if response.Data == nil {
+		return []byte{}, nil
+	}
+	return response.Data, nil
+}
+
+// Hash returns the digest of the file at name, computed by the server.
+func (r *RemoteFS) Hash(name string) (string, error) {
+	response, err := r.call(remoteRequest{Op: "hash", Name: name})
+	if err != nil {
+		return "", err
+	}
+	return response.Hash, nil
+}
+
+// WriteFile replaces the content of the file at name, creating it with perm.
+func (r *RemoteFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	_, err := r.call(remoteRequest{Op: "write", Name: name, Data: data, Mode: uint32(perm)})
+	return err
+}
+
+// Mkdir creates the directory name.
+func (r *RemoteFS) Mkdir(name string, perm fs.FileMode) error {
+	_, err := r.call(remoteRequest{Op: "mkdir", Name: name, Mode: uint32(perm)})
+	return err
+}
+
+// MkdirAll creates the directory name along with any missing parents.
+func (r *RemoteFS) MkdirAll(name string, perm fs.FileMode) error {
+	_, err := r.call(remoteRequest{Op: "mkdirall", Name: name, Mode: uint32(perm)})
+	return err
+}
+
+// Rename moves oldName to newName.
+func (r *RemoteFS) Rename(oldName string, newName string) error {
+	_, err := r.call(remoteRequest{Op: "rename", Name: oldName, NewName: newName})
+	return err
+}
+
+// Remove removes the file, link or empty directory at name.
+func (r *RemoteFS) Remove(name string) error {
+	_, err := r.call(remoteRequest{Op: "remove", Name: name})
+	return err
+}
+
+// RemoveAll removes name and everything below it.
+func (r *RemoteFS) RemoveAll(name string) error {
+	_, err := r.call(remoteRequest{Op: "removeall", Name: name})
+	return err
+}
+
+// Chmod changes the permission bits of name.
+func (r *RemoteFS) Chmod(name string, mode fs.FileMode) error {
+	_, err := r.call(remoteRequest{Op: "chmod", Name: name, Mode: uint32(mode)})
+	return err
+}
+
+// Symlink creates name as a symbolic link to target.
+func (r *RemoteFS) Symlink(target string, name string) error {
+	_, err := r.call(remoteRequest{Op: "symlink", Name: name, Target: target})
+	return err
+}
+
+// Readlink returns the target of the symbolic link name.
+func (r *RemoteFS) Readlink(name string) (string, error) {
+	response, err := r.call(remoteRequest{Op: "readlink", Name: name})
+	if err != nil {
+		return "", err
+	}
+	return response.Target, nil
+}
+
+func (r *RemoteFS) resolve(name string) (string, bool, error) {
+	response, err := r.call(remoteRequest{Op: "resolve", Name: name})
+	if err != nil {
+		return "", false, err
+	}
+	return response.Target, response.Inside, nil
+}
@@ -0,0 +1,202 @@
+package sync_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	stdsync "sync"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+// countingFS counts the file contents read from the wrapped replica, leaving
+// out the reads needed to hash them.
+type countingFS struct {
+	*syncpkg.MemoryFS
+	mutex stdsync.Mutex
+	reads int
+}
+
+func (c *countingFS) ReadFile(name string) ([]byte, error) {
+	c.mutex.Lock()
+	c.reads++
+	c.mutex.Unlock()
+	return c.MemoryFS.ReadFile(name)
+}
+
+func (c *countingFS) Hash(name string) (string, error) {
+	content, err := c.MemoryFS.ReadFile(name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func (c *countingFS) readCount() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.reads
+}
+
+// serveOverPipes connects a RemoteFS to ServeReplica for served.
+func serveOverPipes(t *testing.T, served syncpkg.ReplicaFS) *syncpkg.RemoteFS {
+	t.Helper()
+	requestReader, requestWriter := io.Pipe()
+	responseReader, responseWriter := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		err := syncpkg.ServeReplica(served, requestReader, responseWriter)
+		responseWriter.Close()
+		done <- err
+	}()
+	remote, err := syncpkg.NewRemoteFS(responseReader, requestWriter)
+	if err != nil {
+		t.Fatalf("connect: %v", err)
+	}
+	t.Cleanup(func() {
+		requestWriter.Close()
+		if err := <-done; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+	})
+	return remote
+}
+
+func TestRemoteReplica(t *testing.T) {
+	served := &countingFS{MemoryFS: syncpkg.NewMemoryFS()}
+	remote := serveOverPipes(t, served)
+	rootA := t.TempDir()
+	opts := defaultOptions(rootA, "ssh://host/notes", t.TempDir())
+	opts.ReplicaB = remote
+
+	writeFile(t, filepath.Join(rootA, "local.md"), "from A")
+	writeReplicaFile(t, served, "docs/remote.md", "from B")
+	if err := served.Symlink("remote.md", "docs/link.md"); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("initial sync: %v", err)
+	}
+	if got := readReplicaFile(t, served, "local.md"); got != "from A" {
+		t.Fatalf("remote has %q", got)
+	}
+	if got := readFile(t, filepath.Join(rootA, "docs", "remote.md")); got != "from B" {
+		t.Fatalf("local has %q", got)
+	}
+	if target, err := os.Readlink(filepath.Join(rootA, "docs", "link.md")); err != nil || target != "remote.md" {
+		t.Fatalf("link = %q, %v", target, err)
+	}
+
+	before := served.readCount()
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("unchanged sync: %v", err)
+	}
+	if reads := served.readCount() - before; reads != 0 {
+		t.Fatalf("unchanged files were transferred %d times", reads)
+	}
+
+	writeFile(t, filepath.Join(rootA, "local.md"), "changed on A")
+	before = served.readCount()
+	res, err := syncpkg.RunSync(opts, zap.NewNop())
+	if err != nil {
+		t.Fatalf("update sync: %v", err)
+	}
+	if reads := served.readCount() - before; reads != 0 {
+		t.Fatalf("remote content was transferred %d times for a local change", reads)
+	}
+	if got := readReplicaFile(t, served, "local.md"); got != "changed on A" {
+		t.Fatalf("remote has %q after update", got)
+	}
+	if res.ChangedFileCount != 1 {
+		t.Fatalf("changed %d files, want 1", res.ChangedFileCount)
+	}
+}
+
+func TestRemoteFSErrors(t *testing.T) {
+	remote := serveOverPipes(t, syncpkg.NewMemoryFS())
+	if _, err := remote.Stat("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat missing = %v", err)
+	}
+	writeReplicaFile(t, remote, "dir/file.txt", "x")
+	if err := remote.Mkdir("dir", 0o755); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("mkdir existing = %v", err)
+	}
+	hash, err := remote.Hash("dir/file.txt")
+	if err != nil || hash != "2d711642b726b04401627ca9fbac32f5c8530fb1903cc4db02258717921a4881" {
+		t.Fatalf("hash = %q, %v", hash, err)
+	}
+
+	var walked []string
+	err = remote.WalkDir(".", func(name string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		walked = append(walked, name)
+		if name == "dir" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	if err != nil || strings.Join(walked, ",") != ".,dir" {
+		t.Fatalf("walked %v, %v", walked, err)
+	}
+}
+
+func TestDialSSHCommand(t *testing.T) {
+	dir := t.TempDir()
+	argsPath := filepath.Join(dir, "args")
+	script := filepath.Join(dir, "fake-ssh")
+	content := "#!/bin/sh\necho \"$@\" > " + argsPath + "\necho 'permission denied' >&2\nexit 255\n"
+	if err := os.WriteFile(script, []byte(content), 0o755); err != nil {
+		t.Fatalf("write script: %v", err)
+	}
+
+	_, err := syncpkg.DialSSH("ssh://me@example.org:2222/it's/notes", script+" -q", "bin/zync")
+	if err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Fatalf("expected the ssh error output, got %v", err)
+	}
+	want := "-q -p 2222 me@example.org bin/zync server 'it'\\''s/notes'\n"
+	if got := readFile(t, argsPath); got != want {
+		t.Fatalf("ssh ran with %q, want %q", got, want)
+	}
+}
+
+func TestServeReplicaRejectsEscapingNames(t *testing.T) {
+	parent := t.TempDir()
+	served := filepath.Join(parent, "served")
+	writeFile(t, filepath.Join(served, "inside.txt"), "in")
+	writeFile(t, filepath.Join(parent, "secret.txt"), "secret")
+	remote := serveOverPipes(t, syncpkg.NewLocalFS(served))
+
+	if _, err := remote.ReadFile("../secret.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("read outside root = %v", err)
+	}
+	if err := remote.WriteFile("../written.txt", []byte("x"), 0o644); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("write outside root = %v", err)
+	}
+	if err := remote.Rename("inside.txt", "../moved.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("rename outside root = %v", err)
+	}
+	if err := remote.RemoveAll(".."); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("removeall of parent = %v", err)
+	}
+	for _, name := range []string{"written.txt", "moved.txt"} {
+		if _, err := os.Lstat(filepath.Join(parent, name)); !os.IsNotExist(err) {
+			t.Fatalf("%s was created outside the root", name)
+		}
+	}
+	if got := readFile(t, filepath.Join(parent, "secret.txt")); got != "secret" {
+		t.Fatalf("secret = %q", got)
+	}
+	if got, err := remote.ReadFile("inside.txt"); err != nil || string(got) != "in" {
+		t.Fatalf("read inside root = %q, %v", got, err)
+	}
+}
@@ -0,0 +1,342 @@
+package sync
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ReplicaFS is the file system holding one synchronized root. Names are slash
+// separated and relative to the root, which is named ".". Stat, ReadDir,
+// ReadFile, WriteFile and Chmod follow symbolic links; the other methods act
+// on links themselves. Errors for missing entries match fs.ErrNotExist.
+type ReplicaFS interface {
+	Stat(name string) (fs.FileInfo, error)
+	Lstat(name string) (fs.FileInfo, error)
+	ReadDir(name string) ([]fs.DirEntry, error)
+	// WalkDir walks the tree at name like filepath.WalkDir, passing names
+	// relative to the root to fn and not following links.
+	WalkDir(name string, fn fs.WalkDirFunc) error
+	ReadFile(name string) ([]byte, error)
+	WriteFile(name string, data []byte, perm fs.FileMode) error
+	Mkdir(name string, perm fs.FileMode) error
+	MkdirAll(name string, perm fs.FileMode) error
+	Rename(oldName string, newName string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	Chmod(name string, mode fs.FileMode) error
+	Symlink(target string, name string) error
+	Readlink(name string) (string, error)
+}
+
+// ownerSetter is implemented by replicas that can change the owner of an
+// entry.
+type ownerSetter interface {
+	Lchown(name string, uid int, gid int) error
+}
+
+// symlinkStorer is implemented by replicas that may be unable to store
+// symbolic links. Paths that are links on the other side are skipped.
+type symlinkStorer interface {
+	storesSymlinks() bool
+}
+
+func storesSymlinks(fsys ReplicaFS) bool {
+	storer, ok := fsys.(symlinkStorer)
+	return !ok || storer.storesSymlinks()
+}
+
+// replicaFlusher is implemented by replicas that hold writes until they are
+// flushed. Runs flush them before recording the new state.
+type replicaFlusher interface {
+	flush() error
+}
+
+func flushReplica(fsys ReplicaFS) error {
+	if flusher, ok := fsys.(replicaFlusher); ok {
+		return flusher.flush()
+	}
+	return nil
+}
+
+// readOnlyReplica is implemented by replicas that may discard writes. Runs
+// against them record no state, since the state would describe content the
+// replica does not keep.
+type readOnlyReplica interface {
+	readOnly() bool
+}
+
+func isReadOnly(fsys ReplicaFS) bool {
+	replica, ok := fsys.(readOnlyReplica)
+	return ok && replica.readOnly()
+}
+
+// WalkReplica implements ReplicaFS.WalkDir with ReadDir and Lstat, for
+// replicas that have no faster way to walk a tree.
+func WalkReplica(fsys ReplicaFS, name string, fn fs.WalkDirFunc) error {
+	info, err := fsys.Lstat(name)
+	if err != nil {
+		err = fn(name, nil, err)
+	} else {
+		err = walkReplicaDir(fsys, name, fs.FileInfoToDirEntry(info), fn)
+	}
+	if errors.Is(err, fs.SkipDir) || errors.Is(err, fs.SkipAll) {
+		return nil
+	}
+	return err
+}
+
+func walkReplicaDir(fsys ReplicaFS, name string, entry fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, entry, nil); err != nil || !entry.IsDir() {
+		if errors.Is(err, fs.SkipDir) && entry.IsDir() {
+			err = nil
+		}
+		return err
+	}
+	entries, err := fsys.ReadDir(name)
+	if err != nil {
+		err = fn(name, entry, err)
+		if err != nil {
+			if errors.Is(err, fs.SkipDir) && entry.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+	for _, child := range entries {
+		if err := walkReplicaDir(fsys, path.Join(name, child.Name()), child, fn); err != nil {
+			if errors.Is(err, fs.SkipDir) {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// pathResolver is implemented by replicas that resolve links themselves
+// rather than one Lstat and Readlink at a time.
+type pathResolver interface {
+	resolve(name string) (string, bool, error)
+}
+
+// resolveReplicaPath resolves every symbolic link in name, including dangling
+// links and components that do not exist yet, and reports whether the result
+// stays inside the replica.
+func resolveReplicaPath(fsys ReplicaFS, name string) (string, bool, error) {
+	if resolver, ok := fsys.(pathResolver); ok {
+		return resolver.resolve(name)
+	}
+	return resolveLinks(fsys, name)
+}
+
+// resolveLinks resolves name component by component through Lstat and
+// Readlink. Absolute link targets leave the replica.
+func resolveLinks(fsys ReplicaFS, name string) (string, bool, error) {
+	pending := strings.Split(name, "/")
+	var resolved []string
+	hops := 0
+	for len(pending) > 0 {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			if len(resolved) == 0 {
+				return "", false, nil
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+		candidate := path.Join(path.Join(resolved...), part)
+		info, err := fsys.Lstat(candidate)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", false, err
+		}
+		if err != nil || info.Mode()&fs.ModeSymlink == 0 {
+			resolved = append(resolved, part)
+			continue
+		}
+		hops++
+		if hops > maxSymlinkHops {
+			return "", false, errSymlinkLoop
+		}
+		target, err := fsys.Readlink(candidate)
+		if err != nil {
+			return "", false, err
+		}
+		if path.IsAbs(target) {
+			return "", false, nil
+		}
+		pending = append(strings.Split(target, "/"), pending...)
+	}
+	if len(resolved) == 0 {
+		return ".", true, nil
+	}
+	return path.Join(resolved...), true, nil
+}
+
+// withinReplica reports whether name, with all links resolved, stays inside
+// the replica.
+func withinReplica(fsys ReplicaFS, name string) (bool, error) {
+	_, inside, err := resolveReplicaPath(fsys, name)
+	return inside, err
+}
+
+// LocalFS is a ReplicaFS rooted at a directory of the local file system.
+type LocalFS struct {
+	root string
+}
+
+// NewLocalFS returns a replica for the directory root.
+func NewLocalFS(root string) *LocalFS {
+	return &LocalFS{root: root}
+}
+
+// Root returns the directory the replica is rooted at.
+func (l *LocalFS) Root() string {
+	return l.root
+}
+
+func (l *LocalFS) path(name string) string {
+	return filepath.Join(l.root, filepath.FromSlash(name))
+}
+
+// Stat returns information about the entry at name, following links.
+func (l *LocalFS) Stat(name string) (fs.FileInfo, error) {
+	return os.Stat(l.path(name))
+}
+
+// Lstat returns information about the entry at name.
+func (l *LocalFS) Lstat(name string) (fs.FileInfo, error) {
+	return os.Lstat(l.path(name))
+}
+
+// ReadDir lists the directory at name sorted by file name.
+func (l *LocalFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(l.path(name))
+}
+
+// WalkDir walks the tree at name with filepath.WalkDir.
+func (l *LocalFS) WalkDir(name string, fn fs.WalkDirFunc) error {
+	return filepath.WalkDir(l.path(name), func(currentPath string, d fs.DirEntry, walkErr error) error {
+		rel, err := filepath.Rel(l.root, currentPath)
+		if err != nil {
+			return err
+		}
+		return fn(filepath.ToSlash(rel), d, walkErr)
+	})
+}
+
+// ReadFile returns the content of the file at name.
+func (l *LocalFS) ReadFile(name string) ([]byte, error) {
+	return os.ReadFile(l.path(name))
+}
+
+// WriteFile replaces the content of the file at name, creating it with perm.
+func (l *LocalFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	return os.WriteFile(l.path(name), data, perm)
+}
+
+// Mkdir creates the directory name.
+func (l *LocalFS) Mkdir(name string, perm fs.FileMode) error {
+	return os.Mkdir(l.path(name), perm)
+}
+
+// MkdirAll creates the directory name along with any missing parents.
+func (l *LocalFS) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(l.path(name), perm)
+}
+
+// Rename moves oldName to newName.
+func (l *LocalFS) Rename(oldName string, newName string) error {
+	return os.Rename(l.path(oldName), l.path(newName))
+}
+
+// Remove removes the file, link or empty directory at name.
+func (l *LocalFS) Remove(name string) error {
+	return os.Remove(l.path(name))
+}
+
+// RemoveAll removes name and everything below it.
+func (l *LocalFS) RemoveAll(name string) error {
+	return os.RemoveAll(l.path(name))
+}
+
+// Chmod changes the permission bits of name.
+func (l *LocalFS) Chmod(name string, mode fs.FileMode) error {
+	return os.Chmod(l.path(name), mode)
+}
+
+// Symlink creates name as a symbolic link to target.
+func (l *LocalFS) Symlink(target string, name string) error {
+	return os.Symlink(target, l.path(name))
+}
+
+// Readlink returns the target of the symbolic link name.
+func (l *LocalFS) Readlink(name string) (string, error) {
+	return os.Readlink(l.path(name))
+}
+
+// Lchown changes the owner of name without following links.
+func (l *LocalFS) Lchown(name string, uid int, gid int) error {
+	return os.Lchown(l.path(name), uid, gid)
+}
+
+func (l *LocalFS) resolve(name string) (string, bool, error) {
+	realRoot, err := filepath.EvalSymlinks(l.root)
+	if err != nil {
+		return "", false, err
+	}
+	realPath, err := resolvePath(l.path(name))
+	if err != nil {
+		return "", false, err
+	}
+	if !pathContains(realRoot, realPath) {
+		return "", false, nil
+	}
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil {
+		return "", false, err
+	}
+	return filepath.ToSlash(rel), true, nil
+}
+
+// localPath returns the path of name on the local file system for replicas
+// that have one.
+func localPath(fsys ReplicaFS, name string) (string, bool) {
+	local, ok := fsys.(*LocalFS)
+	if !ok {
+		return "", false
+	}
+	return local.path(name), true
+}
+
+func sortDirEntries(entries []fs.DirEntry) {
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+}
+
+// withReplicas opens the roots given only by path as local replicas.
+func withReplicas(options Options) Options {
+	if options.ReplicaA == nil {
+		options.ReplicaA = NewLocalFS(options.RootAPath)
+	}
+	if options.ReplicaB == nil {
+		options.ReplicaB = NewLocalFS(options.RootBPath)
+	}
+	return options
+}
+
+// replicaFor returns the replica of root B when sideB is set and of root A
+// otherwise.
+func replicaFor(options Options, sideB bool) ReplicaFS {
+	if sideB {
+		return options.ReplicaB
+	}
+	return options.ReplicaA
+}
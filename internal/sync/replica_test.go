@@ -0,0 +1,187 @@
+package sync_test
+
+import (
+	"errors"
+	"io/fs"
+	"os/exec"
+	"path"
+	"reflect"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+func writeReplicaFile(t *testing.T, fsys syncpkg.ReplicaFS, name string, content string) {
+	t.Helper()
+	if err := fsys.MkdirAll(path.Dir(name), 0o755); err != nil {
+		t.Fatalf("mkdir for %s: %v", name, err)
+	}
+	if err := fsys.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatalf("write %s: %v", name, err)
+	}
+}
+
+func readReplicaFile(t *testing.T, fsys syncpkg.ReplicaFS, name string) string {
+	t.Helper()
+	data, err := fsys.ReadFile(name)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return string(data)
+}
+
+func TestMemoryReplicas(t *testing.T) {
+	cases := []struct {
+		name string
+		run  func(t *testing.T, opts syncpkg.Options, replicaA *syncpkg.MemoryFS, replicaB *syncpkg.MemoryFS)
+	}{
+		{
+			name: "CreatesFilesAndDirectories",
+			run: func(t *testing.T, opts syncpkg.Options, replicaA *syncpkg.MemoryFS, replicaB *syncpkg.MemoryFS) {
+				writeReplicaFile(t, replicaA, "notes/a.md", "from A")
+				writeReplicaFile(t, replicaB, "b.md", "from B")
+				if err := replicaB.MkdirAll("empty/dir", 0o755); err != nil {
+					t.Fatalf("mkdir: %v", err)
+				}
+				if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+					t.Fatalf("sync: %v", err)
+				}
+				if got := readReplicaFile(t, replicaB, "notes/a.md"); got != "from A" {
+					t.Fatalf("B has %q", got)
+				}
+				if got := readReplicaFile(t, replicaA, "b.md"); got != "from B" {
+					t.Fatalf("A has %q", got)
+				}
+				if info, statErr := replicaA.Stat("empty/dir"); statErr != nil || !info.IsDir() {
+					t.Fatalf("directory not created on A: %v", statErr)
+				}
+			},
+		},
+		{
+			name: "MergesBothSides",
+			run: func(t *testing.T, opts syncpkg.Options, replicaA *syncpkg.MemoryFS, replicaB *syncpkg.MemoryFS) {
+				if _, err := exec.LookPath("diff3"); err != nil {
+					t.Skip("diff3 is required")
+				}
+				writeReplicaFile(t, replicaA, "doc.txt", "one\ntwo\nthree\n")
+				if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+					t.Fatalf("initial sync: %v", err)
+				}
+				writeReplicaFile(t, replicaA, "doc.txt", "ONE\ntwo\nthree\n")
+				writeReplicaFile(t, replicaB, "doc.txt", "one\ntwo\nTHREE\n")
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("merge sync: %v", err)
+				}
+				if res.ActionCounters["merge(3way)"] != 1 {
+					t.Fatalf("expected a 3-way merge, got %v", res.ActionCounters)
+				}
+				for _, replica := range []*syncpkg.MemoryFS{replicaA, replicaB} {
+					if got := readReplicaFile(t, replica, "doc.txt"); got != "ONE\ntwo\nTHREE\n" {
+						t.Fatalf("merged content = %q", got)
+					}
+				}
+			},
+		},
+		{
+			name: "PropagatesDirectoryDeletion",
+			run: func(t *testing.T, opts syncpkg.Options, replicaA *syncpkg.MemoryFS, replicaB *syncpkg.MemoryFS) {
+				writeReplicaFile(t, replicaA, "old/file.txt", "x")
+				writeReplicaFile(t, replicaA, "keep.txt", "k")
+				if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+					t.Fatalf("initial sync: %v", err)
+				}
+				if err := replicaB.RemoveAll("old"); err != nil {
+					t.Fatalf("remove: %v", err)
+				}
+				if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+					t.Fatalf("sync: %v", err)
+				}
+				if _, err := replicaA.Lstat("old"); !errors.Is(err, fs.ErrNotExist) {
+					t.Fatalf("expected old to be removed from A, got %v", err)
+				}
+			},
+		},
+		{
+			name: "SymlinksStayInside",
+			run: func(t *testing.T, opts syncpkg.Options, replicaA *syncpkg.MemoryFS, replicaB *syncpkg.MemoryFS) {
+				writeReplicaFile(t, replicaA, "target.txt", "t")
+				if err := replicaA.Symlink("target.txt", "inside"); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+				if err := replicaB.Symlink("..", "escape"); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+				writeReplicaFile(t, replicaA, "escape/file.txt", "should not land outside")
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("sync: %v", err)
+				}
+				if target, linkErr := replicaB.Readlink("inside"); linkErr != nil || target != "target.txt" {
+					t.Fatalf("link on B = %q, %v", target, linkErr)
+				}
+				if res.ActionCounters["skip(escape)"] == 0 && res.ActionCounters["conflict(type)"] == 0 {
+					t.Fatalf("expected the escaping path to be refused, got %v", res.ActionCounters)
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			replicaA, replicaB := syncpkg.NewMemoryFS(), syncpkg.NewMemoryFS()
+			opts := defaultOptions("memory-a", "memory-b", t.TempDir())
+			opts.ReplicaA = replicaA
+			opts.ReplicaB = replicaB
+			tc.run(t, opts, replicaA, replicaB)
+		})
+	}
+}
+
+func TestMemoryFS(t *testing.T) {
+	fsys := syncpkg.NewMemoryFS()
+	writeReplicaFile(t, fsys, "dir/a.txt", "a")
+	writeReplicaFile(t, fsys, "dir/sub/b.txt", "b")
+	if err := fsys.Symlink("dir", "link"); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+
+	if got := readReplicaFile(t, fsys, "link/sub/b.txt"); got != "b" {
+		t.Fatalf("read through link = %q", got)
+	}
+	if info, err := fsys.Lstat("link"); err != nil || info.Mode()&fs.ModeSymlink == 0 {
+		t.Fatalf("lstat link: %v %v", info, err)
+	}
+	if err := fsys.Remove("dir"); err == nil {
+		t.Fatal("expected removing a non-empty directory to fail")
+	}
+	if err := fsys.Rename("dir", "moved"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if _, err := fsys.Stat("link"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected dangling link, got %v", err)
+	}
+	if err := fsys.Chmod("moved/a.txt", 0o600); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	if info, _ := fsys.Stat("moved/a.txt"); info.Mode().Perm() != 0o600 {
+		t.Fatalf("mode = %v", info.Mode())
+	}
+
+	var walked []string
+	err := fsys.WalkDir(".", func(name string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		walked = append(walked, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("walk: %v", err)
+	}
+	want := []string{".", "link", "moved", "moved/a.txt", "moved/sub", "moved/sub/b.txt"}
+	if !reflect.DeepEqual(walked, want) {
+		t.Fatalf("walked %v, want %v", walked, want)
+	}
+}
@@ -0,0 +1,266 @@
+package sync
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Resolutions a conflict rule can apply.
+const (
+	ResolveOurs   = "ours"
+	ResolveTheirs = "theirs"
+	ResolveUnion  = "union"
+)
+
+// Reasons recorded for automatically resolved conflicts.
+const (
+	ResolvedWhitespace = "whitespace"
+	ResolvedPrefix     = "prefix"
+	ResolvedSuperset   = "superset"
+	ResolvedRule       = "rule"
+)
+
+// ConflictRule resolves conflicting regions of files matching Pattern, or of
+// every file when it is empty, in which all lines on both sides match the
+// regular expression Match. Resolution is ours, theirs or union.
+type ConflictRule struct {
+	Pattern    string
+	Match      string
+	Resolution string
+}
+
+// AutoResolution records a conflicting region that was resolved without
+// leaving markers. Line is the first line of the region in the merged file.
+type AutoResolution struct {
+	Path   string `json:"path"`
+	Line   int    `json:"line"`
+	Reason string `json:"reason"`
+	Rule   string `json:"rule,omitempty"`
+}
+
+func validateConflictRules(rules []ConflictRule) error {
+	_, err := compileConflictRules(rules)
+	return err
+}
+
+type compiledConflictRule struct {
+	ConflictRule
+	match *regexp.Regexp
+}
+
+func compileConflictRules(rules []ConflictRule) ([]compiledConflictRule, error) {
+	compiled := make([]compiledConflictRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Pattern != "" {
+			if err := validatePathPattern(rule.Pattern); err != nil {
+				return nil, err
+			}
+		}
+		switch rule.Resolution {
+		case ResolveOurs, ResolveTheirs, ResolveUnion:
+		default:
+			return nil, fmt.Errorf("unknown conflict resolution %q for %q", rule.Resolution, rule.Match)
+		}
+		match, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid conflict rule %q: %w", rule.Match, err)
+		}
+		compiled = append(compiled, compiledConflictRule{ConflictRule: rule, match: match})
+	}
+	return compiled, nil
+}
+
+// conflictBlock is one region between conflict markers.
+type conflictBlock struct {
+	a []string
+	b []string
+}
+
+// resolveMergeConflicts runs the automatic resolution pass over merged when
+// options enable it and logs every region it resolves.
+func resolveMergeConflicts(options Options, relativePath string, merged []byte, logger *zap.Logger) ([]byte, []AutoResolution) {
+	if !options.AutoResolve && len(options.ConflictRules) == 0 {
+		return merged, nil
+	}
+	rules, _ := compileConflictRules(options.ConflictRules)
+	resolved, resolutions := autoResolveConflicts(relativePath, merged, rules, options.AutoResolve)
+	if logger != nil {
+		for _, resolution := range resolutions {
+			logger.Info("conflict resolved automatically", zap.String("path", resolution.Path), zap.Int("line", resolution.Line), zap.String("reason", resolution.Reason), zap.String("rule", resolution.Rule))
+		}
+	}
+	return resolved, resolutions
+}
+
+// autoResolveConflicts rewrites the conflict regions of merged that a rule
+// matching relativePath covers and, with builtin set, those that differ only
+// in white space or where one side extends the other. Other regions keep
+// their markers.
+func autoResolveConflicts(relativePath string, merged []byte, rules []compiledConflictRule, builtin bool) ([]byte, []AutoResolution) {
+	if !strings.Contains(string(merged), "<<<<<<<") {
+		return merged, nil
+	}
+	var applicable []compiledConflictRule
+	for _, rule := range rules {
+		if rule.Pattern == "" || matchPathPattern(rule.Pattern, relativePath) {
+			applicable = append(applicable, rule)
+		}
+	}
+
+	lines := splitLines(string(merged))
+	var out []string
+	var resolutions []AutoResolution
+	for index := 0; index < len(lines); index++ {
+		if !isConflictMarker(lines[index], "<<<<<<<") {
+			out = append(out, lines[index])
+			continue
+		}
+		block, end, ok := parseConflictBlock(lines, index)
+		if !ok {
+			out = append(out, lines[index])
+			continue
+		}
+		resolved, resolution, ok := resolveConflictBlock(block, applicable, builtin)
+		if !ok {
+			out = append(out, lines[index:end+1]...)
+			index = end
+			continue
+		}
+		resolution.Path = relativePath
+		resolution.Line = len(out) + 1
+		resolutions = append(resolutions, resolution)
+		out = append(out, resolved...)
+		index = end
+	}
+	return []byte(strings.Join(out, "")), resolutions
+}
+
+func isConflictMarker(line string, marker string) bool {
+	rest, ok := strings.CutPrefix(strings.TrimRight(line, "\r\n"), marker)
+	return ok && (rest == "" || rest[0] == ' ')
+}
+
+// parseConflictBlock reads the region starting at lines[start], skipping the
+// ancestor section diff3 writes, and returns the index of its closing marker.
+func parseConflictBlock(lines []string, start int) (conflictBlock, int, bool) {
+	var block conflictBlock
+	section := &block.a
+	for index := start + 1; index < len(lines); index++ {
+		line := lines[index]
+		switch {
+		case isConflictMarker(line, "|||||||") && section == &block.a:
+			section = nil
+		case isConflictMarker(line, "=======") && section != &block.b:
+			section = &block.b
+		case isConflictMarker(line, ">>>>>>>") && section == &block.b:
+			return block, index, true
+		case isConflictMarker(line, "<<<<<<<"):
+			return conflictBlock{}, 0, false
+		case section != nil:
+			*section = append(*section, line)
+		}
+	}
+	return conflictBlock{}, 0, false
+}
+
+func resolveConflictBlock(block conflictBlock, rules []compiledConflictRule, builtin bool) ([]string, AutoResolution, bool) {
+	for index := len(rules) - 1; index >= 0; index-- {
+		rule := rules[index]
+		if !allLinesMatch(rule.match, block.a) || !allLinesMatch(rule.match, block.b) {
+			continue
+		}
+		resolution := AutoResolution{Reason: ResolvedRule, Rule: rule.Match}
+		switch rule.Resolution {
+		case ResolveOurs:
+			return block.a, resolution, true
+		case ResolveTheirs:
+			return block.b, resolution, true
+		default:
+			return terminateLines(mergeUnionLines(block.a, block.b)), resolution, true
+		}
+	}
+
+	if !builtin {
+		return nil, AutoResolution{}, false
+	}
+	if joinedWords(block.a) == joinedWords(block.b) {
+		return block.a, AutoResolution{Reason: ResolvedWhitespace}, true
+	}
+	shorter, longer := block.a, block.b
+	if len(shorter) > len(longer) {
+		shorter, longer = longer, shorter
+	}
+	if len(shorter) == 0 {
+		return nil, AutoResolution{}, false
+	}
+	if sequencesEqual(squashLines(shorter), squashLines(longer[:len(shorter)]), stringsEqual) {
+		return longer, AutoResolution{Reason: ResolvedPrefix}, true
+	}
+	if isSubsequence(squashLines(shorter), squashLines(longer)) {
+		return longer, AutoResolution{Reason: ResolvedSuperset}, true
+	}
+	return nil, AutoResolution{}, false
+}
+
+func allLinesMatch(pattern *regexp.Regexp, lines []string) bool {
+	for _, line := range lines {
+		if !pattern.MatchString(strings.TrimRight(line, "\r\n")) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeUnionLines keeps the lines of a followed by those of b not already
+// present in a.
+func mergeUnionLines(a []string, b []string) []string {
+	seen := map[string]bool{}
+	merged := append([]string(nil), a...)
+	for _, line := range a {
+		seen[strings.TrimRight(line, "\r\n")] = true
+	}
+	for _, line := range b {
+		if !seen[strings.TrimRight(line, "\r\n")] {
+			merged = append(merged, line)
+		}
+	}
+	return merged
+}
+
+// terminateLines ends every line but the last with a newline, so that lines
+// taken from the end of one side can precede lines of the other.
+func terminateLines(lines []string) []string {
+	for index := 0; index+1 < len(lines); index++ {
+		if !strings.HasSuffix(lines[index], "\n") {
+			lines[index] += "\n"
+		}
+	}
+	return lines
+}
+
+// squashLines collapses white space so that lines differing only in
+// formatting compare equal.
+func squashLines(lines []string) []string {
+	squashed := make([]string, len(lines))
+	for index, line := range lines {
+		squashed[index] = strings.Join(strings.Fields(line), " ")
+	}
+	return squashed
+}
+
+func stringsEqual(x string, y string) bool {
+	return x == y
+}
+
+func isSubsequence(shorter []string, longer []string) bool {
+	position := 0
+	for _, line := range longer {
+		if position < len(shorter) && shorter[position] == line {
+			position++
+		}
+	}
+	return position == len(shorter)
+}
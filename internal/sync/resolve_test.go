@@ -0,0 +1,115 @@
+package sync_test
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+func TestAutoResolveConflicts(t *testing.T) {
+	if _, err := exec.LookPath("diff3"); err != nil {
+		t.Skip("diff3 is required")
+	}
+	cases := []struct {
+		name   string
+		rules  []syncpkg.ConflictRule
+		auto   bool
+		base   string
+		sideA  string
+		sideB  string
+		want   string
+		reason string
+	}{
+		{
+			name:   "WhitespaceOnly",
+			auto:   true,
+			base:   "head\nx = 1\ntail\n",
+			sideA:  "head\nx  =  2\ntail\n",
+			sideB:  "head\nx = 2\ntail\n",
+			want:   "head\nx  =  2\ntail\n",
+			reason: syncpkg.ResolvedWhitespace,
+		},
+		{
+			name:   "Prefix",
+			auto:   true,
+			base:   "head\nold\ntail\n",
+			sideA:  "head\nnew\ntail\n",
+			sideB:  "head\nnew\nmore\ntail\n",
+			want:   "head\nnew\nmore\ntail\n",
+			reason: syncpkg.ResolvedPrefix,
+		},
+		{
+			name:   "Superset",
+			auto:   true,
+			base:   "head\nold\ntail\n",
+			sideA:  "head\none\nthree\ntail\n",
+			sideB:  "head\none\ntwo\nthree\ntail\n",
+			want:   "head\none\ntwo\nthree\ntail\n",
+			reason: syncpkg.ResolvedSuperset,
+		},
+		{
+			name:   "Rule",
+			rules:  []syncpkg.ConflictRule{{Pattern: "*.txt", Match: `^version = `, Resolution: syncpkg.ResolveTheirs}},
+			base:   "head\nversion = 1\ntail\n",
+			sideA:  "head\nversion = 2\ntail\n",
+			sideB:  "head\nversion = 3\ntail\n",
+			want:   "head\nversion = 3\ntail\n",
+			reason: syncpkg.ResolvedRule,
+		},
+		{
+			name:  "RuleForOtherPaths",
+			rules: []syncpkg.ConflictRule{{Pattern: "*.cfg", Match: `.`, Resolution: syncpkg.ResolveOurs}},
+			base:  "head\nold\ntail\n",
+			sideA: "head\nnew\ntail\n",
+			sideB: "head\nnew\nmore\ntail\n",
+		},
+		{
+			name:  "RealConflictKeepsMarkers",
+			auto:  true,
+			base:  "head\nold\ntail\n",
+			sideA: "head\nleft\ntail\n",
+			sideB: "head\nright\ntail\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+			opts.AutoResolve = tc.auto
+			opts.ConflictRules = tc.rules
+
+			res := mergeBothChanged(t, opts, "notes.txt", tc.base, tc.sideA, tc.sideB)
+			got := readFile(t, filepath.Join(opts.RootAPath, "notes.txt"))
+			if tc.reason == "" {
+				if len(res.AutoResolutions) != 0 {
+					t.Fatalf("unexpected resolutions %v", res.AutoResolutions)
+				}
+				if got == tc.sideA || got == tc.sideB {
+					t.Fatalf("expected conflict markers, got %q", got)
+				}
+				return
+			}
+			if got != tc.want {
+				t.Fatalf("merged content = %q, want %q", got, tc.want)
+			}
+			if len(res.AutoResolutions) != 1 {
+				t.Fatalf("expected one resolution, got %v", res.AutoResolutions)
+			}
+			resolution := res.AutoResolutions[0]
+			if resolution.Path != "notes.txt" || resolution.Line != 2 || resolution.Reason != tc.reason {
+				t.Fatalf("unexpected resolution %+v", resolution)
+			}
+		})
+	}
+}
+
+func TestConflictRulesRejectUnknownResolution(t *testing.T) {
+	opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+	opts.ConflictRules = []syncpkg.ConflictRule{{Match: ".", Resolution: "newest"}}
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err == nil {
+		t.Fatal("expected an error for an unknown resolution")
+	}
+}
@@ -0,0 +1,74 @@
+package sync
+
+import (
+	"io"
+	"os"
+	"strings"
+)
+
+// RootConfig holds the settings used to reach roots given as URLs.
+type RootConfig struct {
+	// StateDirectory is where replicas keep caches between runs, usually
+	// the state directory of the sync.
+	StateDirectory string
+	// SSHCommand runs a command on a remote host, as "ssh" or
+	// "ssh -i key". It is followed by the host and the command to run.
+	SSHCommand string
+	// RemoteCommand is the zync executable on remote hosts.
+	RemoteCommand string
+	// IdentityFiles are the private keys offered to SFTP servers. When
+	// empty, the default keys in ~/.ssh are tried.
+	IdentityFiles []string
+	// KnownHostsFile verifies the host keys of SFTP servers; it defaults to
+	// ~/.ssh/known_hosts.
+	KnownHostsFile string
+	// SFTPMaxRequests bounds the requests in flight on one SFTP connection.
+	SFTPMaxRequests int
+	// S3Endpoint is the base URL of an S3-compatible service, such as
+	// http://nas:9000 for MinIO. It defaults to AWS in S3Region.
+	S3Endpoint string
+	S3Region   string
+	// S3AccessKeyID, S3SecretAccessKey and S3SessionToken default to the
+	// standard AWS environment variables.
+	S3AccessKeyID     string
+	S3SecretAccessKey string
+	S3SessionToken    string
+	// WebDAVPassword is the password for webdav:// and davs:// roots whose
+	// URL names a user without one.
+	WebDAVPassword string
+	// WriteArchives lets zync rewrite archive roots with the merged tree.
+	// Archives are read-only sources otherwise.
+	WriteArchives bool
+}
+
+// OpenRoot returns the replica for root. ssh:// URLs connect to a zync server
+// on the remote host, sftp:// URLs to an SFTP server, s3:// URLs to a bucket
+// and webdav:// or davs:// URLs to a WebDAV collection. Paths ending in .tar,
+// .tar.gz, .tgz or .zip that are not directories are archives; anything else
+// is a local directory.
+func OpenRoot(root string, config RootConfig) (ReplicaFS, error) {
+	switch {
+	case strings.HasPrefix(root, "ssh://"):
+		return DialSSH(root, config.SSHCommand, config.RemoteCommand)
+	case strings.HasPrefix(root, "sftp://"):
+		return DialSFTP(root, config)
+	case strings.HasPrefix(root, "s3://"):
+		return DialS3(root, config)
+	case strings.HasPrefix(root, "webdav://"), strings.HasPrefix(root, "davs://"):
+		return DialWebDAV(root, config)
+	case archiveFormat(root) != "":
+		if info, err := os.Stat(root); err == nil && info.IsDir() {
+			break
+		}
+		return OpenArchive(root, config.WriteArchives)
+	}
+	return NewLocalFS(root), nil
+}
+
+// CloseReplica releases the connection held by replicas that have one.
+func CloseReplica(fsys ReplicaFS) error {
+	if closer, ok := fsys.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
@@ -0,0 +1,706 @@
+package sync
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	stdsync "sync"
+	"time"
+)
+
+// Object metadata written by zync. The digest lets later runs compare content
+// without downloading it; the link target turns an empty object into a
+// symbolic link.
+const (
+	s3DigestHeader = "X-Amz-Meta-Zync-Sha256"
+	s3LinkHeader   = "X-Amz-Meta-Zync-Link"
+)
+
+// s3Entry is what zync knows about one name of the replica. Directories
+// exist as key prefixes and, when empty, as marker objects ending in "/".
+type s3Entry struct {
+	dir     bool
+	marker  bool
+	size    int64
+	etag    string
+	modTime time.Time
+	// headed is set once the object's metadata has been fetched.
+	headed bool
+	link   string
+	digest string
+}
+
+func (e s3Entry) mode() fs.FileMode {
+	switch {
+	case e.dir:
+		return fs.ModeDir | 0o755
+	case e.link != "":
+		return fs.ModeSymlink | 0o777
+	}
+	return 0o644
+}
+
+type s3FileInfo struct {
+	name  string
+	entry s3Entry
+}
+
+func (i s3FileInfo) Name() string { return i.name }
+func (i s3FileInfo) Size() int64 {
+	if i.entry.link != "" {
+		return int64(len(i.entry.link))
+	}
+	return i.entry.size
+}
+func (i s3FileInfo) Mode() fs.FileMode  { return i.entry.mode() }
+func (i s3FileInfo) ModTime() time.Time { return i.entry.modTime }
+func (i s3FileInfo) IsDir() bool        { return i.entry.dir }
+func (i s3FileInfo) Sys() any           { return nil }
+
+// S3FS is a ReplicaFS kept under a key prefix of an S3-compatible bucket.
+// The bucket is listed once when the replica is opened and the listing is
+// kept up to date with zync's own changes. Writes are conditional on the
+// object being unchanged since it was listed or read, so concurrent updates
+// by other clients are refused rather than lost. Permission bits are not
+// stored; Chmod does nothing.
+type S3FS struct {
+	client  *s3Client
+	prefix  string
+	digests digestCache
+	mutex   stdsync.Mutex
+	entries map[string]*s3Entry
+	// children indexes the names in entries by their parent directory.
+	children map[string]map[string]struct{}
+}
+
+// DialS3 opens rootURL, an s3://bucket/prefix URL, and lists the objects
+// below the prefix. Digests of listed objects are remembered in
+// config.StateDirectory when it is set. Credentials missing from config are read from
+// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN, the region
+// from AWS_REGION.
+func DialS3(rootURL string, config RootConfig) (*S3FS, error) {
+	parsed, err := url.Parse(rootURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "s3" || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid s3 root %q, expected s3://bucket/prefix", rootURL)
+	}
+	region := firstNonEmpty(config.S3Region, os.Getenv("AWS_REGION"), "us-east-1")
+	endpoint, err := url.Parse(firstNonEmpty(config.S3Endpoint, "https://s3."+region+".amazonaws.com"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid s3 endpoint: %w", err)
+	}
+	client := &s3Client{
+		endpoint:     endpoint,
+		bucket:       parsed.Host,
+		region:       region,
+		accessKey:    firstNonEmpty(config.S3AccessKeyID, os.Getenv("AWS_ACCESS_KEY_ID")),
+		secretKey:    firstNonEmpty(config.S3SecretAccessKey, os.Getenv("AWS_SECRET_ACCESS_KEY")),
+		sessionToken: firstNonEmpty(config.S3SessionToken, os.Getenv("AWS_SESSION_TOKEN")),
+		http:         &http.Client{Timeout: 5 * time.Minute},
+		now:          time.Now,
+	}
+	if client.accessKey == "" || client.secretKey == "" {
+		return nil, errors.New("no S3 credentials, set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	prefix := strings.Trim(parsed.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	scope := endpoint.Host + "/" + client.bucket + "/" + prefix
+	replica := &S3FS{client: client, prefix: prefix, digests: newDigestCache(config.StateDirectory, "s3-digests.json", scope)}
+	if err := replica.load(); err != nil {
+		return nil, fmt.Errorf("list %s: %w", rootURL, err)
+	}
+	return replica, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// load builds the index from a listing of every object below the prefix,
+// taking digests from the cache where the ETag still matches.
+func (s *S3FS) load() error {
+	listing, err := s.client.list(s.prefix)
+	if err != nil {
+		return err
+	}
+	cached, err := s.digests.read()
+	if err != nil {
+		return err
+	}
+	s.entries = map[string]*s3Entry{".": {dir: true, marker: true}}
+	s.children = map[string]map[string]struct{}{}
+	for _, object := range listing.Contents {
+		name := strings.TrimPrefix(object.Key, s.prefix)
+		if name == "" {
+			continue
+		}
+		if strings.HasSuffix(name, "/") {
+			name = strings.TrimSuffix(name, "/")
+			s.setEntry(name, &s3Entry{dir: true, marker: true, modTime: object.LastModified})
+		} else {
+			s.setEntry(name, &s3Entry{size: object.Size, etag: object.ETag, modTime: object.LastModified})
+			if remembered, ok := cached[name]; ok && remembered.ETag == object.ETag {
+				s.entries[name].digest = remembered.Digest
+			}
+		}
+		s.addParents(name, object.LastModified)
+	}
+	return nil
+}
+
+// Close remembers the digests of the objects below the prefix for the next
+// run.
+func (s *S3FS) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	digests := map[string]cachedDigest{}
+	for name, current := range s.entries {
+		if !current.dir && current.etag != "" && current.digest != "" {
+			digests[name] = cachedDigest{ETag: current.etag, Digest: current.digest}
+		}
+	}
+	return s.digests.write(digests)
+}
+
+// setEntry records entry for name in the index. The caller holds the lock or
+// has not shared the replica yet.
+func (s *S3FS) setEntry(name string, entry *s3Entry) {
+	if _, ok := s.entries[name]; !ok && name != "." {
+		parent := path.Dir(name)
+		if s.children[parent] == nil {
+			s.children[parent] = map[string]struct{}{}
+		}
+		s.children[parent][name] = struct{}{}
+	}
+	s.entries[name] = entry
+}
+
+// deleteEntry drops name from the index. The caller holds the lock.
+func (s *S3FS) deleteEntry(name string) {
+	delete(s.entries, name)
+	parent := path.Dir(name)
+	if siblings := s.children[parent]; siblings != nil {
+		delete(siblings, name)
+		if len(siblings) == 0 {
+			delete(s.children, parent)
+		}
+	}
+}
+
+// addParents records the directories implied by name. The caller holds the
+// lock or has not shared the replica yet.
+func (s *S3FS) addParents(name string, modTime time.Time) {
+	for parent := path.Dir(name); parent != "."; parent = path.Dir(parent) {
+		if _, ok := s.entries[parent]; ok {
+			return
+		}
+		s.setEntry(parent, &s3Entry{dir: true, modTime: modTime})
+	}
+}
+
+func (s *S3FS) key(name string) string {
+	return s.prefix + name
+}
+
+// locate returns the index name of name with the links in its parent
+// directories resolved, and with follow set also a link at name itself.
+func (s *S3FS) locate(op string, name string, follow bool) (string, error) {
+	clean := path.Clean(name)
+	if !fs.ValidPath(clean) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if clean == "." {
+		return clean, nil
+	}
+	parent, inside, err := resolveLinks(s, path.Dir(clean))
+	if err == nil && inside && follow {
+		parent, inside, err = resolveLinks(s, path.Join(parent, path.Base(clean)))
+		if err == nil && inside {
+			return parent, nil
+		}
+	}
+	if err != nil {
+		return "", &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if !inside {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return path.Join(parent, path.Base(clean)), nil
+}
+
+// entry returns a copy of the index entry for name, fetching the metadata of
+// empty objects, which may be links. The caller holds the lock.
+func (s *S3FS) entry(name string) (s3Entry, bool, error) {
+	current, ok := s.entries[name]
+	if !ok {
+		return s3Entry{}, false, nil
+	}
+	if !current.dir && !current.headed && current.size == 0 {
+		if err := s.head(name, current); err != nil {
+			return s3Entry{}, false, err
+		}
+	}
+	return *current, true, nil
+}
+
+// head fetches the metadata of the object for name into current. The caller
+// holds the lock.
+func (s *S3FS) head(name string, current *s3Entry) error {
+	response, err := s.client.do(http.MethodHead, s.key(name), nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	current.etag = response.Header.Get("ETag")
+	current.link = response.Header.Get(s3LinkHeader)
+	current.digest = response.Header.Get(s3DigestHeader)
+	current.headed = true
+	return nil
+}
+
+// requireParent checks that the parent of name is a directory. The caller
+// holds the lock.
+func (s *S3FS) requireParent(op string, displayName string, name string) error {
+	parent, ok := s.entries[path.Dir(name)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: displayName, Err: fs.ErrNotExist}
+	}
+	if !parent.dir {
+		return &fs.PathError{Op: op, Path: displayName, Err: errNotDirectory}
+	}
+	return nil
+}
+
+func (s *S3FS) info(op string, name string, follow bool) (fs.FileInfo, error) {
+	located, err := s.locate(op, name, follow)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok, err := s.entry(located)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: name, Err: err}
+	}
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return s3FileInfo{name: path.Base(located), entry: current}, nil
+}
+
+// Stat returns information about the entry at name, following links.
+func (s *S3FS) Stat(name string) (fs.FileInfo, error) {
+	return s.info("stat", name, true)
+}
+
+// Lstat returns information about the entry at name.
+func (s *S3FS) Lstat(name string) (fs.FileInfo, error) {
+	return s.info("lstat", name, false)
+}
+
+// ReadDir lists the directory at name sorted by file name.
+func (s *S3FS) ReadDir(name string) ([]fs.DirEntry, error) {
+	located, err := s.locate("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.entries[located]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !current.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDirectory}
+	}
+	var entries []fs.DirEntry
+	for other := range s.children[located] {
+		child, _, err := s.entry(other)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+		entries = append(entries, fs.FileInfoToDirEntry(s3FileInfo{name: path.Base(other), entry: child}))
+	}
+	sortDirEntries(entries)
+	return entries, nil
+}
+
+// WalkDir walks the tree at name from the listing.
+func (s *S3FS) WalkDir(name string, fn fs.WalkDirFunc) error {
+	return WalkReplica(s, name, fn)
+}
+
+// ReadFile downloads the object at name.
+func (s *S3FS) ReadFile(name string) ([]byte, error) {
+	located, err := s.locate("read", name, true)
+	if err != nil {
+		return nil, err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.read(name, located)
+}
+
+// read downloads located and records its digest. The caller holds the lock.
+func (s *S3FS) read(name string, located string) ([]byte, error) {
+	current, ok := s.entries[located]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	if current.dir {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errIsDirectory}
+	}
+	response, err := s.client.do(http.MethodGet, s.key(located), nil, nil, nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	current.etag = response.Header.Get("ETag")
+	current.size = int64(len(content))
+	current.digest = digestBytes(content)
+	return content, nil
+}
+
+// Hash returns the digest of the object at name. Objects written by zync
+// carry it in their metadata; others are downloaded once per run.
+func (s *S3FS) Hash(name string) (string, error) {
+	located, err := s.locate("hash", name, true)
+	if err != nil {
+		return "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.entries[located]
+	if !ok || current.dir {
+		return "", &fs.PathError{Op: "hash", Path: name, Err: fs.ErrNotExist}
+	}
+	if current.digest == "" && !current.headed {
+		if err := s.head(located, current); err != nil {
+			return "", &fs.PathError{Op: "hash", Path: name, Err: err}
+		}
+	}
+	if current.digest == "" {
+		if _, err := s.read(name, located); err != nil {
+			return "", err
+		}
+	}
+	return current.digest, nil
+}
+
+// put uploads an object for name, refused if the object changed since zync
+// last saw it or, for new names, if one appeared meanwhile. The caller holds
+// the lock.
+func (s *S3FS) put(name string, data []byte, header http.Header) (*s3Entry, error) {
+	if header == nil {
+		header = http.Header{}
+	}
+	if current, ok := s.entries[name]; ok && current.etag != "" {
+		header.Set("If-Match", current.etag)
+	} else if !ok {
+		header.Set("If-None-Match", "*")
+	}
+	response, err := s.client.do(http.MethodPut, s.key(name), nil, header, data)
+	if err != nil {
+		return nil, err
+	}
+	response.Body.Close()
+	written := &s3Entry{size: int64(len(data)), etag: response.Header.Get("ETag"), modTime: time.Now(), headed: true}
+	s.setEntry(name, written)
+	s.addParents(name, written.modTime)
+	return written, nil
+}
+
+// WriteFile uploads data as the object at name.
+func (s *S3FS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	located, err := s.locate("write", name, true)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err := s.requireParent("write", name, located); err != nil {
+		return err
+	}
+	if current, ok := s.entries[located]; ok && current.dir {
+		return &fs.PathError{Op: "write", Path: name, Err: errIsDirectory}
+	}
+	digest := digestBytes(data)
+	header := http.Header{"Content-Type": {"application/octet-stream"}}
+	header.Set(s3DigestHeader, digest)
+	written, err := s.put(located, data, header)
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	written.digest = digest
+	return nil
+}
+
+// Mkdir creates the directory name as a marker object.
+func (s *S3FS) Mkdir(name string, perm fs.FileMode) error {
+	located, err := s.locate("mkdir", name, false)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.entries[located]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := s.requireParent("mkdir", name, located); err != nil {
+		return err
+	}
+	return s.putMarker(name, located)
+}
+
+// putMarker uploads the marker of the directory located. The caller holds
+// the lock.
+func (s *S3FS) putMarker(name string, located string) error {
+	response, err := s.client.do(http.MethodPut, s.key(located)+"/", nil, nil, nil)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	response.Body.Close()
+	s.setEntry(located, &s3Entry{dir: true, marker: true, modTime: time.Now()})
+	s.addParents(located, time.Now())
+	return nil
+}
+
+// MkdirAll creates the directory name along with any missing parents.
+func (s *S3FS) MkdirAll(name string, perm fs.FileMode) error {
+	located, inside, err := resolveLinks(s, name)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	if !inside {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrInvalid}
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for parent := located; parent != "."; parent = path.Dir(parent) {
+		if current, ok := s.entries[parent]; ok && !current.dir {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDirectory}
+		}
+	}
+	if _, ok := s.entries[located]; ok {
+		return nil
+	}
+	return s.putMarker(name, located)
+}
+
+// Rename moves oldName to newName by copying every object below it on the
+// server and deleting the originals.
+func (s *S3FS) Rename(oldName string, newName string) error {
+	from, err := s.locate("rename", oldName, false)
+	if err != nil {
+		return err
+	}
+	to, err := s.locate("rename", newName, false)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	source, ok := s.entries[from]
+	if !ok {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	if err := s.requireParent("rename", newName, to); err != nil {
+		return err
+	}
+	if target, ok := s.entries[to]; ok && (target.dir != source.dir || target.dir && s.hasChildren(to)) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	}
+	moved := s.below(from)
+	for _, name := range moved {
+		current := s.entries[name]
+		if current.dir && !current.marker {
+			continue
+		}
+		objectKey, destinationKey := s.key(name), s.key(to+strings.TrimPrefix(name, from))
+		if current.dir {
+			objectKey, destinationKey = objectKey+"/", destinationKey+"/"
+		}
+		header := http.Header{"X-Amz-Copy-Source": {"/" + s.client.bucket + "/" + s3Escape(objectKey, false)}}
+		response, err := s.client.do(http.MethodPut, destinationKey, nil, header, nil)
+		if err != nil {
+			return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+		}
+		var copied struct {
+			ETag string `xml:"ETag"`
+		}
+		_ = xml.NewDecoder(response.Body).Decode(&copied)
+		response.Body.Close()
+		if copied.ETag != "" {
+			current.etag = copied.ETag
+		}
+	}
+	if err := s.deleteObjects(oldName, moved); err != nil {
+		return err
+	}
+	for _, name := range moved {
+		current := s.entries[name]
+		s.deleteEntry(name)
+		s.setEntry(to+strings.TrimPrefix(name, from), current)
+	}
+	s.addParents(to, time.Now())
+	return nil
+}
+
+// below returns name and every name under it. The caller holds the lock.
+func (s *S3FS) below(name string) []string {
+	names := []string{name}
+	for index := 0; index < len(names); index++ {
+		for child := range s.children[names[index]] {
+			names = append(names, child)
+		}
+	}
+	return names
+}
+
+// hasChildren reports whether any entry lies below name. The caller holds
+// the lock.
+func (s *S3FS) hasChildren(name string) bool {
+	return len(s.children[name]) > 0
+}
+
+// deleteObjects deletes the objects behind names, leaving the index alone.
+// The caller holds the lock.
+func (s *S3FS) deleteObjects(displayName string, names []string) error {
+	for _, name := range names {
+		current := s.entries[name]
+		if current.dir && !current.marker {
+			continue
+		}
+		objectKey := s.key(name)
+		if current.dir {
+			objectKey += "/"
+		}
+		response, err := s.client.do(http.MethodDelete, objectKey, nil, nil, nil)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return &fs.PathError{Op: "remove", Path: displayName, Err: err}
+		}
+		if response != nil {
+			response.Body.Close()
+		}
+	}
+	return nil
+}
+
+// Remove removes the file, link or empty directory at name.
+func (s *S3FS) Remove(name string) error {
+	located, err := s.locate("remove", name, false)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	current, ok := s.entries[located]
+	if !ok || located == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if current.dir && s.hasChildren(located) {
+		return &fs.PathError{Op: "remove", Path: name, Err: errDirectoryInUse}
+	}
+	if err := s.deleteObjects(name, []string{located}); err != nil {
+		return err
+	}
+	s.deleteEntry(located)
+	s.keepParent(located)
+	return nil
+}
+
+// keepParent writes a marker for the parent of a removed name when the
+// removal would otherwise make the empty parent vanish. The caller holds the
+// lock.
+func (s *S3FS) keepParent(name string) {
+	parent := path.Dir(name)
+	if current, ok := s.entries[parent]; parent == "." || !ok || current.marker || s.hasChildren(parent) {
+		return
+	}
+	_ = s.putMarker(parent, parent)
+}
+
+// RemoveAll removes name and everything below it.
+func (s *S3FS) RemoveAll(name string) error {
+	located, err := s.locate("remove", name, false)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.entries[located]; !ok {
+		return nil
+	}
+	removed := s.below(located)
+	if err := s.deleteObjects(name, removed); err != nil {
+		return err
+	}
+	for _, other := range removed {
+		s.deleteEntry(other)
+	}
+	s.keepParent(located)
+	return nil
+}
+
+// Chmod checks that name exists; objects have no permission bits.
+func (s *S3FS) Chmod(name string, mode fs.FileMode) error {
+	_, err := s.info("chmod", name, true)
+	return err
+}
+
+// Symlink creates name as an empty object naming target in its metadata.
+func (s *S3FS) Symlink(target string, name string) error {
+	located, err := s.locate("symlink", name, false)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.entries[located]; ok {
+		return &fs.PathError{Op: "symlink", Path: name, Err: fs.ErrExist}
+	}
+	if err := s.requireParent("symlink", name, located); err != nil {
+		return err
+	}
+	header := http.Header{}
+	header.Set(s3LinkHeader, target)
+	written, err := s.put(located, nil, header)
+	if err != nil {
+		return &fs.PathError{Op: "symlink", Path: name, Err: err}
+	}
+	written.link = target
+	return nil
+}
+
+// Readlink returns the target of the symbolic link name.
+func (s *S3FS) Readlink(name string) (string, error) {
+	info, err := s.info("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	entry := info.(s3FileInfo).entry
+	if entry.link == "" {
+		return "", &fs.PathError{Op: "readlink", Path: name, Err: errNotLink}
+	}
+	return entry.link, nil
+}
@@ -0,0 +1,269 @@
+package sync_test
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	stdsync "sync"
+	"testing"
+	"time"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+type fakeObject struct {
+	data     []byte
+	etag     string
+	metadata http.Header
+	modTime  time.Time
+}
+
+// fakeS3 is a path-style S3 server for one bucket with the requests zync
+// uses: paged ListObjectsV2, HEAD, GET, conditional PUT, copy and DELETE.
+type fakeS3 struct {
+	bucket    string
+	mutex     stdsync.Mutex
+	objects   map[string]*fakeObject
+	downloads int
+}
+
+func newFakeS3(t *testing.T, bucket string) (*fakeS3, string) {
+	fake := &fakeS3{bucket: bucket, objects: map[string]*fakeObject{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	return fake, server.URL
+}
+
+func (f *fakeS3) put(key string, data []byte, metadata http.Header) string {
+	sum := md5.Sum(data)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	f.objects[key] = &fakeObject{data: data, etag: etag, metadata: metadata, modTime: time.Now()}
+	return etag
+}
+
+func (f *fakeS3) object(key string) (*fakeObject, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	object, ok := f.objects[key]
+	return object, ok
+}
+
+func (f *fakeS3) downloadCount() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.downloads
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	body, _ := io.ReadAll(r.Body)
+	payloadSum := sha256.Sum256(body)
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test-key/") ||
+		r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payloadSum[:]) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if r.URL.Path == "/"+f.bucket && r.Method == http.MethodGet {
+		f.list(w, r)
+		return
+	}
+	key, ok := strings.CutPrefix(r.URL.Path, "/"+f.bucket+"/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	object, exists := f.objects[key]
+	switch r.Method {
+	case http.MethodHead, http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		for name, values := range object.metadata {
+			w.Header()[name] = values
+		}
+		w.Header().Set("ETag", object.etag)
+		w.Header().Set("Content-Length", fmt.Sprint(len(object.data)))
+		if r.Method == http.MethodGet {
+			f.downloads++
+			w.Write(object.data)
+		}
+	case http.MethodPut:
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || object.etag != match) ||
+			r.Header.Get("If-None-Match") == "*" && exists {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			original, found := f.objects[strings.TrimPrefix(source, "/"+f.bucket+"/")]
+			if !found {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			etag := f.put(key, original.data, original.metadata)
+			fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", etag)
+			return
+		}
+		metadata := http.Header{}
+		for name, values := range r.Header {
+			if strings.HasPrefix(name, "X-Amz-Meta-") {
+				metadata[name] = values
+			}
+		}
+		w.Header().Set("ETag", f.put(key, body, metadata))
+	case http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// list answers ListObjectsV2 two keys at a time to exercise paging.
+func (f *fakeS3) list(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("prefix")
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, prefix) && key > r.URL.Query().Get("continuation-token") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var result struct {
+		XMLName  xml.Name `xml:"ListBucketResult"`
+		Contents []struct {
+			Key          string
+			Size         int
+			ETag         string
+			LastModified time.Time
+		}
+		IsTruncated           bool
+		NextContinuationToken string `xml:",omitempty"`
+	}
+	for i, key := range keys {
+		if i == 2 {
+			result.IsTruncated = true
+			result.NextContinuationToken = keys[1]
+			break
+		}
+		object := f.objects[key]
+		result.Contents = append(result.Contents, struct {
+			Key          string
+			Size         int
+			ETag         string
+			LastModified time.Time
+		}{key, len(object.data), object.etag, object.modTime})
+	}
+	xml.NewEncoder(w).Encode(result)
+}
+
+func TestS3Replica(t *testing.T) {
+	fake, endpoint := newFakeS3(t, "vault")
+	fake.put("notes/remote.md", []byte("from the bucket"), nil)
+	fake.put("notes/empty/", nil, nil)
+	fake.put("notes/deep/a/b.md", []byte("deep"), nil)
+	fake.put("other/unrelated.md", []byte("not ours"), nil)
+
+	rootA, stateDir := t.TempDir(), t.TempDir()
+	config := syncpkg.RootConfig{S3Endpoint: endpoint, S3AccessKeyID: "test-key", S3SecretAccessKey: "secret", StateDirectory: stateDir}
+	opts := defaultOptions(rootA, "s3://vault/notes", stateDir)
+	run := func() syncpkg.SyncResult {
+		t.Helper()
+		replica, err := syncpkg.OpenRoot("s3://vault/notes", config)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		opts.ReplicaB = replica
+		res, err := syncpkg.RunSync(opts, zap.NewNop())
+		if err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		if err := syncpkg.CloseReplica(replica); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		return res
+	}
+
+	writeFile(t, filepath.Join(rootA, "local.md"), "from A")
+	if err := os.Symlink("local.md", filepath.Join(rootA, "link.md")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	run()
+	if got := readFile(t, filepath.Join(rootA, "remote.md")); got != "from the bucket" {
+		t.Fatalf("A has %q", got)
+	}
+	if got := readFile(t, filepath.Join(rootA, "deep", "a", "b.md")); got != "deep" {
+		t.Fatalf("A has %q", got)
+	}
+	if info, err := os.Stat(filepath.Join(rootA, "empty")); err != nil || !info.IsDir() {
+		t.Fatalf("empty directory not created: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rootA, "unrelated.md")); !os.IsNotExist(err) {
+		t.Fatalf("object outside the prefix was synced: %v", err)
+	}
+	object, ok := fake.object("notes/local.md")
+	if !ok || string(object.data) != "from A" || object.metadata.Get("X-Amz-Meta-Zync-Sha256") == "" {
+		t.Fatalf("uploaded object = %+v", object)
+	}
+	if link, ok := fake.object("notes/link.md"); !ok || link.metadata.Get("X-Amz-Meta-Zync-Link") != "local.md" {
+		t.Fatalf("link object = %+v", link)
+	}
+
+	before := fake.downloadCount()
+	run()
+	if downloads := fake.downloadCount() - before; downloads != 0 {
+		t.Fatalf("unchanged objects were downloaded %d times", downloads)
+	}
+
+	if err := os.RemoveAll(filepath.Join(rootA, "deep")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	writeFile(t, filepath.Join(rootA, "remote.md"), "changed on A")
+	run()
+	if object, _ := fake.object("notes/remote.md"); string(object.data) != "changed on A" {
+		t.Fatalf("bucket has %q", object.data)
+	}
+	if _, ok := fake.object("notes/deep/a/b.md"); ok {
+		t.Fatal("expected the deleted directory to be removed from the bucket")
+	}
+}
+
+func TestS3ConditionalWrite(t *testing.T) {
+	fake, endpoint := newFakeS3(t, "vault")
+	fake.put("doc.md", []byte("v1"), nil)
+	config := syncpkg.RootConfig{S3Endpoint: endpoint, S3AccessKeyID: "test-key", S3SecretAccessKey: "secret"}
+	replica, err := syncpkg.OpenRoot("s3://vault", config)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	fake.mutex.Lock()
+	fake.put("doc.md", []byte("written by someone else"), nil)
+	fake.put("new.md", []byte("also theirs"), nil)
+	fake.mutex.Unlock()
+
+	if err := replica.WriteFile("doc.md", []byte("v2"), 0o644); err == nil {
+		t.Fatal("expected the write over a changed object to be refused")
+	}
+	if err := replica.WriteFile("new.md", []byte("mine"), 0o644); err == nil {
+		t.Fatal("expected the write over an object created meanwhile to be refused")
+	}
+	for key, want := range map[string]string{"doc.md": "written by someone else", "new.md": "also theirs"} {
+		if object, _ := fake.object(key); string(object.data) != want {
+			t.Fatalf("%s = %q, want %q", key, object.data, want)
+		}
+	}
+	if _, err := syncpkg.OpenRoot("s3://vault", syncpkg.RootConfig{S3Endpoint: endpoint, S3AccessKeyID: "wrong", S3SecretAccessKey: "secret"}); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected a permission error for bad credentials, got %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package sync
+
+// mergeHunk is one region of a three-way sequence merge. Stable hunks are
+// identical on all three sides; other hunks carry what each side has in the
+// region and, unless Conflict is set, the Resolved result.
+type mergeHunk[T any] struct {
+	Stable   bool
+	Conflict bool
+	Base     []T
+	A        []T
+	B        []T
+	Resolved []T
+}
+
+// lcsMatches returns, for every element of x, the index of the element of y
+// it is paired with in a longest common subsequence, or -1.
+func lcsMatches[T any](x []T, y []T, eq func(T, T) bool) []int {
+	matches := make([]int, len(x))
+	for index := range matches {
+		matches[index] = -1
+	}
+
+	prefix := 0
+	for prefix < len(x) && prefix < len(y) && eq(x[prefix], y[prefix]) {
+		matches[prefix] = prefix
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(x)-prefix && suffix < len(y)-prefix && eq(x[len(x)-1-suffix], y[len(y)-1-suffix]) {
+		matches[len(x)-1-suffix] = len(y) - 1 - suffix
+		suffix++
+	}
+
+	innerX := x[prefix : len(x)-suffix]
+	innerY := y[prefix : len(y)-suffix]
+	for _, pair := range myersPairs(innerX, innerY, eq) {
+		matches[prefix+pair[0]] = prefix + pair[1]
+	}
+	return matches
+}
+
+// myersPairs computes a shortest edit script between x and y with Myers'
+// algorithm and returns the pairs of equal elements it keeps.
+func myersPairs[T any](x []T, y []T, eq func(T, T) bool) [][2]int {
+	n, m := len(x), len(y)
+	if n == 0 || m == 0 {
+		return nil
+	}
+	maxD := n + m
+	offset := maxD + 1
+	v := make([]int, 2*maxD+3)
+	var trace []myersRow
+
+	for d := 0; d <= maxD; d++ {
+		low := offset - d - 1
+		row := myersRow{low: low, values: append([]int(nil), v[low:offset+d+2]...)}
+		trace = append(trace, row)
+		for k := -d; k <= d; k += 2 {
+			var px int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				px = v[offset+k+1]
+			} else {
+				px = v[offset+k-1] + 1
+			}
+			py := px - k
+			for px < n && py < m && eq(x[px], y[py]) {
+				px++
+				py++
+			}
+			v[offset+k] = px
+			if px >= n && py >= m {
+				return backtrackMyers(trace, offset, n, m, d)
+			}
+		}
+	}
+	return nil
+}
+
+// myersRow keeps the furthest reaching points of one Myers iteration for the
+// diagonals it can touch, starting at index low of the full array.
+type myersRow struct {
+	low    int
+	values []int
+}
+
+func (r myersRow) at(index int) int {
+	return r.values[index-r.low]
+}
+
+func backtrackMyers(trace []myersRow, offset int, n int, m int, finalD int) [][2]int {
+	var pairs [][2]int
+	px, py := n, m
+	for d := finalD; d > 0; d-- {
+		row := trace[d]
+		k := px - py
+		var prevK int
+		if k == -d || (k != d && row.at(offset+k-1) < row.at(offset+k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := row.at(offset + prevK)
+		prevY := prevX - prevK
+		for px > prevX && py > prevY {
+			px--
+			py--
+			pairs = append(pairs, [2]int{px, py})
+		}
+		px, py = prevX, prevY
+	}
+	for px > 0 && py > 0 {
+		px--
+		py--
+		pairs = append(pairs, [2]int{px, py})
+	}
+	for left, right := 0, len(pairs)-1; left < right; left, right = left+1, right-1 {
+		pairs[left], pairs[right] = pairs[right], pairs[left]
+	}
+	return pairs
+}
+
+func sequencesEqual[T any](x []T, y []T, eq func(T, T) bool) bool {
+	if len(x) != len(y) {
+		return false
+	}
+	for index := range x {
+		if !eq(x[index], y[index]) {
+			return false
+		}
+	}
+	return true
+}
+
+// diff3Hunks splits a three-way merge of a and b against base into hunks in
+// the manner of diff3: regions changed on one side take that side, regions
+// changed identically on both sides are taken once, and regions changed
+// differently on both sides are conflicts.
+func diff3Hunks[T any](base []T, a []T, b []T, eq func(T, T) bool) []mergeHunk[T] {
+	matchA := lcsMatches(base, a, eq)
+	matchB := lcsMatches(base, b, eq)
+
+	var hunks []mergeHunk[T]
+	emitUnstable := func(baseChunk, aChunk, bChunk []T) {
+		if len(baseChunk) == 0 && len(aChunk) == 0 && len(bChunk) == 0 {
+			return
+		}
+		hunk := mergeHunk[T]{Base: baseChunk, A: aChunk, B: bChunk}
+		switch {
+		case sequencesEqual(aChunk, baseChunk, eq):
+			hunk.Resolved = bChunk
+		case sequencesEqual(bChunk, baseChunk, eq):
+			hunk.Resolved = aChunk
+		case sequencesEqual(aChunk, bChunk, eq):
+			hunk.Resolved = aChunk
+		default:
+			hunk.Conflict = true
+		}
+		hunks = append(hunks, hunk)
+	}
+
+	i, j, k := 0, 0, 0
+	for {
+		run := 0
+		for i+run < len(base) && matchA[i+run] == j+run && matchB[i+run] == k+run {
+			run++
+		}
+		if run > 0 {
+			stable := base[i : i+run]
+			hunks = append(hunks, mergeHunk[T]{Stable: true, Base: stable, A: a[j : j+run], B: b[k : k+run], Resolved: stable})
+			i, j, k = i+run, j+run, k+run
+			continue
+		}
+
+		next := i
+		for next < len(base) && (matchA[next] < j || matchB[next] < k) {
+			next++
+		}
+		if next == len(base) {
+			emitUnstable(base[i:], a[j:], b[k:])
+			return hunks
+		}
+		emitUnstable(base[i:next], a[j:matchA[next]], b[k:matchB[next]])
+		i, j, k = next, matchA[next], matchB[next]
+	}
+}
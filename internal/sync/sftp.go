@@ -0,0 +1,448 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	stdsync "sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// defaultSFTPRequests bounds the requests in flight on one SFTP connection
+// when RootConfig.SFTPMaxRequests is not set.
+const defaultSFTPRequests = 8
+
+// posixRenameExtension is the OpenSSH extension that renames over an existing
+// file in one step.
+const posixRenameExtension = "posix-rename@openssh.com"
+
+// sftpConnection is an SSH connection with its SFTP session, shared by every
+// root opened on the same account and host.
+type sftpConnection struct {
+	key    string
+	conn   *ssh.Client
+	client *sftp.Client
+	slots  chan struct{}
+	refs   int
+}
+
+var sftpConnections = struct {
+	mutex stdsync.Mutex
+	open  map[string]*sftpConnection
+}{open: map[string]*sftpConnection{}}
+
+// do runs op once a request slot is free.
+func (c *sftpConnection) do(op func(client *sftp.Client) error) error {
+	c.slots <- struct{}{}
+	defer func() { <-c.slots }()
+	return op(c.client)
+}
+
+// SFTPFS is a ReplicaFS for a directory on an SFTP server. Files are written
+// to a temporary name and renamed into place.
+type SFTPFS struct {
+	connection *sftpConnection
+	host       string
+	root       string
+	closeOnce  stdsync.Once
+}
+
+// DialSFTP opens rootURL, an sftp://[user[:password]@]host[:port]/path URL,
+// reusing the connection of roots already open on the same account. As with
+// ssh:// roots, the path is relative to the login directory unless it starts
+// with a second slash.
+func DialSFTP(rootURL string, config RootConfig) (*SFTPFS, error) {
+	parsed, err := url.Parse(rootURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme != "sftp" || parsed.Hostname() == "" {
+		return nil, fmt.Errorf("invalid sftp root %q, expected sftp://[user@]host[:port]/path", rootURL)
+	}
+	username := parsed.User.Username()
+	if username == "" {
+		current, userErr := user.Current()
+		if userErr != nil {
+			return nil, userErr
+		}
+		username = current.Username
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = "22"
+	}
+	address := net.JoinHostPort(parsed.Hostname(), port)
+	root := strings.TrimPrefix(parsed.Path, "/")
+	if root == "" {
+		root = "."
+	}
+
+	key := username + "@" + address
+	sftpConnections.mutex.Lock()
+	defer sftpConnections.mutex.Unlock()
+	connection, ok := sftpConnections.open[key]
+	if !ok {
+		password, _ := parsed.User.Password()
+		connection, err = dialSFTPConnection(key, username, password, address, config)
+		if err != nil {
+			return nil, err
+		}
+		sftpConnections.open[key] = connection
+	}
+	connection.refs++
+	return &SFTPFS{connection: connection, host: address, root: root}, nil
+}
+
+func dialSFTPConnection(key string, username string, password string, address string, config RootConfig) (*sftpConnection, error) {
+	knownHostsFile := config.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeys, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("load known hosts: %w", err)
+	}
+	auth, err := sftpAuthMethods(password, config.IdentityFiles)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ssh.Dial("tcp", address, &ssh.ClientConfig{
+		User:            username,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+		Timeout:         30 * time.Second,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("connect to %s: %w", address, err)
+	}
+	requests := config.SFTPMaxRequests
+	if requests <= 0 {
+		requests = defaultSFTPRequests
+	}
+	client, err := sftp.NewClient(conn, sftp.MaxConcurrentRequestsPerFile(requests))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("start sftp on %s: %w", address, err)
+	}
+	return &sftpConnection{key: key, conn: conn, client: client, slots: make(chan struct{}, requests)}, nil
+}
+
+// sftpAuthMethods offers the password from the URL, the identity files and
+// the keys of a running SSH agent, in that order. Without identity files the
+// default keys in ~/.ssh are tried.
+func sftpAuthMethods(password string, identityFiles []string) ([]ssh.AuthMethod, error) {
+	var methods []ssh.AuthMethod
+	if password != "" {
+		methods = append(methods, ssh.Password(password))
+	}
+	explicit := len(identityFiles) > 0
+	if !explicit {
+		if home, err := os.UserHomeDir(); err == nil {
+			for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+				identityFiles = append(identityFiles, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+	var signers []ssh.Signer
+	for _, identityFile := range identityFiles {
+		pem, err := os.ReadFile(identityFile)
+		if errors.Is(err, fs.ErrNotExist) && !explicit {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read identity: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			if explicit {
+				return nil, fmt.Errorf("parse identity %s: %w", identityFile, err)
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" {
+		if agentConn, err := net.Dial("unix", socket); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(agentConn).Signers))
+		}
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no password, identity file or ssh agent to authenticate with")
+	}
+	return methods, nil
+}
+
+// Close releases the replica's share of its connection, closing the
+// connection once no root uses it.
+func (s *SFTPFS) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		sftpConnections.mutex.Lock()
+		defer sftpConnections.mutex.Unlock()
+		s.connection.refs--
+		if s.connection.refs > 0 {
+			return
+		}
+		delete(sftpConnections.open, s.connection.key)
+		err = errors.Join(s.connection.client.Close(), s.connection.conn.Close())
+	})
+	return err
+}
+
+func (s *SFTPFS) path(name string) string {
+	return path.Join(s.root, name)
+}
+
+// wrap adds the operation and the replica path to errors from the server,
+// which often carry neither.
+func (s *SFTPFS) wrap(op string, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		err = pathErr.Err
+	}
+	return &fs.PathError{Op: op, Path: s.host + ":" + s.path(name), Err: err}
+}
+
+// Stat returns information about the entry at name, following links.
+func (s *SFTPFS) Stat(name string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := s.connection.do(func(client *sftp.Client) error {
+		var statErr error
+		info, statErr = client.Stat(s.path(name))
+		return statErr
+	})
+	return info, s.wrap("stat", name, err)
+}
+
+// Lstat returns information about the entry at name.
+func (s *SFTPFS) Lstat(name string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := s.connection.do(func(client *sftp.Client) error {
+		var statErr error
+		info, statErr = client.Lstat(s.path(name))
+		return statErr
+	})
+	return info, s.wrap("lstat", name, err)
+}
+
+// ReadDir lists the directory at name sorted by file name.
+func (s *SFTPFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	var infos []fs.FileInfo
+	err := s.connection.do(func(client *sftp.Client) error {
+		var readErr error
+		infos, readErr = client.ReadDir(s.path(name))
+		return readErr
+	})
+	if err != nil {
+		return nil, s.wrap("readdir", name, err)
+	}
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	sortDirEntries(entries)
+	return entries, nil
+}
+
+// WalkDir walks the tree at name one directory listing at a time.
+func (s *SFTPFS) WalkDir(name string, fn fs.WalkDirFunc) error {
+	return WalkReplica(s, name, fn)
+}
+
+// ReadFile returns the content of the file at name.
+func (s *SFTPFS) ReadFile(name string) ([]byte, error) {
+	var content []byte
+	err := s.connection.do(func(client *sftp.Client) error {
+		file, openErr := client.Open(s.path(name))
+		if openErr != nil {
+			return openErr
+		}
+		defer file.Close()
+		var readErr error
+		content, readErr = io.ReadAll(file)
+		return readErr
+	})
+	return content, s.wrap("read", name, err)
+}
+
+// WriteFile replaces the content of the file at name. The content is written
+// to a temporary file next to it, which then takes its place, so readers
+// never see a partial file. Existing files keep their permissions; links are
+// written through.
+func (s *SFTPFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	err := s.connection.do(func(client *sftp.Client) error {
+		target := s.path(name)
+		if info, statErr := client.Lstat(target); statErr == nil {
+			if info.Mode()&fs.ModeSymlink != 0 {
+				return writeSFTPFile(client, target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, data)
+			}
+			perm = info.Mode().Perm()
+		}
+		temp := temporarySibling(target)
+		if err := writeSFTPFile(client, temp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, data); err != nil {
+			client.Remove(temp)
+			return err
+		}
+		if err := client.Chmod(temp, perm); err != nil {
+			client.Remove(temp)
+			return err
+		}
+		if err := renameSFTP(client, temp, target); err != nil {
+			client.Remove(temp)
+			return err
+		}
+		return nil
+	})
+	return s.wrap("write", name, err)
+}
+
+// temporarySibling returns a hidden name next to name for content that is
+// about to replace it.
+func temporarySibling(name string) string {
+	return path.Join(path.Dir(name), "."+path.Base(name)+"."+strconv.FormatInt(time.Now().UnixNano(), 36)+".zync-tmp")
+}
+
+func writeSFTPFile(client *sftp.Client, name string, flags int, data []byte) error {
+	file, err := client.OpenFile(name, flags)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// renameSFTP moves oldName over newName, replacing it in one step where the
+// server supports it.
+func renameSFTP(client *sftp.Client, oldName string, newName string) error {
+	if _, ok := client.HasExtension(posixRenameExtension); ok {
+		return client.PosixRename(oldName, newName)
+	}
+	if err := client.Remove(newName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return client.Rename(oldName, newName)
+}
+
+// Mkdir creates the directory name.
+func (s *SFTPFS) Mkdir(name string, perm fs.FileMode) error {
+	err := s.connection.do(func(client *sftp.Client) error {
+		if err := client.Mkdir(s.path(name)); err != nil {
+			if _, statErr := client.Lstat(s.path(name)); statErr == nil {
+				return fs.ErrExist
+			}
+			return err
+		}
+		return client.Chmod(s.path(name), perm)
+	})
+	return s.wrap("mkdir", name, err)
+}
+
+// MkdirAll creates the directory name along with any missing parents.
+func (s *SFTPFS) MkdirAll(name string, perm fs.FileMode) error {
+	err := s.connection.do(func(client *sftp.Client) error {
+		return client.MkdirAll(s.path(name))
+	})
+	return s.wrap("mkdir", name, err)
+}
+
+// Rename moves oldName to newName, replacing newName if it exists.
+func (s *SFTPFS) Rename(oldName string, newName string) error {
+	err := s.connection.do(func(client *sftp.Client) error {
+		return renameSFTP(client, s.path(oldName), s.path(newName))
+	})
+	return s.wrap("rename", oldName, err)
+}
+
+// Remove removes the file, link or empty directory at name.
+func (s *SFTPFS) Remove(name string) error {
+	err := s.connection.do(func(client *sftp.Client) error {
+		return client.Remove(s.path(name))
+	})
+	return s.wrap("remove", name, err)
+}
+
+// RemoveAll removes name and everything below it without following links.
+// A missing name is not an error.
+func (s *SFTPFS) RemoveAll(name string) error {
+	err := s.connection.do(func(client *sftp.Client) error {
+		return removeSFTPTree(client, s.path(name))
+	})
+	return s.wrap("remove", name, err)
+}
+
+func removeSFTPTree(client *sftp.Client, name string) error {
+	info, err := client.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		children, err := client.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := removeSFTPTree(client, path.Join(name, child.Name())); err != nil {
+				return err
+			}
+		}
+		return client.RemoveDirectory(name)
+	}
+	return client.Remove(name)
+}
+
+// Chmod changes the permission bits of name.
+func (s *SFTPFS) Chmod(name string, mode fs.FileMode) error {
+	err := s.connection.do(func(client *sftp.Client) error {
+		return client.Chmod(s.path(name), mode)
+	})
+	return s.wrap("chmod", name, err)
+}
+
+// Symlink creates name as a symbolic link to target.
+func (s *SFTPFS) Symlink(target string, name string) error {
+	err := s.connection.do(func(client *sftp.Client) error {
+		return client.Symlink(target, s.path(name))
+	})
+	return s.wrap("symlink", name, err)
+}
+
+// Readlink returns the target of the symbolic link name.
+func (s *SFTPFS) Readlink(name string) (string, error) {
+	var target string
+	err := s.connection.do(func(client *sftp.Client) error {
+		var readErr error
+		target, readErr = client.ReadLink(s.path(name))
+		return readErr
+	})
+	return target, s.wrap("readlink", name, err)
+}
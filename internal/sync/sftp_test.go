@@ -0,0 +1,192 @@
+package sync_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// startSFTPServer serves the local file system over SFTP on a loopback port,
+// accepting the user zync with the password secret. It returns the address,
+// a known hosts file for it and the number of connections accepted so far.
+func startSFTPServer(t *testing.T) (string, string, *atomic.Int32) {
+	t.Helper()
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("host key: %v", err)
+	}
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("signer: %v", err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(meta ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if meta.User() == "zync" && string(password) == "secret" {
+				return nil, nil
+			}
+			return nil, errors.New("access denied")
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	accepted := &atomic.Int32{}
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			accepted.Add(1)
+			go serveSFTPConnection(conn, config)
+		}
+	}()
+
+	address := listener.Addr().String()
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(address)}, signer.PublicKey())
+	if err := os.WriteFile(knownHostsFile, []byte(line+"\n"), 0o600); err != nil {
+		t.Fatalf("write known hosts: %v", err)
+	}
+	return address, knownHostsFile, accepted
+}
+
+func serveSFTPConnection(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for request := range channelRequests {
+				isSFTP := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+				request.Reply(isSFTP, nil)
+				if !isSFTP {
+					continue
+				}
+				server, serverErr := sftp.NewServer(channel)
+				if serverErr == nil {
+					server.Serve()
+					server.Close()
+				}
+				channel.Close()
+			}
+		}()
+	}
+}
+
+func TestSFTPReplica(t *testing.T) {
+	address, knownHostsFile, accepted := startSFTPServer(t)
+	config := syncpkg.RootConfig{KnownHostsFile: knownHostsFile, SFTPMaxRequests: 2}
+	dirA, dirB := t.TempDir(), t.TempDir()
+
+	open := func(dir string) syncpkg.ReplicaFS {
+		replica, err := syncpkg.OpenRoot("sftp://zync:secret@"+address+"/"+dir, config)
+		if err != nil {
+			t.Fatalf("open %s: %v", dir, err)
+		}
+		return replica
+	}
+	replicaA, replicaB := open(dirA), open(dirB)
+	if got := accepted.Load(); got != 1 {
+		t.Fatalf("roots on one server opened %d connections", got)
+	}
+
+	writeFile(t, filepath.Join(dirA, "notes", "a.md"), "from A")
+	writeFile(t, filepath.Join(dirB, "b.md"), "from B")
+	if err := os.Symlink("b.md", filepath.Join(dirB, "link.md")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	opts := defaultOptions("sftp-a", "sftp-b", t.TempDir())
+	opts.ReplicaA = replicaA
+	opts.ReplicaB = replicaB
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("initial sync: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dirB, "notes", "a.md")); got != "from A" {
+		t.Fatalf("B has %q", got)
+	}
+	if got := readFile(t, filepath.Join(dirA, "b.md")); got != "from B" {
+		t.Fatalf("A has %q", got)
+	}
+	if target, err := os.Readlink(filepath.Join(dirA, "link.md")); err != nil || target != "b.md" {
+		t.Fatalf("link on A = %q, %v", target, err)
+	}
+
+	if err := os.Chmod(filepath.Join(dirB, "b.md"), 0o600); err != nil {
+		t.Fatalf("chmod: %v", err)
+	}
+	writeFile(t, filepath.Join(dirA, "b.md"), "changed on A")
+	if err := os.RemoveAll(filepath.Join(dirA, "notes")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("update sync: %v", err)
+	}
+	if got := readFile(t, filepath.Join(dirB, "b.md")); got != "changed on A" {
+		t.Fatalf("B has %q after update", got)
+	}
+	if info, err := os.Stat(filepath.Join(dirB, "b.md")); err != nil || info.Mode().Perm() != 0o600 {
+		t.Fatalf("rewritten file lost its mode: %v, %v", info, err)
+	}
+	if _, err := os.Lstat(filepath.Join(dirB, "notes")); !os.IsNotExist(err) {
+		t.Fatalf("expected notes to be removed from B, got %v", err)
+	}
+	entries, err := os.ReadDir(dirB)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".zync-tmp") {
+			t.Fatalf("temporary file %s left behind", entry.Name())
+		}
+	}
+
+	for _, replica := range []syncpkg.ReplicaFS{replicaA, replicaB} {
+		if err := syncpkg.CloseReplica(replica); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+	reopened := open(dirA)
+	defer syncpkg.CloseReplica(reopened)
+	if got := accepted.Load(); got != 2 {
+		t.Fatalf("expected a new connection after closing, got %d", got)
+	}
+}
+
+func TestSFTPRejectsUnknownHost(t *testing.T) {
+	address, _, _ := startSFTPServer(t)
+	knownHostsFile := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHostsFile, nil, 0o600); err != nil {
+		t.Fatalf("write known hosts: %v", err)
+	}
+	config := syncpkg.RootConfig{KnownHostsFile: knownHostsFile}
+	if _, err := syncpkg.OpenRoot("sftp://zync:secret@"+address+"/"+t.TempDir(), config); err == nil {
+		t.Fatal("expected an unknown host key to be refused")
+	}
+}
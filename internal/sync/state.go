@@ -11,16 +11,26 @@ import (
 )
 
 type syncState struct {
+	RootA     string                `json:"root_a,omitempty"`
+	RootB     string                `json:"root_b,omitempty"`
 	FileEntry map[string]stateEntry `json:"file_entry"`
+	DirEntry  map[string]struct{}   `json:"dir_entry,omitempty"`
 }
 
+// stateEntry is what the state knows about a file or link. SentHex is the
+// digest the last bundle created here carried for the path.
 type stateEntry struct {
-	AncestorHex string `json:"ancestor_hex"`
+	AncestorHex string            `json:"ancestor_hex"`
+	LinkTarget  string            `json:"link_target,omitempty"`
+	Xattrs      map[string]string `json:"xattrs,omitempty"`
+	History     []historyEntry    `json:"history,omitempty"`
+	SentHex     string            `json:"sent_hex,omitempty"`
 }
 
 type stateStore struct {
 	StatePath string
 	AncDir    string
+	BackupDir string
 }
 
 func createOrOpenStateStore(stateDir string) (*stateStore, *syncState, error) {
@@ -32,7 +42,7 @@ func createOrOpenStateStore(stateDir string) (*stateStore, *syncState, error) {
 		return nil, nil, err
 	}
 	statePath := filepath.Join(stateDir, "state.json")
-	state := &syncState{FileEntry: map[string]stateEntry{}}
+	state := &syncState{FileEntry: map[string]stateEntry{}, DirEntry: map[string]struct{}{}}
 
 	if _, err := os.Stat(statePath); errors.Is(err, fs.ErrNotExist) {
 		if err := os.WriteFile(statePath, []byte(`{"file_entry":{}}`), 0o644); err != nil {
@@ -46,11 +56,17 @@ func createOrOpenStateStore(stateDir string) (*stateStore, *syncState, error) {
 		if unmarshalErr := json.Unmarshal(data, state); unmarshalErr != nil {
 			return nil, nil, unmarshalErr
 		}
+		if state.FileEntry == nil {
+			state.FileEntry = map[string]stateEntry{}
+		}
+		if state.DirEntry == nil {
+			state.DirEntry = map[string]struct{}{}
+		}
 	} else {
 		return nil, nil, err
 	}
 
-	return &stateStore{StatePath: statePath, AncDir: ancDir}, state, nil
+	return &stateStore{StatePath: statePath, AncDir: ancDir, BackupDir: backupDirectory(stateDir)}, state, nil
 }
 
 func (s *stateStore) save(state *syncState) error {
@@ -0,0 +1,393 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	structuredJSON = "json"
+	structuredYAML = "yaml"
+	structuredTOML = "toml"
+	structuredINI  = "ini"
+)
+
+var structuredExtensions = map[string]string{
+	".json":   structuredJSON,
+	".canvas": structuredJSON,
+	".ipynb":  structuredJSON,
+	".yaml":   structuredYAML,
+	".yml":    structuredYAML,
+	".toml":   structuredTOML,
+	".ini":    structuredINI,
+	".cfg":    structuredINI,
+	".conf":   structuredINI,
+}
+
+// detectStructuredFormat picks a structured format by extension, falling back
+// to sniffing JSON content for files without a known extension.
+func detectStructuredFormat(relativePath string, content []byte) string {
+	if format, ok := structuredExtensions[strings.ToLower(filepath.Ext(relativePath))]; ok {
+		return format
+	}
+	trimmed := bytes.TrimSpace(content)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		return structuredJSON
+	}
+	return ""
+}
+
+// mergeStructured merges a and b against base as structured data. applicable
+// is false when the path is not a structured format or one of the inputs does
+// not parse; conflicts lists the keys changed differently on both sides.
+func mergeStructured(relativePath string, base []byte, a []byte, b []byte) ([]byte, []string, bool) {
+	switch detectStructuredFormat(relativePath, a) {
+	case structuredJSON:
+		return mergeJSONDocuments(base, a, b)
+	case structuredYAML:
+		return mergeYAMLDocuments(base, a, b)
+	case structuredTOML:
+		return mergeSectionedDocuments(base, a, b, structuredTOML)
+	case structuredINI:
+		return mergeSectionedDocuments(base, a, b, structuredINI)
+	}
+	return nil, nil, false
+}
+
+// keyedEntries is an ordered collection of values addressed by key.
+type keyedEntries[V any] struct {
+	keys   []string
+	values map[string]V
+}
+
+func (e keyedEntries[V]) get(key string) (V, bool) {
+	value, ok := e.values[key]
+	return value, ok
+}
+
+// mergeKeyed merges three keyed collections key by key. Keys added or removed
+// on one side follow that side, keys changed on both sides are merged with
+// mergeBoth, and removals facing modifications are conflicts. The merged
+// order follows a, with keys new in b placed after their predecessor in b.
+func mergeKeyed[V any](path string, base, a, b keyedEntries[V], equal func(V, V) bool, mergeBoth func(path string, base V, hasBase bool, a V, b V) V, conflicts *[]string) keyedEntries[V] {
+	merged := keyedEntries[V]{values: map[string]V{}}
+	keep := func(key string) (V, bool) {
+		baseValue, inBase := base.get(key)
+		aValue, inA := a.get(key)
+		bValue, inB := b.get(key)
+		childPath := key
+		if path != "" {
+			childPath = path + "." + key
+		}
+		switch {
+		case inA && inB:
+			return mergeBoth(childPath, baseValue, inBase, aValue, bValue), true
+		case inA && !inBase:
+			return aValue, true
+		case inB && !inBase:
+			return bValue, true
+		case inA:
+			if equal(baseValue, aValue) {
+				return aValue, false
+			}
+			*conflicts = append(*conflicts, childPath)
+			return aValue, true
+		case inB:
+			if equal(baseValue, bValue) {
+				return bValue, false
+			}
+			*conflicts = append(*conflicts, childPath)
+			return bValue, true
+		}
+		var zero V
+		return zero, false
+	}
+
+	for _, key := range a.keys {
+		if value, kept := keep(key); kept {
+			merged.keys = append(merged.keys, key)
+			merged.values[key] = value
+		}
+	}
+	insertAt := 0
+	for _, key := range b.keys {
+		if _, done := merged.values[key]; done {
+			for index, existing := range merged.keys {
+				if existing == key {
+					insertAt = index + 1
+				}
+			}
+			continue
+		}
+		if _, inA := a.get(key); inA {
+			continue
+		}
+		value, kept := keep(key)
+		if !kept {
+			continue
+		}
+		merged.keys = append(merged.keys[:insertAt], append([]string{key}, merged.keys[insertAt:]...)...)
+		merged.values[key] = value
+		insertAt++
+	}
+	return merged
+}
+
+// mergeSequence merges three lists element by element with a diff3 over the
+// elements. Regions changed on both sides are merged pairwise when they have
+// the same length, kept in full when both only insert, and conflicts otherwise.
+func mergeSequence[V any](path string, base, a, b []V, equal func(V, V) bool, mergeBoth func(path string, base V, hasBase bool, a V, b V) V, conflicts *[]string) []V {
+	var merged []V
+	for _, hunk := range diff3Hunks(base, a, b, equal) {
+		if !hunk.Conflict {
+			merged = append(merged, hunk.Resolved...)
+			continue
+		}
+		switch {
+		case len(hunk.A) == len(hunk.B) && len(hunk.A) == len(hunk.Base):
+			for index := range hunk.A {
+				merged = append(merged, mergeBoth(fmt.Sprintf("%s[%d]", path, len(merged)), hunk.Base[index], true, hunk.A[index], hunk.B[index]))
+			}
+		case len(hunk.Base) == 0:
+			merged = append(merged, hunk.A...)
+			merged = append(merged, hunk.B...)
+		default:
+			*conflicts = append(*conflicts, fmt.Sprintf("%s[%d]", path, len(merged)))
+			merged = append(merged, hunk.A...)
+		}
+	}
+	return merged
+}
+
+// jsonObject is a JSON object that remembers the order of its keys.
+type jsonObject = keyedEntries[any]
+
+func decodeJSONDocument(content []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	value, err := decodeJSONValue(decoder)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("trailing data after JSON value")
+	}
+	return value, nil
+}
+
+func decodeJSONValue(decoder *json.Decoder) (any, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch delim := token.(type) {
+	case json.Delim:
+		switch delim {
+		case '{':
+			object := &jsonObject{values: map[string]any{}}
+			for decoder.More() {
+				keyToken, keyErr := decoder.Token()
+				if keyErr != nil {
+					return nil, keyErr
+				}
+				key, _ := keyToken.(string)
+				value, valueErr := decodeJSONValue(decoder)
+				if valueErr != nil {
+					return nil, valueErr
+				}
+				if _, duplicate := object.values[key]; !duplicate {
+					object.keys = append(object.keys, key)
+				}
+				object.values[key] = value
+			}
+			_, err = decoder.Token()
+			return object, err
+		case '[':
+			list := []any{}
+			for decoder.More() {
+				value, valueErr := decodeJSONValue(decoder)
+				if valueErr != nil {
+					return nil, valueErr
+				}
+				list = append(list, value)
+			}
+			_, err = decoder.Token()
+			return list, err
+		}
+	}
+	return token, nil
+}
+
+func jsonValuesEqual(x any, y any) bool {
+	switch left := x.(type) {
+	case *jsonObject:
+		right, ok := y.(*jsonObject)
+		if !ok || len(left.values) != len(right.values) {
+			return false
+		}
+		for key, value := range left.values {
+			other, present := right.values[key]
+			if !present || !jsonValuesEqual(value, other) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		right, ok := y.([]any)
+		return ok && sequencesEqual(left, right, jsonValuesEqual)
+	case json.Number:
+		right, ok := y.(json.Number)
+		return ok && left == right
+	}
+	return x == y
+}
+
+func mergeJSONValues(path string, base any, hasBase bool, a any, b any, conflicts *[]string) any {
+	if jsonValuesEqual(a, b) {
+		return a
+	}
+	if hasBase && jsonValuesEqual(base, a) {
+		return b
+	}
+	if hasBase && jsonValuesEqual(base, b) {
+		return a
+	}
+	mergeBoth := func(childPath string, childBase any, childHasBase bool, childA any, childB any) any {
+		return mergeJSONValues(childPath, childBase, childHasBase, childA, childB, conflicts)
+	}
+	objectA, isObjectA := a.(*jsonObject)
+	objectB, isObjectB := b.(*jsonObject)
+	if isObjectA && isObjectB {
+		baseObject, isObjectBase := base.(*jsonObject)
+		if !hasBase || !isObjectBase {
+			baseObject = &jsonObject{values: map[string]any{}}
+		}
+		merged := mergeKeyed(path, *baseObject, *objectA, *objectB, jsonValuesEqual, mergeBoth, conflicts)
+		return &merged
+	}
+	listA, isListA := a.([]any)
+	listB, isListB := b.([]any)
+	if isListA && isListB {
+		baseList, _ := base.([]any)
+		return mergeSequence(path, baseList, listA, listB, jsonValuesEqual, mergeBoth, conflicts)
+	}
+	*conflicts = append(*conflicts, path)
+	return a
+}
+
+// detectJSONIndent returns the indentation unit of a pretty-printed document,
+// or "" for compact documents.
+func detectJSONIndent(content []byte) string {
+	for _, line := range strings.Split(string(content), "\n")[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if len(trimmed) < len(line) && trimmed != "" {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return ""
+}
+
+func encodeJSONDocument(value any, indent string, trailingNewline bool) ([]byte, error) {
+	var buffer bytes.Buffer
+	if err := encodeJSONValue(&buffer, value, indent, 0); err != nil {
+		return nil, err
+	}
+	if trailingNewline {
+		buffer.WriteByte('\n')
+	}
+	return buffer.Bytes(), nil
+}
+
+func encodeJSONValue(buffer *bytes.Buffer, value any, indent string, depth int) error {
+	newline := func(level int) {
+		if indent != "" {
+			buffer.WriteByte('\n')
+			buffer.WriteString(strings.Repeat(indent, level))
+		}
+	}
+	switch typed := value.(type) {
+	case *jsonObject:
+		if len(typed.keys) == 0 {
+			buffer.WriteString("{}")
+			return nil
+		}
+		buffer.WriteByte('{')
+		for index, key := range typed.keys {
+			if index > 0 {
+				buffer.WriteByte(',')
+			}
+			newline(depth + 1)
+			if err := encodeJSONScalar(buffer, key); err != nil {
+				return err
+			}
+			buffer.WriteByte(':')
+			if indent != "" {
+				buffer.WriteByte(' ')
+			}
+			if err := encodeJSONValue(buffer, typed.values[key], indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		buffer.WriteByte('}')
+		return nil
+	case []any:
+		if len(typed) == 0 {
+			buffer.WriteString("[]")
+			return nil
+		}
+		buffer.WriteByte('[')
+		for index, item := range typed {
+			if index > 0 {
+				buffer.WriteByte(',')
+			}
+			newline(depth + 1)
+			if err := encodeJSONValue(buffer, item, indent, depth+1); err != nil {
+				return err
+			}
+		}
+		newline(depth)
+		buffer.WriteByte(']')
+		return nil
+	}
+	return encodeJSONScalar(buffer, value)
+}
+
+func encodeJSONScalar(buffer *bytes.Buffer, value any) error {
+	if number, ok := value.(json.Number); ok {
+		buffer.WriteString(number.String())
+		return nil
+	}
+	var scratch bytes.Buffer
+	encoder := json.NewEncoder(&scratch)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return err
+	}
+	buffer.Write(bytes.TrimSuffix(scratch.Bytes(), []byte("\n")))
+	return nil
+}
+
+func mergeJSONDocuments(base []byte, a []byte, b []byte) ([]byte, []string, bool) {
+	baseValue, baseErr := decodeJSONDocument(base)
+	aValue, aErr := decodeJSONDocument(a)
+	bValue, bErr := decodeJSONDocument(b)
+	if baseErr != nil || aErr != nil || bErr != nil {
+		return nil, nil, false
+	}
+	var conflicts []string
+	merged := mergeJSONValues("$", baseValue, true, aValue, bValue, &conflicts)
+	if len(conflicts) > 0 {
+		return nil, conflicts, true
+	}
+	out, err := encodeJSONDocument(merged, detectJSONIndent(a), bytes.HasSuffix(a, []byte("\n")))
+	if err != nil {
+		return nil, nil, false
+	}
+	return out, nil, true
+}
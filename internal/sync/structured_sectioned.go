@@ -0,0 +1,266 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pelletier/go-toml/v2"
+)
+
+// sectionedLine is one line of an INI or TOML section. Comments and blank
+// lines have an empty key.
+type sectionedLine struct {
+	key   string
+	value string
+	raw   string
+}
+
+type sectionedSection struct {
+	header string
+	lines  []sectionedLine
+}
+
+// sectionedDocument is an INI or TOML file kept line by line, so that a merge
+// can rewrite changed keys and leave comments and layout alone.
+type sectionedDocument struct {
+	lineEnding      string
+	trailingNewline bool
+	sections        keyedEntries[*sectionedSection]
+}
+
+func parseSectionedDocument(content []byte, format string) (*sectionedDocument, error) {
+	text := string(content)
+	document := &sectionedDocument{
+		lineEnding:      "\n",
+		trailingNewline: strings.HasSuffix(text, "\n"),
+		sections:        keyedEntries[*sectionedSection]{values: map[string]*sectionedSection{}},
+	}
+	if strings.Contains(text, "\r\n") {
+		document.lineEnding = "\r\n"
+	}
+	text = strings.TrimSuffix(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	current := &sectionedSection{}
+	document.sections.keys = append(document.sections.keys, "")
+	document.sections.values[""] = current
+	occurrences := map[string]int{}
+	for _, raw := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(raw)
+		switch {
+		case trimmed == "" || strings.HasPrefix(trimmed, "#") || (format == structuredINI && strings.HasPrefix(trimmed, ";")):
+			current.lines = append(current.lines, sectionedLine{raw: raw})
+		case strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			name := trimmed
+			occurrences[name]++
+			if occurrences[name] > 1 {
+				name = fmt.Sprintf("%s#%d", name, occurrences[name])
+			}
+			current = &sectionedSection{header: raw}
+			document.sections.keys = append(document.sections.keys, name)
+			document.sections.values[name] = current
+		default:
+			line, err := parseSectionedKey(raw, format)
+			if err != nil {
+				return nil, err
+			}
+			for _, existing := range current.lines {
+				if existing.key == line.key {
+					return nil, fmt.Errorf("duplicate key %q", line.key)
+				}
+			}
+			current.lines = append(current.lines, line)
+		}
+	}
+	return document, nil
+}
+
+func parseSectionedKey(raw string, format string) (sectionedLine, error) {
+	separator := strings.Index(raw, "=")
+	if format == structuredINI {
+		if colon := strings.Index(raw, ":"); colon >= 0 && (separator < 0 || colon < separator) {
+			separator = colon
+		}
+	}
+	if separator <= 0 {
+		return sectionedLine{}, fmt.Errorf("unsupported line %q", raw)
+	}
+	line := sectionedLine{
+		key:   strings.TrimSpace(raw[:separator]),
+		value: strings.TrimSpace(raw[separator+1:]),
+		raw:   raw,
+	}
+	if format == structuredTOML && !singleLineTOMLValue(line.value) {
+		return sectionedLine{}, fmt.Errorf("multi-line value for %q", line.key)
+	}
+	return line, nil
+}
+
+// singleLineTOMLValue reports whether value is complete on its line: no
+// multi-line strings and balanced array and table brackets.
+func singleLineTOMLValue(value string) bool {
+	if strings.Contains(value, `"""`) || strings.Contains(value, "'''") {
+		return false
+	}
+	depth := 0
+	var quote rune
+	escaped := false
+	for _, char := range value {
+		switch {
+		case quote != 0:
+			if escaped {
+				escaped = false
+			} else if char == '\\' && quote == '"' {
+				escaped = true
+			} else if char == quote {
+				quote = 0
+			}
+		case char == '"' || char == '\'':
+			quote = char
+		case char == '#':
+			return depth == 0
+		case char == '[' || char == '{':
+			depth++
+		case char == ']' || char == '}':
+			depth--
+		}
+	}
+	return depth == 0 && quote == 0
+}
+
+func sectionLines(section *sectionedSection) keyedEntries[sectionedLine] {
+	entries := keyedEntries[sectionedLine]{values: map[string]sectionedLine{}}
+	for _, line := range section.lines {
+		if line.key != "" {
+			entries.keys = append(entries.keys, line.key)
+			entries.values[line.key] = line
+		}
+	}
+	return entries
+}
+
+func sectionedLinesEqual(x sectionedLine, y sectionedLine) bool {
+	return x.value == y.value
+}
+
+func sectionsEqual(x *sectionedSection, y *sectionedSection) bool {
+	left, right := sectionLines(x), sectionLines(y)
+	if len(left.keys) != len(right.keys) {
+		return false
+	}
+	for key, line := range left.values {
+		other, ok := right.values[key]
+		if !ok || !sectionedLinesEqual(line, other) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeSections merges the keys of a section and lays them out over a's
+// lines: merged values replace a's, removed keys are dropped and keys new in
+// b are placed after their predecessor.
+func mergeSections(path string, base *sectionedSection, hasBase bool, a *sectionedSection, b *sectionedSection, conflicts *[]string) *sectionedSection {
+	baseLines := keyedEntries[sectionedLine]{values: map[string]sectionedLine{}}
+	if hasBase {
+		baseLines = sectionLines(base)
+	}
+	mergeLine := func(linePath string, lineBase sectionedLine, lineHasBase bool, lineA sectionedLine, lineB sectionedLine) sectionedLine {
+		switch {
+		case sectionedLinesEqual(lineA, lineB):
+			return lineA
+		case lineHasBase && sectionedLinesEqual(lineBase, lineA):
+			return lineB
+		case lineHasBase && sectionedLinesEqual(lineBase, lineB):
+			return lineA
+		}
+		*conflicts = append(*conflicts, linePath)
+		return lineA
+	}
+	linesA := sectionLines(a)
+	merged := mergeKeyed(path, baseLines, linesA, sectionLines(b), sectionedLinesEqual, mergeLine, conflicts)
+
+	result := &sectionedSection{header: a.header}
+	position := 0
+	emitUntil := func(key string) {
+		for position < len(a.lines) {
+			line := a.lines[position]
+			position++
+			if line.key == "" {
+				result.lines = append(result.lines, line)
+				continue
+			}
+			if kept, ok := merged.values[line.key]; ok {
+				result.lines = append(result.lines, kept)
+			}
+			if line.key == key {
+				return
+			}
+		}
+	}
+	for _, key := range merged.keys {
+		if _, inA := linesA.values[key]; inA {
+			emitUntil(key)
+			continue
+		}
+		result.lines = append(result.lines, merged.values[key])
+	}
+	emitUntil("")
+	return result
+}
+
+func (d *sectionedDocument) render(sections keyedEntries[*sectionedSection]) []byte {
+	var lines []string
+	for _, name := range sections.keys {
+		section := sections.values[name]
+		if name != "" {
+			lines = append(lines, section.header)
+		}
+		for _, line := range section.lines {
+			lines = append(lines, line.raw)
+		}
+	}
+	out := strings.Join(lines, d.lineEnding)
+	if d.trailingNewline {
+		out += d.lineEnding
+	}
+	return []byte(out)
+}
+
+func mergeSectionedDocuments(base []byte, a []byte, b []byte, format string) ([]byte, []string, bool) {
+	if format == structuredTOML {
+		for _, content := range [][]byte{base, a, b} {
+			if err := validTOML(content); err != nil {
+				return nil, nil, false
+			}
+		}
+	}
+	baseDocument, baseErr := parseSectionedDocument(base, format)
+	aDocument, aErr := parseSectionedDocument(a, format)
+	bDocument, bErr := parseSectionedDocument(b, format)
+	if baseErr != nil || aErr != nil || bErr != nil {
+		return nil, nil, false
+	}
+
+	var conflicts []string
+	mergeBoth := func(path string, sectionBase *sectionedSection, hasBase bool, sectionA *sectionedSection, sectionB *sectionedSection) *sectionedSection {
+		return mergeSections(path, sectionBase, hasBase, sectionA, sectionB, &conflicts)
+	}
+	sections := mergeKeyed("", baseDocument.sections, aDocument.sections, bDocument.sections, sectionsEqual, mergeBoth, &conflicts)
+	if len(conflicts) > 0 {
+		return nil, conflicts, true
+	}
+	out := aDocument.render(sections)
+	if format == structuredTOML && validTOML(out) != nil {
+		return nil, nil, false
+	}
+	return out, nil, true
+}
+
+func validTOML(content []byte) error {
+	var decoded map[string]any
+	if err := toml.Unmarshal(content, &decoded); err != nil {
+		return errors.Join(errors.New("invalid TOML"), err)
+	}
+	return nil
+}
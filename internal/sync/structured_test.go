@@ -0,0 +1,111 @@
+package sync_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+func TestStructuredMerge(t *testing.T) {
+	cases := []struct {
+		name       string
+		file       string
+		base       string
+		sideA      string
+		sideB      string
+		want       string
+		structured bool
+	}{
+		{
+			name:       "JSONDifferentKeys",
+			file:       "board.canvas",
+			base:       "{\n  \"nodes\": [\n    {\"id\": \"a\", \"x\": 1},\n    {\"id\": \"b\", \"x\": 2}\n  ],\n  \"title\": \"t\"\n}\n",
+			sideA:      "{\n  \"nodes\": [\n    {\"id\": \"a\", \"x\": 10},\n    {\"id\": \"b\", \"x\": 2}\n  ],\n  \"title\": \"t\"\n}\n",
+			sideB:      "{\n  \"nodes\": [\n    {\"id\": \"a\", \"x\": 1},\n    {\"id\": \"b\", \"x\": 20}\n  ],\n  \"title\": \"t\",\n  \"zoom\": 2\n}\n",
+			want:       "{\n  \"nodes\": [\n    {\n      \"id\": \"a\",\n      \"x\": 10\n    },\n    {\n      \"id\": \"b\",\n      \"x\": 20\n    }\n  ],\n  \"title\": \"t\",\n  \"zoom\": 2\n}\n",
+			structured: true,
+		},
+		{
+			name:       "JSONSniffedWithoutExtension",
+			file:       "settings",
+			base:       `{"a":1,"b":1}`,
+			sideA:      `{"a":2,"b":1}`,
+			sideB:      `{"a":1,"b":3}`,
+			want:       `{"a":2,"b":3}`,
+			structured: true,
+		},
+		{
+			name:       "YAMLKeepsComments",
+			file:       "config.yml",
+			base:       "# settings\nname: app\nports:\n  - 80\nlevel: info\n",
+			sideA:      "# settings\nname: app2\nports:\n  - 80\nlevel: info\n",
+			sideB:      "# settings\nname: app\nports:\n  - 80\n  - 443\nlevel: debug # verbose\n",
+			want:       "# settings\nname: app2\nports:\n  - 80\n  - 443\nlevel: debug # verbose\n",
+			structured: true,
+		},
+		{
+			name:       "INISections",
+			file:       "app.ini",
+			base:       "; app\n[server]\nhost = localhost\nport = 80\n\n[log]\nlevel = info\n",
+			sideA:      "; app\n[server]\nhost = example.com\nport = 80\n\n[log]\nlevel = info\n",
+			sideB:      "; app\n[server]\nhost = localhost\nport = 80\ntimeout = 5\n\n[log]\nlevel = debug\n",
+			want:       "; app\n[server]\nhost = example.com\nport = 80\ntimeout = 5\n\n[log]\nlevel = debug\n",
+			structured: true,
+		},
+		{
+			name:       "TOMLRemovedKey",
+			file:       "Cargo.toml",
+			base:       "[package]\nname = \"x\"\nversion = \"0.1.0\"\nedition = \"2021\"\n\n[dependencies]\nserde = \"1\"\n",
+			sideA:      "[package]\nname = \"x\"\nversion = \"0.2.0\"\nedition = \"2021\"\n\n[dependencies]\nserde = \"1\"\n",
+			sideB:      "[package]\nname = \"x\"\nversion = \"0.1.0\"\n\n[dependencies]\nserde = \"1\"\nrand = \"0.8\"\n",
+			want:       "[package]\nname = \"x\"\nversion = \"0.2.0\"\n\n[dependencies]\nserde = \"1\"\nrand = \"0.8\"\n",
+			structured: true,
+		},
+		{
+			name:  "OverlappingKeyFallsBack",
+			file:  "c.json",
+			base:  "{\"a\": 1}\n",
+			sideA: "{\"a\": 2}\n",
+			sideB: "{\"a\": 3}\n",
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("PATH", t.TempDir())
+			rootA := t.TempDir()
+			rootB := t.TempDir()
+			state := t.TempDir()
+			opts := defaultOptions(rootA, rootB, state)
+			opts.StructuredMerge = true
+
+			writeFile(t, filepath.Join(rootA, tc.file), tc.base)
+			if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+				t.Fatalf("initial sync: %v", err)
+			}
+			writeFile(t, filepath.Join(rootA, tc.file), tc.sideA)
+			writeFile(t, filepath.Join(rootB, tc.file), tc.sideB)
+			res, err := syncpkg.RunSync(opts, zap.NewNop())
+			if err != nil {
+				t.Fatalf("merge sync: %v", err)
+			}
+
+			if !tc.structured {
+				if res.ActionCounters["merge(struct)"] != 0 {
+					t.Fatalf("expected a text merge, got %v", res.ActionCounters)
+				}
+				return
+			}
+			if res.ActionCounters["merge(struct)"] != 1 {
+				t.Fatalf("expected a structured merge, got %v", res.ActionCounters)
+			}
+			for _, root := range []string{rootA, rootB} {
+				if got := readFile(t, filepath.Join(root, tc.file)); got != tc.want {
+					t.Fatalf("merged content = %q, want %q", got, tc.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,159 @@
+package sync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// yamlPair is one key and value of a YAML mapping.
+type yamlPair struct {
+	key   *yaml.Node
+	value *yaml.Node
+}
+
+func decodeYAMLDocument(content []byte) (*yaml.Node, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	var document yaml.Node
+	if err := decoder.Decode(&document); err != nil {
+		return nil, err
+	}
+	var extra yaml.Node
+	if err := decoder.Decode(&extra); err != io.EOF {
+		return nil, errors.New("multiple YAML documents")
+	}
+	if document.Kind != yaml.DocumentNode || len(document.Content) != 1 || usesYAMLReferences(&document) {
+		return nil, errors.New("unsupported YAML document")
+	}
+	return &document, nil
+}
+
+// usesYAMLReferences reports anchors, aliases and merge keys, which tie
+// distant parts of a document together and cannot be merged key by key.
+func usesYAMLReferences(node *yaml.Node) bool {
+	if node.Anchor != "" || node.Kind == yaml.AliasNode || (node.Kind == yaml.ScalarNode && node.ShortTag() == "!!merge") {
+		return true
+	}
+	for _, child := range node.Content {
+		if usesYAMLReferences(child) {
+			return true
+		}
+	}
+	return false
+}
+
+func yamlNodesEqual(x *yaml.Node, y *yaml.Node) bool {
+	if x == nil || y == nil {
+		return x == y
+	}
+	if x.Kind != y.Kind {
+		return false
+	}
+	if x.Kind == yaml.ScalarNode {
+		return x.ShortTag() == y.ShortTag() && x.Value == y.Value
+	}
+	return sequencesEqual(x.Content, y.Content, yamlNodesEqual)
+}
+
+func yamlMapping(node *yaml.Node) keyedEntries[yamlPair] {
+	entries := keyedEntries[yamlPair]{values: map[string]yamlPair{}}
+	for index := 0; index+1 < len(node.Content); index += 2 {
+		key := node.Content[index].Value
+		if _, duplicate := entries.values[key]; !duplicate {
+			entries.keys = append(entries.keys, key)
+		}
+		entries.values[key] = yamlPair{key: node.Content[index], value: node.Content[index+1]}
+	}
+	return entries
+}
+
+func mergeYAMLNodes(path string, base *yaml.Node, hasBase bool, a *yaml.Node, b *yaml.Node, conflicts *[]string) *yaml.Node {
+	if yamlNodesEqual(a, b) {
+		return a
+	}
+	if hasBase && yamlNodesEqual(base, a) {
+		return b
+	}
+	if hasBase && yamlNodesEqual(base, b) {
+		return a
+	}
+	if a.Kind == yaml.MappingNode && b.Kind == yaml.MappingNode {
+		baseEntries := keyedEntries[yamlPair]{values: map[string]yamlPair{}}
+		if hasBase && base.Kind == yaml.MappingNode {
+			baseEntries = yamlMapping(base)
+		}
+		pairsEqual := func(x yamlPair, y yamlPair) bool {
+			return yamlNodesEqual(x.value, y.value)
+		}
+		mergePairs := func(childPath string, childBase yamlPair, childHasBase bool, childA yamlPair, childB yamlPair) yamlPair {
+			return yamlPair{key: childA.key, value: mergeYAMLNodes(childPath, childBase.value, childHasBase, childA.value, childB.value, conflicts)}
+		}
+		merged := mergeKeyed(path, baseEntries, yamlMapping(a), yamlMapping(b), pairsEqual, mergePairs, conflicts)
+		node := *a
+		node.Content = nil
+		for _, key := range merged.keys {
+			pair := merged.values[key]
+			node.Content = append(node.Content, pair.key, pair.value)
+		}
+		return &node
+	}
+	if a.Kind == yaml.SequenceNode && b.Kind == yaml.SequenceNode {
+		var baseItems []*yaml.Node
+		if hasBase && base.Kind == yaml.SequenceNode {
+			baseItems = base.Content
+		}
+		mergeItems := func(childPath string, childBase *yaml.Node, childHasBase bool, childA *yaml.Node, childB *yaml.Node) *yaml.Node {
+			return mergeYAMLNodes(childPath, childBase, childHasBase, childA, childB, conflicts)
+		}
+		node := *a
+		node.Content = mergeSequence(path, baseItems, a.Content, b.Content, yamlNodesEqual, mergeItems, conflicts)
+		return &node
+	}
+	*conflicts = append(*conflicts, path)
+	return a
+}
+
+// detectYAMLIndent returns the indentation width of the first nested line,
+// defaulting to two spaces.
+func detectYAMLIndent(content []byte) int {
+	for _, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed != "" && len(trimmed) < len(line) && !strings.HasPrefix(trimmed, "#") {
+			return len(line) - len(trimmed)
+		}
+	}
+	return 2
+}
+
+func mergeYAMLDocuments(base []byte, a []byte, b []byte) ([]byte, []string, bool) {
+	baseDocument, baseErr := decodeYAMLDocument(base)
+	aDocument, aErr := decodeYAMLDocument(a)
+	bDocument, bErr := decodeYAMLDocument(b)
+	if baseErr != nil || aErr != nil || bErr != nil {
+		return nil, nil, false
+	}
+	var conflicts []string
+	root := mergeYAMLNodes("$", baseDocument.Content[0], true, aDocument.Content[0], bDocument.Content[0], &conflicts)
+	if len(conflicts) > 0 {
+		return nil, conflicts, true
+	}
+
+	document := *aDocument
+	document.Content = []*yaml.Node{root}
+	var buffer bytes.Buffer
+	if bytes.HasPrefix(a, []byte("---")) {
+		buffer.WriteString("---\n")
+	}
+	encoder := yaml.NewEncoder(&buffer)
+	encoder.SetIndent(detectYAMLIndent(a))
+	if err := encoder.Encode(&document); err != nil {
+		return nil, nil, false
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, nil, false
+	}
+	return buffer.Bytes(), nil, true
+}
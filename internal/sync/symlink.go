@@ -0,0 +1,291 @@
+package sync
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SymlinkMode selects how symbolic links inside the roots are synchronized.
+type SymlinkMode string
+
+const (
+	// SymlinkModePreserve synchronizes the link itself by copying its target string.
+	SymlinkModePreserve SymlinkMode = "preserve"
+	// SymlinkModeFollow reads through links whose targets stay inside the root.
+	SymlinkModeFollow SymlinkMode = "follow"
+)
+
+const maxSymlinkHops = 255
+
+var errSymlinkLoop = errors.New("too many levels of symbolic links")
+
+type entryKind int
+
+const (
+	entryMissing entryKind = iota
+	entryFile
+	entryLink
+	entryDir
+)
+
+func lstatKind(fsys ReplicaFS, name string) (entryKind, fs.FileInfo, error) {
+	info, err := fsys.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return entryMissing, nil, nil
+	}
+	if err != nil {
+		return entryMissing, nil, err
+	}
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return entryLink, info, nil
+	}
+	if info.IsDir() {
+		return entryDir, info, nil
+	}
+	return entryFile, info, nil
+}
+
+func validateSymlinkMode(mode SymlinkMode) error {
+	switch mode {
+	case "", SymlinkModePreserve, SymlinkModeFollow:
+		return nil
+	}
+	return fmt.Errorf("unknown symlink mode %q", mode)
+}
+
+// resolvePath resolves every symbolic link in path, including dangling links
+// and components that do not exist yet, so that writes can be checked before
+// they happen.
+func resolvePath(path string) (string, error) {
+	return resolvePathHops(filepath.Clean(path), 0)
+}
+
+func resolvePathHops(path string, hops int) (string, error) {
+	if hops > maxSymlinkHops {
+		return "", errSymlinkLoop
+	}
+	real, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		return real, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	info, lstatErr := os.Lstat(path)
+	if lstatErr == nil && info.Mode()&fs.ModeSymlink != 0 {
+		target, readErr := os.Readlink(path)
+		if readErr != nil {
+			return "", readErr
+		}
+		if !filepath.IsAbs(target) {
+			target = filepath.Join(filepath.Dir(path), target)
+		}
+		return resolvePathHops(filepath.Clean(target), hops+1)
+	}
+	parent := filepath.Dir(path)
+	if parent == path {
+		return path, nil
+	}
+	resolvedParent, parentErr := resolvePathHops(parent, hops)
+	if parentErr != nil {
+		return "", parentErr
+	}
+	return filepath.Join(resolvedParent, filepath.Base(path)), nil
+}
+
+func pathContains(realRoot string, realPath string) bool {
+	rel, err := filepath.Rel(realRoot, realPath)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// guardWithinRoots reports whether name stays inside both replicas once its
+// links are resolved.
+func guardWithinRoots(options Options, name string, logger *zap.Logger) (bool, error) {
+	for _, candidate := range []struct {
+		fsys ReplicaFS
+		root string
+	}{
+		{options.ReplicaA, options.RootAPath},
+		{options.ReplicaB, options.RootBPath},
+	} {
+		inside, err := withinReplica(candidate.fsys, name)
+		if err != nil {
+			if logger != nil {
+				logger.Error("resolve path", zap.String("path", filepath.Join(candidate.root, filepath.FromSlash(name))), zap.Error(err))
+			}
+			return false, err
+		}
+		if !inside {
+			if logger != nil {
+				logger.Warn("refusing path that resolves outside root", zap.String("path", filepath.Join(candidate.root, filepath.FromSlash(name))), zap.String("root", candidate.root))
+			}
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func writeSymlinkEnsure(fsys ReplicaFS, name string, target string) error {
+	if err := fsys.MkdirAll(path.Dir(name), 0o755); err != nil {
+		return err
+	}
+	if err := fsys.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return fsys.Symlink(target, name)
+}
+
+func lstatModtimeSeconds(fsys ReplicaFS, name string) float64 {
+	info, err := fsys.Lstat(name)
+	if err != nil {
+		return 0
+	}
+	return float64(info.ModTime().UnixNano()) / float64(time.Second)
+}
+
+// processSymlink synchronizes a path that is a symbolic link on at least one
+// side. The link target string is the synchronized content and the previous
+// agreed target is kept in the state entry as the merge ancestor.
+func processSymlink(relativePath string, kindA entryKind, kindB entryKind, options Options, state *syncState, logger *zap.Logger) (bool, string, error) {
+	pathA := filepath.Join(options.RootAPath, relativePath)
+	pathB := filepath.Join(options.RootBPath, relativePath)
+	entry := state.FileEntry[relativePath]
+
+	parentsInside, guardErr := guardWithinRoots(options, path.Dir(relativePath), logger)
+	if guardErr != nil {
+		return false, "", guardErr
+	}
+	if !parentsInside {
+		return false, "skip(escape)", nil
+	}
+	if !storesSymlinks(options.ReplicaA) || !storesSymlinks(options.ReplicaB) {
+		if logger != nil {
+			logger.Warn("replica cannot store symbolic links", zap.String("path", relativePath))
+		}
+		return false, "skip(link)", nil
+	}
+
+	if (kindA == entryLink && kindB != entryLink && kindB != entryMissing) || (kindB == entryLink && kindA != entryLink && kindA != entryMissing) {
+		if logger != nil {
+			logger.Warn("symlink conflicts with regular entry", zap.String("path", relativePath))
+		}
+		return false, "conflict(type)", nil
+	}
+
+	var targetA, targetB string
+	if kindA == entryLink {
+		target, err := options.ReplicaA.Readlink(relativePath)
+		if err != nil {
+			if logger != nil {
+				logger.Error("read link", zap.String("path", pathA), zap.Error(err))
+			}
+			return false, "", err
+		}
+		targetA = target
+	}
+	if kindB == entryLink {
+		target, err := options.ReplicaB.Readlink(relativePath)
+		if err != nil {
+			if logger != nil {
+				logger.Error("read link", zap.String("path", pathB), zap.Error(err))
+			}
+			return false, "", err
+		}
+		targetB = target
+	}
+
+	writeLink := func(towardB bool, target string) error {
+		linkPath := pathA
+		if towardB {
+			linkPath = pathB
+		}
+		if err := ensureDirsLike(options, path.Dir(relativePath), towardB); err != nil {
+			if logger != nil {
+				logger.Error("create directory", zap.String("path", filepath.Dir(linkPath)), zap.Error(err))
+			}
+			return err
+		}
+		if err := writeSymlinkEnsure(replicaFor(options, towardB), relativePath, target); err != nil {
+			if logger != nil {
+				logger.Error("write link", zap.String("path", linkPath), zap.Error(err))
+			}
+			return err
+		}
+		if err := adoptOwnership(options, relativePath, towardB); err != nil {
+			if logger != nil {
+				logger.Error("set owner", zap.String("path", linkPath), zap.Error(err))
+			}
+			return err
+		}
+		return nil
+	}
+
+	switch {
+	case kindB == entryMissing:
+		if err := writeLink(true, targetA); err != nil {
+			return false, "", err
+		}
+		recordLink(state, relativePath, targetA)
+		return true, "B<-A (link)", nil
+	case kindA == entryMissing:
+		if err := writeLink(false, targetB); err != nil {
+			return false, "", err
+		}
+		recordLink(state, relativePath, targetB)
+		return true, "A<-B (link)", nil
+	case targetA == targetB:
+		recordLink(state, relativePath, targetA)
+		return false, "equal", nil
+	case entry.LinkTarget != "" && entry.LinkTarget == targetA:
+		if err := writeLink(false, targetB); err != nil {
+			return false, "", err
+		}
+		recordLink(state, relativePath, targetB)
+		return true, "A<-B (link)", nil
+	case entry.LinkTarget != "" && entry.LinkTarget == targetB:
+		if err := writeLink(true, targetA); err != nil {
+			return false, "", err
+		}
+		recordLink(state, relativePath, targetA)
+		return true, "B<-A (link)", nil
+	}
+
+	modA := lstatModtimeSeconds(options.ReplicaA, relativePath)
+	modB := lstatModtimeSeconds(options.ReplicaB, relativePath)
+	if logger != nil {
+		logger.Warn("conflicting symlink targets", zap.String("path", relativePath), zap.String("target_a", targetA), zap.String("target_b", targetB))
+	}
+	if absFloat64(modA-modB) <= options.ConflictMtimeEpsilonSeconds {
+		return false, "link(conflict)", nil
+	}
+	winner := targetA
+	towardB := true
+	if modB > modA {
+		winner = targetB
+		towardB = false
+	}
+	if err := writeLink(towardB, winner); err != nil {
+		return false, "", err
+	}
+	recordLink(state, relativePath, winner)
+	return true, "link(conflict)", nil
+}
+
+// recordLink records target as the synchronized target of the link at
+// relativePath, keeping the history and attributes of the entry.
+func recordLink(state *syncState, relativePath string, target string) {
+	entry := state.FileEntry[relativePath]
+	entry.AncestorHex, entry.LinkTarget = "", target
+	state.FileEntry[relativePath] = entry
+}
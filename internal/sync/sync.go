@@ -2,11 +2,13 @@ package sync
 
 import (
 	"errors"
+	"fmt"
 	"io/fs"
-	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
 	"sort"
+	"strings"
 	"time"
 
 	"go.uber.org/zap"
@@ -16,21 +18,89 @@ type SyncResult struct {
 	ChangedFileCount int
 	ActionCounters   map[string]int
 	Diff3Available   bool
+	RunID            string
+	AutoResolutions  []AutoResolution
+	GitCommits       []string
 }
 
 // RunSync performs a bidirectional synchronization between two roots.
 func RunSync(options Options, logger *zap.Logger) (SyncResult, error) {
 	var result SyncResult
 	result.ActionCounters = map[string]int{
-		"A<-B (create)": 0,
-		"B<-A (create)": 0,
-		"merge(seed)":   0,
-		"merge(3way)":   0,
-		"merge(2way)":   0,
-		"equal":         0,
-		"absent":        0,
+		"A<-B (create)":      0,
+		"B<-A (create)":      0,
+		"merge(seed)":        0,
+		"merge(3way)":        0,
+		"merge(2way)":        0,
+		"merge(struct)":      0,
+		"merge(markdown)":    0,
+		"merge(driver)":      0,
+		"conflict(driver)":   0,
+		"merge(words)":       0,
+		"conflict(encoding)": 0,
+		"equal":              0,
+		"absent":             0,
+		"A<-B (link)":        0,
+		"B<-A (link)":        0,
+		"link(conflict)":     0,
+		"conflict(type)":     0,
+		"skip(escape)":       0,
+		"skip(link)":         0,
+		"A<-B (mkdir)":       0,
+		"B<-A (mkdir)":       0,
+		"A<-B (rmdir)":       0,
+		"B<-A (rmdir)":       0,
+		"xattr(sync)":        0,
+		"xattr(conflict)":    0,
 	}
 
+	if err := validateSymlinkMode(options.SymlinkMode); err != nil {
+		if logger != nil {
+			logger.Error("invalid options", zap.Error(err))
+		}
+		return result, err
+	}
+	if err := validateLineEnding(options.LineEnding); err != nil {
+		if logger != nil {
+			logger.Error("invalid options", zap.Error(err))
+		}
+		return result, err
+	}
+	if _, err := resolveLegacyCharset(options.LegacyCharset); err != nil {
+		if logger != nil {
+			logger.Error("invalid options", zap.Error(err))
+		}
+		return result, err
+	}
+	if err := validateFilterRules(options.FilterRules); err != nil {
+		if logger != nil {
+			logger.Error("invalid options", zap.Error(err))
+		}
+		return result, err
+	}
+	if err := validateMergeRules(options.MergeRules); err != nil {
+		if logger != nil {
+			logger.Error("invalid options", zap.Error(err))
+		}
+		return result, err
+	}
+	if err := validateConflictRules(options.ConflictRules); err != nil {
+		if logger != nil {
+			logger.Error("invalid options", zap.Error(err))
+		}
+		return result, err
+	}
+	if err := validateGitCommit(options.GitCommit); err != nil {
+		if logger != nil {
+			logger.Error("invalid options", zap.Error(err))
+		}
+		return result, err
+	}
+	if options.PreserveOwnership && !ownershipEnabled(options) && logger != nil {
+		logger.Warn("not running privileged, file ownership will not be preserved")
+	}
+
+	options = withReplicas(options)
 	store, state, err := createOrOpenStateStore(options.StateDirectory)
 	if err != nil {
 		if logger != nil {
@@ -39,29 +109,39 @@ func RunSync(options Options, logger *zap.Logger) (SyncResult, error) {
 		return result, err
 	}
 
-	relativeSet := map[string]struct{}{}
+	state.RootA = localRoot(options.ReplicaA)
+	state.RootB = localRoot(options.ReplicaB)
 
-	err = filepath.WalkDir(options.RootAPath, func(currentPath string, d fs.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
+	for _, side := range gitCommitSides(options.GitCommit) {
+		root := localRoot(replicaFor(options, side == VersionSideB))
+		if root == "" {
+			err = fmt.Errorf("git commits need a local directory as root %s", strings.ToUpper(side))
+		} else {
+			err = checkGitRoot(root, options.StateDirectory, options.GitRequireClean)
 		}
-		if d.IsDir() {
-			rel, _ := filepath.Rel(options.RootAPath, currentPath)
-			if rel != "." && shouldIgnorePath(rel, options.IgnorePathPrefixes) {
-				return filepath.SkipDir
+		if err != nil {
+			if logger != nil {
+				logger.Error("check git work tree", zap.Error(err))
 			}
-			return nil
-		}
-		fileName := d.Name()
-		if shouldIgnoreName(fileName, options.IgnoreFileNames) {
-			return nil
+			return result, err
 		}
-		rel, _ := filepath.Rel(options.RootAPath, currentPath)
-		if shouldInclude(rel, fileName, options.IncludeGlob) {
-			relativeSet[filepath.ToSlash(rel)] = struct{}{}
+	}
+
+	stateBefore, err := cloneState(state)
+	if err != nil {
+		return result, err
+	}
+	if options.seedState != nil {
+		if err := options.seedState(store, state); err != nil {
+			return result, err
 		}
-		return nil
-	})
+	}
+	recorder := newRunRecorder(store, state, options, time.Now())
+
+	relativeSet := map[string]struct{}{}
+	dirSet := map[string]struct{}{}
+
+	err = collectRelativePaths(options.ReplicaA, options, relativeSet, dirSet, logger)
 	if err != nil {
 		if logger != nil {
 			logger.Error("walk root A", zap.String("root", options.RootAPath), zap.Error(err))
@@ -69,84 +149,256 @@ func RunSync(options Options, logger *zap.Logger) (SyncResult, error) {
 		return result, err
 	}
 
-	err = filepath.WalkDir(options.RootBPath, func(currentPath string, d fs.DirEntry, walkErr error) error {
-		if walkErr != nil {
-			return walkErr
-		}
-		if d.IsDir() {
-			rel, _ := filepath.Rel(options.RootBPath, currentPath)
-			if rel != "." && shouldIgnorePath(rel, options.IgnorePathPrefixes) {
-				return filepath.SkipDir
-			}
-			return nil
-		}
-		fileName := d.Name()
-		if shouldIgnoreName(fileName, options.IgnoreFileNames) {
-			return nil
-		}
-		rel, _ := filepath.Rel(options.RootBPath, currentPath)
-		if shouldInclude(rel, fileName, options.IncludeGlob) {
-			relativeSet[filepath.ToSlash(rel)] = struct{}{}
-		}
-		return nil
-	})
+	emptyA := len(relativeSet) == 0 && len(dirSet) == 0
+
+	relativeSetB := map[string]struct{}{}
+	dirSetB := map[string]struct{}{}
+	err = collectRelativePaths(options.ReplicaB, options, relativeSetB, dirSetB, logger)
 	if err != nil {
 		if logger != nil {
 			logger.Error("walk root B", zap.String("root", options.RootBPath), zap.Error(err))
 		}
 		return result, err
 	}
+	emptyB := len(relativeSetB) == 0 && len(dirSetB) == 0
+	for rel := range relativeSetB {
+		relativeSet[rel] = struct{}{}
+	}
+	for rel := range dirSetB {
+		dirSet[rel] = struct{}{}
+	}
+
+	var removedDirs []string
+	switch {
+	case isReadOnly(options.ReplicaA) || isReadOnly(options.ReplicaB):
+		// A one-way source only adds and merges; what it lacks is older, not
+		// deleted.
+		if logger != nil {
+			logger.Info("read-only root, directory deletions not propagated")
+		}
+	case (emptyA || emptyB) && len(state.DirEntry) > 0 && !options.ForceDirDeletions:
+		// An unmounted mount point or a fresh directory looks as if every
+		// known directory had been deleted from it.
+		if logger != nil {
+			emptyRoot := options.RootAPath
+			if emptyB {
+				emptyRoot = options.RootBPath
+			}
+			logger.Warn("root is empty, directory deletions not propagated", zap.String("root", emptyRoot))
+		}
+	default:
+		removedDirs, err = propagateDirectoryDeletions(options, state, &result, recorder, logger)
+		if err != nil {
+			if logger != nil {
+				logger.Error("propagate directory deletions", zap.Error(err))
+			}
+			return result, err
+		}
+	}
 
 	relativeList := make([]string, 0, len(relativeSet))
 	for rel := range relativeSet {
+		if underAnyDirectory(rel, removedDirs) {
+			continue
+		}
 		relativeList = append(relativeList, rel)
 	}
 	sort.Strings(relativeList)
 
+	dirList := make([]string, 0, len(dirSet)+len(state.DirEntry))
+	for rel := range state.DirEntry {
+		dirSet[rel] = struct{}{}
+	}
+	for rel := range dirSet {
+		if rel == "" || underAnyDirectory(rel+"/", removedDirs) {
+			continue
+		}
+		dirList = append(dirList, rel)
+	}
+	sort.Strings(dirList)
+
 	diff3Path, lookupErr := exec.LookPath("diff3")
 	diff3Available := lookupErr == nil
 	result.Diff3Available = diff3Available
 
+	syncAttrs := options.SyncXattrs || options.SyncACLs
 	for _, relativePath := range relativeList {
-		changed, tag, procErr := processSingleFile(relativePath, options, store, state, diff3Path, logger)
+		previousEntry := state.FileEntry[relativePath]
+		if err := recorder.watch(relativePath); err != nil {
+			if logger != nil {
+				logger.Error("snapshot file", zap.String("path", relativePath), zap.Error(err))
+			}
+			return result, err
+		}
+		changed, tag, procErr := processSingleFile(relativePath, options, store, state, recorder, diff3Path, &result, logger)
 		if procErr != nil {
 			if logger != nil {
 				logger.Error("process file", zap.String("path", relativePath), zap.Error(procErr))
 			}
 			return result, procErr
 		}
+		if syncAttrs && tag != "skip(escape)" && tag != "conflict(type)" && tag != "absent" {
+			attrsChanged, attrErr := syncAttributes(relativePath, previousEntry.Xattrs, options, state, &result, logger)
+			if attrErr != nil {
+				return result, attrErr
+			}
+			changed = changed || attrsChanged
+		}
+		if err := recorder.settle(tag, changed); err != nil {
+			if logger != nil {
+				logger.Error("record changes", zap.String("path", relativePath), zap.Error(err))
+			}
+			return result, err
+		}
 		if changed {
 			result.ChangedFileCount++
 		}
 		result.ActionCounters[tag] = result.ActionCounters[tag] + 1
 	}
 
-	if err := store.save(state); err != nil {
+	if err := reconcileDirectories(dirList, options, state, &result, recorder, logger); err != nil {
 		if logger != nil {
-			logger.Error("save state", zap.Error(err))
+			logger.Error("reconcile directories", zap.Error(err))
 		}
 		return result, err
 	}
+
+	for _, replica := range []ReplicaFS{options.ReplicaA, options.ReplicaB} {
+		if err := flushReplica(replica); err != nil {
+			if logger != nil {
+				logger.Error("flush root", zap.Error(err))
+			}
+			return result, err
+		}
+	}
+
+	if isReadOnly(options.ReplicaA) || isReadOnly(options.ReplicaB) {
+		if logger != nil {
+			logger.Info("read-only root, state and run journal not recorded")
+		}
+	} else {
+		dropped := pruneHistory(state, options.HistoryLimit)
+		if err := store.save(state); err != nil {
+			if logger != nil {
+				logger.Error("save state", zap.Error(err))
+			}
+			return result, err
+		}
+
+		recorder.journal.Resolutions = result.AutoResolutions
+		journaled, journalErr := recorder.finish(stateBefore, state)
+		if journalErr != nil {
+			if logger != nil {
+				logger.Error("save run journal", zap.Error(journalErr))
+			}
+			return result, journalErr
+		}
+		if journaled {
+			result.RunID = recorder.journal.ID
+		}
+
+		if err := pruneAncestors(store, options.StateDirectory, state, dropped); err != nil {
+			if logger != nil {
+				logger.Error("prune ancestors", zap.Error(err))
+			}
+			return result, err
+		}
+	}
+
+	for _, side := range gitCommitSides(options.GitCommit) {
+		root := localRoot(replicaFor(options, side == VersionSideB))
+		commit, commitErr := commitGitChanges(root, recorder.journal.ID, side, recorder.journal.Changes)
+		if commitErr != nil {
+			if logger != nil {
+				logger.Error("commit changes", zap.String("root", root), zap.Error(commitErr))
+			}
+			return result, commitErr
+		}
+		if commit != "" {
+			result.GitCommits = append(result.GitCommits, commit)
+		}
+	}
+
+	removed, pruneErr := PruneBackups(options.StateDirectory, options.BackupRetention, time.Now())
+	if pruneErr != nil {
+		if logger != nil {
+			logger.Error("prune backups", zap.Error(pruneErr))
+		}
+		return result, pruneErr
+	}
+	if len(removed) > 0 && logger != nil {
+		logger.Debug("pruned backups", zap.Int("count", len(removed)))
+	}
 	return result, nil
 }
 
-func readAll(path string) ([]byte, error) {
-	return os.ReadFile(path)
+func writeAllEnsure(fsys ReplicaFS, name string, data []byte) error {
+	if err := fsys.MkdirAll(path.Dir(name), 0o755); err != nil {
+		return err
+	}
+	return fsys.WriteFile(name, data, 0o644)
 }
 
-func writeAllEnsure(path string, data []byte) error {
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
-		return err
+// readReplicaContent returns the content of name. Replicas that hash on their
+// own side are asked for a digest first, and content matching the ancestor is
+// taken from the state store instead of being transferred.
+func readReplicaContent(store *stateStore, fsys ReplicaFS, name string, ancestorHex string) ([]byte, error) {
+	if hasher, ok := fsys.(ReplicaHasher); ok && ancestorHex != "" {
+		digest, err := hasher.Hash(name)
+		if err != nil {
+			return nil, err
+		}
+		if digest == ancestorHex {
+			if content, ancErr := store.ancestorBytes(ancestorHex); ancErr == nil {
+				return content, nil
+			}
+		}
+	}
+	return fsys.ReadFile(name)
+}
+
+// localRoot returns the absolute directory of a local replica, or an empty
+// string for other replicas.
+func localRoot(fsys ReplicaFS) string {
+	local, ok := fsys.(*LocalFS)
+	if !ok {
+		return ""
 	}
-	return os.WriteFile(path, data, 0o644)
+	root, err := filepath.Abs(local.Root())
+	if err != nil {
+		return local.Root()
+	}
+	return root
 }
 
-func processSingleFile(relativePath string, options Options, store *stateStore, state *syncState, diff3Path string, logger *zap.Logger) (bool, string, error) {
+func processSingleFile(relativePath string, options Options, store *stateStore, state *syncState, recorder *runRecorder, diff3Path string, result *SyncResult, logger *zap.Logger) (bool, string, error) {
 	pathA := filepath.Join(options.RootAPath, relativePath)
 	pathB := filepath.Join(options.RootBPath, relativePath)
 
-	_, statAErr := os.Stat(pathA)
-	_, statBErr := os.Stat(pathB)
+	if options.SymlinkMode != SymlinkModeFollow {
+		kindA, _, lstatAErr := lstatKind(options.ReplicaA, relativePath)
+		if lstatAErr != nil {
+			return false, "", lstatAErr
+		}
+		kindB, _, lstatBErr := lstatKind(options.ReplicaB, relativePath)
+		if lstatBErr != nil {
+			return false, "", lstatBErr
+		}
+		if kindA == entryLink || kindB == entryLink {
+			return processSymlink(relativePath, kindA, kindB, options, state, logger)
+		}
+	}
+
+	inside, guardErr := guardWithinRoots(options, relativePath, logger)
+	if guardErr != nil {
+		return false, "", guardErr
+	}
+	if !inside {
+		return false, "skip(escape)", nil
+	}
+
+	_, statAErr := options.ReplicaA.Stat(relativePath)
+	_, statBErr := options.ReplicaB.Stat(relativePath)
 
 	existsA := !errors.Is(statAErr, fs.ErrNotExist)
 	existsB := !errors.Is(statBErr, fs.ErrNotExist)
@@ -154,19 +406,31 @@ func processSingleFile(relativePath string, options Options, store *stateStore,
 	entry := state.FileEntry[relativePath]
 
 	if existsA && !existsB {
-		content, readErr := readAll(pathA)
+		content, readErr := options.ReplicaA.ReadFile(relativePath)
 		if readErr != nil {
 			if logger != nil {
 				logger.Error("read file", zap.String("path", pathA), zap.Error(readErr))
 			}
 			return false, "", readErr
 		}
-		if err := writeAllEnsure(pathB, content); err != nil {
+		if err := ensureDirsLike(options, path.Dir(relativePath), true); err != nil {
+			if logger != nil {
+				logger.Error("create directory", zap.String("path", filepath.Dir(pathB)), zap.Error(err))
+			}
+			return false, "", err
+		}
+		if err := writeAllEnsure(options.ReplicaB, relativePath, content); err != nil {
 			if logger != nil {
 				logger.Error("write file", zap.String("path", pathB), zap.Error(err))
 			}
 			return false, "", err
 		}
+		if err := adoptOwnership(options, relativePath, true); err != nil {
+			if logger != nil {
+				logger.Error("set owner", zap.String("path", pathB), zap.Error(err))
+			}
+			return false, "", err
+		}
 		hexDigest, ancErr := store.ensureAncestorStored(content)
 		if ancErr != nil {
 			if logger != nil {
@@ -174,24 +438,36 @@ func processSingleFile(relativePath string, options Options, store *stateStore,
 			}
 			return false, "", ancErr
 		}
-		state.FileEntry[relativePath] = stateEntry{AncestorHex: hexDigest}
+		recordVersion(state, relativePath, hexDigest, VersionSideA, time.Now())
 		return true, "B<-A (create)", nil
 	}
 
 	if existsB && !existsA {
-		content, readErr := readAll(pathB)
+		content, readErr := options.ReplicaB.ReadFile(relativePath)
 		if readErr != nil {
 			if logger != nil {
 				logger.Error("read file", zap.String("path", pathB), zap.Error(readErr))
 			}
 			return false, "", readErr
 		}
-		if err := writeAllEnsure(pathA, content); err != nil {
+		if err := ensureDirsLike(options, path.Dir(relativePath), false); err != nil {
+			if logger != nil {
+				logger.Error("create directory", zap.String("path", filepath.Dir(pathA)), zap.Error(err))
+			}
+			return false, "", err
+		}
+		if err := writeAllEnsure(options.ReplicaA, relativePath, content); err != nil {
 			if logger != nil {
 				logger.Error("write file", zap.String("path", pathA), zap.Error(err))
 			}
 			return false, "", err
 		}
+		if err := adoptOwnership(options, relativePath, false); err != nil {
+			if logger != nil {
+				logger.Error("set owner", zap.String("path", pathA), zap.Error(err))
+			}
+			return false, "", err
+		}
 		hexDigest, ancErr := store.ensureAncestorStored(content)
 		if ancErr != nil {
 			if logger != nil {
@@ -199,7 +475,7 @@ func processSingleFile(relativePath string, options Options, store *stateStore,
 			}
 			return false, "", ancErr
 		}
-		state.FileEntry[relativePath] = stateEntry{AncestorHex: hexDigest}
+		recordVersion(state, relativePath, hexDigest, VersionSideB, time.Now())
 		return true, "A<-B (create)", nil
 	}
 
@@ -208,23 +484,36 @@ func processSingleFile(relativePath string, options Options, store *stateStore,
 		return false, "absent", nil
 	}
 
-	contentA, readAErr := readAll(pathA)
+	contentA, readAErr := readReplicaContent(store, options.ReplicaA, relativePath, entry.AncestorHex)
 	if readAErr != nil {
 		if logger != nil {
 			logger.Error("read file", zap.String("path", pathA), zap.Error(readAErr))
 		}
 		return false, "", readAErr
 	}
-	contentB, readBErr := readAll(pathB)
+	contentB, readBErr := readReplicaContent(store, options.ReplicaB, relativePath, entry.AncestorHex)
 	if readBErr != nil {
 		if logger != nil {
 			logger.Error("read file", zap.String("path", pathB), zap.Error(readBErr))
 		}
 		return false, "", readBErr
 	}
+	recorder.observe(relativePath, contentA, contentB)
 
-	if bytesEqual(contentA, contentB) {
-		if entry.AncestorHex == "" {
+	codec, compatible := newTextCodec(options, contentA, contentB)
+	if !compatible {
+		if logger != nil {
+			logger.Warn("sides use different text encodings, not merging", zap.String("path", relativePath))
+		}
+		return false, "conflict(encoding)", nil
+	}
+	filter := newFileFilter(options.FilterRules, relativePath, logger)
+	decodedA, decodedB := filter.clean(codec.decode(contentA, true)), filter.clean(codec.decode(contentB, false))
+	text := newTextNormalizer(options, decodedA, decodedB)
+	normalA, normalB := text.normalize(decodedA), text.normalize(decodedB)
+
+	if text.equal(normalA, normalB) {
+		if entry.AncestorHex != digestBytes(contentA) {
 			hexDigest, ancErr := store.ensureAncestorStored(contentA)
 			if ancErr != nil {
 				if logger != nil {
@@ -232,7 +521,7 @@ func processSingleFile(relativePath string, options Options, store *stateStore,
 				}
 				return false, "", ancErr
 			}
-			state.FileEntry[relativePath] = stateEntry{AncestorHex: hexDigest}
+			recordVersion(state, relativePath, hexDigest, VersionSideBoth, time.Now())
 		}
 		return false, "equal", nil
 	}
@@ -246,86 +535,114 @@ func processSingleFile(relativePath string, options Options, store *stateStore,
 	}
 
 	if baseBytes == nil {
-		infoA, _ := os.Stat(pathA)
-		infoB, _ := os.Stat(pathB)
+		infoA, _ := options.ReplicaA.Stat(relativePath)
+		infoB, _ := options.ReplicaB.Stat(relativePath)
 		modA := modtimeSeconds(infoA)
 		modB := modtimeSeconds(infoB)
 		var merged []byte
 
 		if options.CreateBackupsOnWrite {
-			_ = copyFile(pathA, pathA+".bak.a")
-			_ = copyFile(pathB, pathB+".bak.b")
+			if err := backupBothSides(store, relativePath, contentA, contentB, logger); err != nil {
+				return false, "", err
+			}
 		}
 
 		if absFloat64(modA-modB) <= options.ConflictMtimeEpsilonSeconds {
-			merged = mergeWithMarkers(contentA, contentB)
+			merged = mergeWithMarkers(normalA, normalB)
 		} else if modA > modB {
-			merged = contentA
+			merged = normalA
 		} else {
-			merged = contentB
+			merged = normalB
 		}
 
-		if err := writeAllEnsure(pathA, merged); err != nil {
+		mergedA, mergedB, encodeErr := encodeForSides(codec, text, filter, merged)
+		if encodeErr != nil {
+			if logger != nil {
+				logger.Error("encode file", zap.String("path", relativePath), zap.Error(encodeErr))
+			}
+			return false, "", encodeErr
+		}
+		if err := writeAllEnsure(options.ReplicaA, relativePath, mergedA); err != nil {
 			if logger != nil {
 				logger.Error("write file", zap.String("path", pathA), zap.Error(err))
 			}
 			return false, "", err
 		}
-		if err := writeAllEnsure(pathB, merged); err != nil {
+		if err := writeAllEnsure(options.ReplicaB, relativePath, mergedB); err != nil {
 			if logger != nil {
 				logger.Error("write file", zap.String("path", pathB), zap.Error(err))
 			}
 			return false, "", err
 		}
-		hexDigest, ancErr := store.ensureAncestorStored(merged)
+		hexDigest, ancErr := store.ensureAncestorStored(mergedA)
 		if ancErr != nil {
 			if logger != nil {
 				logger.Error("store ancestor", zap.Error(ancErr))
 			}
 			return false, "", ancErr
 		}
-		state.FileEntry[relativePath] = stateEntry{AncestorHex: hexDigest}
+		recordVersion(state, relativePath, hexDigest, mergedSide(merged, normalA, normalB), time.Now())
 		return true, "merge(seed)", nil
 	}
 
 	if options.CreateBackupsOnWrite {
-		_ = copyFile(pathA, pathA+".bak.a")
-		_ = copyFile(pathB, pathB+".bak.b")
+		if err := backupBothSides(store, relativePath, contentA, contentB, logger); err != nil {
+			return false, "", err
+		}
 	}
 
-	merged, diffUsed := mergeThreeWay(mergeInputs{
-		BaseBytes:  baseBytes,
-		SideABytes: contentA,
-		SideBBytes: contentB,
-		Diff3Path:  diff3Path,
-	})
+	normalBase := text.normalize(filter.clean(codec.decodeBase(baseBytes)))
+	alignedBase, alignedA, alignedB := text.alignWhitespace(normalBase, normalA, normalB)
+	merged, mergeTag := mergeFile(options, relativePath, alignedBase, alignedA, alignedB, diff3Path, logger)
+	if mergeTag == "conflict(driver)" {
+		return false, mergeTag, nil
+	}
+	merged, resolutions := resolveMergeConflicts(options, relativePath, merged, logger)
+	result.AutoResolutions = append(result.AutoResolutions, resolutions...)
 
-	if err := writeAllEnsure(pathA, merged); err != nil {
+	mergedA, mergedB, encodeErr := encodeForSides(codec, text, filter, merged)
+	if encodeErr != nil {
+		if logger != nil {
+			logger.Error("encode file", zap.String("path", relativePath), zap.Error(encodeErr))
+		}
+		return false, "", encodeErr
+	}
+	if err := writeAllEnsure(options.ReplicaA, relativePath, mergedA); err != nil {
 		if logger != nil {
 			logger.Error("write file", zap.String("path", pathA), zap.Error(err))
 		}
 		return false, "", err
 	}
-	if err := writeAllEnsure(pathB, merged); err != nil {
+	if err := writeAllEnsure(options.ReplicaB, relativePath, mergedB); err != nil {
 		if logger != nil {
 			logger.Error("write file", zap.String("path", pathB), zap.Error(err))
 		}
 		return false, "", err
 	}
 
-	hexDigest, ancErr := store.ensureAncestorStored(merged)
+	hexDigest, ancErr := store.ensureAncestorStored(mergedA)
 	if ancErr != nil {
 		if logger != nil {
 			logger.Error("store ancestor", zap.Error(ancErr))
 		}
 		return false, "", ancErr
 	}
-	state.FileEntry[relativePath] = stateEntry{AncestorHex: hexDigest}
+	recordVersion(state, relativePath, hexDigest, mergedSide(merged, normalA, normalB), time.Now())
+	return true, mergeTag, nil
+}
 
-	if diffUsed {
-		return true, "merge(3way)", nil
+// encodeForSides converts merged content to the line endings, filtered form
+// and encoding of each side.
+func encodeForSides(codec textCodec, text textNormalizer, filter fileFilter, merged []byte) ([]byte, []byte, error) {
+	mergedA, err := codec.encode(filter.smudge(text.forSide(merged, true)), true)
+	if err != nil {
+		return nil, nil, err
+	}
+	mergedB, err := codec.encode(filter.smudge(text.forSide(merged, false)), false)
+	if err != nil {
+		return nil, nil, err
 	}
-	return true, "merge(2way)", nil
+	return mergedA, mergedB, nil
 }
 
 func bytesEqual(a []byte, b []byte) bool {
@@ -340,12 +657,21 @@ func bytesEqual(a []byte, b []byte) bool {
 	return true
 }
 
-func copyFile(fromPath string, toPath string) error {
-	data, err := os.ReadFile(fromPath)
-	if err != nil {
+func backupBothSides(store *stateStore, relativePath string, contentA []byte, contentB []byte, logger *zap.Logger) error {
+	now := time.Now()
+	if err := store.storeBackup(relativePath, "a", contentA, now); err != nil {
+		if logger != nil {
+			logger.Error("store backup", zap.String("path", relativePath), zap.Error(err))
+		}
+		return err
+	}
+	if err := store.storeBackup(relativePath, "b", contentB, now); err != nil {
+		if logger != nil {
+			logger.Error("store backup", zap.String("path", relativePath), zap.Error(err))
+		}
 		return err
 	}
-	return writeAllEnsure(toPath, data)
+	return nil
 }
 
 func modtimeSeconds(info fs.FileInfo) float64 {
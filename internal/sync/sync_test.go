@@ -288,6 +288,274 @@ func TestDiff3Missing(t *testing.T) {
 	}
 }
 
+func TestDirectories(t *testing.T) {
+	cases := []struct {
+		name string
+		run  func(t *testing.T, rootA, rootB, state string)
+	}{
+		{
+			name: "EmptyDirectoryCreated",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				if err := os.MkdirAll(filepath.Join(rootB, "inbox", "empty"), 0o755); err != nil {
+					t.Fatalf("mkdir: %v", err)
+				}
+				opts := defaultOptions(rootA, rootB, state)
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("sync err: %v", err)
+				}
+				if res.ActionCounters["A<-B (mkdir)"] != 2 {
+					t.Fatalf("expected two directories created, got %v", res.ActionCounters)
+				}
+				if info, err := os.Stat(filepath.Join(rootA, "inbox", "empty")); err != nil || !info.IsDir() {
+					t.Fatalf("directory not created: %v", err)
+				}
+			},
+		},
+		{
+			name: "DeletionPropagates",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				writeFile(t, filepath.Join(rootA, "old", "n.md"), "N")
+				writeFile(t, filepath.Join(rootA, "keep.md"), "K")
+				if err := os.MkdirAll(filepath.Join(rootA, "old", "sub"), 0o755); err != nil {
+					t.Fatalf("mkdir: %v", err)
+				}
+				opts := defaultOptions(rootA, rootB, state)
+				if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+					t.Fatalf("initial sync: %v", err)
+				}
+				if err := os.RemoveAll(filepath.Join(rootA, "old")); err != nil {
+					t.Fatalf("remove: %v", err)
+				}
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("sync err: %v", err)
+				}
+				if res.ActionCounters["B<-A (rmdir)"] != 1 {
+					t.Fatalf("expected directory removal, got %v", res.ActionCounters)
+				}
+				if _, err := os.Stat(filepath.Join(rootB, "old")); !os.IsNotExist(err) {
+					t.Fatalf("directory still present on B")
+				}
+				if _, err := os.Stat(filepath.Join(rootA, "old")); !os.IsNotExist(err) {
+					t.Fatalf("directory recreated on A")
+				}
+			},
+		},
+		{
+			name: "EmptyRootKeepsDirectories",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				writeFile(t, filepath.Join(rootA, "notes", "n.md"), "N")
+				writeFile(t, filepath.Join(rootA, "projects", "p.md"), "P")
+				opts := defaultOptions(rootA, rootB, state)
+				if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+					t.Fatalf("initial sync: %v", err)
+				}
+				opts.RootAPath = t.TempDir()
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("sync err: %v", err)
+				}
+				if res.ActionCounters["B<-A (rmdir)"] != 0 {
+					t.Fatalf("empty root deleted directories: %v", res.ActionCounters)
+				}
+				if got := readFile(t, filepath.Join(rootB, "projects", "p.md")); got != "P" {
+					t.Fatalf("B has %q", got)
+				}
+				if got := readFile(t, filepath.Join(opts.RootAPath, "notes", "n.md")); got != "N" {
+					t.Fatalf("empty root was not refilled: %q", got)
+				}
+
+				opts.RootAPath = t.TempDir()
+				opts.ForceDirDeletions = true
+				if res, err = syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+					t.Fatalf("forced sync: %v", err)
+				}
+				if res.ActionCounters["B<-A (rmdir)"] != 2 {
+					t.Fatalf("expected forced removal of both directories, got %v", res.ActionCounters)
+				}
+			},
+		},
+		{
+			name: "DeletionKeepsNewContent",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				writeFile(t, filepath.Join(rootA, "old", "n.md"), "N")
+				opts := defaultOptions(rootA, rootB, state)
+				if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+					t.Fatalf("initial sync: %v", err)
+				}
+				if err := os.RemoveAll(filepath.Join(rootA, "old")); err != nil {
+					t.Fatalf("remove: %v", err)
+				}
+				writeFile(t, filepath.Join(rootB, "old", "new.md"), "fresh")
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("sync err: %v", err)
+				}
+				if res.ActionCounters["B<-A (rmdir)"] != 0 {
+					t.Fatalf("directory with new content was removed")
+				}
+				if got := readFile(t, filepath.Join(rootA, "old", "new.md")); got != "fresh" {
+					t.Fatalf("unexpected content: %q", got)
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rootA := t.TempDir()
+			rootB := t.TempDir()
+			state := t.TempDir()
+			tc.run(t, rootA, rootB, state)
+		})
+	}
+}
+
+func TestSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlink tests skipped on Windows")
+	}
+
+	cases := []struct {
+		name string
+		run  func(t *testing.T, rootA, rootB, state string)
+	}{
+		{
+			name: "PreserveCopiesLinkTarget",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				writeFile(t, filepath.Join(rootA, "real.md"), "R")
+				if err := os.Symlink("real.md", filepath.Join(rootA, "alias.md")); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+				opts := defaultOptions(rootA, rootB, state)
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("sync err: %v", err)
+				}
+				if res.ActionCounters["B<-A (link)"] != 1 {
+					t.Fatalf("expected link copy, got %v", res.ActionCounters)
+				}
+				target, err := os.Readlink(filepath.Join(rootB, "alias.md"))
+				if err != nil {
+					t.Fatalf("readlink: %v", err)
+				}
+				if target != "real.md" {
+					t.Fatalf("unexpected target: %q", target)
+				}
+			},
+		},
+		{
+			name: "PreserveMergesLinkChange",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				if err := os.Symlink("one", filepath.Join(rootA, "l")); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+				opts := defaultOptions(rootA, rootB, state)
+				if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+					t.Fatalf("initial sync: %v", err)
+				}
+				if err := os.Remove(filepath.Join(rootB, "l")); err != nil {
+					t.Fatalf("remove: %v", err)
+				}
+				if err := os.Symlink("two", filepath.Join(rootB, "l")); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("sync err: %v", err)
+				}
+				if res.ActionCounters["A<-B (link)"] != 1 {
+					t.Fatalf("expected link update, got %v", res.ActionCounters)
+				}
+				target, err := os.Readlink(filepath.Join(rootA, "l"))
+				if err != nil {
+					t.Fatalf("readlink: %v", err)
+				}
+				if target != "two" {
+					t.Fatalf("unexpected target: %q", target)
+				}
+			},
+		},
+		{
+			name: "FollowRefusesEscape",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				outside := t.TempDir()
+				writeFile(t, filepath.Join(outside, "secret.md"), "S")
+				if err := os.Symlink(filepath.Join(outside, "secret.md"), filepath.Join(rootA, "secret.md")); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+				if err := os.Symlink(outside, filepath.Join(rootA, "out")); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+				opts := defaultOptions(rootA, rootB, state)
+				opts.SymlinkMode = syncpkg.SymlinkModeFollow
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("sync err: %v", err)
+				}
+				if res.ChangedFileCount != 0 {
+					t.Fatalf("expected no changes, got %v", res.ActionCounters)
+				}
+				if _, err := os.Lstat(filepath.Join(rootB, "secret.md")); !os.IsNotExist(err) {
+					t.Fatalf("escaping link was synced")
+				}
+			},
+		},
+		{
+			name: "FollowBreaksCycles",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				writeFile(t, filepath.Join(rootA, "dir", "n.md"), "N")
+				if err := os.Symlink("..", filepath.Join(rootA, "dir", "up")); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+				opts := defaultOptions(rootA, rootB, state)
+				opts.SymlinkMode = syncpkg.SymlinkModeFollow
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("sync err: %v", err)
+				}
+				if res.ChangedFileCount != 1 {
+					t.Fatalf("expected one change, got %v", res.ActionCounters)
+				}
+				if got := readFile(t, filepath.Join(rootB, "dir", "n.md")); got != "N" {
+					t.Fatalf("unexpected content: %q", got)
+				}
+			},
+		},
+		{
+			name: "PreserveRefusesWriteThroughEscapingLink",
+			run: func(t *testing.T, rootA, rootB, state string) {
+				outside := t.TempDir()
+				writeFile(t, filepath.Join(rootA, "dir", "n.md"), "N")
+				if err := os.Symlink(outside, filepath.Join(rootB, "dir")); err != nil {
+					t.Fatalf("symlink: %v", err)
+				}
+				opts := defaultOptions(rootA, rootB, state)
+				res, err := syncpkg.RunSync(opts, zap.NewNop())
+				if err != nil {
+					t.Fatalf("sync err: %v", err)
+				}
+				if res.ActionCounters["skip(escape)"] == 0 {
+					t.Fatalf("expected escape refusal, got %v", res.ActionCounters)
+				}
+				if _, err := os.Stat(filepath.Join(outside, "n.md")); !os.IsNotExist(err) {
+					t.Fatalf("file written outside root")
+				}
+			},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rootA := t.TempDir()
+			rootB := t.TempDir()
+			state := t.TempDir()
+			tc.run(t, rootA, rootB, state)
+		})
+	}
+}
+
 func testTime(sec int64) time.Time {
 	return time.Unix(sec, 0)
 }
@@ -0,0 +1,155 @@
+package sync
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Line endings accepted for Options.LineEnding.
+const (
+	LineEndingPreserve = ""
+	LineEndingLF       = "lf"
+	LineEndingCRLF     = "crlf"
+)
+
+// binarySniffLength is how much of a file is checked for NUL bytes before it
+// is treated as text.
+const binarySniffLength = 8000
+
+func validateLineEnding(lineEnding string) error {
+	switch lineEnding {
+	case LineEndingPreserve, LineEndingLF, LineEndingCRLF:
+		return nil
+	}
+	return fmt.Errorf("unknown line ending %q", lineEnding)
+}
+
+// textForm is how one side writes a text file.
+type textForm struct {
+	crlf         bool
+	finalNewline bool
+}
+
+// textNormalizer compares and merges text files in a normal form with LF
+// line endings and a final newline, optionally ignoring trailing white space
+// when lines are compared, and converts merged results back to the form each
+// side uses.
+type textNormalizer struct {
+	enabled      bool
+	trimTrailing bool
+	formA        textForm
+	formB        textForm
+}
+
+func newTextNormalizer(options Options, contentA []byte, contentB []byte) textNormalizer {
+	if !options.NormalizeLineEndings && !options.IgnoreTrailingWhitespace {
+		return textNormalizer{}
+	}
+	if !looksLikeText(contentA) || !looksLikeText(contentB) {
+		return textNormalizer{}
+	}
+	normalizer := textNormalizer{
+		enabled:      true,
+		trimTrailing: options.IgnoreTrailingWhitespace,
+		formA:        detectTextForm(contentA),
+		formB:        detectTextForm(contentB),
+	}
+	if options.LineEnding != LineEndingPreserve {
+		normalizer.formA.crlf = options.LineEnding == LineEndingCRLF
+		normalizer.formB.crlf = options.LineEnding == LineEndingCRLF
+	}
+	return normalizer
+}
+
+func looksLikeText(content []byte) bool {
+	return bytes.IndexByte(content[:min(len(content), binarySniffLength)], 0) < 0
+}
+
+// detectTextForm picks CRLF when most line breaks are CRLF.
+func detectTextForm(content []byte) textForm {
+	crlf := bytes.Count(content, []byte("\r\n"))
+	lf := bytes.Count(content, []byte("\n")) - crlf
+	return textForm{
+		crlf:         crlf > lf,
+		finalNewline: len(content) == 0 || bytes.HasSuffix(content, []byte("\n")),
+	}
+}
+
+func (n textNormalizer) normalize(content []byte) []byte {
+	if !n.enabled || content == nil {
+		return content
+	}
+	normal := bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	if len(normal) > 0 && normal[len(normal)-1] != '\n' {
+		normal = append(normal, '\n')
+	}
+	return normal
+}
+
+// equal reports whether two normalized texts match, ignoring trailing white
+// space when that is enabled.
+func (n textNormalizer) equal(a []byte, b []byte) bool {
+	if !n.trimTrailing {
+		return bytesEqual(a, b)
+	}
+	linesA, linesB := strings.Split(string(a), "\n"), strings.Split(string(b), "\n")
+	return sequencesEqual(linesA, linesB, sameIgnoringTrailing)
+}
+
+func sameIgnoringTrailing(x string, y string) bool {
+	return strings.TrimRight(x, " \t") == strings.TrimRight(y, " \t")
+}
+
+// alignWhitespace prepares normalized texts for a merge when trailing white
+// space is ignored. Lines that differ only in trailing white space take one
+// common form in base and on both sides, so that the merge neither reports
+// them as changed nor drops the white space of lines nobody edited. A white
+// space change that meets a real edit of the same line on the other side
+// gives way to that edit.
+func (n textNormalizer) alignWhitespace(base []byte, a []byte, b []byte) ([]byte, []byte, []byte) {
+	if !n.trimTrailing || base == nil {
+		return base, a, b
+	}
+	baseLines := strings.Split(string(base), "\n")
+	linesA, linesB := strings.Split(string(a), "\n"), strings.Split(string(b), "\n")
+	matchA := lcsMatches(baseLines, linesA, sameIgnoringTrailing)
+	matchB := lcsMatches(baseLines, linesB, sameIgnoringTrailing)
+	for index, line := range baseLines {
+		atA, atB := matchA[index], matchB[index]
+		switch {
+		case atA >= 0 && atB >= 0:
+			if linesA[atA] != line {
+				baseLines[index] = linesA[atA]
+			} else {
+				baseLines[index] = linesB[atB]
+			}
+			linesA[atA], linesB[atB] = baseLines[index], baseLines[index]
+		case atA >= 0:
+			linesA[atA] = line
+		case atB >= 0:
+			linesB[atB] = line
+		}
+	}
+	join := func(lines []string) []byte { return []byte(strings.Join(lines, "\n")) }
+	return join(baseLines), join(linesA), join(linesB)
+}
+
+// forSide converts normalized content to the form of side A or side B.
+func (n textNormalizer) forSide(content []byte, sideA bool) []byte {
+	if !n.enabled {
+		return content
+	}
+	form := n.formB
+	if sideA {
+		form = n.formA
+	}
+	out := content
+	if !form.finalNewline {
+		out = bytes.TrimSuffix(out, []byte("\n"))
+	}
+	if form.crlf {
+		out = bytes.ReplaceAll(out, []byte("\n"), []byte("\r\n"))
+	}
+	return out
+}
@@ -0,0 +1,122 @@
+package sync_test
+
+import (
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+)
+
+func TestTextNormalization(t *testing.T) {
+	if _, err := exec.LookPath("diff3"); err != nil {
+		t.Skip("diff3 not available")
+	}
+	cases := []struct {
+		name       string
+		configure  func(*syncpkg.Options)
+		base       string
+		sideA      string
+		sideB      string
+		wantA      string
+		wantB      string
+		wantChange bool
+	}{
+		{
+			name:      "LineEndingsOnlyAreEqual",
+			configure: func(o *syncpkg.Options) { o.NormalizeLineEndings = true },
+			base:      "one\ntwo\n",
+			sideA:     "one\r\ntwo\r\n",
+			sideB:     "one\ntwo",
+			wantA:     "one\r\ntwo\r\n",
+			wantB:     "one\ntwo",
+		},
+		{
+			name:       "MergeKeepsEachSidesConvention",
+			configure:  func(o *syncpkg.Options) { o.NormalizeLineEndings = true },
+			base:       "one\ntwo\nthree\nfour\n",
+			sideA:      "ONE\r\ntwo\r\nthree\r\nfour\r\n",
+			sideB:      "one\ntwo\nthree\nFOUR",
+			wantA:      "ONE\r\ntwo\r\nthree\r\nFOUR\r\n",
+			wantB:      "ONE\ntwo\nthree\nFOUR",
+			wantChange: true,
+		},
+		{
+			name: "CanonicalLineEnding",
+			configure: func(o *syncpkg.Options) {
+				o.NormalizeLineEndings = true
+				o.LineEnding = syncpkg.LineEndingLF
+			},
+			base:       "one\ntwo\nthree\nfour\n",
+			sideA:      "ONE\r\ntwo\r\nthree\r\nfour\r\n",
+			sideB:      "one\ntwo\nthree\nFOUR\n",
+			wantA:      "ONE\ntwo\nthree\nFOUR\n",
+			wantB:      "ONE\ntwo\nthree\nFOUR\n",
+			wantChange: true,
+		},
+		{
+			name:      "TrailingWhitespaceIgnored",
+			configure: func(o *syncpkg.Options) { o.IgnoreTrailingWhitespace = true },
+			base:      "one\ntwo\n",
+			sideA:     "one  \ntwo\n",
+			sideB:     "one\ntwo\t\n",
+			wantA:     "one  \ntwo\n",
+			wantB:     "one\ntwo\t\n",
+		},
+		{
+			name:       "TrailingWhitespaceKeptWhenOneSideEdits",
+			configure:  func(o *syncpkg.Options) { o.IgnoreTrailingWhitespace = true },
+			base:       "hard  \nbreak\nend\n",
+			sideA:      "hard  \nbreak\nEND\n",
+			sideB:      "hard  \nbreak\nend\n",
+			wantA:      "hard  \nbreak\nEND\n",
+			wantB:      "hard  \nbreak\nEND\n",
+			wantChange: true,
+		},
+		{
+			name:       "TrailingWhitespaceChangeMergedWithEdit",
+			configure:  func(o *syncpkg.Options) { o.IgnoreTrailingWhitespace = true },
+			base:       "hard\nbreak\nend\n",
+			sideA:      "hard  \nbreak\nend\n",
+			sideB:      "hard\nbreak\nEND\n",
+			wantA:      "hard  \nbreak\nEND\n",
+			wantB:      "hard  \nbreak\nEND\n",
+			wantChange: true,
+		},
+		{
+			name:       "LoneCarriageReturnKept",
+			configure:  func(o *syncpkg.Options) { o.NormalizeLineEndings = true },
+			base:       "x\ry\nmiddle\nend\n",
+			sideA:      "x\ry\nmiddle\nEND\n",
+			sideB:      "X\ry\r\nmiddle\r\nend\r\n",
+			wantA:      "X\ry\nmiddle\nEND\n",
+			wantB:      "X\ry\r\nmiddle\r\nEND\r\n",
+			wantChange: true,
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+			tc.configure(&opts)
+
+			res := mergeBothChanged(t, opts, "n.txt", tc.base, tc.sideA, tc.sideB)
+			if changed := res.ChangedFileCount > 0; changed != tc.wantChange {
+				t.Fatalf("changed = %v, counters %v", changed, res.ActionCounters)
+			}
+			if got := readFile(t, filepath.Join(opts.RootAPath, "n.txt")); got != tc.wantA {
+				t.Fatalf("side A = %q, want %q", got, tc.wantA)
+			}
+			if got := readFile(t, filepath.Join(opts.RootBPath, "n.txt")); got != tc.wantB {
+				t.Fatalf("side B = %q, want %q", got, tc.wantB)
+			}
+		})
+	}
+
+	opts := defaultOptions(t.TempDir(), t.TempDir(), t.TempDir())
+	opts.LineEnding = "cr"
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err == nil {
+		t.Fatalf("expected an error for an unknown line ending")
+	}
+}
@@ -0,0 +1,47 @@
+package sync
+
+import "strings"
+
+// mergeUnion merges line by line and never conflicts: where both sides
+// changed the same region, the lines of a are followed by the lines of b.
+// With dedup, a line from such a region is dropped when an equal line was
+// already kept, which suits list-like files such as .gitignore. Lines outside
+// those regions are kept as they are, repeated or not.
+func mergeUnion(base []byte, a []byte, b []byte, dedup bool) []byte {
+	equal := func(x string, y string) bool {
+		return x == y
+	}
+	var lines []string
+	seen := map[string]bool{}
+	keep := func(line string, fromConflict bool) {
+		key := strings.TrimRight(line, "\r\n")
+		if dedup && fromConflict && strings.TrimSpace(key) != "" && seen[key] {
+			return
+		}
+		seen[key] = true
+		lines = append(lines, line)
+	}
+	for _, hunk := range diff3Hunks(splitLines(string(base)), splitLines(string(a)), splitLines(string(b)), equal) {
+		if !hunk.Conflict {
+			for _, line := range hunk.Resolved {
+				keep(line, false)
+			}
+			continue
+		}
+		for _, line := range hunk.A {
+			keep(line, true)
+		}
+		for _, line := range hunk.B {
+			keep(line, true)
+		}
+	}
+
+	var out strings.Builder
+	for index, line := range lines {
+		out.WriteString(line)
+		if index < len(lines)-1 && !strings.HasSuffix(line, "\n") {
+			out.WriteByte('\n')
+		}
+	}
+	return []byte(out.String())
+}
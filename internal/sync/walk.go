@@ -1,8 +1,13 @@
 package sync
 
 import (
+	"errors"
+	"io/fs"
+	"path"
 	"path/filepath"
 	"strings"
+
+	"go.uber.org/zap"
 )
 
 func shouldIgnorePath(relativePath string, ignorePrefixes []string) bool {
@@ -34,3 +39,114 @@ func shouldInclude(relativePath, fileName, includeGlob string) bool {
 	matchName, _ := filepath.Match(includeGlob, fileName)
 	return matchRel || matchName
 }
+
+// collectRelativePaths adds every synchronizable path of fsys to relativeSet
+// and every directory to dirSet. Symbolic links are reported as entries of
+// their own unless the options ask to follow them.
+func collectRelativePaths(fsys ReplicaFS, options Options, relativeSet map[string]struct{}, dirSet map[string]struct{}, logger *zap.Logger) error {
+	if options.SymlinkMode == SymlinkModeFollow {
+		realRoot, _, err := resolveReplicaPath(fsys, ".")
+		if err != nil {
+			return err
+		}
+		visited := map[string]struct{}{realRoot: {}}
+		return walkFollowingLinks(fsys, realRoot, "", options, visited, relativeSet, dirSet, logger)
+	}
+
+	return fsys.WalkDir(".", func(rel string, d fs.DirEntry, walkErr error) error {
+		if walkErr != nil {
+			return walkErr
+		}
+		if d.IsDir() {
+			if rel == "." {
+				return nil
+			}
+			if shouldIgnorePath(rel, options.IgnorePathPrefixes) {
+				return fs.SkipDir
+			}
+			dirSet[rel] = struct{}{}
+			return nil
+		}
+		fileName := d.Name()
+		if shouldIgnoreName(fileName, options.IgnoreFileNames) {
+			return nil
+		}
+		if shouldInclude(rel, fileName, options.IncludeGlob) {
+			relativeSet[rel] = struct{}{}
+		}
+		return nil
+	})
+}
+
+// walkFollowingLinks walks the directory dirName of fsys, which has its links
+// resolved, descending into linked directories whose targets stay inside the
+// replica. visited holds the resolved directories on the current descent path
+// and breaks link cycles.
+func walkFollowingLinks(fsys ReplicaFS, dirName string, relativeDir string, options Options, visited map[string]struct{}, relativeSet map[string]struct{}, dirSet map[string]struct{}, logger *zap.Logger) error {
+	entries, err := fsys.ReadDir(dirName)
+	if err != nil {
+		return err
+	}
+	for _, d := range entries {
+		name := d.Name()
+		rel := path.Join(relativeDir, name)
+		currentName := path.Join(dirName, name)
+		isDir := d.IsDir()
+
+		if d.Type()&fs.ModeSymlink != 0 {
+			target, inside, resolveErr := resolveReplicaPath(fsys, currentName)
+			if resolveErr != nil {
+				if logger != nil {
+					logger.Warn("skipping unresolvable symlink", zap.String("path", rel), zap.Error(resolveErr))
+				}
+				continue
+			}
+			if !inside {
+				if logger != nil {
+					logger.Warn("skipping symlink that resolves outside root", zap.String("path", rel))
+				}
+				continue
+			}
+			info, statErr := fsys.Stat(target)
+			if errors.Is(statErr, fs.ErrNotExist) {
+				if logger != nil {
+					logger.Warn("skipping unresolvable symlink", zap.String("path", rel), zap.Error(statErr))
+				}
+				continue
+			}
+			if statErr != nil {
+				return statErr
+			}
+			isDir = info.IsDir()
+			currentName = target
+		}
+
+		if isDir {
+			if shouldIgnorePath(rel, options.IgnorePathPrefixes) {
+				continue
+			}
+			if _, seen := visited[currentName]; seen {
+				if logger != nil {
+					logger.Warn("skipping symlink cycle", zap.String("path", rel))
+				}
+				continue
+			}
+			dirSet[rel] = struct{}{}
+			visited[currentName] = struct{}{}
+			walkErr := walkFollowingLinks(fsys, currentName, rel, options, visited, relativeSet, dirSet, logger)
+			delete(visited, currentName)
+			if walkErr != nil {
+				return walkErr
+			}
+			continue
+		}
+
+		if shouldIgnoreName(name, options.IgnoreFileNames) {
+			continue
+		}
+		if shouldInclude(rel, name, options.IncludeGlob) {
+			relativeSet[rel] = struct{}{}
+		}
+	}
+	return nil
+}
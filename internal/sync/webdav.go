@@ -0,0 +1,670 @@
+package sync
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	stdsync "sync"
+	"time"
+)
+
+// davPropfind asks for the properties zync reads from a WebDAV server.
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/><D:getetag/></D:prop></D:propfind>`
+
+// davEntry is what zync knows about one name of a WebDAV replica.
+type davEntry struct {
+	dir     bool
+	size    int64
+	etag    string
+	modTime time.Time
+	digest  string
+}
+
+type davFileInfo struct {
+	name  string
+	entry davEntry
+}
+
+func (i davFileInfo) Name() string { return i.name }
+func (i davFileInfo) Size() int64  { return i.entry.size }
+func (i davFileInfo) Mode() fs.FileMode {
+	if i.entry.dir {
+		return fs.ModeDir | 0o755
+	}
+	return 0o644
+}
+func (i davFileInfo) ModTime() time.Time { return i.entry.modTime }
+func (i davFileInfo) IsDir() bool        { return i.entry.dir }
+func (i davFileInfo) Sys() any           { return nil }
+
+// davError is a WebDAV response with an unexpected status.
+type davError struct {
+	Method string
+	Status int
+}
+
+func (e *davError) Error() string {
+	return fmt.Sprintf("webdav: %s: %d %s", e.Method, e.Status, http.StatusText(e.Status))
+}
+
+// Unwrap maps the response status to the matching fs error.
+func (e *davError) Unwrap() error {
+	switch e.Status {
+	case http.StatusNotFound:
+		return fs.ErrNotExist
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return fs.ErrPermission
+	case http.StatusPreconditionFailed, http.StatusLocked:
+		return errChangedRemotely
+	}
+	return nil
+}
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ETag          string `xml:"DAV: getetag"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// WebDAVFS is a ReplicaFS kept in a collection of a WebDAV server, such as
+// Nextcloud or a NAS. The collection is listed once when the replica is
+// opened and the listing is kept up to date with zync's own changes. Files
+// are uploaded next to their destination and moved into place, after
+// checking that the destination's ETag did not change since it was listed,
+// so concurrent updates by other clients are refused rather than lost.
+// Symbolic links cannot be stored and permission bits are not kept.
+type WebDAVFS struct {
+	base     *url.URL
+	user     string
+	password string
+	http     *http.Client
+	digests  digestCache
+	mutex    stdsync.Mutex
+	entries  map[string]*davEntry
+}
+
+// DialWebDAV opens rootURL, a webdav:// or davs:// URL for a collection
+// served over HTTP or HTTPS, and lists everything below it. Basic
+// authentication uses the user of the URL with its password or
+// config.WebDAVPassword. Digests of listed files are remembered in
+// config.StateDirectory when it is set.
+func DialWebDAV(rootURL string, config RootConfig) (*WebDAVFS, error) {
+	parsed, err := url.Parse(rootURL)
+	if err != nil {
+		return nil, err
+	}
+	base := *parsed
+	switch parsed.Scheme {
+	case "webdav":
+		base.Scheme = "http"
+	case "davs":
+		base.Scheme = "https"
+	}
+	if base.Scheme == parsed.Scheme || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid webdav root %q, expected webdav://host/path or davs://host/path", parsed.Redacted())
+	}
+	replica := &WebDAVFS{http: &http.Client{Timeout: 5 * time.Minute}}
+	if parsed.User != nil {
+		replica.user = parsed.User.Username()
+		replica.password, _ = parsed.User.Password()
+	}
+	if replica.password == "" {
+		replica.password = config.WebDAVPassword
+	}
+	base.User = nil
+	base.Path = strings.TrimSuffix(base.Path, "/") + "/"
+	base.RawPath = ""
+	base.RawQuery, base.Fragment = "", ""
+	replica.base = &base
+	replica.digests = newDigestCache(config.StateDirectory, "webdav-digests.json", base.String())
+	if err := replica.load(); err != nil {
+		return nil, fmt.Errorf("list %s: %w", base.String(), err)
+	}
+	return replica, nil
+}
+
+// target returns the URL of name, with a trailing slash for collections.
+func (w *WebDAVFS) target(name string, dir bool) string {
+	location := *w.base
+	if name != "." {
+		location.Path += name
+		if dir {
+			location.Path += "/"
+		}
+	}
+	return location.String()
+}
+
+// do sends a request for name and returns the response of a successful
+// request with its body unread.
+func (w *WebDAVFS) do(method string, name string, dir bool, header http.Header, body []byte) (*http.Response, error) {
+	request, err := http.NewRequest(method, w.target(name, dir), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	if w.user != "" {
+		request.SetBasicAuth(w.user, w.password)
+	}
+	response, err := w.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode/100 == 2 {
+		return response, nil
+	}
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+	response.Body.Close()
+	return nil, &davError{Method: method, Status: response.StatusCode}
+}
+
+// propfind returns the entries of name and, with depth "1", of its children.
+func (w *WebDAVFS) propfind(name string, dir bool, depth string) (map[string]davEntry, error) {
+	header := http.Header{"Depth": {depth}, "Content-Type": {"application/xml; charset=utf-8"}}
+	response, err := w.do("PROPFIND", name, dir, header, []byte(davPropfind))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var status davMultistatus
+	if err := xml.NewDecoder(response.Body).Decode(&status); err != nil {
+		return nil, fmt.Errorf("webdav: decode listing: %w", err)
+	}
+	entries := map[string]davEntry{}
+	for _, item := range status.Responses {
+		href, err := url.Parse(item.Href)
+		if err != nil {
+			return nil, fmt.Errorf("webdav: invalid href %q: %w", item.Href, err)
+		}
+		relative, ok := strings.CutPrefix(strings.TrimSuffix(href.Path, "/")+"/", w.base.Path)
+		if !ok {
+			continue
+		}
+		found := "."
+		if relative = strings.TrimSuffix(relative, "/"); relative != "" {
+			found = relative
+		}
+		var entry davEntry
+		for _, propstat := range item.Propstat {
+			if !strings.Contains(propstat.Status, " 200") {
+				continue
+			}
+			prop := propstat.Prop
+			entry.dir = entry.dir || prop.ResourceType.Collection != nil
+			if size, err := strconv.ParseInt(strings.TrimSpace(prop.ContentLength), 10, 64); err == nil {
+				entry.size = size
+			}
+			if modTime, err := http.ParseTime(prop.LastModified); err == nil {
+				entry.modTime = modTime
+			}
+			if prop.ETag != "" {
+				entry.etag = prop.ETag
+			}
+		}
+		if entry.dir {
+			entry.size, entry.etag = 0, ""
+		}
+		entries[found] = entry
+	}
+	return entries, nil
+}
+
+// load builds the index by listing one collection at a time, as many servers
+// refuse PROPFIND with infinite depth, taking digests from the cache where
+// the ETag still matches.
+func (w *WebDAVFS) load() error {
+	cached, err := w.digests.read()
+	if err != nil {
+		return err
+	}
+	w.entries = map[string]*davEntry{".": {dir: true}}
+	pending := []string{"."}
+	for len(pending) > 0 {
+		dir := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		listing, err := w.propfind(dir, true, "1")
+		if err != nil {
+			return err
+		}
+		for name, entry := range listing {
+			if name == dir || path.Dir(name) != dir {
+				continue
+			}
+			if remembered, ok := cached[name]; ok && !entry.dir && remembered.ETag == entry.etag {
+				entry.digest = remembered.Digest
+			}
+			entry := entry
+			w.entries[name] = &entry
+			if entry.dir {
+				pending = append(pending, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Close remembers the digests of the files below the collection for the next
+// run.
+func (w *WebDAVFS) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	digests := map[string]cachedDigest{}
+	for name, current := range w.entries {
+		if !current.dir && current.etag != "" && current.digest != "" {
+			digests[name] = cachedDigest{ETag: current.etag, Digest: current.digest}
+		}
+	}
+	return w.digests.write(digests)
+}
+
+// storesSymlinks reports that WebDAV has no symbolic links.
+func (w *WebDAVFS) storesSymlinks() bool {
+	return false
+}
+
+// locate returns the index name of name. Without links, no resolution is
+// needed.
+func (w *WebDAVFS) locate(op string, name string) (string, error) {
+	clean := path.Clean(name)
+	if !fs.ValidPath(clean) {
+		return "", &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return clean, nil
+}
+
+// requireParent checks that the parent of name is a collection. The caller
+// holds the lock.
+func (w *WebDAVFS) requireParent(op string, displayName string, name string) error {
+	parent, ok := w.entries[path.Dir(name)]
+	if !ok {
+		return &fs.PathError{Op: op, Path: displayName, Err: fs.ErrNotExist}
+	}
+	if !parent.dir {
+		return &fs.PathError{Op: op, Path: displayName, Err: errNotDirectory}
+	}
+	return nil
+}
+
+// Stat returns information about the entry at name.
+func (w *WebDAVFS) Stat(name string) (fs.FileInfo, error) {
+	return w.info("stat", name)
+}
+
+// Lstat returns information about the entry at name, the same as Stat.
+func (w *WebDAVFS) Lstat(name string) (fs.FileInfo, error) {
+	return w.info("lstat", name)
+}
+
+func (w *WebDAVFS) info(op string, name string) (fs.FileInfo, error) {
+	located, err := w.locate(op, name)
+	if err != nil {
+		return nil, err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	current, ok := w.entries[located]
+	if !ok {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	}
+	return davFileInfo{name: path.Base(located), entry: *current}, nil
+}
+
+// ReadDir lists the collection at name sorted by file name.
+func (w *WebDAVFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	located, err := w.locate("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	current, ok := w.entries[located]
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	if !current.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errNotDirectory}
+	}
+	var entries []fs.DirEntry
+	for other, child := range w.entries {
+		if other != "." && path.Dir(other) == located {
+			entries = append(entries, fs.FileInfoToDirEntry(davFileInfo{name: path.Base(other), entry: *child}))
+		}
+	}
+	sortDirEntries(entries)
+	return entries, nil
+}
+
+// WalkDir walks the tree at name from the listing.
+func (w *WebDAVFS) WalkDir(name string, fn fs.WalkDirFunc) error {
+	return WalkReplica(w, name, fn)
+}
+
+// ReadFile downloads the file at name.
+func (w *WebDAVFS) ReadFile(name string) ([]byte, error) {
+	located, err := w.locate("read", name)
+	if err != nil {
+		return nil, err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.read(name, located)
+}
+
+// read downloads located and records its digest. The caller holds the lock.
+func (w *WebDAVFS) read(name string, located string) ([]byte, error) {
+	current, ok := w.entries[located]
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: fs.ErrNotExist}
+	}
+	if current.dir {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errIsDirectory}
+	}
+	response, err := w.do(http.MethodGet, located, false, nil, nil)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	defer response.Body.Close()
+	content, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	if etag := response.Header.Get("ETag"); etag != "" {
+		current.etag = etag
+	}
+	current.size = int64(len(content))
+	current.digest = digestBytes(content)
+	return content, nil
+}
+
+// Hash returns the digest of the file at name, remembered from an earlier
+// run while its ETag is unchanged and otherwise downloaded once per run.
+func (w *WebDAVFS) Hash(name string) (string, error) {
+	located, err := w.locate("hash", name)
+	if err != nil {
+		return "", err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	current, ok := w.entries[located]
+	if !ok || current.dir {
+		return "", &fs.PathError{Op: "hash", Path: name, Err: fs.ErrNotExist}
+	}
+	if current.digest == "" {
+		if _, err := w.read(name, located); err != nil {
+			return "", err
+		}
+	}
+	return current.digest, nil
+}
+
+// unchanged checks that the server still has located as zync last saw it,
+// or still has nothing at a name zync has not seen. The caller holds the
+// lock.
+func (w *WebDAVFS) unchanged(located string) error {
+	current, known := w.entries[located]
+	remote, err := w.propfind(located, false, "0")
+	if errors.Is(err, fs.ErrNotExist) {
+		if known {
+			return errChangedRemotely
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !known || current.etag != "" && remote[located].etag != current.etag {
+		return errChangedRemotely
+	}
+	return nil
+}
+
+// move renames from to to on the server.
+func (w *WebDAVFS) move(from string, to string, dir bool, overwrite bool) error {
+	header := http.Header{"Destination": {w.target(to, dir)}, "Overwrite": {"F"}}
+	if overwrite {
+		header.Set("Overwrite", "T")
+	}
+	response, err := w.do("MOVE", from, dir, header, nil)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// WriteFile uploads data next to name and moves it into place.
+func (w *WebDAVFS) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	located, err := w.locate("write", name)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.requireParent("write", name, located); err != nil {
+		return err
+	}
+	if current, ok := w.entries[located]; ok && current.dir {
+		return &fs.PathError{Op: "write", Path: name, Err: errIsDirectory}
+	}
+	if err := w.unchanged(located); err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	temp := temporarySibling(located)
+	response, err := w.do(http.MethodPut, temp, false, http.Header{"Content-Type": {"application/octet-stream"}}, data)
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	response.Body.Close()
+	if err := w.move(temp, located, false, true); err != nil {
+		if cleanup, cleanupErr := w.do(http.MethodDelete, temp, false, nil, nil); cleanupErr == nil {
+			cleanup.Body.Close()
+		}
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+	written := davEntry{size: int64(len(data)), modTime: time.Now()}
+	if listing, err := w.propfind(located, false, "0"); err == nil {
+		written = listing[located]
+	}
+	written.digest = digestBytes(data)
+	w.entries[located] = &written
+	return nil
+}
+
+// Mkdir creates the collection name.
+func (w *WebDAVFS) Mkdir(name string, perm fs.FileMode) error {
+	located, err := w.locate("mkdir", name)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if _, ok := w.entries[located]; ok {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+	if err := w.requireParent("mkdir", name, located); err != nil {
+		return err
+	}
+	return w.mkcol(name, located)
+}
+
+// mkcol creates the collection located. The caller holds the lock.
+func (w *WebDAVFS) mkcol(name string, located string) error {
+	response, err := w.do("MKCOL", located, true, nil, nil)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	response.Body.Close()
+	w.entries[located] = &davEntry{dir: true, modTime: time.Now()}
+	return nil
+}
+
+// MkdirAll creates the collection name along with any missing parents.
+func (w *WebDAVFS) MkdirAll(name string, perm fs.FileMode) error {
+	located, err := w.locate("mkdir", name)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	var missing []string
+	for parent := located; parent != "."; parent = path.Dir(parent) {
+		current, ok := w.entries[parent]
+		if ok && !current.dir {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errNotDirectory}
+		}
+		if !ok {
+			missing = append(missing, parent)
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if err := w.mkcol(name, missing[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename moves oldName to newName on the server.
+func (w *WebDAVFS) Rename(oldName string, newName string) error {
+	from, err := w.locate("rename", oldName)
+	if err != nil {
+		return err
+	}
+	to, err := w.locate("rename", newName)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	source, ok := w.entries[from]
+	if !ok || from == "." {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: fs.ErrNotExist}
+	}
+	if err := w.requireParent("rename", newName, to); err != nil {
+		return err
+	}
+	target, exists := w.entries[to]
+	if exists && (target.dir != source.dir || target.dir && w.hasChildren(to)) {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	}
+	if err := w.move(from, to, source.dir, exists); err != nil {
+		return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+	}
+	moved := map[string]*davEntry{}
+	for other, entry := range w.entries {
+		if other == from || isBelow(other, from) {
+			moved[to+strings.TrimPrefix(other, from)] = entry
+			delete(w.entries, other)
+		}
+	}
+	for other, entry := range moved {
+		w.entries[other] = entry
+	}
+	return nil
+}
+
+// hasChildren reports whether any entry lies below name. The caller holds
+// the lock.
+func (w *WebDAVFS) hasChildren(name string) bool {
+	for other := range w.entries {
+		if isBelow(other, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remove removes the file or empty collection at name.
+func (w *WebDAVFS) Remove(name string) error {
+	located, err := w.locate("remove", name)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	current, ok := w.entries[located]
+	if !ok || located == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	if current.dir && w.hasChildren(located) {
+		return &fs.PathError{Op: "remove", Path: name, Err: errDirectoryInUse}
+	}
+	return w.delete(name, located, current.dir)
+}
+
+// delete deletes located and everything below it. The caller holds the
+// lock.
+func (w *WebDAVFS) delete(name string, located string, dir bool) error {
+	response, err := w.do(http.MethodDelete, located, dir, nil, nil)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if response != nil {
+		response.Body.Close()
+	}
+	for other := range w.entries {
+		if other == located || isBelow(other, located) {
+			delete(w.entries, other)
+		}
+	}
+	return nil
+}
+
+// RemoveAll removes name and everything below it.
+func (w *WebDAVFS) RemoveAll(name string) error {
+	located, err := w.locate("remove", name)
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	current, ok := w.entries[located]
+	if !ok {
+		return nil
+	}
+	if located == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	return w.delete(name, located, current.dir)
+}
+
+// Chmod checks that name exists; WebDAV keeps no permission bits.
+func (w *WebDAVFS) Chmod(name string, mode fs.FileMode) error {
+	_, err := w.info("chmod", name)
+	return err
+}
+
+// Symlink fails, as WebDAV cannot store symbolic links.
+func (w *WebDAVFS) Symlink(target string, name string) error {
+	return &fs.PathError{Op: "symlink", Path: name, Err: errors.ErrUnsupported}
+}
+
+// Readlink fails, as no entry of a WebDAV replica is a link.
+func (w *WebDAVFS) Readlink(name string) (string, error) {
+	if _, err := w.info("readlink", name); err != nil {
+		return "", err
+	}
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: errNotLink}
+}
@@ -0,0 +1,152 @@
+package sync_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	stdsync "sync"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+)
+
+// startWebDAVServer serves dir below /dav with basic authentication and
+// counts the downloads made by clients.
+func startWebDAVServer(t *testing.T, dir string) (string, func() int) {
+	t.Helper()
+	handler := &webdav.Handler{Prefix: "/dav", FileSystem: webdav.Dir(dir), LockSystem: webdav.NewMemLS()}
+	var mutex stdsync.Mutex
+	downloads := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "zync" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Method == http.MethodGet {
+			mutex.Lock()
+			downloads++
+			mutex.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return strings.Replace(server.URL, "http://", "webdav://zync@", 1) + "/dav/notes", func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return downloads
+	}
+}
+
+func TestWebDAVReplica(t *testing.T) {
+	served := t.TempDir()
+	writeFile(t, filepath.Join(served, "notes", "remote.md"), "from the server")
+	writeFile(t, filepath.Join(served, "notes", "deep", "a", "b.md"), "deep")
+	if err := os.MkdirAll(filepath.Join(served, "notes", "empty"), 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	rootURL, downloadCount := startWebDAVServer(t, served)
+
+	rootA, stateDir := t.TempDir(), t.TempDir()
+	config := syncpkg.RootConfig{WebDAVPassword: "secret", StateDirectory: stateDir}
+	opts := defaultOptions(rootA, rootURL, stateDir)
+	run := func() syncpkg.SyncResult {
+		t.Helper()
+		replica, err := syncpkg.OpenRoot(rootURL, config)
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		opts.ReplicaB = replica
+		res, err := syncpkg.RunSync(opts, zap.NewNop())
+		if err != nil {
+			t.Fatalf("sync: %v", err)
+		}
+		if err := syncpkg.CloseReplica(replica); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+		return res
+	}
+
+	writeFile(t, filepath.Join(rootA, "local.md"), "from A")
+	if err := os.Symlink("local.md", filepath.Join(rootA, "link.md")); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	res := run()
+	if got := readFile(t, filepath.Join(rootA, "remote.md")); got != "from the server" {
+		t.Fatalf("A has %q", got)
+	}
+	if got := readFile(t, filepath.Join(rootA, "deep", "a", "b.md")); got != "deep" {
+		t.Fatalf("A has %q", got)
+	}
+	if info, err := os.Stat(filepath.Join(rootA, "empty")); err != nil || !info.IsDir() {
+		t.Fatalf("empty directory not created: %v", err)
+	}
+	if got := readFile(t, filepath.Join(served, "notes", "local.md")); got != "from A" {
+		t.Fatalf("server has %q", got)
+	}
+	if res.ActionCounters["skip(link)"] != 1 {
+		t.Fatalf("expected the link to be skipped, counters %v", res.ActionCounters)
+	}
+	if _, err := os.Lstat(filepath.Join(served, "notes", "link.md")); !os.IsNotExist(err) {
+		t.Fatalf("link was uploaded: %v", err)
+	}
+
+	before := downloadCount()
+	run()
+	if downloads := downloadCount() - before; downloads != 0 {
+		t.Fatalf("unchanged files were downloaded %d times", downloads)
+	}
+
+	if err := os.RemoveAll(filepath.Join(rootA, "deep")); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	writeFile(t, filepath.Join(rootA, "remote.md"), "changed on A")
+	run()
+	if got := readFile(t, filepath.Join(served, "notes", "remote.md")); got != "changed on A" {
+		t.Fatalf("server has %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(served, "notes", "deep")); !os.IsNotExist(err) {
+		t.Fatalf("expected the deleted directory to be removed from the server: %v", err)
+	}
+	entries, err := os.ReadDir(filepath.Join(served, "notes"))
+	if err != nil {
+		t.Fatalf("readdir: %v", err)
+	}
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), ".zync-tmp") {
+			t.Fatalf("temporary file left behind: %s", entry.Name())
+		}
+	}
+}
+
+func TestWebDAVConditionalWrite(t *testing.T) {
+	served := t.TempDir()
+	writeFile(t, filepath.Join(served, "notes", "doc.md"), "v1")
+	rootURL, _ := startWebDAVServer(t, served)
+	replica, err := syncpkg.OpenRoot(rootURL, syncpkg.RootConfig{WebDAVPassword: "secret"})
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+
+	writeFile(t, filepath.Join(served, "notes", "doc.md"), "written by someone else")
+	writeFile(t, filepath.Join(served, "notes", "new.md"), "also theirs")
+
+	if err := replica.WriteFile("doc.md", []byte("v2"), 0o644); err == nil {
+		t.Fatal("expected the write over a changed file to be refused")
+	}
+	if err := replica.WriteFile("new.md", []byte("mine"), 0o644); err == nil {
+		t.Fatal("expected the write over a file created meanwhile to be refused")
+	}
+	for name, want := range map[string]string{"doc.md": "written by someone else", "new.md": "also theirs"} {
+		if got := readFile(t, filepath.Join(served, "notes", name)); got != want {
+			t.Fatalf("%s = %q, want %q", name, got, want)
+		}
+	}
+	if _, err := syncpkg.OpenRoot(rootURL, syncpkg.RootConfig{WebDAVPassword: "wrong"}); !errors.Is(err, os.ErrPermission) {
+		t.Fatalf("expected a permission error for a bad password, got %v", err)
+	}
+}
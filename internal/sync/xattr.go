@@ -0,0 +1,203 @@
+package sync
+
+import (
+	"path"
+	"sort"
+
+	"go.uber.org/zap"
+)
+
+// DefaultXattrInclude lists the attribute name patterns synchronized when
+// extended attribute sync is enabled without explicit include patterns.
+var DefaultXattrInclude = []string{"user.*"}
+
+var aclAttributeNames = map[string]struct{}{
+	"system.posix_acl_access":  {},
+	"system.posix_acl_default": {},
+}
+
+func attributeSelected(name string, options Options) bool {
+	if _, isACL := aclAttributeNames[name]; isACL {
+		return options.SyncACLs
+	}
+	if !options.SyncXattrs {
+		return false
+	}
+	include := options.XattrInclude
+	if len(include) == 0 {
+		include = DefaultXattrInclude
+	}
+	included := false
+	for _, pattern := range include {
+		if matched, _ := path.Match(pattern, name); matched {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range options.XattrExclude {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	return true
+}
+
+func readSelectedAttributes(filePath string, options Options) (map[string][]byte, error) {
+	names, err := listXattrs(filePath)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string][]byte{}
+	for _, name := range names {
+		if !attributeSelected(name, options) {
+			continue
+		}
+		value, getErr := getXattr(filePath, name)
+		if getErr != nil {
+			return nil, getErr
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+func applyAttribute(filePath string, name string, value []byte, present bool) error {
+	if present {
+		return setXattr(filePath, name, value)
+	}
+	return removeXattr(filePath, name)
+}
+
+// syncAttributes merges the selected extended attributes and ACLs of a file
+// present on both sides. ancestor maps each attribute name to the digest of
+// its value after the previous run. Attributes changed on only one side are
+// copied to the other; attributes changed differently on both are reported
+// and left untouched.
+func syncAttributes(relativePath string, ancestor map[string]string, options Options, state *syncState, result *SyncResult, logger *zap.Logger) (bool, error) {
+	pathA, localA := localPath(options.ReplicaA, relativePath)
+	pathB, localB := localPath(options.ReplicaB, relativePath)
+	if !localA || !localB {
+		return false, nil
+	}
+
+	kindA, _, errA := lstatKind(options.ReplicaA, relativePath)
+	if errA != nil {
+		return false, errA
+	}
+	kindB, _, errB := lstatKind(options.ReplicaB, relativePath)
+	if errB != nil {
+		return false, errB
+	}
+	if options.SymlinkMode == SymlinkModeFollow {
+		if kindA == entryLink {
+			kindA = entryFile
+		}
+		if kindB == entryLink {
+			kindB = entryFile
+		}
+	}
+	if kindA != entryFile || kindB != entryFile {
+		return false, nil
+	}
+
+	valuesA, readAErr := readSelectedAttributes(pathA, options)
+	if readAErr != nil {
+		if logger != nil {
+			logger.Error("read attributes", zap.String("path", pathA), zap.Error(readAErr))
+		}
+		return false, readAErr
+	}
+	valuesB, readBErr := readSelectedAttributes(pathB, options)
+	if readBErr != nil {
+		if logger != nil {
+			logger.Error("read attributes", zap.String("path", pathB), zap.Error(readBErr))
+		}
+		return false, readBErr
+	}
+
+	nameSet := map[string]struct{}{}
+	for name := range valuesA {
+		nameSet[name] = struct{}{}
+	}
+	for name := range valuesB {
+		nameSet[name] = struct{}{}
+	}
+	for name := range ancestor {
+		if attributeSelected(name, options) {
+			nameSet[name] = struct{}{}
+		}
+	}
+	names := make([]string, 0, len(nameSet))
+	for name := range nameSet {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	merged := map[string]string{}
+	changed := false
+	conflicted := false
+	for _, name := range names {
+		valueA, presentA := valuesA[name]
+		valueB, presentB := valuesB[name]
+		digestA, digestB := "", ""
+		if presentA {
+			digestA = digestBytes(valueA)
+		}
+		if presentB {
+			digestB = digestBytes(valueB)
+		}
+		base := ancestor[name]
+
+		switch {
+		case digestA == digestB:
+		case digestA == base:
+			if err := applyAttribute(pathA, name, valueB, presentB); err != nil {
+				if logger != nil {
+					logger.Error("write attribute", zap.String("path", pathA), zap.String("name", name), zap.Error(err))
+				}
+				return changed, err
+			}
+			digestA = digestB
+			changed = true
+		case digestB == base:
+			if err := applyAttribute(pathB, name, valueA, presentA); err != nil {
+				if logger != nil {
+					logger.Error("write attribute", zap.String("path", pathB), zap.String("name", name), zap.Error(err))
+				}
+				return changed, err
+			}
+			digestB = digestA
+			changed = true
+		default:
+			if logger != nil {
+				logger.Warn("conflicting attribute changes", zap.String("path", relativePath), zap.String("name", name))
+			}
+			conflicted = true
+			if base != "" {
+				merged[name] = base
+			}
+			continue
+		}
+		if digestA != "" {
+			merged[name] = digestA
+		}
+	}
+
+	entry := state.FileEntry[relativePath]
+	entry.Xattrs = nil
+	if len(merged) > 0 {
+		entry.Xattrs = merged
+	}
+	state.FileEntry[relativePath] = entry
+
+	if changed {
+		result.ActionCounters["xattr(sync)"]++
+	}
+	if conflicted {
+		result.ActionCounters["xattr(conflict)"]++
+	}
+	return changed, nil
+}
@@ -0,0 +1,80 @@
+//go:build linux
+
+package sync_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	syncpkg "github.com/MarkoPoloResearchLab/zync/internal/sync"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+func TestExtendedAttributes(t *testing.T) {
+	rootA := t.TempDir()
+	rootB := t.TempDir()
+	state := t.TempDir()
+	pathA := filepath.Join(rootA, "n.md")
+	pathB := filepath.Join(rootB, "n.md")
+	writeFile(t, pathA, "N")
+	if err := unix.Setxattr(pathA, "user.tag", []byte("red"), 0); err != nil {
+		t.Skipf("xattrs unsupported: %v", err)
+	}
+	setXattr(t, pathA, "user.skip", "x")
+
+	opts := defaultOptions(rootA, rootB, state)
+	opts.SyncXattrs = true
+	opts.XattrExclude = []string{"user.skip"}
+	if _, err := syncpkg.RunSync(opts, zap.NewNop()); err != nil {
+		t.Fatalf("initial sync: %v", err)
+	}
+	if got := getXattr(t, pathB, "user.tag"); got != "red" {
+		t.Fatalf("attribute not copied: %q", got)
+	}
+	if got := getXattr(t, pathB, "user.skip"); got != "" {
+		t.Fatalf("excluded attribute copied: %q", got)
+	}
+
+	setXattr(t, pathB, "user.tag", "blue")
+	res, err := syncpkg.RunSync(opts, zap.NewNop())
+	if err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	if res.ActionCounters["xattr(sync)"] != 1 {
+		t.Fatalf("expected attribute sync, got %v", res.ActionCounters)
+	}
+	if got := getXattr(t, pathA, "user.tag"); got != "blue" {
+		t.Fatalf("attribute change not propagated: %q", got)
+	}
+
+	setXattr(t, pathA, "user.tag", "green")
+	setXattr(t, pathB, "user.tag", "yellow")
+	res, err = syncpkg.RunSync(opts, zap.NewNop())
+	if err != nil {
+		t.Fatalf("sync err: %v", err)
+	}
+	if res.ActionCounters["xattr(conflict)"] != 1 {
+		t.Fatalf("expected attribute conflict, got %v", res.ActionCounters)
+	}
+	if getXattr(t, pathA, "user.tag") != "green" || getXattr(t, pathB, "user.tag") != "yellow" {
+		t.Fatalf("conflicting attributes were modified")
+	}
+}
+
+func setXattr(t *testing.T, path, name, value string) {
+	t.Helper()
+	if err := unix.Setxattr(path, name, []byte(value), 0); err != nil {
+		t.Fatalf("setxattr %s: %v", name, err)
+	}
+}
+
+func getXattr(t *testing.T, path, name string) string {
+	t.Helper()
+	buf := make([]byte, 256)
+	n, err := unix.Getxattr(path, name, buf)
+	if err != nil {
+		return ""
+	}
+	return string(buf[:n])
+}
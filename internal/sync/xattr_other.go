@@ -0,0 +1,23 @@
+//go:build !linux && !darwin
+
+package sync
+
+import "errors"
+
+var errXattrUnsupported = errors.New("extended attributes are not supported on this platform")
+
+func listXattrs(path string) ([]string, error) {
+	return nil, nil
+}
+
+func getXattr(path string, name string) ([]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+func setXattr(path string, name string, value []byte) error {
+	return errXattrUnsupported
+}
+
+func removeXattr(path string, name string) error {
+	return errXattrUnsupported
+}